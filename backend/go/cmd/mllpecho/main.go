@@ -0,0 +1,96 @@
+// Command mllpecho is a stand-in HL7 system for local development and
+// testing, in two modes.
+//
+// As a receiver, it prints every message it gets over MLLP and acknowledges
+// it, which is enough to exercise the ORU^R01 results sent by the API once
+// a facility's result receiver is set to localhost:2575:
+//
+//	go run ./cmd/mllpecho -addr :2575
+//
+// With -ack AE or -ack AR it answers with errors or rejections instead, to
+// exercise retries and dead-lettering.
+//
+// As a sender, it sends a message file (or standard input, "-") to an MLLP
+// listener, such as the API's ADT listener, and prints the acknowledgment:
+//
+//	go run ./cmd/mllpecho -send adt_a04.hl7 -to localhost:2576
+//
+// Files may use line breaks between segments.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"fracture-detection-webapp/hl7"
+)
+
+func main() {
+	addr := flag.String("addr", ":2575", "address to listen on")
+	ackCode := flag.String("ack", hl7.AckAccept, "acknowledgment code to answer with: AA, AE or AR")
+	send := flag.String("send", "", "send this message file (- for standard input) instead of listening")
+	to := flag.String("to", "localhost:2576", "host:port to send to with -send")
+	flag.Parse()
+
+	if *send != "" {
+		if err := sendFile(*send, *to); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	switch *ackCode {
+	case hl7.AckAccept, hl7.AckError, hl7.AckReject:
+	default:
+		log.Fatalf("invalid -ack %q", *ackCode)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	count := 0
+	log.Printf("MLLP echo listening on %s, answering %s", *addr, *ackCode)
+	err := hl7.ListenAndServe(ctx, *addr, func(ctx context.Context, _ net.Addr, msg *hl7.Message) *hl7.Message {
+		count++
+		fmt.Printf("----- message %d: %s %s -----\n%s\n----- end of message -----\n", count, msg.Type(), msg.ControlID(), msg)
+		text := ""
+		if *ackCode != hl7.AckAccept {
+			text = "refused by -ack"
+		}
+		return hl7.Ack(msg, *ackCode, text)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func sendFile(path, addr string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	msg, err := hl7.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ack, err := hl7.Send(ctx, addr, msg)
+	if ack != nil {
+		fmt.Println(ack)
+	}
+	return err
+}
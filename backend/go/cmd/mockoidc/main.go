@@ -0,0 +1,368 @@
+// Command mockoidc is a stand-in OpenID Connect provider for local
+// development and testing of single sign-on. It implements discovery, the
+// authorization code flow with PKCE (S256 only), userinfo and the JWKS, and
+// signs ID tokens with an RSA key generated at startup.
+//
+//	go run ./cmd/mockoidc -addr :9400 -groups doctors
+//	OIDC_ISSUER=http://localhost:9400
+//	OIDC_CLIENT_ID=fracture-detection
+//	OIDC_DOCTOR_GROUPS=doctors
+//
+// The authorization page asks who to sign in as, prefilled from -email,
+// -name, -groups and -facility; with -auto it signs that user in without
+// asking, so the flow can be followed with curl -L.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// identity is who the user signs in as.
+type identity struct {
+	Email    string
+	Name     string
+	Groups   []string
+	Facility string
+}
+
+func (id identity) subject() string {
+	sum := sha256.Sum256([]byte(strings.ToLower(id.Email)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (id identity) claims() jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":            id.subject(),
+		"email":          id.Email,
+		"email_verified": true,
+		"name":           id.Name,
+		"groups":         id.Groups,
+	}
+	if id.Facility != "" {
+		claims["facility"] = id.Facility
+	}
+	return claims
+}
+
+// grant is an authorization code waiting to be redeemed.
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	user        identity
+	expires     time.Time
+}
+
+type server struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	auto         bool
+	defaults     identity
+	key          *rsa.PrivateKey
+	keyID        string
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	tokens map[string]identity // access tokens, for userinfo
+}
+
+func main() {
+	addr := flag.String("addr", ":9400", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9400", "issuer URL, as the API reaches this server")
+	clientID := flag.String("client-id", "fracture-detection", "client ID accepted")
+	clientSecret := flag.String("client-secret", "", "client secret required, if set; otherwise PKCE alone")
+	email := flag.String("email", "doctor@hospital.test", "default email of the user signing in")
+	name := flag.String("name", "Dr. Test User", "default name of the user signing in")
+	groups := flag.String("groups", "doctors", "default comma-separated groups of the user signing in")
+	facility := flag.String("facility", "", "facility code put in the facility claim, if set")
+	auto := flag.Bool("auto", false, "sign the default user in without showing the authorization page")
+	flag.Parse()
+
+	s, err := newServer(*issuer, *clientID, *clientSecret, *auto,
+		identity{Email: *email, Name: *name, Groups: splitGroups(*groups), Facility: *facility})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Mock OIDC provider %s listening on %s", s.issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, s.handler()))
+}
+
+// newServer returns a provider for issuer with a new signing key.
+func newServer(issuer, clientID, clientSecret string, auto bool, defaults identity) (*server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		auto:         auto,
+		defaults:     defaults,
+		key:          key,
+		keyID:        randomString(8),
+		codes:        map[string]grant{},
+		tokens:       map[string]identity{},
+	}, nil
+}
+
+// handler routes the provider's endpoints.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/userinfo", s.userinfo)
+	mux.HandleFunc("/jwks", s.jwks)
+	return mux
+}
+
+func splitGroups(s string) []string {
+	groups := []string{}
+	for _, g := range strings.Split(s, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// oauthError answers a token or userinfo request with an OAuth 2.0 error.
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (s *server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"userinfo_endpoint":                     s.issuer + "/userinfo",
+		"jwks_uri":                              s.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"sub", "email", "email_verified", "name", "groups", "facility"},
+	})
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html><head><title>Mock OIDC sign-in</title></head>
+<body style="font-family: sans-serif; max-width: 28em; margin: 3em auto">
+<h2>Mock OIDC sign-in</h2>
+<form method="post" action="/authorize">
+{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<p><label>Email<br><input name="email" value="{{.User.Email}}" size="40"></label></p>
+<p><label>Name<br><input name="name" value="{{.User.Name}}" size="40"></label></p>
+<p><label>Groups (comma-separated)<br><input name="groups" value="{{.Groups}}" size="40"></label></p>
+<p><label>Facility code<br><input name="facility" value="{{.User.Facility}}" size="40"></label></p>
+<p><button name="action" value="approve">Sign in</button> <button name="action" value="deny">Deny</button></p>
+</form>
+</body></html>
+`))
+
+// authorize checks an authorization request, then asks who to sign in as,
+// unless -auto is set, and redirects back with a code.
+func (s *server) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	params := url.Values{}
+	for _, k := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+		params.Set(k, r.Form.Get(k))
+	}
+	redirectURI, err := url.Parse(params.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if params.Get("client_id") != s.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	back := func(values url.Values) {
+		values.Set("state", params.Get("state"))
+		u := *redirectURI
+		u.RawQuery = values.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+	switch {
+	case params.Get("response_type") != "code":
+		back(url.Values{"error": {"unsupported_response_type"}})
+		return
+	case !strings.Contains(" "+params.Get("scope")+" ", " openid "):
+		back(url.Values{"error": {"invalid_scope"}, "error_description": {"the openid scope is required"}})
+		return
+	case params.Get("code_challenge") == "" || params.Get("code_challenge_method") != "S256":
+		back(url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with S256 is required"}})
+		return
+	}
+
+	user := s.defaults
+	if r.Method == http.MethodPost {
+		if r.Form.Get("action") != "approve" {
+			back(url.Values{"error": {"access_denied"}})
+			return
+		}
+		user = identity{
+			Email:    strings.TrimSpace(r.Form.Get("email")),
+			Name:     strings.TrimSpace(r.Form.Get("name")),
+			Groups:   splitGroups(r.Form.Get("groups")),
+			Facility: strings.TrimSpace(r.Form.Get("facility")),
+		}
+	} else if !s.auto {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		authorizePage.Execute(w, map[string]any{
+			"Params": params,
+			"User":   user,
+			"Groups": strings.Join(user.Groups, ", "),
+		})
+		return
+	}
+
+	code := randomString(24)
+	s.mu.Lock()
+	s.codes[code] = grant{
+		clientID:    s.clientID,
+		redirectURI: params.Get("redirect_uri"),
+		challenge:   params.Get("code_challenge"),
+		nonce:       params.Get("nonce"),
+		user:        user,
+		expires:     time.Now().Add(time.Minute),
+	}
+	s.mu.Unlock()
+	log.Printf("Signed in %s (%s) with groups %v", user.Email, user.subject(), user.Groups)
+	back(url.Values{"code": {code}})
+}
+
+// token redeems an authorization code, once, for an access token and an ID
+// token, checking the PKCE verifier.
+func (s *server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "invalid form")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != s.clientID || (s.clientSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.clientSecret)) != 1) {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	s.mu.Lock()
+	g, found := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.mu.Unlock()
+	if !found || time.Now().After(g.expires) || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "unknown, used or expired code, or redirect_uri mismatch")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	now := time.Now()
+	claims := g.user.claims()
+	claims["iss"] = s.issuer
+	claims["aud"] = g.clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = s.keyID
+	signed, err := idToken.SignedString(s.key)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken := randomString(24)
+	s.mu.Lock()
+	s.tokens[accessToken] = g.user
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+func (s *server) userinfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	user, ok := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_token", "unknown access token")
+		return
+	}
+	writeJSON(w, http.StatusOK, user.claims())
+}
+
+func (s *server) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": s.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"fracture-detection-webapp/sso"
+)
+
+const redirectURL = "https://api.hospital.test/api/auth/oidc/callback"
+
+// start runs the provider, requiring secret from clients if set and signing
+// user in without asking, and configures single sign-on against it with
+// clientSecret.
+func start(t *testing.T, secret, clientSecret string, user identity) *server {
+	t.Helper()
+	s, err := newServer("", "fracture-detection", secret, true, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	s.issuer = srv.URL
+
+	saved := sso.Current()
+	t.Cleanup(func() { sso.Configure(saved) })
+	if err := sso.Configure(sso.Config{
+		Issuer:        srv.URL,
+		ClientID:      "fracture-detection",
+		ClientSecret:  clientSecret,
+		RedirectURL:   redirectURL,
+		Scopes:        []string{"openid", "profile", "email"},
+		GroupsClaim:   "groups",
+		ChefGroups:    []string{"radiology-chefs"},
+		DoctorGroups:  []string{"doctors"},
+		FacilityClaim: "facility",
+		Facility:      "DEFAULT",
+		PostLoginURL:  "https://app.hospital.test/login",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// authorize follows a new sign-in to the provider and returns it with the
+// code the provider redirects back with.
+func authorize(t *testing.T) (sso.Login, string) {
+	t.Helper()
+	ctx := context.Background()
+	l, err := sso.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := sso.AuthURL(ctx, l)
+	if err != nil {
+		t.Fatalf("authorization URL: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || !strings.HasPrefix(back.String(), redirectURL+"?") {
+		t.Fatalf("authorization answered %d, redirecting to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	q := back.Query()
+	if q.Get("state") != l.State {
+		t.Errorf("state = %q, want %q", q.Get("state"), l.State)
+	}
+	if q.Get("code") == "" {
+		t.Fatalf("no code: %s", q.Get("error"))
+	}
+	return l, q.Get("code")
+}
+
+func TestSignIn(t *testing.T) {
+	for _, tt := range []struct {
+		user           identity
+		role, facility string
+	}{
+		{identity{Email: "Doctor@Hospital.test", Name: "Dr. Test User", Groups: []string{"staff", "doctors"}, Facility: "GEN"}, "doctor", "GEN"},
+		{identity{Email: "chef@hospital.test", Name: "Chef", Groups: []string{"doctors", "radiology-chefs"}}, "chef", "DEFAULT"},
+		{identity{Email: "nurse@hospital.test", Name: "Nurse", Groups: []string{"nurses"}}, "", "DEFAULT"},
+	} {
+		s := start(t, "", "", tt.user)
+		l, code := authorize(t)
+		id, err := sso.Exchange(context.Background(), l, code)
+		if err != nil {
+			t.Errorf("%s: exchanging code: %v", tt.user.Email, err)
+			continue
+		}
+		if id.Issuer != s.issuer || id.Subject != tt.user.subject() || id.Email != strings.ToLower(tt.user.Email) ||
+			!id.EmailVerified || id.Name != tt.user.Name || !slices.Equal(id.Groups, tt.user.Groups) {
+			t.Errorf("%s: identity = %+v", tt.user.Email, id)
+		}
+		if id.Role != tt.role || id.Facility != tt.facility {
+			t.Errorf("%s: role %q in %q, want %q in %q", tt.user.Email, id.Role, id.Facility, tt.role, tt.facility)
+		}
+		if _, err := sso.Exchange(context.Background(), l, code); err == nil {
+			t.Errorf("%s: code redeemed twice", tt.user.Email)
+		}
+	}
+}
+
+func TestSignInRefused(t *testing.T) {
+	user := identity{Email: "doctor@hospital.test", Groups: []string{"doctors"}}
+	ctx := context.Background()
+
+	start(t, "", "", user)
+	l, code := authorize(t)
+	other, _ := sso.NewLogin()
+	l.Verifier = other.Verifier
+	if _, err := sso.Exchange(ctx, l, code); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("wrong PKCE verifier: err = %v", err)
+	}
+
+	l, code = authorize(t)
+	l.Nonce = other.Nonce
+	if _, err := sso.Exchange(ctx, l, code); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("wrong nonce: err = %v", err)
+	}
+
+	start(t, "client-secret", "wrong-secret", user)
+	l, code = authorize(t)
+	if _, err := sso.Exchange(ctx, l, code); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("wrong client secret: err = %v", err)
+	}
+
+	start(t, "client-secret", "client-secret", user)
+	l, code = authorize(t)
+	if _, err := sso.Exchange(ctx, l, code); err != nil {
+		t.Errorf("client secret: %v", err)
+	}
+}
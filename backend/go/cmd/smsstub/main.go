@@ -0,0 +1,90 @@
+// Command smsstub is a stand-in SMS gateway for local development and
+// testing. It accepts messages in the format sent by the API's HTTP SMS
+// transport, prints them and keeps them in memory.
+//
+//	go run ./cmd/smsstub -addr :9099
+//	SMS_GATEWAY_URL=http://localhost:9099/messages
+//
+// GET /messages lists the messages received. With -fail, every message is
+// refused with that HTTP status, to exercise retries and dead-lettering.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type message struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from,omitempty"`
+	To         string    `json:"to"`
+	Text       string    `json:"text"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// gateway is the stub's /messages endpoint.
+type gateway struct {
+	apiKey string // bearer token required from clients, if set
+	fail   int    // HTTP status every message is refused with, if set
+
+	mu       sync.Mutex
+	messages []message
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.apiKey != "" && r.Header.Get("Authorization") != "Bearer "+g.apiKey {
+		http.Error(w, "invalid API key", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.messages)
+	case http.MethodPost:
+		if g.fail != 0 {
+			http.Error(w, "refused by -fail", g.fail)
+			return
+		}
+		var m message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(m.To) == "" || m.Text == "" {
+			http.Error(w, "to and text are required", http.StatusBadRequest)
+			return
+		}
+		g.mu.Lock()
+		m.ID = fmt.Sprintf("sms-%d", len(g.messages)+1)
+		m.ReceivedAt = time.Now()
+		g.messages = append(g.messages, m)
+		g.mu.Unlock()
+		log.Printf("%s to %s: %s", m.ID, m.To, m.Text)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": m.ID})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":9099", "address to listen on")
+	apiKey := flag.String("api-key", "", "bearer token required from clients, if set")
+	fail := flag.Int("fail", 0, "HTTP status to refuse every message with, e.g. 503")
+	flag.Parse()
+
+	http.Handle("/messages", &gateway{apiKey: *apiKey, fail: *fail})
+
+	log.Printf("SMS stub listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
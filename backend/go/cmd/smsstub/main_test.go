@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fracture-detection-webapp/utils"
+)
+
+// serve starts the stub and returns a sender configured for it, and the
+// stub's /messages URL.
+func serve(t *testing.T, g *gateway, apiKey string) (utils.SMSSender, string) {
+	t.Helper()
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+	sender, err := utils.NewSMSSender(utils.SMSConfig{
+		Transport: utils.SMSTransportHTTP,
+		URL:       srv.URL + "/messages",
+		APIKey:    apiKey,
+		From:      "FRACTURE",
+		Timeout:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, srv.URL + "/messages"
+}
+
+func TestGatewayReceives(t *testing.T) {
+	g := &gateway{apiKey: "sms-key"}
+	sender, url := serve(t, g, "sms-key")
+	if err := sender.Send(context.Background(), "+33612345678", "Your code is 123456"); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer sms-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []message
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("%d messages listed, want 1", len(got))
+	}
+	if m := got[0]; m.ID != "sms-1" || m.From != "FRACTURE" || m.To != "+33612345678" || m.Text != "Your code is 123456" {
+		t.Errorf("message = %+v", m)
+	}
+}
+
+func TestGatewayRefuses(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		g         *gateway
+		apiKey    string
+		status    int
+		temporary bool
+	}{
+		{"wrong API key", &gateway{apiKey: "sms-key"}, "other-key", http.StatusUnauthorized, false},
+		{"no API key", &gateway{apiKey: "sms-key"}, "", http.StatusUnauthorized, false},
+		{"gateway down", &gateway{fail: http.StatusServiceUnavailable}, "", http.StatusServiceUnavailable, true},
+		{"rate limited", &gateway{fail: http.StatusTooManyRequests}, "", http.StatusTooManyRequests, true},
+	} {
+		sender, _ := serve(t, tt.g, tt.apiKey)
+		err := sender.Send(context.Background(), "+33612345678", "hello")
+		var gerr *utils.GatewayError
+		if !errors.As(err, &gerr) {
+			t.Errorf("%s: err = %v, want a gateway error", tt.name, err)
+			continue
+		}
+		if gerr.StatusCode != tt.status || gerr.Temporary() != tt.temporary {
+			t.Errorf("%s: status %d, temporary %v, want %d, %v", tt.name, gerr.StatusCode, gerr.Temporary(), tt.status, tt.temporary)
+		}
+		if len(tt.g.messages) != 0 {
+			t.Errorf("%s: message kept", tt.name)
+		}
+	}
+}
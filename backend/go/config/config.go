@@ -0,0 +1,330 @@
+// Package config loads the server configuration and checks it before
+// anything starts. Settings come from defaults, an optional YAML file, a .env
+// file and the environment, each overriding the one before.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/hl7"
+	"fracture-detection-webapp/logging"
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/sso"
+	"fracture-detection-webapp/tracing"
+	"fracture-detection-webapp/utils"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole server configuration. The YAML file uses the field
+// names in the tags; each setting can also be given by the environment
+// variable named in its comment.
+type Config struct {
+	Port         string     `yaml:"port"`         // PORT
+	AppURL       string     `yaml:"appUrl"`       // APP_URL, base URL of the web app used in links
+	JWTSecret    string     `yaml:"jwtSecret"`    // JWT_SECRET, signs login tokens; required
+	InferenceURL string     `yaml:"inferenceUrl"` // PYTHON_SERVICE_URL, analysis endpoint of the Python service
+	MetricsToken string     `yaml:"metricsToken"` // METRICS_TOKEN, bearer token required to scrape /metrics, if set
+	Mongo        Mongo      `yaml:"mongo"`
+	MRN          MRN        `yaml:"mrn"`
+	SuperAdmin   SuperAdmin `yaml:"superAdmin"`
+
+	// WebhookAllowedNetworks are the IP addresses or CIDR ranges webhooks may
+	// be sent to although they are not public; WEBHOOK_ALLOWED_NETWORKS,
+	// separated by commas.
+	WebhookAllowedNetworks []string `yaml:"webhookAllowedNetworks"`
+
+	Log     logging.Config     `yaml:"log"`     // LOG_*
+	Tracing tracing.Config     `yaml:"tracing"` // OTEL_*
+	Mail    utils.MailerConfig `yaml:"mail"`    // MAIL_* and SMTP_*
+	SMS     utils.SMSConfig    `yaml:"sms"`     // SMS_*
+	HL7     hl7.Config         `yaml:"hl7"`     // HL7_*
+	SSO     sso.Config         `yaml:"sso"`     // OIDC_*
+}
+
+// Mongo is the database connection.
+type Mongo struct {
+	URI      string `yaml:"uri"`      // MONGO_URI
+	Database string `yaml:"database"` // MONGO_DB
+	// ConnectTimeout is how long startup keeps retrying an unreachable
+	// server before giving up; MONGO_CONNECT_TIMEOUT.
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+}
+
+// MRN controls how medical record numbers are generated; see
+// models.ConfigureMRN.
+type MRN struct {
+	Format   string `yaml:"format"`   // MRN_FORMAT
+	Facility string `yaml:"facility"` // FACILITY_CODE
+}
+
+// SuperAdmin is the account created at startup if it does not exist yet, so
+// a new installation can be set up.
+type SuperAdmin struct {
+	Email    string `yaml:"email"`    // SUPERADMIN_EMAIL
+	Password string `yaml:"password"` // SUPERADMIN_PASSWORD
+}
+
+// Default is used for anything not set in the config file or the
+// environment.
+var Default = Config{
+	Port:         "3000",
+	InferenceURL: "http://localhost:8000/analyze",
+	Mongo:        Mongo{URI: "mongodb://localhost:27017", Database: "fracture_detection_db", ConnectTimeout: 2 * time.Minute},
+	MRN:          MRN{Format: models.DefaultMRNFormat, Facility: "FX"},
+	Log:          logging.DefaultConfig,
+	Tracing:      tracing.DefaultConfig,
+	Mail:         utils.DefaultMailerConfig,
+	SMS:          utils.DefaultSMSConfig,
+	HL7:          hl7.DefaultConfig,
+	SSO:          sso.DefaultConfig,
+}
+
+// Load reads the configuration and validates it. The YAML file at path is
+// read first, or the one named by CONFIG_FILE when path is empty; without
+// either, only the environment is used. Variables in .env are added to the
+// environment, without replacing those already set.
+func Load(path string) (Config, error) {
+	cfg := Default
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, fmt.Errorf("reading .env: %w", err)
+	}
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.readEnv(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// readFile overrides the configuration with a YAML file. Unknown keys are
+// refused, so a misspelt setting is not silently ignored.
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// readEnv overrides the configuration with the environment variables that
+// are set.
+func (c *Config) readEnv() error {
+	for key, dst := range map[string]*string{
+		"PORT":                &c.Port,
+		"APP_URL":             &c.AppURL,
+		"JWT_SECRET":          &c.JWTSecret,
+		"PYTHON_SERVICE_URL":  &c.InferenceURL,
+		"METRICS_TOKEN":       &c.MetricsToken,
+		"MONGO_URI":           &c.Mongo.URI,
+		"MONGO_DB":            &c.Mongo.Database,
+		"MRN_FORMAT":          &c.MRN.Format,
+		"FACILITY_CODE":       &c.MRN.Facility,
+		"SUPERADMIN_EMAIL":    &c.SuperAdmin.Email,
+		"SUPERADMIN_PASSWORD": &c.SuperAdmin.Password,
+	} {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+
+	if v := os.Getenv("WEBHOOK_ALLOWED_NETWORKS"); v != "" {
+		c.WebhookAllowedNetworks = nil
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				c.WebhookAllowedNetworks = append(c.WebhookAllowedNetworks, n)
+			}
+		}
+	}
+
+	if v := os.Getenv("MONGO_CONNECT_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid MONGO_CONNECT_TIMEOUT %q, expected a duration such as 2m", v)
+		}
+		c.Mongo.ConnectTimeout = d
+	}
+
+	var err error
+	if c.Log, err = logging.ConfigFromEnv(c.Log); err != nil {
+		return fmt.Errorf("logging: %w", err)
+	}
+	if c.Tracing, err = tracing.ConfigFromEnv(c.Tracing); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	if c.Mail, err = utils.MailerConfigFromEnv(c.Mail); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	if c.SMS, err = utils.SMSConfigFromEnv(c.SMS); err != nil {
+		return fmt.Errorf("SMS: %w", err)
+	}
+	if c.HL7, err = hl7.ConfigFromEnv(c.HL7); err != nil {
+		return fmt.Errorf("HL7: %w", err)
+	}
+	if c.SSO, err = sso.ConfigFromEnv(c.SSO, c.AppURL); err != nil {
+		return fmt.Errorf("single sign-on: %w", err)
+	}
+	return nil
+}
+
+// minJWTSecretLength is the shortest JWT_SECRET accepted, in bytes: HMAC-SHA256
+// keys shorter than its 32-byte output weaken it.
+const minJWTSecretLength = 32
+
+// Validate checks the configuration, reporting every problem found rather
+// than only the first.
+func (c Config) Validate() error {
+	var errs []error
+	if c.JWTSecret == "" {
+		errs = append(errs, errors.New("JWT_SECRET is required to sign login tokens"))
+	} else if len(c.JWTSecret) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("JWT_SECRET must be at least %d characters; generate one with `openssl rand -hex 32`", minJWTSecretLength))
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid PORT %q", c.Port))
+	}
+	if c.AppURL != "" && !isHTTPURL(c.AppURL) {
+		errs = append(errs, fmt.Errorf("invalid APP_URL %q, expected an http(s) URL", c.AppURL))
+	}
+	if !isHTTPURL(c.InferenceURL) {
+		errs = append(errs, fmt.Errorf("invalid PYTHON_SERVICE_URL %q, expected an http(s) URL", c.InferenceURL))
+	}
+	if !strings.HasPrefix(c.Mongo.URI, "mongodb://") && !strings.HasPrefix(c.Mongo.URI, "mongodb+srv://") {
+		errs = append(errs, errors.New("invalid MONGO_URI, expected a mongodb:// or mongodb+srv:// URI"))
+	}
+	if c.Mongo.Database == "" {
+		errs = append(errs, errors.New("MONGO_DB is required"))
+	}
+	if c.Mongo.ConnectTimeout <= 0 {
+		errs = append(errs, errors.New("MONGO_CONNECT_TIMEOUT must be positive"))
+	}
+	for _, n := range c.WebhookAllowedNetworks {
+		if _, err := parseNetwork(n); err != nil {
+			errs = append(errs, fmt.Errorf("invalid WEBHOOK_ALLOWED_NETWORKS entry %q, expected an IP address or CIDR range", n))
+		}
+	}
+	if err := models.CheckMRNFormat(c.MRN.Format); err != nil {
+		errs = append(errs, err)
+	}
+	if (c.SuperAdmin.Email == "") != (c.SuperAdmin.Password == "") {
+		errs = append(errs, errors.New("set both SUPERADMIN_EMAIL and SUPERADMIN_PASSWORD, or neither"))
+	}
+	for _, sub := range []struct {
+		name string
+		err  error
+	}{
+		{"logging", c.Log.Validate()},
+		{"tracing", c.Tracing.Validate()},
+		{"mail", c.Mail.Validate()},
+		{"SMS", c.SMS.Validate()},
+		{"HL7", c.HL7.Validate()},
+		{"single sign-on", c.SSO.Validate()},
+	} {
+		if sub.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.name, sub.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WebhookNetworks returns WebhookAllowedNetworks parsed, leaving out invalid
+// entries, which Validate reports.
+func (c Config) WebhookNetworks() []netip.Prefix {
+	var out []netip.Prefix
+	for _, n := range c.WebhookAllowedNetworks {
+		if p, err := parseNetwork(n); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// parseNetwork parses a CIDR range, or an IP address as a range of one.
+func parseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// redacted replaces secrets when the configuration is printed.
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the configuration with its secrets masked, safe
+// to print or log.
+func (c Config) Redacted() Config {
+	for _, s := range []*string{
+		&c.JWTSecret,
+		&c.MetricsToken,
+		&c.SuperAdmin.Password,
+		&c.Mail.Password,
+		&c.SMS.APIKey,
+		&c.SSO.ClientSecret,
+	} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	c.Mongo.URI = RedactURI(c.Mongo.URI)
+	return c
+}
+
+// RedactURI masks the password of a URI such as a MongoDB connection
+// string, as "xxxxx".
+func RedactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		if strings.Contains(uri, "@") {
+			return redacted
+		}
+		return uri
+	}
+	return u.Redacted()
+}
+
+// String returns the configuration as YAML, with its secrets masked, so that
+// printing or logging it never leaks them.
+func (c Config) String() string {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return "<config: " + err.Error() + ">"
+	}
+	return string(b)
+}
+
+// GoString masks secrets from %#v as well.
+func (c Config) GoString() string {
+	return c.String()
+}
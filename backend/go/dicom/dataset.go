@@ -0,0 +1,489 @@
+// Package dicom reads DICOM Part 10 files: enough of the standard to store
+// instances received over DICOMweb, index them and render their pixel data
+// for analysis. Only little endian transfer syntaxes are supported.
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tag is a data element tag, the group in the high 16 bits.
+type Tag uint32
+
+// NewTag returns the tag (group,element).
+func NewTag(group, element uint16) Tag {
+	return Tag(uint32(group)<<16 | uint32(element))
+}
+
+// Group returns the tag's group number.
+func (t Tag) Group() uint16 { return uint16(t >> 16) }
+
+// Element returns the tag's element number.
+func (t Tag) Element() uint16 { return uint16(t) }
+
+// String formats the tag as in DICOM JSON, "GGGGEEEE".
+func (t Tag) String() string {
+	return fmt.Sprintf("%08X", uint32(t))
+}
+
+// Tags used by the application.
+var (
+	ErrorComment                   = NewTag(0x0000, 0x0902)
+	TransferSyntaxUID              = NewTag(0x0002, 0x0010)
+	SOPClassUID                    = NewTag(0x0008, 0x0016)
+	SOPInstanceUID                 = NewTag(0x0008, 0x0018)
+	StudyDate                      = NewTag(0x0008, 0x0020)
+	StudyTime                      = NewTag(0x0008, 0x0030)
+	AccessionNumber                = NewTag(0x0008, 0x0050)
+	Modality                       = NewTag(0x0008, 0x0060)
+	ModalitiesInStudy              = NewTag(0x0008, 0x0061)
+	ReferringPhysicianName         = NewTag(0x0008, 0x0090)
+	StudyDescription               = NewTag(0x0008, 0x1030)
+	SeriesDescription              = NewTag(0x0008, 0x103E)
+	RetrieveURL                    = NewTag(0x0008, 0x1190)
+	FailedSOPSequence              = NewTag(0x0008, 0x1198)
+	ReferencedSOPSequence          = NewTag(0x0008, 0x1199)
+	ReferencedSOPClassUID          = NewTag(0x0008, 0x1150)
+	ReferencedSOPInstanceUID       = NewTag(0x0008, 0x1155)
+	FailureReason                  = NewTag(0x0008, 0x1197)
+	PatientName                    = NewTag(0x0010, 0x0010)
+	PatientID                      = NewTag(0x0010, 0x0020)
+	PatientBirthDate               = NewTag(0x0010, 0x0030)
+	PatientSex                     = NewTag(0x0010, 0x0040)
+	BodyPartExamined               = NewTag(0x0018, 0x0015)
+	StudyInstanceUID               = NewTag(0x0020, 0x000D)
+	SeriesInstanceUID              = NewTag(0x0020, 0x000E)
+	StudyID                        = NewTag(0x0020, 0x0010)
+	SeriesNumber                   = NewTag(0x0020, 0x0011)
+	InstanceNumber                 = NewTag(0x0020, 0x0013)
+	NumberOfStudyRelatedSeries     = NewTag(0x0020, 0x1206)
+	NumberOfStudyRelatedInstances  = NewTag(0x0020, 0x1208)
+	NumberOfSeriesRelatedInstances = NewTag(0x0020, 0x1209)
+	SamplesPerPixel                = NewTag(0x0028, 0x0002)
+	PhotometricInterpretation      = NewTag(0x0028, 0x0004)
+	PlanarConfiguration            = NewTag(0x0028, 0x0006)
+	NumberOfFrames                 = NewTag(0x0028, 0x0008)
+	Rows                           = NewTag(0x0028, 0x0010)
+	Columns                        = NewTag(0x0028, 0x0011)
+	BitsAllocated                  = NewTag(0x0028, 0x0100)
+	BitsStored                     = NewTag(0x0028, 0x0101)
+	PixelRepresentation            = NewTag(0x0028, 0x0103)
+	WindowCenter                   = NewTag(0x0028, 0x1050)
+	WindowWidth                    = NewTag(0x0028, 0x1051)
+	RescaleIntercept               = NewTag(0x0028, 0x1052)
+	RescaleSlope                   = NewTag(0x0028, 0x1053)
+	PixelData                      = NewTag(0x7FE0, 0x0010)
+
+	item                 = NewTag(0xFFFE, 0xE000)
+	itemDelimitation     = NewTag(0xFFFE, 0xE00D)
+	sequenceDelimitation = NewTag(0xFFFE, 0xE0DD)
+)
+
+// Transfer syntaxes.
+const (
+	ImplicitVRLittleEndian = "1.2.840.10008.1.2"
+	ExplicitVRLittleEndian = "1.2.840.10008.1.2.1"
+	ExplicitVRBigEndian    = "1.2.840.10008.1.2.2"
+	DeflatedExplicitVR     = "1.2.840.10008.1.2.1.99"
+	JPEGBaseline           = "1.2.840.10008.1.2.4.50"
+	JPEGExtended           = "1.2.840.10008.1.2.4.51"
+)
+
+// undefinedLength marks elements and items delimited by a marker instead.
+const undefinedLength = 0xFFFFFFFF
+
+// Element is a data element. Value holds the raw little endian value;
+// sequences have Items instead, and encapsulated pixel data Fragments.
+type Element struct {
+	Tag       Tag
+	VR        string
+	Value     []byte
+	Items     []*Dataset
+	Fragments [][]byte // the basic offset table first
+}
+
+// Dataset is a set of data elements.
+type Dataset struct {
+	Elements map[Tag]*Element
+	// Order lists the tags in the order they were read.
+	Order []Tag
+}
+
+// NewDataset returns an empty data set.
+func NewDataset() *Dataset {
+	return &Dataset{Elements: map[Tag]*Element{}}
+}
+
+func (ds *Dataset) add(e *Element) {
+	if _, ok := ds.Elements[e.Tag]; !ok {
+		ds.Order = append(ds.Order, e.Tag)
+	}
+	ds.Elements[e.Tag] = e
+}
+
+// Get returns an element, or nil.
+func (ds *Dataset) Get(t Tag) *Element {
+	return ds.Elements[t]
+}
+
+// Strings returns the values of a string element, split on backslashes and
+// trimmed of padding.
+func (ds *Dataset) Strings(t Tag) []string {
+	e := ds.Get(t)
+	if e == nil || len(e.Value) == 0 {
+		return nil
+	}
+	var out []string
+	for _, v := range strings.Split(string(e.Value), `\`) {
+		out = append(out, strings.Trim(v, " \x00"))
+	}
+	return out
+}
+
+// String returns the first value of a string element.
+func (ds *Dataset) String(t Tag) string {
+	if v := ds.Strings(t); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Float returns the first value of a decimal string (DS) or integer string
+// (IS) element.
+func (ds *Dataset) Float(t Tag) (float64, bool) {
+	f, err := strconv.ParseFloat(ds.String(t), 64)
+	return f, err == nil
+}
+
+// Int returns the first value of an integer string (IS) element.
+func (ds *Dataset) Int(t Tag) (int, bool) {
+	n, err := strconv.Atoi(ds.String(t))
+	return n, err == nil
+}
+
+// Uint16 returns the value of an unsigned short (US) element.
+func (ds *Dataset) Uint16(t Tag) (uint16, bool) {
+	e := ds.Get(t)
+	if e == nil || len(e.Value) < 2 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(e.Value), true
+}
+
+// TransferSyntax returns the transfer syntax UID of a parsed file.
+func (ds *Dataset) TransferSyntax() string {
+	return ds.String(TransferSyntaxUID)
+}
+
+// Errors returned by Parse.
+var (
+	ErrNotDICOM          = errors.New("not a DICOM Part 10 file")
+	ErrUnsupportedSyntax = errors.New("unsupported transfer syntax")
+	errTruncated         = errors.New("truncated DICOM data")
+	errTooDeep           = errors.New("sequences nested too deeply")
+)
+
+// maxDepth bounds the nesting of sequences, so a crafted file cannot exhaust
+// the stack.
+const maxDepth = 32
+
+// Parse parses a DICOM Part 10 file: a 128-byte preamble, "DICM", the file
+// meta information and the data set. The meta information elements are
+// included in the returned data set.
+func Parse(data []byte) (*Dataset, error) {
+	if len(data) < 132 || string(data[128:132]) != "DICM" {
+		return nil, ErrNotDICOM
+	}
+	r := &reader{data: data, pos: 132, explicit: true}
+	ds := NewDataset()
+	// The meta information is always explicit VR little endian.
+	for r.pos+4 <= len(data) && binary.LittleEndian.Uint16(data[r.pos:]) == 0x0002 {
+		e, err := r.element()
+		if err != nil {
+			return nil, fmt.Errorf("file meta information: %w", err)
+		}
+		ds.add(e)
+	}
+	switch syntax := ds.TransferSyntax(); syntax {
+	case ImplicitVRLittleEndian:
+		r.explicit = false
+	case ExplicitVRBigEndian, DeflatedExplicitVR:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedSyntax, syntax)
+	case "":
+		return nil, errors.New("file meta information has no transfer syntax")
+	}
+	if err := r.dataset(ds, len(data)); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// reader reads data elements from a buffer.
+type reader struct {
+	data     []byte
+	pos      int
+	explicit bool
+	depth    int
+}
+
+func (r *reader) uint16() (uint16, error) {
+	if r.pos+2 > len(r.data) {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint16(r.data[r.pos:])
+	r.pos += 2
+	return v, nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *reader) tag() (Tag, error) {
+	g, err := r.uint16()
+	if err != nil {
+		return 0, err
+	}
+	e, err := r.uint16()
+	return NewTag(g, e), err
+}
+
+func (r *reader) bytes(n uint32) ([]byte, error) {
+	if n > uint32(len(r.data)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// longVRs have a 4-byte length preceded by 2 reserved bytes in explicit VR.
+var longVRs = map[string]bool{
+	"OB": true, "OD": true, "OF": true, "OL": true, "OV": true, "OW": true,
+	"SQ": true, "SV": true, "UC": true, "UN": true, "UR": true, "UT": true, "UV": true,
+}
+
+// dataset reads elements into ds until end, or until an item delimitation
+// when end is negative.
+func (r *reader) dataset(ds *Dataset, end int) error {
+	for r.pos < len(r.data) && (end < 0 || r.pos < end) {
+		if end < 0 {
+			if r.pos+4 > len(r.data) {
+				return errTruncated
+			}
+			if t := NewTag(binary.LittleEndian.Uint16(r.data[r.pos:]), binary.LittleEndian.Uint16(r.data[r.pos+2:])); t == itemDelimitation {
+				r.pos += 8
+				return nil
+			}
+		}
+		e, err := r.element()
+		if err != nil {
+			return err
+		}
+		ds.add(e)
+	}
+	if end < 0 {
+		return errTruncated
+	}
+	return nil
+}
+
+// element reads one data element.
+func (r *reader) element() (*Element, error) {
+	if r.pos+8 > len(r.data) {
+		return nil, errTruncated
+	}
+	t, err := r.tag()
+	if err != nil {
+		return nil, err
+	}
+	e := &Element{Tag: t}
+	var length uint32
+	if r.explicit && t.Group() != 0xFFFE {
+		vr, err := r.bytes(2)
+		if err != nil {
+			return nil, err
+		}
+		e.VR = string(vr)
+		if longVRs[e.VR] {
+			r.pos += 2
+			length, err = r.uint32()
+		} else {
+			var l uint16
+			l, err = r.uint16()
+			length = uint32(l)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if length, err = r.uint32(); err != nil {
+			return nil, err
+		}
+		e.VR = implicitVR(t)
+	}
+
+	switch {
+	case t == PixelData && length == undefinedLength:
+		e.Fragments, err = r.fragments()
+	case e.VR == "SQ" || length == undefinedLength:
+		e.VR = "SQ"
+		e.Items, err = r.items(length)
+	default:
+		e.Value, err = r.bytes(length)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("element %s: %w", t, err)
+	}
+	return e, nil
+}
+
+// items reads the items of a sequence.
+func (r *reader) items(length uint32) ([]*Dataset, error) {
+	if r.depth++; r.depth > maxDepth {
+		return nil, errTooDeep
+	}
+	defer func() { r.depth-- }()
+	end := -1
+	if length != undefinedLength {
+		if length > uint32(len(r.data)-r.pos) {
+			return nil, errTruncated
+		}
+		end = r.pos + int(length)
+	}
+	var items []*Dataset
+	for end < 0 || r.pos < end {
+		t, err := r.tag()
+		if err != nil {
+			return nil, err
+		}
+		l, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if t == sequenceDelimitation {
+			return items, nil
+		}
+		if t != item {
+			return nil, fmt.Errorf("unexpected tag %s in sequence", t)
+		}
+		ds := NewDataset()
+		itemEnd := -1
+		if l != undefinedLength {
+			if l > uint32(len(r.data)-r.pos) {
+				return nil, errTruncated
+			}
+			itemEnd = r.pos + int(l)
+		}
+		if err := r.dataset(ds, itemEnd); err != nil {
+			return nil, err
+		}
+		items = append(items, ds)
+	}
+	return items, nil
+}
+
+// fragments reads encapsulated pixel data.
+func (r *reader) fragments() ([][]byte, error) {
+	var frags [][]byte
+	for {
+		t, err := r.tag()
+		if err != nil {
+			return nil, err
+		}
+		l, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if t == sequenceDelimitation {
+			return frags, nil
+		}
+		if t != item {
+			return nil, fmt.Errorf("unexpected tag %s in pixel data", t)
+		}
+		b, err := r.bytes(l)
+		if err != nil {
+			return nil, err
+		}
+		frags = append(frags, b)
+	}
+}
+
+// implicitVR returns the VR of the elements the application reads, for
+// implicit VR transfer syntaxes. Others are left as "UN".
+func implicitVR(t Tag) string {
+	switch t {
+	case SamplesPerPixel, PlanarConfiguration, Rows, Columns, BitsAllocated, BitsStored, PixelRepresentation:
+		return "US"
+	case PixelData:
+		return "OW"
+	case FailedSOPSequence, ReferencedSOPSequence:
+		return "SQ"
+	}
+	if vr, ok := stringVRs[t]; ok {
+		return vr
+	}
+	return "UN"
+}
+
+// stringVRs are the VRs of the string elements the application reads.
+var stringVRs = map[Tag]string{
+	TransferSyntaxUID:         "UI",
+	SOPClassUID:               "UI",
+	SOPInstanceUID:            "UI",
+	StudyDate:                 "DA",
+	StudyTime:                 "TM",
+	AccessionNumber:           "SH",
+	Modality:                  "CS",
+	ReferringPhysicianName:    "PN",
+	StudyDescription:          "LO",
+	SeriesDescription:         "LO",
+	PatientName:               "PN",
+	PatientID:                 "LO",
+	PatientBirthDate:          "DA",
+	PatientSex:                "CS",
+	BodyPartExamined:          "CS",
+	StudyInstanceUID:          "UI",
+	SeriesInstanceUID:         "UI",
+	StudyID:                   "SH",
+	SeriesNumber:              "IS",
+	InstanceNumber:            "IS",
+	PhotometricInterpretation: "CS",
+	NumberOfFrames:            "IS",
+	WindowCenter:              "DS",
+	WindowWidth:               "DS",
+	RescaleIntercept:          "DS",
+	RescaleSlope:              "DS",
+}
+
+// pixelBytes returns the native pixel data, or nil for encapsulated data.
+func (ds *Dataset) pixelBytes() []byte {
+	if e := ds.Get(PixelData); e != nil && e.Fragments == nil {
+		return e.Value
+	}
+	return nil
+}
+
+// frame returns the first frame of encapsulated pixel data. Single-frame
+// images may be split over several fragments.
+func (ds *Dataset) frame() ([]byte, error) {
+	e := ds.Get(PixelData)
+	if e == nil || len(e.Fragments) < 2 {
+		return nil, errors.New("no encapsulated pixel data")
+	}
+	frags := e.Fragments[1:] // after the basic offset table
+	if n, ok := ds.Int(NumberOfFrames); ok && n > 1 {
+		return frags[0], nil
+	}
+	return bytes.Join(frags, nil), nil
+}
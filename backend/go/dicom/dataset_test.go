@@ -0,0 +1,151 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testDataset returns a small secondary capture instance with a sequence and
+// native pixel data.
+func testDataset() *Dataset {
+	return NewDataset().
+		SetString(SOPClassUID, "UI", SecondaryCaptureImageStorage).
+		SetString(SOPInstanceUID, "UI", "1.2.3.4.5").
+		SetString(StudyInstanceUID, "UI", "1.2.3.4").
+		SetString(PatientName, "PN", "Doe^Jane").
+		SetString(PatientBirthDate, "DA", "19800229").
+		SetString(Modality, "CS", "OT").
+		SetString(ModalitiesInStudy, "CS", "CR", "OT").
+		SetSequence(ReferencedSOPSequence, NewDataset().
+			SetString(ReferencedSOPClassUID, "UI", SecondaryCaptureImageStorage).
+			SetString(ReferencedSOPInstanceUID, "UI", "1.2.3.4.6")).
+		SetUint16(SamplesPerPixel, 1).
+		SetString(PhotometricInterpretation, "CS", "MONOCHROME2").
+		SetUint16(Rows, 2).
+		SetUint16(Columns, 2).
+		SetUint16(BitsAllocated, 8).
+		SetUint16(BitsStored, 8).
+		SetUint16(PixelRepresentation, 0).
+		SetBytes(PixelData, "OB", []byte{0, 64, 128, 255})
+}
+
+// undefinedLengthItem appends an SQ element holding one item, both of
+// undefined length, to a written file, followed by tail and nothing else.
+func undefinedLengthItem(t testing.TB, tail ...byte) []byte {
+	t.Helper()
+	data, err := WriteFile(testDataset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	data = le.AppendUint16(data, 0x0040)
+	data = le.AppendUint16(data, 0xA730)
+	data = append(data, 'S', 'Q', 0, 0)
+	data = le.AppendUint32(data, undefinedLength)
+	data = le.AppendUint16(data, item.Group())
+	data = le.AppendUint16(data, item.Element())
+	data = le.AppendUint32(data, undefinedLength)
+	return append(data, tail...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	data, err := WriteFile(testDataset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.TransferSyntax(); got != ExplicitVRLittleEndian {
+		t.Errorf("transfer syntax = %q", got)
+	}
+	for tag, want := range map[Tag]string{
+		SOPInstanceUID:   "1.2.3.4.5",
+		PatientName:      "Doe^Jane",
+		PatientBirthDate: "19800229",
+		Modality:         "OT",
+	} {
+		if got := ds.String(tag); got != want {
+			t.Errorf("%s = %q, want %q", tag, got, want)
+		}
+	}
+	if got := ds.Strings(ModalitiesInStudy); len(got) != 2 || got[0] != "CR" || got[1] != "OT" {
+		t.Errorf("modalities in study = %q", got)
+	}
+	seq := ds.Get(ReferencedSOPSequence)
+	if seq == nil || len(seq.Items) != 1 || seq.Items[0].String(ReferencedSOPInstanceUID) != "1.2.3.4.6" {
+		t.Fatalf("referenced SOP sequence = %+v", seq)
+	}
+	if rows, _ := ds.Uint16(Rows); rows != 2 {
+		t.Errorf("rows = %d", rows)
+	}
+	if got := ds.pixelBytes(); !bytes.Equal(got, []byte{0, 64, 128, 255}) {
+		t.Errorf("pixel data = %v", got)
+	}
+	if _, err := ds.PNG(); err != nil {
+		t.Errorf("rendering: %v", err)
+	}
+
+	again, err := WriteFile(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Error("writing a parsed file changed it")
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	for n := 0; n < 4; n++ {
+		data := undefinedLengthItem(t, make([]byte, n)...)
+		if _, err := Parse(data); !errors.Is(err, errTruncated) {
+			t.Errorf("%d trailing bytes: err = %v, want truncated", n, err)
+		}
+	}
+	// A file cut between two elements is still valid; anywhere else it must
+	// be refused rather than panic.
+	data, _ := WriteFile(testDataset())
+	for n := 132; n < len(data); n++ {
+		Parse(data[:n])
+	}
+}
+
+func TestParseNestingLimit(t *testing.T) {
+	data, _ := WriteFile(testDataset())
+	le := binary.LittleEndian
+	for i := 0; i <= maxDepth; i++ {
+		data = le.AppendUint16(data, 0x0040)
+		data = le.AppendUint16(data, 0xA730)
+		data = append(data, 'S', 'Q', 0, 0)
+		data = le.AppendUint32(data, undefinedLength)
+		data = le.AppendUint16(data, item.Group())
+		data = le.AppendUint16(data, item.Element())
+		data = le.AppendUint32(data, undefinedLength)
+	}
+	if _, err := Parse(data); !errors.Is(err, errTooDeep) {
+		t.Errorf("err = %v, want too deep", err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	data, err := WriteFile(testDataset())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add(undefinedLengthItem(f))
+	f.Add(undefinedLengthItem(f, 0xFE, 0xFF))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ds, err := Parse(data)
+		if err != nil {
+			return
+		}
+		ds.Image()
+		for _, tag := range ds.Order {
+			ds.Strings(tag)
+		}
+	})
+}
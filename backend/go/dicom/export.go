@@ -0,0 +1,387 @@
+package dicom
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+)
+
+// Export is what a report is exported to DICOM from: the report with its
+// patient, signing doctor and facility, and the instance it analyzed when it
+// was received over DICOMweb, which the exported objects then reference.
+type Export struct {
+	Facility models.Facility
+	Patient  models.Patient
+	Doctor   models.User // who signed the report, if anyone
+	Report   models.Report
+	Source   *models.DicomInstance
+}
+
+// ErrNoImage is returned by SecondaryCapture for reports without an
+// annotated image.
+var ErrNoImage = errors.New("report has no annotated image")
+
+// Attributes of the exported objects, beyond those the application reads.
+var (
+	specificCharacterSet      = NewTag(0x0008, 0x0005)
+	imageType                 = NewTag(0x0008, 0x0008)
+	instanceCreationDate      = NewTag(0x0008, 0x0012)
+	instanceCreationTime      = NewTag(0x0008, 0x0013)
+	contentDate               = NewTag(0x0008, 0x0023)
+	contentTime               = NewTag(0x0008, 0x0033)
+	conversionType            = NewTag(0x0008, 0x0064)
+	manufacturer              = NewTag(0x0008, 0x0070)
+	institutionName           = NewTag(0x0008, 0x0080)
+	codeValue                 = NewTag(0x0008, 0x0100)
+	codingSchemeDesignator    = NewTag(0x0008, 0x0102)
+	codeMeaning               = NewTag(0x0008, 0x0104)
+	mappingResource           = NewTag(0x0008, 0x0105)
+	referencedPPSSequence     = NewTag(0x0008, 0x1111)
+	referencedSeriesSequence  = NewTag(0x0008, 0x1115)
+	derivationDescription     = NewTag(0x0008, 0x2111)
+	sourceImageSequence       = NewTag(0x0008, 0x2112)
+	issuerOfPatientID         = NewTag(0x0010, 0x0021)
+	patientOrientation        = NewTag(0x0020, 0x0020)
+	highBit                   = NewTag(0x0028, 0x0102)
+	burnedInAnnotation        = NewTag(0x0028, 0x0301)
+	measurementUnitsCodeSeq   = NewTag(0x0040, 0x08EA)
+	relationshipType          = NewTag(0x0040, 0xA010)
+	verifyingOrganization     = NewTag(0x0040, 0xA027)
+	verificationDateTime      = NewTag(0x0040, 0xA030)
+	valueType                 = NewTag(0x0040, 0xA040)
+	conceptNameCodeSequence   = NewTag(0x0040, 0xA043)
+	continuityOfContent       = NewTag(0x0040, 0xA050)
+	verifyingObserverSequence = NewTag(0x0040, 0xA073)
+	verifyingObserverName     = NewTag(0x0040, 0xA075)
+	verifyingObserverIDCodes  = NewTag(0x0040, 0xA088)
+	personNameValue           = NewTag(0x0040, 0xA123)
+	textValue                 = NewTag(0x0040, 0xA160)
+	conceptCodeSequence       = NewTag(0x0040, 0xA168)
+	measuredValueSequence     = NewTag(0x0040, 0xA300)
+	numericValue              = NewTag(0x0040, 0xA30A)
+	performedProcedureCodeSeq = NewTag(0x0040, 0xA372)
+	evidenceSequence          = NewTag(0x0040, 0xA375)
+	completionFlag            = NewTag(0x0040, 0xA491)
+	verificationFlag          = NewTag(0x0040, 0xA493)
+	contentTemplateSequence   = NewTag(0x0040, 0xA504)
+	contentSequence           = NewTag(0x0040, 0xA730)
+	templateIdentifier        = NewTag(0x0040, 0xDB00)
+)
+
+// Series numbers of the exported objects, so viewers list them after the
+// acquired series.
+const (
+	secondaryCaptureSeries = 901
+	structuredReportSeries = 902
+)
+
+// manufacturerName is the Manufacturer of the exported objects, and the
+// device observer of their findings.
+const manufacturerName = "Fracture Detection"
+
+func da(t time.Time) string { return t.Format("20060102") }
+func tm(t time.Time) string { return t.Format("150405") }
+func dt(t time.Time) string { return t.Format("20060102150405-0700") }
+
+// pn formats a full name as a DICOM person name, "Family^Given", the family
+// name being its last word.
+func pn(full string) string {
+	parts := strings.Fields(full)
+	if len(parts) < 2 {
+		return strings.TrimSpace(full)
+	}
+	return parts[len(parts)-1] + "^" + strings.Join(parts[:len(parts)-1], " ")
+}
+
+// sexCode maps the application's sex values onto DICOM.
+func sexCode(sex string) string {
+	switch sex {
+	case "male":
+		return "M"
+	case "female":
+		return "F"
+	case "other":
+		return "O"
+	}
+	return ""
+}
+
+// findingsTime is when the findings were made final: when the report was
+// signed, or created for drafts.
+func (e *Export) findingsTime() time.Time {
+	if e.Report.SignedAt != nil {
+		return *e.Report.SignedAt
+	}
+	return e.Report.CreatedAt
+}
+
+// newInstance starts an exported object with the patient, study, series,
+// equipment and SOP common modules. Its UIDs are derived from the report and
+// its version, so exporting the same report twice gives the same object.
+func (e *Export) newInstance(kind, sopClass, modality string, seriesNumber int, seriesDescription string) *Dataset {
+	r := &e.Report
+	id := r.ID.Hex()
+	version := strconv.Itoa(max(r.Version, 1))
+	created, content := r.CreatedAt, e.findingsTime()
+
+	ds := NewDataset().
+		SetString(specificCharacterSet, "CS", "ISO_IR 192").
+		SetString(SOPClassUID, "UI", sopClass).
+		SetString(SOPInstanceUID, "UI", UIDFromName("report", id, kind, version)).
+		SetString(instanceCreationDate, "DA", da(created)).
+		SetString(instanceCreationTime, "TM", tm(created)).
+		SetString(contentDate, "DA", da(content)).
+		SetString(contentTime, "TM", tm(content)).
+		SetString(Modality, "CS", modality).
+		SetString(manufacturer, "LO", manufacturerName).
+		SetString(institutionName, "LO", e.Facility.Name).
+		SetString(ReferringPhysicianName, "PN").
+		SetString(SeriesDescription, "LO", seriesDescription).
+		SetString(SeriesInstanceUID, "UI", UIDFromName("report", id, kind, "series")).
+		SetString(SeriesNumber, "IS", strconv.Itoa(seriesNumber)).
+		SetString(InstanceNumber, "IS", version)
+
+	// Patient module: the MRN, issued by the facility.
+	p := &e.Patient
+	ds.SetString(PatientName, "PN", pn(p.FullName)).
+		SetString(PatientID, "LO", p.MRN).
+		SetString(issuerOfPatientID, "LO", e.Facility.Code).
+		SetString(PatientSex, "CS", sexCode(p.Sex))
+	if p.DateOfBirth != nil {
+		ds.SetString(PatientBirthDate, "DA", da(*p.DateOfBirth))
+	} else {
+		ds.SetString(PatientBirthDate, "DA")
+	}
+
+	// Study module: the study analyzed, or one of the report's own.
+	if s := e.Source; s != nil {
+		ds.SetString(StudyInstanceUID, "UI", s.StudyInstanceUID).
+			SetString(StudyDate, "DA", s.StudyDate).
+			SetString(StudyTime, "TM", s.StudyTime).
+			SetString(AccessionNumber, "SH", s.AccessionNumber).
+			SetString(StudyID, "SH", s.StudyID).
+			SetString(StudyDescription, "LO", s.StudyDescription)
+	} else {
+		ds.SetString(StudyInstanceUID, "UI", UIDFromName("report", id, "study")).
+			SetString(StudyDate, "DA", da(created)).
+			SetString(StudyTime, "TM", tm(created)).
+			SetString(AccessionNumber, "SH").
+			SetString(StudyID, "SH").
+			SetString(StudyDescription, "LO", "Fracture detection")
+	}
+	return ds
+}
+
+// sourceReference is an item referencing the instance analyzed.
+func (e *Export) sourceReference() *Dataset {
+	return NewDataset().
+		SetString(ReferencedSOPClassUID, "UI", e.Source.SOPClassUID).
+		SetString(ReferencedSOPInstanceUID, "UI", e.Source.SOPInstanceUID)
+}
+
+// finding is how the detected fracture is reported.
+func (e *Export) finding() string {
+	if e.Report.FractureType == "" {
+		return "No fracture detected"
+	}
+	return e.Report.FractureType
+}
+
+// SecondaryCapture exports the report's annotated image, with the detections
+// drawn on it, as a Secondary Capture image in the study analyzed.
+func SecondaryCapture(e Export) (*Dataset, error) {
+	data, _, err := utils.DecodeBase64Image(e.Report.AnnotatedImage)
+	if err != nil {
+		return nil, ErrNoImage
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > 0xFFFF || h > 0xFFFF {
+		return nil, errors.New("annotated image too large")
+	}
+	pixels := make([]byte, 0, 3*w*h)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixels = append(pixels, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+	}
+
+	ds := e.newInstance("sc", SecondaryCaptureImageStorage, "OT", secondaryCaptureSeries, "AI fracture detection overlay")
+	ds.SetString(conversionType, "CS", "WSD").
+		SetString(imageType, "CS", "DERIVED", "SECONDARY").
+		SetString(patientOrientation, "CS").
+		SetString(burnedInAnnotation, "CS", "YES").
+		SetString(derivationDescription, "ST", "AI fracture detection: "+e.finding()).
+		SetUint16(SamplesPerPixel, 3).
+		SetString(PhotometricInterpretation, "CS", "RGB").
+		SetUint16(PlanarConfiguration, 0).
+		SetUint16(Rows, uint16(h)).
+		SetUint16(Columns, uint16(w)).
+		SetUint16(BitsAllocated, 8).
+		SetUint16(BitsStored, 8).
+		SetUint16(highBit, 7).
+		SetUint16(PixelRepresentation, 0).
+		SetBytes(PixelData, "OB", pixels)
+	if e.Source != nil {
+		ds.SetSequence(sourceImageSequence, e.sourceReference())
+	}
+	return ds, nil
+}
+
+// Code is a coded concept: a code value in a coding scheme, with its meaning.
+type Code struct {
+	Value, Scheme, Meaning string
+}
+
+func (c Code) item() *Dataset {
+	return NewDataset().
+		SetString(codeValue, "SH", c.Value).
+		SetString(codingSchemeDesignator, "SH", c.Scheme).
+		SetString(codeMeaning, "LO", c.Meaning)
+}
+
+// Concepts of the structured report. The findings without a standard code
+// use the private "99FRACTURE" scheme.
+var (
+	codeMeasurementReport   = Code{"126000", "DCM", "Imaging Measurement Report"}
+	codeImagingMeasurements = Code{"126010", "DCM", "Imaging Measurements"}
+	codeMeasurementGroup    = Code{"125007", "DCM", "Measurement Group"}
+	codeObserverType        = Code{"121005", "DCM", "Observer Type"}
+	codeDevice              = Code{"121007", "DCM", "Device"}
+	codePerson              = Code{"121006", "DCM", "Person"}
+	codeDeviceObserverName  = Code{"121013", "DCM", "Device Observer Name"}
+	codePersonObserverName  = Code{"121008", "DCM", "Person Observer Name"}
+	codeFinding             = Code{"121071", "DCM", "Finding"}
+	codeComment             = Code{"121106", "DCM", "Comment"}
+	codeSourceOfMeasurement = Code{"121112", "DCM", "Source of Measurement"}
+	codeConfidence          = Code{"CONFIDENCE", "99FRACTURE", "Fracture detection confidence"}
+	codeRecoveryTime        = Code{"RECOVERY-TIME", "99FRACTURE", "Estimated recovery time"}
+	unitPercent             = Code{"%", "UCUM", "percent"}
+	unitDay                 = Code{"d", "UCUM", "day"}
+)
+
+// Relationships between content items.
+const (
+	relContains        = "CONTAINS"
+	relHasObsContext   = "HAS OBS CONTEXT"
+	relInferredFrom    = "INFERRED FROM"
+	continuitySeparate = "SEPARATE"
+)
+
+func contentItem(rel, vt string, name Code) *Dataset {
+	ds := NewDataset().
+		SetString(valueType, "CS", vt).
+		SetSequence(conceptNameCodeSequence, name.item())
+	if rel != "" {
+		ds.SetString(relationshipType, "CS", rel)
+	}
+	return ds
+}
+
+func container(rel string, name Code, children ...*Dataset) *Dataset {
+	return contentItem(rel, "CONTAINER", name).
+		SetString(continuityOfContent, "CS", continuitySeparate).
+		SetSequence(contentSequence, children...)
+}
+
+func textItem(rel string, name Code, text string) *Dataset {
+	return contentItem(rel, "TEXT", name).SetString(textValue, "UT", text)
+}
+
+func codeItem(rel string, name, value Code) *Dataset {
+	return contentItem(rel, "CODE", name).SetSequence(conceptCodeSequence, value.item())
+}
+
+func pnameItem(rel string, name Code, person string) *Dataset {
+	return contentItem(rel, "PNAME", name).SetString(personNameValue, "PN", person)
+}
+
+func numItem(rel string, name Code, value float64, unit Code) *Dataset {
+	measured := NewDataset().
+		SetString(numericValue, "DS", strconv.FormatFloat(value, 'f', -1, 64)).
+		SetSequence(measurementUnitsCodeSeq, unit.item())
+	return contentItem(rel, "NUM", name).SetSequence(measuredValueSequence, measured)
+}
+
+func imageItem(rel string, name Code, ref *Dataset) *Dataset {
+	return contentItem(rel, "IMAGE", name).SetSequence(ReferencedSOPSequence, ref)
+}
+
+// StructuredReport exports the report's findings as a Comprehensive SR
+// document following the Measurement Report template (TID 1500): the
+// detected fracture, the confidence and the recovery time, inferred from the
+// image analyzed. Signed reports are complete and verified by their doctor.
+func StructuredReport(e Export) *Dataset {
+	r := &e.Report
+	group := []*Dataset{textItem(relContains, codeFinding, e.finding())}
+	if r.Confidence != nil {
+		percent := math.Round(*r.Confidence*1000) / 10
+		group = append(group, numItem(relContains, codeConfidence, percent, unitPercent))
+	}
+	if days, ok := r.RecoveryDays(); ok {
+		group = append(group, numItem(relContains, codeRecoveryTime, float64(days), unitDay))
+	}
+	if e.Source != nil {
+		group = append(group, imageItem(relInferredFrom, codeSourceOfMeasurement, e.sourceReference()))
+	}
+
+	content := []*Dataset{
+		codeItem(relHasObsContext, codeObserverType, codeDevice),
+		textItem(relHasObsContext, codeDeviceObserverName, manufacturerName),
+	}
+	if r.IsSigned() && e.Doctor.FullName != "" {
+		content = append(content,
+			codeItem(relHasObsContext, codeObserverType, codePerson),
+			pnameItem(relHasObsContext, codePersonObserverName, pn(e.Doctor.FullName)))
+	}
+	content = append(content, container(relContains, codeImagingMeasurements,
+		container(relContains, codeMeasurementGroup, group...)))
+	if r.Comments != "" {
+		content = append(content, textItem(relContains, codeComment, r.Comments))
+	}
+
+	ds := e.newInstance("sr", ComprehensiveSRStorage, "SR", structuredReportSeries, "AI fracture detection report")
+	ds.SetString(valueType, "CS", "CONTAINER").
+		SetSequence(conceptNameCodeSequence, codeMeasurementReport.item()).
+		SetString(continuityOfContent, "CS", continuitySeparate).
+		SetSequence(contentSequence, content...).
+		SetSequence(contentTemplateSequence, NewDataset().
+			SetString(mappingResource, "CS", "DCMR").
+			SetString(templateIdentifier, "CS", "1500"))
+	ds.SetSequence(referencedPPSSequence).
+		SetSequence(performedProcedureCodeSeq)
+
+	if r.IsSigned() {
+		ds.SetString(completionFlag, "CS", "COMPLETE").
+			SetString(verificationFlag, "CS", "VERIFIED")
+		ds.SetSequence(verifyingObserverSequence, NewDataset().
+			SetString(verifyingObserverName, "PN", pn(e.Doctor.FullName)).
+			SetSequence(verifyingObserverIDCodes).
+			SetString(verifyingOrganization, "LO", e.Facility.Name).
+			SetString(verificationDateTime, "DT", dt(e.findingsTime())))
+	} else {
+		ds.SetString(completionFlag, "CS", "PARTIAL").
+			SetString(verificationFlag, "CS", "UNVERIFIED")
+	}
+	if s := e.Source; s != nil {
+		series := NewDataset().
+			SetString(SeriesInstanceUID, "UI", s.SeriesInstanceUID).
+			SetSequence(ReferencedSOPSequence, e.sourceReference())
+		ds.SetSequence(evidenceSequence, NewDataset().
+			SetString(StudyInstanceUID, "UI", s.StudyInstanceUID).
+			SetSequence(referencedSeriesSequence, series))
+	}
+	return ds
+}
@@ -0,0 +1,41 @@
+package dicom
+
+// JSON is a data set in the DICOM JSON model (PS3.18 F.2), as returned by
+// QIDO-RS and STOW-RS: attributes keyed by their tag.
+type JSON map[string]Attribute
+
+// Attribute is an attribute in the DICOM JSON model.
+type Attribute struct {
+	VR    string `json:"vr"`
+	Value []any  `json:"Value,omitempty"`
+}
+
+// Set sets an attribute. Empty strings are left out of the values, so an
+// attribute with no values is present but empty, as the model requires for
+// zero-length attributes.
+func (j JSON) Set(t Tag, vr string, values ...any) JSON {
+	a := Attribute{VR: vr}
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			if s == "" {
+				continue
+			}
+			if vr == "PN" {
+				v = map[string]string{"Alphabetic": s}
+			}
+		}
+		a.Value = append(a.Value, v)
+	}
+	j[t.String()] = a
+	return j
+}
+
+// SetSequence sets a sequence attribute.
+func (j JSON) SetSequence(t Tag, items ...JSON) JSON {
+	a := Attribute{VR: "SQ"}
+	for _, item := range items {
+		a.Value = append(a.Value, item)
+	}
+	j[t.String()] = a
+	return j
+}
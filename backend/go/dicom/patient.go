@@ -0,0 +1,36 @@
+package dicom
+
+import (
+	"strings"
+	"time"
+)
+
+// PersonName turns a DICOM person name, "Family^Given^Middle^Prefix^Suffix",
+// into "Given Middle Family". Only the alphabetic representation is used.
+func PersonName(pn string) string {
+	alphabetic, _, _ := strings.Cut(pn, "=")
+	parts := strings.Split(alphabetic, "^")
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return strings.Join(strings.Fields(parts[1]+" "+parts[2]+" "+parts[0]), " ")
+}
+
+// Sex maps a DICOM patient sex onto the application's values.
+func Sex(code string) string {
+	switch strings.ToUpper(code) {
+	case "M":
+		return "male"
+	case "F":
+		return "female"
+	case "O":
+		return "other"
+	}
+	return ""
+}
+
+// ParseDate parses a DICOM date (DA), YYYYMMDD.
+func ParseDate(da string) (time.Time, bool) {
+	t, err := time.Parse("20060102", strings.TrimSpace(da))
+	return t, err == nil
+}
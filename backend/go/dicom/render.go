@@ -0,0 +1,142 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// ErrUnsupportedImage is returned by Image for pixel data it cannot decode.
+var ErrUnsupportedImage = errors.New("unsupported DICOM image")
+
+// Image decodes the first frame of the pixel data. Native monochrome images
+// are mapped to 8 bits with the rescale and window of the data set, or their
+// own range when there is no window; native 8-bit RGB and baseline JPEG
+// images are decoded as they are.
+func (ds *Dataset) Image() (image.Image, error) {
+	switch syntax := ds.TransferSyntax(); syntax {
+	case ImplicitVRLittleEndian, ExplicitVRLittleEndian:
+		return ds.nativeImage()
+	case JPEGBaseline, JPEGExtended:
+		frame, err := ds.frame()
+		if err != nil {
+			return nil, err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+		}
+		return img, nil
+	default:
+		return nil, fmt.Errorf("%w: transfer syntax %s", ErrUnsupportedImage, syntax)
+	}
+}
+
+// PNG renders the first frame as PNG, for the inference service.
+func (ds *Dataset) PNG() ([]byte, error) {
+	img, err := ds.Image()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ds *Dataset) nativeImage() (image.Image, error) {
+	rows, _ := ds.Uint16(Rows)
+	cols, _ := ds.Uint16(Columns)
+	bits, _ := ds.Uint16(BitsAllocated)
+	samples, ok := ds.Uint16(SamplesPerPixel)
+	if !ok {
+		samples = 1
+	}
+	if rows == 0 || cols == 0 {
+		return nil, fmt.Errorf("%w: no image dimensions", ErrUnsupportedImage)
+	}
+	w, h := int(cols), int(rows)
+	data := ds.pixelBytes()
+	photometric := ds.String(PhotometricInterpretation)
+
+	switch {
+	case samples == 1 && (bits == 8 || bits == 16):
+		n := w * h
+		if len(data) < n*int(bits/8) {
+			return nil, fmt.Errorf("%w: pixel data too short", ErrUnsupportedImage)
+		}
+		values := make([]float64, n)
+		signed, _ := ds.Uint16(PixelRepresentation)
+		for i := range values {
+			switch {
+			case bits == 8:
+				values[i] = float64(data[i])
+			case signed == 1:
+				values[i] = float64(int16(binary.LittleEndian.Uint16(data[2*i:])))
+			default:
+				values[i] = float64(binary.LittleEndian.Uint16(data[2*i:]))
+			}
+		}
+		return ds.grayscale(w, h, values, photometric == "MONOCHROME1"), nil
+
+	case samples == 3 && bits == 8 && photometric == "RGB":
+		n := w * h
+		if len(data) < 3*n {
+			return nil, fmt.Errorf("%w: pixel data too short", ErrUnsupportedImage)
+		}
+		planar, _ := ds.Uint16(PlanarConfiguration)
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for i := 0; i < n; i++ {
+			var r, g, b byte
+			if planar == 1 {
+				r, g, b = data[i], data[n+i], data[2*n+i]
+			} else {
+				r, g, b = data[3*i], data[3*i+1], data[3*i+2]
+			}
+			img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2], img.Pix[4*i+3] = r, g, b, 0xff
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("%w: %d samples of %d bits, %s", ErrUnsupportedImage, samples, bits, photometric)
+}
+
+// grayscale maps stored values through the modality rescale and the VOI
+// window onto 8 bits.
+func (ds *Dataset) grayscale(w, h int, values []float64, invert bool) *image.Gray {
+	slope, ok := ds.Float(RescaleSlope)
+	if !ok || slope == 0 {
+		slope = 1
+	}
+	intercept, _ := ds.Float(RescaleIntercept)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i, v := range values {
+		v = v*slope + intercept
+		values[i] = v
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	if center, ok := ds.Float(WindowCenter); ok {
+		if width, ok := ds.Float(WindowWidth); ok && width > 1 {
+			lo, hi = center-0.5-(width-1)/2, center-0.5+(width-1)/2
+		}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i, v := range values {
+		var y float64
+		if hi > lo {
+			y = (v - lo) / (hi - lo) * 255
+		}
+		y = math.Max(0, math.Min(255, y))
+		if invert {
+			y = 255 - y
+		}
+		img.Pix[i] = uint8(math.Round(y))
+	}
+	return img
+}
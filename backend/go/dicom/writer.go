@@ -0,0 +1,182 @@
+package dicom
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// SOP classes of the objects the application creates.
+const (
+	SecondaryCaptureImageStorage = "1.2.840.10008.5.1.4.1.1.7"
+	ComprehensiveSRStorage       = "1.2.840.10008.5.1.4.1.1.88.33"
+)
+
+// ImplementationClassUID and ImplementationVersionName identify the
+// application in the files it writes.
+const (
+	ImplementationClassUID    = "2.25.304088038670072495659782180652431064287"
+	ImplementationVersionName = "FRACTURE_DET_1"
+)
+
+// NewUID returns a random UID, from a version 4 UUID (PS3.5 B.2).
+func NewUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return uuidUID(u)
+}
+
+// UIDFromName returns a UID derived from a name, from a version 5 UUID, so
+// the same object gets the same UID every time it is created.
+func UIDFromName(parts ...string) string {
+	sum := sha1.Sum([]byte(ImplementationClassUID + "/" + strings.Join(parts, "/")))
+	var u [16]byte
+	copy(u[:], sum[:])
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return uuidUID(u)
+}
+
+func uuidUID(u [16]byte) string {
+	return "2.25." + new(big.Int).SetBytes(u[:]).String()
+}
+
+// SetString sets a string element; several values are joined with
+// backslashes.
+func (ds *Dataset) SetString(t Tag, vr string, values ...string) *Dataset {
+	ds.add(&Element{Tag: t, VR: vr, Value: []byte(strings.Join(values, `\`))})
+	return ds
+}
+
+// SetUint16 sets an unsigned short (US) element.
+func (ds *Dataset) SetUint16(t Tag, values ...uint16) *Dataset {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint16(b, v)
+	}
+	ds.add(&Element{Tag: t, VR: "US", Value: b})
+	return ds
+}
+
+// SetBytes sets a binary element, such as native pixel data (OB or OW).
+func (ds *Dataset) SetBytes(t Tag, vr string, b []byte) *Dataset {
+	ds.add(&Element{Tag: t, VR: vr, Value: b})
+	return ds
+}
+
+// SetSequence sets a sequence (SQ) element. A sequence with no items is an
+// empty, type 2, attribute.
+func (ds *Dataset) SetSequence(t Tag, items ...*Dataset) *Dataset {
+	ds.add(&Element{Tag: t, VR: "SQ", Items: items})
+	return ds
+}
+
+// File meta information elements.
+var (
+	fileMetaGroupLength      = NewTag(0x0002, 0x0000)
+	fileMetaVersion          = NewTag(0x0002, 0x0001)
+	mediaStorageSOPClass     = NewTag(0x0002, 0x0002)
+	mediaStorageSOPInstance  = NewTag(0x0002, 0x0003)
+	implementationClassUID   = NewTag(0x0002, 0x0012)
+	implementationVersionTag = NewTag(0x0002, 0x0013)
+)
+
+// WriteFile encodes a data set as a DICOM Part 10 file in explicit VR little
+// endian. The file meta information is generated from the data set's SOP
+// class and instance UIDs.
+func WriteFile(ds *Dataset) ([]byte, error) {
+	sopClass, sopInstance := ds.String(SOPClassUID), ds.String(SOPInstanceUID)
+	if sopClass == "" || sopInstance == "" {
+		return nil, errors.New("data set has no SOP class or instance UID")
+	}
+	meta := NewDataset().
+		SetBytes(fileMetaVersion, "OB", []byte{0, 1}).
+		SetString(mediaStorageSOPClass, "UI", sopClass).
+		SetString(mediaStorageSOPInstance, "UI", sopInstance).
+		SetString(TransferSyntaxUID, "UI", ExplicitVRLittleEndian).
+		SetString(implementationClassUID, "UI", ImplementationClassUID).
+		SetString(implementationVersionTag, "SH", ImplementationVersionName)
+	var metaBody bytes.Buffer
+	if err := writeElements(&metaBody, meta, func(Tag) bool { return true }); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(make([]byte, 128))
+	out.WriteString("DICM")
+	writeElement(&out, &Element{Tag: fileMetaGroupLength, VR: "UL", Value: binary.LittleEndian.AppendUint32(nil, uint32(metaBody.Len()))})
+	out.Write(metaBody.Bytes())
+	if err := writeElements(&out, ds, func(t Tag) bool { return t.Group() != 0x0002 }); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeElements writes the elements of a data set accepted by keep, in
+// ascending tag order.
+func writeElements(w *bytes.Buffer, ds *Dataset, keep func(Tag) bool) error {
+	tags := make([]Tag, 0, len(ds.Elements))
+	for t := range ds.Elements {
+		if keep(t) {
+			tags = append(tags, t)
+		}
+	}
+	slices.Sort(tags)
+	for _, t := range tags {
+		if err := writeElement(w, ds.Elements[t]); err != nil {
+			return fmt.Errorf("element %s: %w", t, err)
+		}
+	}
+	return nil
+}
+
+func writeElement(w *bytes.Buffer, e *Element) error {
+	var value []byte
+	switch {
+	case e.VR == "SQ":
+		var items bytes.Buffer
+		for _, ds := range e.Items {
+			var body bytes.Buffer
+			if err := writeElements(&body, ds, func(Tag) bool { return true }); err != nil {
+				return err
+			}
+			binary.Write(&items, binary.LittleEndian, [2]uint16{item.Group(), item.Element()})
+			binary.Write(&items, binary.LittleEndian, uint32(body.Len()))
+			items.Write(body.Bytes())
+		}
+		value = items.Bytes()
+	case e.Fragments != nil:
+		return errors.New("encapsulated pixel data cannot be written")
+	default:
+		value = e.Value
+		if len(value)%2 == 1 {
+			pad := byte(' ')
+			if e.VR == "UI" || e.VR == "OB" || e.VR == "UN" {
+				pad = 0
+			}
+			value = append(slices.Clip(value), pad)
+		}
+	}
+
+	binary.Write(w, binary.LittleEndian, [2]uint16{e.Tag.Group(), e.Tag.Element()})
+	w.WriteString(e.VR)
+	if longVRs[e.VR] {
+		w.Write([]byte{0, 0})
+		binary.Write(w, binary.LittleEndian, uint32(len(value)))
+	} else {
+		if len(value) > 0xFFFF {
+			return fmt.Errorf("value too long for VR %s", e.VR)
+		}
+		binary.Write(w, binary.LittleEndian, uint16(len(value)))
+	}
+	w.Write(value)
+	return nil
+}
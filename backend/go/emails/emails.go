@@ -0,0 +1,318 @@
+// Package emails renders the notification emails sent to patients from
+// localized templates, branded with the sending facility.
+//
+// Each template has an HTML body (templates/<name>.html, wrapped in
+// layout.html) and a plain-text file (templates/<name>.txt) defining the
+// "subject" and "text" templates, and "sms" for templates that can be sent as
+// a text message. Strings are looked up with the "t" function
+// in locales/<locale>.json, falling back to English for missing keys.
+package emails
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"path"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+)
+
+// Template names.
+const (
+	ReportReady      = "report_ready"
+	Invitation       = "invitation"
+	PasswordReset    = "password_reset"
+	FollowUpReminder = "follow_up_reminder"
+)
+
+// Names lists the available templates.
+var Names = []string{ReportReady, Invitation, PasswordReset, FollowUpReminder}
+
+// ErrUnknownTemplate is returned by Render and Preview for unknown names.
+var ErrUnknownTemplate = errors.New("unknown email template")
+
+// DefaultLocale is used for patients without a locale.
+const DefaultLocale = "en"
+
+// rtlLocales are the locales written right to left.
+var rtlLocales = map[string]bool{"ar": true}
+
+// LogoContentID is the Content-ID of the facility logo, attached inline when
+// the facility has one.
+const LogoContentID = "facility-logo"
+
+//go:embed templates/*.html templates/*.txt
+var templateFS embed.FS
+
+//go:embed locales/*.json
+var localeFS embed.FS
+
+var (
+	catalogs      = map[string]map[string]string{}
+	htmlTemplates = map[string]*htmltemplate.Template{}
+	textTemplates = map[string]*texttemplate.Template{}
+)
+
+// Data holds the values a template can use. Fields a template does not need
+// can be left empty.
+type Data struct {
+	Facility     models.Facility
+	PatientName  string
+	Email        string
+	DoctorName   string
+	FractureType string
+	RecoveryTime string
+	// ReportAttached tells the patient the PDF report is attached.
+	ReportAttached bool
+	// ImageCID is the Content-ID of an inline image the caller attaches to
+	// the message, shown in the body when set.
+	ImageCID     string
+	ActionURL    string
+	ExpiresIn    string
+	FollowUpDate *time.Time
+}
+
+// view is what the templates are executed with.
+type view struct {
+	Data
+	Locale  string
+	Dir     string // "ltr" or "rtl"
+	Start   string // the side text starts on, "left" or "right"
+	Subject string
+	LogoCID string
+}
+
+func init() {
+	entries, err := localeFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range entries {
+		raw, err := localeFS.ReadFile("locales/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(raw, &catalog); err != nil {
+			panic(fmt.Sprintf("emails: %s: %v", e.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = catalog
+	}
+
+	// The real functions are bound per locale when rendering.
+	funcs := funcMap(DefaultLocale)
+	for _, name := range Names {
+		htmlTemplates[name] = htmltemplate.Must(htmltemplate.New(name).Funcs(funcs).
+			ParseFS(templateFS, "templates/layout.html", "templates/"+name+".html"))
+		textTemplates[name] = texttemplate.Must(texttemplate.New(name).Funcs(funcs).
+			ParseFS(templateFS, "templates/"+name+".txt"))
+	}
+}
+
+// Locales returns the supported locales, sorted.
+func Locales() []string {
+	locales := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+	slices.Sort(locales)
+	return locales
+}
+
+// NormalizeLocale reduces a language tag such as "fr-CA" to a supported
+// locale. An empty tag is returned as is, meaning the default locale.
+func NormalizeLocale(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", nil
+	}
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	if _, ok := catalogs[tag]; !ok {
+		return "", fmt.Errorf("unsupported locale, expected one of %s", strings.Join(Locales(), ", "))
+	}
+	return tag, nil
+}
+
+// IsTemplate reports whether name is a known template.
+func IsTemplate(name string) bool {
+	return slices.Contains(Names, name)
+}
+
+// Render renders a template in the given locale, falling back to the default
+// locale when it is empty or unsupported. The returned message has its
+// subject, bodies and, when the facility has a logo, the logo attached
+// inline; the caller sets the recipients and adds any other attachments.
+func Render(name, locale string, data Data) (*utils.Message, error) {
+	if !IsTemplate(name) {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+	locale = resolveLocale(locale)
+
+	v := view{Data: data, Locale: locale, Dir: "ltr", Start: "left"}
+	if rtlLocales[locale] {
+		v.Dir, v.Start = "rtl", "right"
+	}
+	msg := &utils.Message{}
+	if img, contentType, err := utils.DecodeBase64Image(data.Facility.LogoBase64); err == nil {
+		v.LogoCID = LogoContentID
+		msg.Attachments = append(msg.Attachments, utils.Attachment{
+			Filename:    "logo" + extension(contentType),
+			ContentType: contentType,
+			Data:        img,
+			ContentID:   LogoContentID,
+		})
+	}
+
+	funcs := funcMap(locale)
+	text, err := textTemplates[name].Clone()
+	if err != nil {
+		return nil, err
+	}
+	text.Funcs(funcs)
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", v); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&body, "text", v); err != nil {
+		return nil, err
+	}
+	v.Subject = strings.TrimSpace(subject.String())
+
+	html, err := htmlTemplates[name].Clone()
+	if err != nil {
+		return nil, err
+	}
+	html.Funcs(funcs)
+	var htmlBody bytes.Buffer
+	if err := html.ExecuteTemplate(&htmlBody, "layout", v); err != nil {
+		return nil, err
+	}
+
+	msg.Subject = v.Subject
+	msg.TextBody = strings.TrimLeft(body.String(), "\n")
+	msg.HTMLBody = htmlBody.String()
+	return msg, nil
+}
+
+// RenderSMS renders the text message version of a template, in the same way
+// as Render. Facility logos and HTML are left out.
+func RenderSMS(name, locale string, data Data) (string, error) {
+	if !IsTemplate(name) {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+	if textTemplates[name].Lookup("sms") == nil {
+		return "", fmt.Errorf("email template %q has no SMS version", name)
+	}
+	locale = resolveLocale(locale)
+	text, err := textTemplates[name].Clone()
+	if err != nil {
+		return "", err
+	}
+	text.Funcs(funcMap(locale))
+	var buf bytes.Buffer
+	if err := text.ExecuteTemplate(&buf, "sms", view{Data: data, Locale: locale}); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// resolveLocale returns the supported locale for a tag, or the default one.
+func resolveLocale(tag string) string {
+	if locale, err := NormalizeLocale(tag); err == nil && locale != "" {
+		return locale
+	}
+	return DefaultLocale
+}
+
+// Preview renders a template with sample data, for a chef to check the
+// wording and branding. Inline images are embedded in the HTML as data URIs
+// so it displays in a browser.
+func Preview(name, locale string, facility models.Facility) (*utils.Message, error) {
+	followUp := time.Now().AddDate(0, 0, 14).Truncate(time.Hour)
+	msg, err := Render(name, locale, Data{
+		Facility:       facility,
+		PatientName:    "Jane Doe",
+		Email:          "jane.doe@example.com",
+		DoctorName:     "John Smith",
+		FractureType:   "Distal radius fracture",
+		RecoveryTime:   "6-8 weeks",
+		ReportAttached: true,
+		ActionURL:      AppURL("/"),
+		ExpiresIn:      "1 hour",
+		FollowUpDate:   &followUp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range msg.Attachments {
+		if a.ContentID == "" {
+			continue
+		}
+		uri := "data:" + a.ContentType + ";base64," + base64.StdEncoding.EncodeToString(a.Data)
+		msg.HTMLBody = strings.ReplaceAll(msg.HTMLBody, "cid:"+a.ContentID, uri)
+	}
+	return msg, nil
+}
+
+// appURL is the base URL of the web app; see SetAppURL.
+var appURL string
+
+// SetAppURL sets the base URL of the web app emails link to.
+func SetAppURL(u string) {
+	appURL = strings.TrimRight(u, "/")
+}
+
+// AppURL returns the link to a page of the web app, or "" when no app URL is
+// set, in which case templates leave the link out.
+func AppURL(p string) string {
+	base := appURL
+	if base == "" {
+		return ""
+	}
+	return base + "/" + strings.TrimLeft(p, "/")
+}
+
+// funcMap returns the template functions for a locale.
+func funcMap(locale string) map[string]any {
+	return map[string]any{
+		"t": func(key string, args ...any) string {
+			return translate(locale, key, args...)
+		},
+		"date": func(t time.Time) string {
+			return t.Format("2006-01-02 15:04")
+		},
+	}
+}
+
+// translate looks up key in the locale's catalog, then in the default one,
+// and formats it with args.
+func translate(locale, key string, args ...any) string {
+	s, ok := catalogs[locale][key]
+	if !ok {
+		if s, ok = catalogs[DefaultLocale][key]; !ok {
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return s
+	}
+	return fmt.Sprintf(s, args...)
+}
+
+func extension(contentType string) string {
+	if contentType == "image/png" {
+		return ".png"
+	}
+	return ".jpg"
+}
@@ -0,0 +1,303 @@
+package fhir
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+)
+
+// Code systems.
+const (
+	// CodeSystem holds the application's own codes, for the findings no
+	// standard terminology covers.
+	CodeSystem = "urn:fracture-detection:codes"
+	loinc      = "http://loinc.org"
+	snomed     = "http://snomed.info/sct"
+	ucum       = "http://unitsofmeasure.org"
+	v2Table74  = "http://terminology.hl7.org/CodeSystem/v2-0074"
+	v2Table203 = "http://terminology.hl7.org/CodeSystem/v2-0203"
+	obsCat     = "http://terminology.hl7.org/CodeSystem/observation-category"
+	mediaType  = "http://terminology.hl7.org/CodeSystem/media-type"
+	dicomModes = "http://dicom.nema.org/resources/ontology/DCM"
+	languages  = "urn:ietf:bcp:47"
+)
+
+// Observation codes, in CodeSystem. They are also the suffixes of the
+// Observation IDs, "<report ID>-<code>".
+const (
+	CodeFractureType = "fracture-type"
+	CodeConfidence   = "fracture-confidence"
+	CodeRecoveryTime = "recovery-time"
+)
+
+// ObservationCodes lists the observations made for every report.
+var ObservationCodes = []string{CodeFractureType, CodeConfidence, CodeRecoveryTime}
+
+// MRNSystem is the identifier system of a facility's medical record numbers.
+func MRNSystem(facility *models.Facility) string {
+	return "urn:fracture-detection:facility:" + strings.ToLower(facility.Code) + ":mrn"
+}
+
+// instant formats a time as a FHIR instant.
+func instant(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// PatientReference refers to a patient by ID.
+func PatientReference(id string) *Reference {
+	return &Reference{Reference: "Patient/" + id}
+}
+
+// FromPatient maps a patient. mrnSystem is the facility's MRNSystem.
+func FromPatient(p *models.Patient, mrnSystem string) Patient {
+	out := Patient{
+		ResourceType: "Patient",
+		ID:           p.ID.Hex(),
+		Meta:         &Meta{LastUpdated: instant(p.CreatedAt)},
+		Active:       p.ArchivedAt == nil && p.MergedInto.IsZero(),
+		Gender:       p.Sex, // the app's values are FHIR's administrative genders
+	}
+	if p.MRN != "" {
+		out.Identifier = []Identifier{{
+			Use:    "usual",
+			Type:   &CodeableConcept{Coding: []Coding{{System: v2Table203, Code: "MR", Display: "Medical record number"}}},
+			System: mrnSystem,
+			Value:  p.MRN,
+		}}
+	}
+	if name := strings.TrimSpace(p.FullName); name != "" {
+		human := HumanName{Use: "official", Text: name}
+		if parts := strings.Fields(name); len(parts) > 1 {
+			human.Family = parts[len(parts)-1]
+			human.Given = parts[:len(parts)-1]
+		}
+		out.Name = []HumanName{human}
+	}
+	if p.PhoneNumber != "" {
+		out.Telecom = append(out.Telecom, ContactPoint{System: "phone", Value: p.PhoneNumber})
+	}
+	if p.Email != "" {
+		out.Telecom = append(out.Telecom, ContactPoint{System: "email", Value: p.Email})
+	}
+	if p.DateOfBirth != nil {
+		out.BirthDate = p.DateOfBirth.Format("2006-01-02")
+	}
+	if p.Locale != "" {
+		out.Communication = []PatientCommunication{{
+			Language:  CodeableConcept{Coding: []Coding{{System: languages, Code: p.Locale}}},
+			Preferred: true,
+		}}
+	}
+	if !p.MergedInto.IsZero() {
+		out.Link = []PatientLink{{Other: Reference{Reference: "Patient/" + p.MergedInto.Hex()}, Type: "replaced-by"}}
+	}
+	return out
+}
+
+// reportStatus maps a report's status: signed reports are final, or amended
+// once they have been amended, and the others preliminary.
+func reportStatus(r *models.Report) string {
+	if r.IsSigned() {
+		if r.Version > 1 {
+			return "amended"
+		}
+		return "final"
+	}
+	return "preliminary"
+}
+
+// issued is when a report was released: when signed, else when created.
+func issued(r *models.Report) string {
+	if r.SignedAt != nil {
+		return instant(*r.SignedAt)
+	}
+	return instant(r.CreatedAt)
+}
+
+func reportMeta(r *models.Report) *Meta {
+	updated := r.CreatedAt
+	if r.SignedAt != nil && r.SignedAt.After(updated) {
+		updated = *r.SignedAt
+	}
+	return &Meta{VersionID: strconv.Itoa(max(r.Version, 1)), LastUpdated: instant(updated)}
+}
+
+// HasImage reports whether a report has an annotated image, exposed as Media
+// and Binary resources.
+func HasImage(r *models.Report) bool {
+	return r.AnnotatedImage != ""
+}
+
+// FromReport maps a report. doctorName is the display name of the reporting
+// doctor and pdfURL the address of the report's PDF; both may be empty.
+func FromReport(r *models.Report, doctorName, pdfURL string) DiagnosticReport {
+	id := r.ID.Hex()
+	out := DiagnosticReport{
+		ResourceType:      "DiagnosticReport",
+		ID:                id,
+		Meta:              reportMeta(r),
+		Status:            reportStatus(r),
+		Category:          []CodeableConcept{{Coding: []Coding{{System: v2Table74, Code: "RAD", Display: "Radiology"}}}},
+		Code:              CodeableConcept{Coding: []Coding{{System: loinc, Code: "18748-4", Display: "Diagnostic imaging study"}}, Text: "X-ray fracture analysis"},
+		Subject:           PatientReference(r.PatientID.Hex()),
+		EffectiveDateTime: instant(r.CreatedAt),
+		Issued:            issued(r),
+		Conclusion:        conclusion(r),
+	}
+	doctor := Reference{Reference: "Practitioner/" + r.DoctorID.Hex(), Display: doctorName}
+	out.Performer = []Reference{doctor}
+	if r.IsSigned() && !r.SignedBy.IsZero() {
+		out.ResultsInterpreter = []Reference{{Reference: "Practitioner/" + r.SignedBy.Hex()}}
+		if r.SignedBy == r.DoctorID {
+			out.ResultsInterpreter[0].Display = doctorName
+		}
+	}
+	for _, code := range ObservationCodes {
+		if obs, ok := observation(r, code); ok {
+			out.Result = append(out.Result, Reference{Reference: "Observation/" + obs.ID})
+		}
+	}
+	if HasImage(r) {
+		out.Media = []DiagnosticReportMedia{{Comment: "Annotated X-ray", Link: Reference{Reference: "Media/" + id}}}
+	}
+	if pdfURL != "" {
+		out.PresentedForm = []Attachment{{
+			ContentType: "application/pdf",
+			URL:         pdfURL,
+			Title:       fmt.Sprintf("Fracture report, version %d", max(r.Version, 1)),
+			Creation:    issued(r),
+		}}
+	}
+	return out
+}
+
+func conclusion(r *models.Report) string {
+	if r.FractureType == "" {
+		return "No fracture detected"
+	}
+	return r.FractureType
+}
+
+// ReportObservations returns the findings of a report.
+func ReportObservations(r *models.Report) []Observation {
+	var out []Observation
+	for _, code := range ObservationCodes {
+		if obs, ok := observation(r, code); ok {
+			out = append(out, obs)
+		}
+	}
+	return out
+}
+
+// ReportObservation returns one finding of a report by code, if the report
+// has it.
+func ReportObservation(r *models.Report, code string) (Observation, bool) {
+	return observation(r, code)
+}
+
+func observation(r *models.Report, code string) (Observation, bool) {
+	obs := Observation{
+		ResourceType:      "Observation",
+		ID:                r.ID.Hex() + "-" + code,
+		Meta:              reportMeta(r),
+		Status:            reportStatus(r),
+		Category:          []CodeableConcept{{Coding: []Coding{{System: obsCat, Code: "imaging", Display: "Imaging"}}}},
+		Subject:           PatientReference(r.PatientID.Hex()),
+		EffectiveDateTime: instant(r.CreatedAt),
+		Issued:            issued(r),
+		Performer:         []Reference{{Reference: "Practitioner/" + r.DoctorID.Hex()}},
+		Method:            &CodeableConcept{Text: "Automated image analysis (YOLOv8)"},
+		DerivedFrom:       []Reference{{Reference: "DiagnosticReport/" + r.ID.Hex()}},
+	}
+	if HasImage(r) {
+		obs.DerivedFrom = append(obs.DerivedFrom, Reference{Reference: "Media/" + r.ID.Hex()})
+	}
+
+	switch code {
+	case CodeFractureType:
+		obs.Code = CodeableConcept{Coding: []Coding{{System: CodeSystem, Code: code, Display: "Fracture type"}}, Text: "Fracture type"}
+		value := &CodeableConcept{Text: conclusion(r)}
+		if r.FractureType != "" {
+			value.Coding = []Coding{{System: snomed, Code: "125605004", Display: "Fracture of bone"}}
+		}
+		obs.ValueCodeableConcept = value
+		if r.Comments != "" {
+			obs.Note = []Annotation{{Text: r.Comments}}
+		}
+	case CodeConfidence:
+		if r.Confidence == nil {
+			return obs, false
+		}
+		obs.Code = CodeableConcept{Coding: []Coding{{System: CodeSystem, Code: code, Display: "Fracture detection confidence"}}, Text: "Detection confidence"}
+		obs.ValueQuantity = &Quantity{Value: math.Round(*r.Confidence*1000) / 10, Unit: "%", System: ucum, Code: "%"}
+	case CodeRecoveryTime:
+		if r.RecoveryTime == "" {
+			return obs, false
+		}
+		obs.Code = CodeableConcept{Coding: []Coding{{System: CodeSystem, Code: code, Display: "Estimated recovery time"}}, Text: "Estimated recovery time"}
+		if days, ok := r.RecoveryDays(); ok {
+			obs.ValueQuantity = &Quantity{Value: float64(days), Unit: "days", System: ucum, Code: "d"}
+		} else {
+			obs.ValueString = r.RecoveryTime
+		}
+	default:
+		return obs, false
+	}
+	return obs, true
+}
+
+// FromReportImage maps the annotated image of a report. binaryURL is where
+// its Binary is served. The boolean is false when the report has no image.
+func FromReportImage(r *models.Report, binaryURL string) (Media, bool) {
+	if !HasImage(r) {
+		return Media{}, false
+	}
+	contentType := "image/png"
+	if _, ct, err := utils.DecodeBase64Image(r.AnnotatedImage); err == nil {
+		contentType = ct
+	}
+	return Media{
+		ResourceType:    "Media",
+		ID:              r.ID.Hex(),
+		Meta:            reportMeta(r),
+		Status:          "completed",
+		Type:            &CodeableConcept{Coding: []Coding{{System: mediaType, Code: "image", Display: "Image"}}},
+		Modality:        &CodeableConcept{Coding: []Coding{{System: dicomModes, Code: "DX", Display: "Digital Radiography"}}},
+		Subject:         PatientReference(r.PatientID.Hex()),
+		CreatedDateTime: instant(r.CreatedAt),
+		Content: Attachment{
+			ContentType: contentType,
+			URL:         binaryURL,
+			Title:       r.ImageName,
+			Creation:    instant(r.CreatedAt),
+		},
+		Note: []Annotation{{Text: "X-ray annotated with the detected fracture"}},
+	}, true
+}
+
+// ReportBinary returns the annotated image of a report as a Binary, along
+// with the decoded bytes. The boolean is false when the report has no
+// readable image.
+func ReportBinary(r *models.Report) (Binary, []byte, bool) {
+	img, contentType, err := utils.DecodeBase64Image(r.AnnotatedImage)
+	if err != nil {
+		return Binary{}, nil, false
+	}
+	return Binary{
+		ResourceType: "Binary",
+		ID:           r.ID.Hex(),
+		Meta:         reportMeta(r),
+		ContentType:  contentType,
+		Data:         base64Encode(img),
+	}, img, true
+}
+
+func base64Encode(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,208 @@
+// Package fhir maps patients and fracture reports onto FHIR R4 resources.
+// Only the elements the application has data for are produced; the types
+// below are the subset of the specification they need.
+package fhir
+
+// Version is the FHIR version served.
+const Version = "4.0.1"
+
+// ContentType is the media type of FHIR JSON.
+const ContentType = "application/fhir+json"
+
+// The FHIR data types used by the resources below.
+
+type Meta struct {
+	VersionID   string `json:"versionId,omitempty"`
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type Identifier struct {
+	Use    string           `json:"use,omitempty"`
+	Type   *CodeableConcept `json:"type,omitempty"`
+	System string           `json:"system,omitempty"`
+	Value  string           `json:"value,omitempty"`
+}
+
+type HumanName struct {
+	Use    string   `json:"use,omitempty"`
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+type ContactPoint struct {
+	System string `json:"system,omitempty"` // "phone" or "email"
+	Value  string `json:"value,omitempty"`
+}
+
+type Quantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+type Attachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	Data        string `json:"data,omitempty"` // base64
+	URL         string `json:"url,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Creation    string `json:"creation,omitempty"`
+}
+
+type Annotation struct {
+	Text string `json:"text"`
+}
+
+// Patient is a patient's demographics.
+type Patient struct {
+	ResourceType  string                 `json:"resourceType"`
+	ID            string                 `json:"id"`
+	Meta          *Meta                  `json:"meta,omitempty"`
+	Identifier    []Identifier           `json:"identifier,omitempty"`
+	Active        bool                   `json:"active"`
+	Name          []HumanName            `json:"name,omitempty"`
+	Telecom       []ContactPoint         `json:"telecom,omitempty"`
+	Gender        string                 `json:"gender,omitempty"`
+	BirthDate     string                 `json:"birthDate,omitempty"`
+	Communication []PatientCommunication `json:"communication,omitempty"`
+	Link          []PatientLink          `json:"link,omitempty"`
+}
+
+type PatientCommunication struct {
+	Language  CodeableConcept `json:"language"`
+	Preferred bool            `json:"preferred,omitempty"`
+}
+
+type PatientLink struct {
+	Other Reference `json:"other"`
+	Type  string    `json:"type"` // "replaced-by" for merged records
+}
+
+// DiagnosticReport is a fracture report.
+type DiagnosticReport struct {
+	ResourceType       string                  `json:"resourceType"`
+	ID                 string                  `json:"id"`
+	Meta               *Meta                   `json:"meta,omitempty"`
+	Status             string                  `json:"status"`
+	Category           []CodeableConcept       `json:"category,omitempty"`
+	Code               CodeableConcept         `json:"code"`
+	Subject            *Reference              `json:"subject,omitempty"`
+	EffectiveDateTime  string                  `json:"effectiveDateTime,omitempty"`
+	Issued             string                  `json:"issued,omitempty"`
+	Performer          []Reference             `json:"performer,omitempty"`
+	ResultsInterpreter []Reference             `json:"resultsInterpreter,omitempty"`
+	Result             []Reference             `json:"result,omitempty"`
+	Media              []DiagnosticReportMedia `json:"media,omitempty"`
+	Conclusion         string                  `json:"conclusion,omitempty"`
+	PresentedForm      []Attachment            `json:"presentedForm,omitempty"`
+}
+
+type DiagnosticReportMedia struct {
+	Comment string    `json:"comment,omitempty"`
+	Link    Reference `json:"link"`
+}
+
+// Observation is one finding of a report: the fracture type, the model's
+// confidence or the recovery estimate.
+type Observation struct {
+	ResourceType         string            `json:"resourceType"`
+	ID                   string            `json:"id"`
+	Meta                 *Meta             `json:"meta,omitempty"`
+	Status               string            `json:"status"`
+	Category             []CodeableConcept `json:"category,omitempty"`
+	Code                 CodeableConcept   `json:"code"`
+	Subject              *Reference        `json:"subject,omitempty"`
+	EffectiveDateTime    string            `json:"effectiveDateTime,omitempty"`
+	Issued               string            `json:"issued,omitempty"`
+	Performer            []Reference       `json:"performer,omitempty"`
+	ValueCodeableConcept *CodeableConcept  `json:"valueCodeableConcept,omitempty"`
+	ValueQuantity        *Quantity         `json:"valueQuantity,omitempty"`
+	ValueString          string            `json:"valueString,omitempty"`
+	Method               *CodeableConcept  `json:"method,omitempty"`
+	DerivedFrom          []Reference       `json:"derivedFrom,omitempty"`
+	Note                 []Annotation      `json:"note,omitempty"`
+}
+
+// Media is the annotated X-ray of a report.
+type Media struct {
+	ResourceType    string           `json:"resourceType"`
+	ID              string           `json:"id"`
+	Meta            *Meta            `json:"meta,omitempty"`
+	Status          string           `json:"status"`
+	Type            *CodeableConcept `json:"type,omitempty"`
+	Modality        *CodeableConcept `json:"modality,omitempty"`
+	Subject         *Reference       `json:"subject,omitempty"`
+	CreatedDateTime string           `json:"createdDateTime,omitempty"`
+	Content         Attachment       `json:"content"`
+	Note            []Annotation     `json:"note,omitempty"`
+}
+
+// Binary holds the bytes of an annotated X-ray.
+type Binary struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	Meta         *Meta  `json:"meta,omitempty"`
+	ContentType  string `json:"contentType"`
+	Data         string `json:"data,omitempty"`
+}
+
+// Bundle is a page of search results.
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"`
+	Total        *int          `json:"total,omitempty"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+type BundleEntry struct {
+	FullURL  string        `json:"fullUrl,omitempty"`
+	Resource interface{}   `json:"resource"`
+	Search   *BundleSearch `json:"search,omitempty"`
+}
+
+type BundleSearch struct {
+	Mode string `json:"mode"` // "match" or "include"
+}
+
+// OperationOutcome describes why a request failed.
+type OperationOutcome struct {
+	ResourceType string  `json:"resourceType"`
+	Issue        []Issue `json:"issue"`
+}
+
+type Issue struct {
+	Severity    string `json:"severity"` // "error", "warning", ...
+	Code        string `json:"code"`     // "not-found", "invalid", "forbidden", ...
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+// NewOperationOutcome returns an outcome with a single error issue.
+func NewOperationOutcome(code, diagnostics string) OperationOutcome {
+	return OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []Issue{{Severity: "error", Code: code, Diagnostics: diagnostics}},
+	}
+}
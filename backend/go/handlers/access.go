@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// errPatientNotFound is returned when a patient does not exist or is not
+	// visible to the caller; the two cases are deliberately indistinguishable.
+	errPatientNotFound = errors.New("patient not found")
+	// errReadOnlyAccess is returned when the caller can see a patient but not modify it.
+	errReadOnlyAccess = errors.New("read-only access to this patient")
+)
+
+// isStaff reports whether the role may manage patients.
+func isStaff(role string) bool {
+	return role == "doctor" || role == "chef"
+}
+
+// currentUser reads the authenticated user's ID and role set by the auth middleware.
+func currentUser(c *fiber.Ctx) (primitive.ObjectID, string, error) {
+	userIDStr, ok := c.Locals("userId").(string)
+	if !ok {
+		return primitive.NilObjectID, "", errors.New("user ID not found in token")
+	}
+	userID, err := primitive.ObjectIDFromHex(userIDStr)
+	if err != nil {
+		return primitive.NilObjectID, "", errors.New("invalid user ID in token")
+	}
+	role, _ := c.Locals("role").(string)
+	if role == "superadmin" {
+		return primitive.NilObjectID, "", errors.New("super-admins cannot access clinical data")
+	}
+	return userID, role, nil
+}
+
+// patientVisibilityFilter returns the patients filter matching the patients
+// the given user is allowed to see, within the facility the collection is
+// scoped to. Chefs and service accounts see every patient, doctors the
+// patients they own or whose care team they are on, and patient accounts only
+// their own profile.
+func patientVisibilityFilter(userID primitive.ObjectID, role string) bson.M {
+	switch role {
+	case "chef", "service":
+		return bson.M{}
+	case "doctor":
+		return bson.M{"$or": bson.A{
+			bson.M{"createdBy": userID},
+			bson.M{"careTeam.doctorId": userID},
+		}}
+	default:
+		return bson.M{"accountId": userID}
+	}
+}
+
+// reportVisibilityFilter returns the reports filter matching the reports the
+// given user is allowed to see: for a doctor, the reports they wrote and every
+// report of the patients they own or are on the care team of.
+func reportVisibilityFilter(ctx context.Context, userID primitive.ObjectID, role string) (bson.M, error) {
+	switch role {
+	case "chef", "service":
+		return bson.M{}, nil
+	case "doctor":
+		patientIDs, err := visiblePatientIDs(ctx, userID, role)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$or": bson.A{
+			bson.M{"doctorId": userID},
+			bson.M{"patientId": bson.M{"$in": patientIDs}},
+		}}, nil
+	}
+	patientID, err := accountPatientID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"patientId": patientID}, nil
+}
+
+// visiblePatientIDs returns the IDs of the patients the given user is
+// allowed to see; see patientVisibilityFilter.
+func visiblePatientIDs(ctx context.Context, userID primitive.ObjectID, role string) ([]primitive.ObjectID, error) {
+	cursor, err := models.Scoped("patients").Find(ctx, patientVisibilityFilter(userID, role),
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var visible []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &visible); err != nil {
+		return nil, err
+	}
+	patientIDs := make([]primitive.ObjectID, 0, len(visible))
+	for _, p := range visible {
+		patientIDs = append(patientIDs, p.ID)
+	}
+	return patientIDs, nil
+}
+
+// recordOwner returns who owns the patients and reports the given user
+// creates: the user, or for a service account the doctor it was set up for,
+// if any.
+func recordOwner(ctx context.Context, userID primitive.ObjectID, role string) (primitive.ObjectID, error) {
+	if role != "service" {
+		return userID, nil
+	}
+	var account models.User
+	err := models.Scoped("users").FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"doctorId": 1})).Decode(&account)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if account.DoctorID.IsZero() {
+		return userID, nil
+	}
+	return account.DoctorID, nil
+}
+
+// accountPatientID returns the ID of the patient profile linked to a portal
+// account, or NilObjectID if the account has none.
+func accountPatientID(ctx context.Context, accountID primitive.ObjectID) (primitive.ObjectID, error) {
+	var patient models.Patient
+	err := models.Scoped("patients").FindOne(ctx, bson.M{"accountId": accountID}).Decode(&patient)
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, nil
+	}
+	return patient.ID, err
+}
+
+// findVisiblePatient loads a patient by ID if the given user is allowed to see it.
+func findVisiblePatient(ctx context.Context, patientID, userID primitive.ObjectID, role string) (*models.Patient, error) {
+	filter := withClause(patientVisibilityFilter(userID, role), bson.M{"_id": patientID})
+
+	var patient models.Patient
+	err := models.Scoped("patients").FindOne(ctx, filter).Decode(&patient)
+	if err == mongo.ErrNoDocuments {
+		return nil, errPatientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &patient, nil
+}
+
+// findWritablePatient loads a patient by ID if the given user is allowed to
+// modify it. Patients the user can only read yield errReadOnlyAccess.
+func findWritablePatient(ctx context.Context, patientID, userID primitive.ObjectID, role string) (*models.Patient, error) {
+	patient, err := findVisiblePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if !models.CanWrite(patient.AccessFor(userID, role)) {
+		return nil, errReadOnlyAccess
+	}
+	return patient, nil
+}
+
+// patientLookupError maps a findVisiblePatient or findWritablePatient error
+// onto an HTTP response.
+func patientLookupError(c *fiber.Ctx, err error) error {
+	switch err {
+	case errPatientNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+	case errReadOnlyAccess:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You only have read access to this patient"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch patient"})
+}
+
+// reportAccess returns the access level the given user has on a report: the
+// doctor who wrote it can always modify it, anyone else gets the access they
+// have on the report's patient.
+func reportAccess(ctx context.Context, report *models.Report, userID primitive.ObjectID, role string) (string, error) {
+	if role == "doctor" && report.DoctorID == userID {
+		return models.AccessWrite, nil
+	}
+	var patient models.Patient
+	err := models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&patient)
+	if err == mongo.ErrNoDocuments {
+		if role == "chef" {
+			return models.AccessOwner, nil
+		}
+		return models.AccessNone, nil
+	}
+	if err != nil {
+		return models.AccessNone, err
+	}
+	return patient.AccessFor(userID, role), nil
+}
+
+// activeOnly restricts a patients filter to patients that have not been archived.
+func activeOnly(filter bson.M) bson.M {
+	return withClause(filter, bson.M{"archivedAt": bson.M{"$exists": false}})
+}
+
+// returnAfter makes FindOneAndUpdate return the updated document.
+func returnAfter() *options.FindOneAndUpdateOptions {
+	return options.FindOneAndUpdate().SetReturnDocument(options.After)
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FacilityRequest defines the payload for creating a facility.
+type FacilityRequest struct {
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+// AssignChefRequest defines the payload for giving a facility a chef: either
+// the ID of an existing chef to move there, or the details of a new one.
+type AssignChefRequest struct {
+	UserID   string `json:"userId,omitempty"`
+	FullName string `json:"fullName,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// FacilitySummary is a facility with the number of users and patients it holds.
+type FacilitySummary struct {
+	models.Facility `bson:",inline"`
+	Chefs           []models.User `json:"chefs"`
+	Doctors         int64         `json:"doctors"`
+	Patients        int64         `json:"patients"`
+}
+
+// CreateFacility creates a new facility. Super-admin only.
+func CreateFacility(c *fiber.Ctx) error {
+	adminID, _ := primitive.ObjectIDFromHex(c.Locals("userId").(string))
+
+	var req FacilityRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Facility name is required"})
+	}
+	code, err := models.NormalizeFacilityCode(req.Code)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	facility := models.Facility{
+		ID:        primitive.NewObjectID(),
+		Name:      req.Name,
+		Code:      code,
+		CreatedBy: adminID,
+		CreatedAt: time.Now(),
+	}
+	_, err = models.DB.Collection("facilities").InsertOne(ctx, facility)
+	if mongo.IsDuplicateKeyError(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A facility with this code already exists"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting facility", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create facility"})
+	}
+	if err := recordAudit(models.WithFacility(ctx, facility.ID), "facility.create", adminID, facility.ID, bson.M{"code": code}); err != nil {
+		slog.ErrorContext(ctx, "Error recording facility audit entry", "error", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(facility)
+}
+
+// GetFacilities lists every facility with its chefs and head counts.
+// Super-admin only.
+func GetFacilities(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := models.DB.Collection("facilities").Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch facilities"})
+	}
+	var facilities []models.Facility
+	if err := cursor.All(ctx, &facilities); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to decode facilities"})
+	}
+
+	summaries := make([]FacilitySummary, 0, len(facilities))
+	for _, f := range facilities {
+		scoped := models.WithFacility(ctx, f.ID)
+		summary := FacilitySummary{Facility: f, Chefs: make([]models.User, 0)}
+		if err := findAll(scoped, models.Scoped("users"), bson.M{"role": "chef"}, &summary.Chefs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch chefs"})
+		}
+		if summary.Doctors, err = models.Scoped("users").CountDocuments(scoped, bson.M{"role": "doctor"}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to count doctors"})
+		}
+		if summary.Patients, err = models.Scoped("patients").CountDocuments(scoped, bson.M{}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to count patients"})
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return c.JSON(summaries)
+}
+
+// AssignChef makes a chef part of a facility, either by moving an existing
+// chef there or by creating a new chef account. Super-admin only.
+func AssignChef(c *fiber.Ctx) error {
+	adminID, _ := primitive.ObjectIDFromHex(c.Locals("userId").(string))
+	facilityID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid facility ID format"})
+	}
+
+	var req AssignChefRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var facility models.Facility
+	if err := models.DB.Collection("facilities").FindOne(ctx, bson.M{"_id": facilityID}).Decode(&facility); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Facility not found"})
+	}
+	users := models.DB.Collection("users")
+
+	var chef models.User
+	if req.UserID != "" {
+		chefID, err := primitive.ObjectIDFromHex(req.UserID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID format"})
+		}
+		err = users.FindOneAndUpdate(ctx,
+			bson.M{"_id": chefID, "role": "chef"},
+			bson.M{"$set": bson.M{"facilityId": facility.ID}},
+			returnAfter(),
+		).Decode(&chef)
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Chef not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to assign chef"})
+		}
+	} else {
+		if req.FullName == "" || req.Email == "" || req.Password == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Either userId or full name, email, and password are required"})
+		}
+		if err := checkEmailAvailable(ctx, "users", req.Email, primitive.NilObjectID); err == errEmailTaken {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A user with this email already exists"})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create chef account"})
+		}
+		chef = models.User{
+			ID:         primitive.NewObjectID(),
+			FullName:   req.FullName,
+			Email:      req.Email,
+			Password:   HashPasswordSHA256(req.Password),
+			Role:       "chef",
+			FacilityID: facility.ID,
+			CreatedBy:  adminID,
+			CreatedAt:  time.Now(),
+		}
+		if _, err := users.InsertOne(ctx, chef); err != nil {
+			slog.ErrorContext(ctx, "Error inserting chef", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create chef account"})
+		}
+	}
+
+	if err := recordAudit(models.WithFacility(ctx, facility.ID), "facility.assign_chef", adminID, chef.ID, bson.M{"facilityId": facility.ID}); err != nil {
+		slog.ErrorContext(ctx, "Error recording facility audit entry", "error", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Chef assigned to " + facility.Name,
+		"user":    chef,
+	})
+}
+
+// UpdateFacilityHL7 replaces a facility's HL7 interface settings; an empty
+// body removes them. Super-admin only: the settings decide which systems may
+// write the facility's patients, and where its results are sent.
+func UpdateFacilityHL7(c *fiber.Ctx) error {
+	adminID, _ := primitive.ObjectIDFromHex(c.Locals("userId").(string))
+	facilityID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid facility ID format"})
+	}
+
+	var req models.FacilityHL7
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+	req.Addr = strings.TrimSpace(req.Addr)
+	req.ReceivingApplication = strings.TrimSpace(req.ReceivingApplication)
+	req.ReceivingFacility = strings.TrimSpace(req.ReceivingFacility)
+	for i := range req.Senders {
+		req.Senders[i].Facility = strings.TrimSpace(req.Senders[i].Facility)
+	}
+	if err := req.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	update := bson.M{"$set": bson.M{"hl7": req}}
+	if req.IsZero() {
+		update = bson.M{"$unset": bson.M{"hl7": ""}}
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var facility models.Facility
+	err = models.DB.Collection("facilities").FindOneAndUpdate(ctx, bson.M{"_id": facilityID}, update, returnAfter()).Decode(&facility)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Facility not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update facility"})
+	}
+	if err := recordAudit(models.WithFacility(ctx, facility.ID), "facility.hl7", adminID, facility.ID, bson.M{"hl7": req}); err != nil {
+		slog.ErrorContext(ctx, "Error recording facility audit entry", "error", err)
+	}
+
+	return c.JSON(facility)
+}
@@ -2,88 +2,158 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
+	"net"
 	"net/http"
-	"os"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/logging"
+	"fracture-detection-webapp/metrics"
+	"fracture-detection-webapp/models"
 
 	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-// AnalyzeResponse represents the expected response from the Python backend
-// and what will be sent to the frontend.
-type AnalyzeResponse struct {
-	Detected     bool     `json:"detected"`
-	Type         string   `json:"type"`
-	RecoveryTime *int     `json:"recovery_time"`
-	ImageBase64  *string  `json:"image_base64"`
-	Confidence   *float64 `json:"confidence"`
-}
-
-// This handler mocks AI analysis and stores a report
+// AnalyzeImage sends an image to the Python service and returns its
+// findings, without storing a report.
 func AnalyzeImage(c *fiber.Ctx) error {
 	file, err := c.FormFile("file")
 	if err != nil {
-		log.Printf("FormFile error: %v", err)
+		slog.WarnContext(c.UserContext(), "No image file in analysis request", "error", err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No image file provided"})
 	}
 
 	src, err := file.Open()
 	if err != nil {
-		log.Printf("File open error: %v", err)
+		slog.ErrorContext(c.UserContext(), "Could not open uploaded file", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not open uploaded file"})
 	}
 	defer src.Close()
 
+	analysis, err := requestAnalysis(c.UserContext(), file.Filename, src)
+	var serviceErr *inferenceError
+	if errors.As(err, &serviceErr) {
+		slog.ErrorContext(c.UserContext(), "Analysis failed", "filename", file.Filename, "error", err)
+		return c.Status(serviceErr.StatusCode).JSON(fiber.Map{"error": "Python service returned an error"})
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Analysis failed", "filename", file.Filename, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Python service request failed"})
+	}
+	return c.JSON(analysis)
+}
+
+// inferenceURL returns the analysis endpoint of the Python service.
+func inferenceURL() string {
+	return settings.InferenceURL
+}
+
+// inferenceClient bounds how long an analysis may take. Its calls are traced
+// and carry the trace context on to the Python service.
+var inferenceClient = &http.Client{
+	Timeout: 2 * time.Minute,
+	Transport: otelhttp.NewTransport(http.DefaultTransport,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "inference " + r.Method + " " + r.URL.Path
+		}),
+	),
+}
+
+// inferenceError is returned by requestAnalysis when the Python service
+// answers with an error status.
+type inferenceError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *inferenceError) Error() string {
+	return fmt.Sprintf("analysis service returned %d: %s", e.StatusCode, e.Body)
+}
+
+// requestAnalysis sends an image to the Python service and returns its
+// findings.
+func requestAnalysis(ctx context.Context, filename string, image io.Reader) (models.AnalyzeResponse, error) {
+	var analysis models.AnalyzeResponse
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", file.Filename)
+	part, err := writer.CreateFormFile("file", filename)
 	if err != nil {
-		log.Printf("CreateFormFile error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not create form file"})
+		return analysis, err
 	}
-	_, err = io.Copy(part, src)
-	if err != nil {
-		log.Printf("io.Copy error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not copy file content"})
+	if _, err := io.Copy(part, image); err != nil {
+		return analysis, err
 	}
 	writer.Close()
 
-	pythonURL := os.Getenv("PYTHON_SERVICE_URL")
-	if pythonURL == "" {
-		pythonURL = "http://localhost:8000/analyze"
-	}
-
-	req, err := http.NewRequest("POST", pythonURL, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inferenceURL(), body)
 	if err != nil {
-		log.Printf("NewRequest error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not create request to Python service"})
+		return analysis, err
 	}
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Python service request error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not send request to Python service"})
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("ReadAll error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not read response from Python service"})
+	start := time.Now()
+	analysis, outcome, err := callInference(req)
+	metrics.ObserveInference(outcome, time.Since(start))
+	if err == nil {
+		metrics.ObserveDetection(analysis.Detected, analysis.Type, analysis.Confidence)
 	}
+	return analysis, err
+}
 
-	// Unmarshal and re-marshal to ensure the confidence field is present and explicit
-	var analyzeResp AnalyzeResponse
-	err = json.Unmarshal(respBody, &analyzeResp)
+// callInference sends an analysis request and decodes the findings,
+// classifying the outcome for the metrics.
+func callInference(req *http.Request) (models.AnalyzeResponse, string, error) {
+	var analysis models.AnalyzeResponse
+	resp, err := inferenceClient.Do(req)
 	if err != nil {
-		log.Printf("Unmarshal error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Invalid response from Python service"})
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return analysis, metrics.InferenceTimeout, err
+		}
+		return analysis, metrics.InferenceUnreachable, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return analysis, metrics.InferenceError, &inferenceError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&analysis); err != nil {
+		return analysis, metrics.InferenceInvalidResponse, fmt.Errorf("invalid response from analysis service: %w", err)
+	}
+	return analysis, metrics.InferenceSuccess, nil
+}
 
-	return c.Status(resp.StatusCode).JSON(analyzeResp)
+// newAnalyzedReport builds the draft report of an analysis. Findings the
+// service left out stay empty.
+func newAnalyzedReport(patientID, doctorID primitive.ObjectID, imageName string, analysis models.AnalyzeResponse) models.Report {
+	report := models.Report{
+		ID:           primitive.NewObjectID(),
+		PatientID:    patientID,
+		DoctorID:     doctorID,
+		ImageName:    imageName,
+		FractureType: analysis.Type,
+		Confidence:   analysis.Confidence,
+		Version:      1,
+		Status:       models.ReportDraft,
+		CreatedAt:    time.Now(),
+	}
+	if analysis.ImageBase64 != nil {
+		report.AnnotatedImage = *analysis.ImageBase64
+	}
+	if analysis.RecoveryTime != nil {
+		report.RecoveryTime = fmt.Sprintf("%d days", *analysis.RecoveryTime)
+	}
+	return report
 }
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"fracture-detection-webapp/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recordAudit appends an entry to the audit log.
+func recordAudit(ctx context.Context, action string, actorID, targetID primitive.ObjectID, details bson.M) error {
+	_, err := models.Scoped("audit_logs").InsertOne(ctx, models.AuditLog{
+		ID:        primitive.NewObjectID(),
+		Action:    action,
+		ActorID:   actorID,
+		TargetID:  targetID,
+		Details:   details,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
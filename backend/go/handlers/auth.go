@@ -5,8 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fracture-detection-webapp/models"
-	"log"
-	"os"
+	"log/slog"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -21,7 +20,7 @@ type RegisterRequest struct {
 	Email     string `json:"email"`
 	Password  string `json:"password"`
 	Role      string `json:"role"`
-	CreatedBy string `json:"createdBy,omitempty"` // ID of the creator (chef for doctor, doctor for patient)
+	CreatedBy string `json:"createdBy,omitempty"` // ID of the chef creating the doctor
 }
 
 // LoginRequest defines the shape of the request for user login.
@@ -48,6 +47,19 @@ func Register(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required fields"})
 	}
 
+	// Patient accounts must be linked to a patient profile, so they are
+	// created through the patient endpoints instead.
+	if req.Role == "patient" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Patient accounts are created from the patient's record"})
+	}
+	// Chefs are assigned to their facility by a super-admin.
+	if req.Role == "chef" || req.Role == "superadmin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Chef accounts are created by an administrator"})
+	}
+	if req.Role != "doctor" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
+	}
+
 	user := models.User{
 		ID:        primitive.NewObjectID(),
 		FullName:  req.FullName,
@@ -57,26 +69,35 @@ func Register(c *fiber.Ctx) error {
 		CreatedAt: time.Now(),
 	}
 
-	// Handle the creator relationship
-	if req.Role == "doctor" || req.Role == "patient" {
-		creatorID, err := primitive.ObjectIDFromHex(req.CreatedBy)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid creator ID"})
-		}
-		user.CreatedBy = creatorID
+	// Handle the creator relationship. The doctor joins the chef's facility.
+	creatorID, err := primitive.ObjectIDFromHex(req.CreatedBy)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid creator ID"})
 	}
+	user.CreatedBy = creatorID
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
 	defer cancel()
 
+	var chef models.User
+	err = models.DB.Collection("users").FindOne(ctx, bson.M{"_id": creatorID, "role": "chef"}).Decode(&chef)
+	if err != nil || chef.FacilityID.IsZero() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid creator ID"})
+	}
+	if err := checkEmailAvailable(ctx, "users", req.Email, primitive.NilObjectID); err == errEmailTaken {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A user with this email already exists"})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create user"})
+	}
+
 	// Insert the user into the database
-	res, err := models.DB.Collection("users").InsertOne(ctx, user)
+	res, err := models.Scoped("users").InsertOne(models.WithFacility(ctx, chef.FacilityID), user)
 	if err != nil {
-		log.Printf("Error inserting user: %v", err)
+		slog.ErrorContext(ctx, "Error inserting user", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create user"})
 	}
 
-	log.Printf("Successfully inserted user with ID: %v", res.InsertedID)
+	slog.InfoContext(ctx, "Registered user", "userId", res.InsertedID)
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "User registered successfully"})
 }
@@ -88,33 +109,58 @@ func Login(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
 	defer cancel()
 
 	var user models.User
 	err := models.DB.Collection("users").FindOne(ctx, bson.M{"email": req.Email}).Decode(&user)
 	if err != nil {
-		log.Printf("Error finding user '%s': %v", req.Email, err)
+		slog.ErrorContext(ctx, "Error finding user", "email", req.Email, "error", err)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "error bro here!"})
 	}
 
+	if user.Password == "" && user.UsesSSO() {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "This account signs in with single sign-on"})
+	}
+	// A login token would not be limited to the scopes of an API key.
+	if user.Role == "service" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Service accounts authenticate with API keys"})
+	}
 	// Hash the incoming password and compare it with the stored hash
 	hashedInput := HashPasswordSHA256(req.Password)
 	if user.Password != hashedInput {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid credentials"})
 	}
+	if user.IsSuspended() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "This account has been suspended"})
+	}
 
+	tokenStr, err := issueToken(&user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+	recordLogin(ctx, user.ID)
+
+	return c.JSON(fiber.Map{"token": tokenStr})
+}
+
+// issueToken returns a login JWT for a user, valid for 24 hours.
+func issueToken(user *models.User) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
 	claims["userId"] = user.ID.Hex()
 	claims["role"] = user.Role
 	claims["email"] = user.Email
+	if !user.FacilityID.IsZero() {
+		claims["facilityId"] = user.FacilityID.Hex()
+	}
 	claims["exp"] = time.Now().Add(24 * time.Hour).Unix()
+	return token.SignedString(settings.JWTSecret)
+}
 
-	tokenStr, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+// recordLogin records when a user last logged in.
+func recordLogin(ctx context.Context, userID primitive.ObjectID) {
+	if _, err := models.DB.Collection("users").UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"lastLoginAt": time.Now()}}); err != nil {
+		slog.ErrorContext(ctx, "Error recording last login", "userId", userID.Hex(), "error", err)
 	}
-
-	return c.JSON(fiber.Map{"token": tokenStr})
 }
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CareTeamAccessRequest defines the payload for granting a doctor access to a patient.
+type CareTeamAccessRequest struct {
+	Access string `json:"access"` // "read" or "write"
+}
+
+// CareTeamDoctor describes a doctor with access to a patient.
+type CareTeamDoctor struct {
+	DoctorID  primitive.ObjectID `json:"doctorId"`
+	FullName  string             `json:"fullName"`
+	Email     string             `json:"email"`
+	Access    string             `json:"access"`
+	GrantedBy primitive.ObjectID `json:"grantedBy,omitempty"`
+	GrantedAt *time.Time         `json:"grantedAt,omitempty"`
+}
+
+// GetCareTeam lists the owner and care team of a patient.
+func GetCareTeam(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can view care teams"})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findVisiblePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return patientLookupError(c, err)
+	}
+
+	doctorIDs := []primitive.ObjectID{patient.CreatedBy}
+	for _, m := range patient.CareTeam {
+		doctorIDs = append(doctorIDs, m.DoctorID)
+	}
+	var doctors []models.User
+	if err := findAll(ctx, models.Scoped("users"), bson.M{"_id": bson.M{"$in": doctorIDs}}, &doctors); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch doctors"})
+	}
+	byID := make(map[primitive.ObjectID]models.User, len(doctors))
+	for _, d := range doctors {
+		byID[d.ID] = d
+	}
+
+	owner := byID[patient.CreatedBy]
+	members := make([]CareTeamDoctor, 0, len(patient.CareTeam))
+	for _, m := range patient.CareTeam {
+		grantedAt := m.GrantedAt
+		members = append(members, CareTeamDoctor{
+			DoctorID:  m.DoctorID,
+			FullName:  byID[m.DoctorID].FullName,
+			Email:     byID[m.DoctorID].Email,
+			Access:    m.Access,
+			GrantedBy: m.GrantedBy,
+			GrantedAt: &grantedAt,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"patientId": patient.ID,
+		"owner": CareTeamDoctor{
+			DoctorID: patient.CreatedBy,
+			FullName: owner.FullName,
+			Email:    owner.Email,
+			Access:   models.AccessOwner,
+		},
+		"members": members,
+	})
+}
+
+// GrantCareTeamAccess adds a doctor to a patient's care team, or changes the
+// access of a doctor already on it. Only the owner or a chef can do this.
+func GrantCareTeamAccess(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+	doctorID, err := primitive.ObjectIDFromHex(c.Params("doctorId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+	}
+
+	var req CareTeamAccessRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Access != models.AccessRead && req.Access != models.AccessWrite {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "access must be \"read\" or \"write\""})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findCareTeamManagedPatient(ctx, c, patientID, userID, role)
+	if patient == nil {
+		return err
+	}
+	if doctorID == patient.CreatedBy {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "This doctor already owns the patient"})
+	}
+	err = models.Scoped("users").FindOne(ctx, bson.M{"_id": doctorID, "role": "doctor"}).Err()
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Doctor not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch doctor"})
+	}
+
+	patients := models.Scoped("patients")
+	res, err := patients.UpdateOne(ctx,
+		bson.M{"_id": patient.ID, "careTeam.doctorId": doctorID},
+		bson.M{"$set": bson.M{"careTeam.$.access": req.Access}})
+	if err == nil && res.MatchedCount == 0 {
+		_, err = patients.UpdateOne(ctx, bson.M{"_id": patient.ID}, bson.M{"$push": bson.M{"careTeam": models.CareTeamMember{
+			DoctorID:  doctorID,
+			Access:    req.Access,
+			GrantedBy: userID,
+			GrantedAt: time.Now(),
+		}}})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error granting care team access", "patientId", patient.ID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update care team"})
+	}
+	if err := recordAudit(ctx, "careteam.grant", userID, patient.ID, bson.M{"doctorId": doctorID, "access": req.Access}); err != nil {
+		slog.ErrorContext(ctx, "Error recording care team audit entry", "error", err)
+	}
+
+	var updated models.Patient
+	if err := patients.FindOne(ctx, bson.M{"_id": patient.ID}).Decode(&updated); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch patient"})
+	}
+	return c.JSON(updated)
+}
+
+// RevokeCareTeamAccess removes a doctor from a patient's care team. Only the
+// owner or a chef can do this.
+func RevokeCareTeamAccess(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+	doctorID, err := primitive.ObjectIDFromHex(c.Params("doctorId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findCareTeamManagedPatient(ctx, c, patientID, userID, role)
+	if patient == nil {
+		return err
+	}
+
+	var updated models.Patient
+	err = models.Scoped("patients").FindOneAndUpdate(ctx,
+		bson.M{"_id": patient.ID},
+		bson.M{"$pull": bson.M{"careTeam": bson.M{"doctorId": doctorID}}},
+		returnAfter(),
+	).Decode(&updated)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update care team"})
+	}
+	if err := recordAudit(ctx, "careteam.revoke", userID, patient.ID, bson.M{"doctorId": doctorID}); err != nil {
+		slog.ErrorContext(ctx, "Error recording care team audit entry", "error", err)
+	}
+
+	return c.JSON(updated)
+}
+
+// findCareTeamManagedPatient loads a patient whose care team the user may
+// manage. On failure it returns a nil patient and the already-written
+// response, which the handler should return as is.
+func findCareTeamManagedPatient(ctx context.Context, c *fiber.Ctx, patientID, userID primitive.ObjectID, role string) (*models.Patient, error) {
+	patient, err := findVisiblePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return nil, patientLookupError(c, err)
+	}
+	if patient.AccessFor(userID, role) != models.AccessOwner {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the patient's owner or a chef can manage the care team"})
+	}
+	if patient.ArchivedAt != nil {
+		return nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Archived patients cannot be modified"})
+	}
+	return patient, nil
+}
@@ -4,13 +4,20 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
+	"fracture-detection-webapp/emails"
 	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/pdf"
+	"fracture-detection-webapp/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // CreateDoctorRequest defines the payload for creating a doctor.
@@ -38,7 +45,7 @@ func CreateDoctor(c *fiber.Ctx) error {
 
 	// Check if user with the same email already exists
 	var existingUser models.User
-	err := models.DB.Collection("users").FindOne(context.Background(), bson.M{"email": payload.Email}).Decode(&existingUser)
+	err := models.DB.Collection("users").FindOne(c.UserContext(), bson.M{"email": payload.Email}).Decode(&existingUser)
 	if err == nil {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A user with this email already exists"})
 	}
@@ -58,7 +65,8 @@ func CreateDoctor(c *fiber.Ctx) error {
 		// Add any other default fields for a doctor here
 	}
 
-	_, err = models.DB.Collection("users").InsertOne(context.Background(), newDoctor)
+	newDoctor.FacilityID, _ = models.FacilityFromContext(c.UserContext())
+	_, err = models.Scoped("users").InsertOne(c.UserContext(), newDoctor)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create doctor account"})
 	}
@@ -68,3 +76,511 @@ func CreateDoctor(c *fiber.Ctx) error {
 		"user":    newDoctor,
 	})
 }
+
+// UpdateDoctorRequest defines the payload for editing a doctor's profile. Only
+// the fields present are changed.
+type UpdateDoctorRequest struct {
+	FullName *string `json:"fullName"`
+	Email    *string `json:"email"`
+}
+
+// ReassignDoctorRequest names the doctor taking over a departing doctor's work.
+type ReassignDoctorRequest struct {
+	ToDoctorID string `json:"toDoctorId"`
+}
+
+// DoctorSummary is a doctor along with their activity in the facility.
+type DoctorSummary struct {
+	models.User    `bson:",inline"`
+	ReportsCreated int64      `json:"reportsCreated"`
+	PatientsOwned  int64      `json:"patientsOwned"`
+	LastReportAt   *time.Time `json:"lastReportAt,omitempty"`
+}
+
+// GetDoctors lists the doctors of the chef's facility with their activity stats.
+func GetDoctors(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var doctors []models.User
+	if err := findAll(ctx, models.Scoped("users"), bson.M{"role": "doctor"}, &doctors,
+		options.Find().SetSort(bson.M{"fullName": 1})); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch doctors"})
+	}
+
+	var reportStats []struct {
+		DoctorID primitive.ObjectID `bson:"_id"`
+		Count    int64              `bson:"count"`
+		Last     time.Time          `bson:"last"`
+	}
+	err := aggregateAll(ctx, models.Scoped("reports"), mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$doctorId", "count": bson.M{"$sum": 1}, "last": bson.M{"$max": "$createdAt"}}}},
+	}, &reportStats)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch doctor statistics"})
+	}
+	var patientStats []struct {
+		DoctorID primitive.ObjectID `bson:"_id"`
+		Count    int64              `bson:"count"`
+	}
+	err = aggregateAll(ctx, models.Scoped("patients"), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"archivedAt": bson.M{"$exists": false}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$createdBy", "count": bson.M{"$sum": 1}}}},
+	}, &patientStats)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch doctor statistics"})
+	}
+
+	summaries := make(map[primitive.ObjectID]*DoctorSummary, len(doctors))
+	result := make([]*DoctorSummary, 0, len(doctors))
+	for _, d := range doctors {
+		s := &DoctorSummary{User: d}
+		summaries[d.ID] = s
+		result = append(result, s)
+	}
+	for _, r := range reportStats {
+		if s, ok := summaries[r.DoctorID]; ok {
+			last := r.Last
+			s.ReportsCreated, s.LastReportAt = r.Count, &last
+		}
+	}
+	for _, p := range patientStats {
+		if s, ok := summaries[p.DoctorID]; ok {
+			s.PatientsOwned = p.Count
+		}
+	}
+
+	return c.JSON(result)
+}
+
+// UpdateDoctor edits a doctor's name or email.
+func UpdateDoctor(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	doctorID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+	}
+
+	var req UpdateDoctorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{}
+	if req.FullName != nil {
+		name := strings.TrimSpace(*req.FullName)
+		if name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Full name cannot be empty"})
+		}
+		set["fullName"] = name
+	}
+	if req.Email != nil {
+		email, err := utils.NormalizeEmail(*req.Email)
+		if err != nil || email == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email address"})
+		}
+		if err := checkEmailAvailable(ctx, "users", email, doctorID); err == errEmailTaken {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A user with this email already exists"})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update doctor"})
+		}
+		set["email"] = email
+	}
+	if len(set) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No fields to update"})
+	}
+
+	var updated models.User
+	err = models.Scoped("users").FindOneAndUpdate(ctx, bson.M{"_id": doctorID, "role": "doctor"}, bson.M{"$set": set}, returnAfter()).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Doctor not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update doctor"})
+	}
+	if err := recordAudit(ctx, "doctor.update", chefID, doctorID, set); err != nil {
+		slog.ErrorContext(ctx, "Error recording doctor audit entry", "error", err)
+	}
+
+	return c.JSON(updated)
+}
+
+// SuspendDoctor blocks a doctor from logging in and invalidates their
+// existing tokens.
+func SuspendDoctor(c *fiber.Ctx) error {
+	return setDoctorSuspended(c, true)
+}
+
+// ReactivateDoctor lifts a doctor's suspension.
+func ReactivateDoctor(c *fiber.Ctx) error {
+	return setDoctorSuspended(c, false)
+}
+
+func setDoctorSuspended(c *fiber.Ctx, suspended bool) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	doctorID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"status": models.UserActive}, "$unset": bson.M{"suspendedAt": ""}}
+	action := "doctor.reactivate"
+	if suspended {
+		update = bson.M{"$set": bson.M{"status": models.UserSuspended, "suspendedAt": time.Now()}}
+		action = "doctor.suspend"
+	}
+
+	var updated models.User
+	err = models.Scoped("users").FindOneAndUpdate(ctx, bson.M{"_id": doctorID, "role": "doctor"}, update, returnAfter()).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Doctor not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update doctor"})
+	}
+	if err := recordAudit(ctx, action, chefID, doctorID, nil); err != nil {
+		slog.ErrorContext(ctx, "Error recording doctor audit entry", "error", err)
+	}
+
+	return c.JSON(updated)
+}
+
+// ReassignDoctor hands every patient and report of a departing doctor over
+// to another doctor of the facility, in a single transaction. The departing
+// doctor's care team memberships are handed over too.
+func ReassignDoctor(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	fromID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+	}
+	var req ReassignDoctorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	toID, err := primitive.ObjectIDFromHex(req.ToDoctorID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid target doctor ID format"})
+	}
+	if toID == fromID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot reassign a doctor's work to themselves"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 30*time.Second)
+	defer cancel()
+
+	users := models.Scoped("users")
+	if err := users.FindOne(ctx, bson.M{"_id": fromID, "role": "doctor"}).Err(); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Doctor not found"})
+	}
+	var target models.User
+	if err := users.FindOne(ctx, bson.M{"_id": toID, "role": "doctor"}).Decode(&target); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Target doctor not found"})
+	}
+	if target.IsSuspended() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Cannot reassign work to a suspended doctor"})
+	}
+
+	var patientsMoved, reportsMoved int64
+	err = models.RunInTransaction(ctx, func(ctx context.Context) error {
+		patients := models.Scoped("patients")
+
+		// The new owner no longer needs a care team entry on their patients.
+		res, err := patients.UpdateMany(ctx,
+			bson.M{"createdBy": fromID},
+			bson.M{
+				"$set":  bson.M{"createdBy": toID},
+				"$pull": bson.M{"careTeam": bson.M{"doctorId": toID}},
+			})
+		if err != nil {
+			return err
+		}
+		patientsMoved = res.ModifiedCount
+
+		// Hand care team memberships over, unless the target already has
+		// access to the patient; then just drop the departing doctor.
+		_, err = patients.UpdateMany(ctx,
+			bson.M{
+				"careTeam.doctorId": fromID,
+				"careTeam":          bson.M{"$not": bson.M{"$elemMatch": bson.M{"doctorId": toID}}},
+				"createdBy":         bson.M{"$ne": toID},
+			},
+			bson.M{"$set": bson.M{"careTeam.$[m].doctorId": toID}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"m.doctorId": fromID}}}))
+		if err != nil {
+			return err
+		}
+		_, err = patients.UpdateMany(ctx,
+			bson.M{"careTeam.doctorId": fromID},
+			bson.M{"$pull": bson.M{"careTeam": bson.M{"doctorId": fromID}}})
+		if err != nil {
+			return err
+		}
+
+		res, err = models.Scoped("reports").UpdateMany(ctx, bson.M{"doctorId": fromID}, bson.M{"$set": bson.M{"doctorId": toID}})
+		if err != nil {
+			return err
+		}
+		reportsMoved = res.ModifiedCount
+
+		return recordAudit(ctx, "doctor.reassign", chefID, fromID, bson.M{
+			"toDoctorId": toID,
+			"patients":   patientsMoved,
+			"reports":    reportsMoved,
+		})
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reassigning doctor", "fromId", fromID.Hex(), "toId", toID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reassign doctor"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Patients and reports reassigned to " + target.FullName,
+		"patientsMoved":    patientsMoved,
+		"reportsMoved":     reportsMoved,
+		"targetDoctorId":   toID,
+		"departedDoctorId": fromID,
+	})
+}
+
+// DeleteDoctor removes a doctor's account. Doctors who still own patients or
+// reports must be reassigned first, so no record is left without an owner.
+func DeleteDoctor(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	doctorID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var doctor models.User
+	if err := models.Scoped("users").FindOne(ctx, bson.M{"_id": doctorID, "role": "doctor"}).Decode(&doctor); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Doctor not found"})
+	}
+	patients, err := models.Scoped("patients").CountDocuments(ctx, bson.M{"createdBy": doctorID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete doctor"})
+	}
+	reports, err := models.Scoped("reports").CountDocuments(ctx, bson.M{"doctorId": doctorID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete doctor"})
+	}
+	if patients > 0 || reports > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":    "This doctor still has patients or reports; reassign them first",
+			"patients": patients,
+			"reports":  reports,
+		})
+	}
+
+	err = models.RunInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := models.Scoped("patients").UpdateMany(ctx,
+			bson.M{"careTeam.doctorId": doctorID},
+			bson.M{"$pull": bson.M{"careTeam": bson.M{"doctorId": doctorID}}}); err != nil {
+			return err
+		}
+		if _, err := models.Scoped("users").DeleteOne(ctx, bson.M{"_id": doctorID}); err != nil {
+			return err
+		}
+		return recordAudit(ctx, "doctor.delete", chefID, doctorID, bson.M{"email": doctor.Email})
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting doctor", "doctorId", doctorID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete doctor"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// FacilityBrandingRequest defines the payload for changing how the facility's
+// report PDFs look. Only the fields present are changed; an empty string
+// clears a field.
+type FacilityBrandingRequest struct {
+	ReportHeader *string `json:"reportHeader"`
+	Address      *string `json:"address"`
+	Phone        *string `json:"phone"`
+	LogoBase64   *string `json:"logoBase64"`
+}
+
+// maxLogoSize caps the size of a facility logo, base64-encoded.
+const maxLogoSize = 512 * 1024
+
+// GetFacility returns the chef's facility, including its branding.
+func GetFacility(c *fiber.Ctx) error {
+	facility, err := models.CurrentFacility(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch facility"})
+	}
+	return c.JSON(facility)
+}
+
+// UpdateFacilityBranding changes the header and logo printed on the
+// facility's report PDFs.
+func UpdateFacilityBranding(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	var req FacilityBrandingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	set, unset := bson.M{}, bson.M{}
+	for field, value := range map[string]*string{
+		"reportHeader": req.ReportHeader,
+		"address":      req.Address,
+		"phone":        req.Phone,
+		"logoBase64":   req.LogoBase64,
+	} {
+		switch {
+		case value == nil:
+		case strings.TrimSpace(*value) == "":
+			unset[field] = ""
+		default:
+			set[field] = strings.TrimSpace(*value)
+		}
+	}
+	if logo, ok := set["logoBase64"].(string); ok {
+		if len(logo) > maxLogoSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Logo must be smaller than 512 KB"})
+		}
+		if err := pdf.ValidateImage(logo); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Logo must be a base64-encoded PNG or JPEG image"})
+		}
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No fields to update"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	facilityID, _ := models.FacilityFromContext(ctx)
+	var updated models.Facility
+	err = models.DB.Collection("facilities").FindOneAndUpdate(ctx, bson.M{"_id": facilityID}, update, returnAfter()).Decode(&updated)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update facility"})
+	}
+	if err := recordAudit(ctx, "facility.branding", chefID, facilityID, nil); err != nil {
+		slog.ErrorContext(ctx, "Error recording facility audit entry", "error", err)
+	}
+
+	return c.JSON(updated)
+}
+
+// MailTestRequest defines the optional payload of TestMailSettings.
+type MailTestRequest struct {
+	To string `json:"to"` // if set, a test email is also sent there
+}
+
+// TestMailSettings checks that the server can deliver email with its current
+// mailer configuration, and optionally sends a test message.
+func TestMailSettings(c *fiber.Ctx) error {
+	var req MailTestRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 30*time.Second)
+	defer cancel()
+
+	settings := utils.CurrentMailerConfig()
+	if err := utils.TestMailer(ctx); err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"ok": false, "error": err.Error(), "settings": settings})
+	}
+	if req.To != "" {
+		to, err := utils.NormalizeEmail(req.To)
+		if err != nil || to == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email address"})
+		}
+		err = utils.SendMessage(ctx, &utils.Message{
+			To:       []string{to},
+			Subject:  "Test email from the Fracture Detection API",
+			TextBody: "This is a test email. Your mail settings work.\r\n",
+			HTMLBody: "<p>This is a test email. Your mail settings work.</p>",
+		})
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"ok": false, "error": err.Error(), "settings": settings})
+		}
+	}
+
+	return c.JSON(fiber.Map{"ok": true, "settings": settings})
+}
+
+// GetEmailTemplates lists the notification email templates and the locales
+// they are available in.
+func GetEmailTemplates(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"templates":     emails.Names,
+		"locales":       emails.Locales(),
+		"defaultLocale": emails.DefaultLocale,
+	})
+}
+
+// PreviewEmailTemplate renders a template with sample patient data and the
+// facility's branding. With ?format=html the HTML body is returned as a page;
+// otherwise the subject, HTML and text bodies are returned as JSON.
+func PreviewEmailTemplate(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if !emails.IsTemplate(name) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Email template not found"})
+	}
+	locale, err := emails.NormalizeLocale(c.Query("locale"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if locale == "" {
+		locale = emails.DefaultLocale
+	}
+
+	facility, err := models.CurrentFacility(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch facility"})
+	}
+	msg, err := emails.Preview(name, locale, *facility)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to render template: " + err.Error()})
+	}
+
+	if c.Query("format") == "html" {
+		c.Type("html", "utf-8")
+		return c.SendString(msg.HTMLBody)
+	}
+	return c.JSON(fiber.Map{
+		"template": name,
+		"locale":   locale,
+		"subject":  msg.Subject,
+		"html":     msg.HTMLBody,
+		"text":     msg.TextBody,
+	})
+}
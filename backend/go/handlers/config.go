@@ -0,0 +1,23 @@
+package handlers
+
+import "net/netip"
+
+// Config holds the settings the handlers need from the server configuration.
+type Config struct {
+	JWTSecret    []byte // signs login tokens
+	InferenceURL string // analysis endpoint of the Python service
+	// WebhookAllowedNetworks are private networks webhooks may be sent to
+	// nonetheless, such as a receiver on the hospital's network.
+	WebhookAllowedNetworks []netip.Prefix
+	// MetricsToken lets monitoring see why /readyz fails, as it does /metrics.
+	MetricsToken string
+}
+
+// settings is the configuration installed with Configure.
+var settings = Config{InferenceURL: "http://localhost:8000/analyze"}
+
+// Configure installs the handlers' configuration. It must be called before
+// the server starts.
+func Configure(cfg Config) {
+	settings = cfg
+}
@@ -0,0 +1,779 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/dicom"
+	"fracture-detection-webapp/middleware"
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DICOMweb (PS3.18) lets a PACS push studies for analysis with STOW-RS,
+// and search and retrieve what it stored with QIDO-RS and WADO-RS. Service
+// accounts and chefs see every instance of their facility, doctors those
+// of the patients they can see.
+
+const (
+	dicomMediaType = "application/dicom"
+	dicomJSONType  = "application/dicom+json"
+)
+
+// STOW-RS failure reasons (PS3.4 Annex B.2.3).
+const (
+	failureProcessing       = 0x0110
+	failureStudyMismatch    = 0xA900
+	failureCannotUnderstand = 0xC000
+)
+
+// stowFailure is why an instance of a STOW-RS request was not stored.
+type stowFailure struct {
+	Reason  int
+	Comment string
+}
+
+// stowRequest holds what storing the instances of one request needs.
+type stowRequest struct {
+	userID primitive.ObjectID
+	role   string
+	owner  primitive.ObjectID // who owns the patients and reports created
+	study  string             // the study of the request URL, if any
+}
+
+func dicomwebBase(c *fiber.Ctx) string {
+	return c.BaseURL() + "/dicomweb"
+}
+
+func studyURL(base, study string) string {
+	return base + "/studies/" + study
+}
+
+func instanceURL(base string, i *models.DicomInstance) string {
+	return fmt.Sprintf("%s/studies/%s/series/%s/instances/%s", base, i.StudyInstanceUID, i.SeriesInstanceUID, i.SOPInstanceUID)
+}
+
+// dicomVisibilityFilter returns the dicom_instances filter matching the
+// instances the given user is allowed to see.
+func dicomVisibilityFilter(ctx context.Context, userID primitive.ObjectID, role string) (bson.M, error) {
+	if role != "doctor" {
+		return bson.M{}, nil
+	}
+	patientIDs, err := visiblePatientIDs(ctx, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"patientId": bson.M{"$in": patientIDs}}, nil
+}
+
+// maxSTOWSize bounds the body of a STOW-RS request, read as it arrives
+// rather than by the server: it may hold a whole study.
+const maxSTOWSize = 512 << 20
+
+// IsSTOWRequest reports whether a request is a STOW-RS request, whose body
+// StoreInstances reads itself.
+func IsSTOWRequest(c *fiber.Ctx) bool {
+	return c.Method() == fiber.MethodPost && strings.HasPrefix(c.Path(), "/dicomweb/studies")
+}
+
+// StoreInstances is STOW-RS: it stores the DICOM instances of a
+// multipart/related request and queues the analysis of those with pixel
+// data. Each instance's patient is matched by MRN, its DICOM Patient ID, and
+// registered when unknown. Instances already stored are acknowledged again.
+func StoreInstances(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	mediaType, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err != nil || mediaType != "multipart/related" || params["boundary"] == "" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": `Expected multipart/related; type="application/dicom"`})
+	}
+	if t := params["type"]; t != "" && t != dicomMediaType {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "Only application/dicom instances can be stored"})
+	}
+
+	if c.Request().Header.ContentLength() > maxSTOWSize {
+		return middleware.BodyTooLarge(c)
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 2*time.Minute)
+	defer cancel()
+
+	owner, err := recordOwner(ctx, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch account"})
+	}
+	req := stowRequest{userID: userID, role: role, owner: owner, study: c.Params("study")}
+	base := dicomwebBase(c)
+
+	var stored, failed []dicom.JSON
+	reader := multipart.NewReader(middleware.BodyReader(c, maxSTOWSize), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, middleware.ErrBodyTooLarge) {
+			return middleware.BodyTooLarge(c)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Malformed multipart body"})
+		}
+		var ds *dicom.Dataset
+		var instance *models.DicomInstance
+		var failure *stowFailure
+		if ct := part.Header.Get(fiber.HeaderContentType); ct != "" && !strings.HasPrefix(ct, dicomMediaType) {
+			failure = &stowFailure{Reason: failureCannotUnderstand, Comment: "Unsupported part type " + ct}
+		} else if data, err := io.ReadAll(part); errors.Is(err, middleware.ErrBodyTooLarge) {
+			return middleware.BodyTooLarge(c)
+		} else if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Malformed multipart body"})
+		} else {
+			ds, instance, failure = storeInstance(ctx, req, data)
+		}
+
+		if failure != nil {
+			item := dicom.JSON{}
+			if ds != nil {
+				item.Set(dicom.ReferencedSOPClassUID, "UI", ds.String(dicom.SOPClassUID))
+				item.Set(dicom.ReferencedSOPInstanceUID, "UI", ds.String(dicom.SOPInstanceUID))
+			}
+			item.Set(dicom.FailureReason, "US", failure.Reason)
+			item.Set(dicom.ErrorComment, "LO", failure.Comment)
+			failed = append(failed, item)
+			continue
+		}
+		stored = append(stored, dicom.JSON{}.
+			Set(dicom.ReferencedSOPClassUID, "UI", instance.SOPClassUID).
+			Set(dicom.ReferencedSOPInstanceUID, "UI", instance.SOPInstanceUID).
+			Set(dicom.RetrieveURL, "UR", instanceURL(base, instance)))
+	}
+	if len(stored) == 0 && len(failed) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No instances in request"})
+	}
+
+	response := dicom.JSON{}
+	if req.study != "" {
+		response.Set(dicom.RetrieveURL, "UR", studyURL(base, req.study))
+	}
+	if len(stored) > 0 {
+		response.SetSequence(dicom.ReferencedSOPSequence, stored...)
+	}
+	if len(failed) > 0 {
+		response.SetSequence(dicom.FailedSOPSequence, failed...)
+	}
+	status := fiber.StatusOK
+	if len(stored) == 0 {
+		status = fiber.StatusConflict
+	} else if len(failed) > 0 {
+		status = fiber.StatusAccepted
+	}
+	return c.Status(status).JSON(response, dicomJSONType)
+}
+
+// storeInstance stores one instance. The data set is returned whenever the
+// instance could be parsed, so failures can name it.
+func storeInstance(ctx context.Context, req stowRequest, data []byte) (*dicom.Dataset, *models.DicomInstance, *stowFailure) {
+	ds, err := dicom.Parse(data)
+	if err != nil {
+		return nil, nil, &stowFailure{Reason: failureCannotUnderstand, Comment: err.Error()}
+	}
+	sopUID := ds.String(dicom.SOPInstanceUID)
+	studyUID := ds.String(dicom.StudyInstanceUID)
+	seriesUID := ds.String(dicom.SeriesInstanceUID)
+	if sopUID == "" || studyUID == "" || seriesUID == "" {
+		return ds, nil, &stowFailure{Reason: failureCannotUnderstand, Comment: "Missing Study, Series or SOP Instance UID"}
+	}
+	if req.study != "" && studyUID != req.study {
+		return ds, nil, &stowFailure{Reason: failureStudyMismatch, Comment: "Instance belongs to study " + studyUID}
+	}
+	processingFailure := func(what string, err error) (*dicom.Dataset, *models.DicomInstance, *stowFailure) {
+		slog.WarnContext(ctx, "DICOMweb: instance refused", "reason", what, "sopInstanceUid", sopUID, "error", err)
+		return ds, nil, &stowFailure{Reason: failureProcessing, Comment: "Failed to " + what}
+	}
+
+	instances := models.Scoped("dicom_instances")
+	var existing models.DicomInstance
+	err = instances.FindOne(ctx, bson.M{"sopInstanceUid": sopUID}).Decode(&existing)
+	if err == nil {
+		return ds, &existing, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return processingFailure("look up instance", err)
+	}
+
+	patient, failure := matchDicomPatient(ctx, req, ds)
+	if failure != nil {
+		return ds, nil, failure
+	}
+
+	fileID, err := models.StoreDicomFile(ctx, sopUID+".dcm", data)
+	if err != nil {
+		return processingFailure("store instance", err)
+	}
+	instance := models.DicomInstance{
+		ID:                primitive.NewObjectID(),
+		PatientID:         patient.ID,
+		StudyInstanceUID:  studyUID,
+		SeriesInstanceUID: seriesUID,
+		SOPInstanceUID:    sopUID,
+		SOPClassUID:       ds.String(dicom.SOPClassUID),
+		TransferSyntaxUID: ds.TransferSyntax(),
+		Modality:          ds.String(dicom.Modality),
+		StudyDate:         ds.String(dicom.StudyDate),
+		StudyTime:         ds.String(dicom.StudyTime),
+		StudyDescription:  ds.String(dicom.StudyDescription),
+		StudyID:           ds.String(dicom.StudyID),
+		AccessionNumber:   ds.String(dicom.AccessionNumber),
+		SeriesDescription: ds.String(dicom.SeriesDescription),
+		BodyPart:          ds.String(dicom.BodyPartExamined),
+		DicomPatientID:    patient.MRN,
+		DicomPatientName:  ds.String(dicom.PatientName),
+		FileID:            fileID,
+		Size:              int64(len(data)),
+		ReceivedBy:        req.userID,
+		CreatedAt:         time.Now(),
+	}
+	if n, ok := ds.Int(dicom.SeriesNumber); ok {
+		instance.SeriesNumber = &n
+	}
+	if n, ok := ds.Int(dicom.InstanceNumber); ok {
+		instance.InstanceNumber = &n
+	}
+	if _, err := instances.InsertOne(ctx, instance); err != nil {
+		if delErr := models.DeleteDicomFile(ctx, fileID); delErr != nil {
+			slog.ErrorContext(ctx, "DICOMweb: removing an instance file failed", "sopInstanceUid", sopUID, "error", delErr)
+		}
+		// Stored by a concurrent request in the meantime.
+		if mongo.IsDuplicateKeyError(err) && instances.FindOne(ctx, bson.M{"sopInstanceUid": sopUID}).Decode(&existing) == nil {
+			return ds, &existing, nil
+		}
+		return processingFailure("store instance", err)
+	}
+	instance.FacilityID, _ = models.FacilityFromContext(ctx)
+
+	if err := recordAudit(ctx, "dicom.store", req.userID, instance.ID, bson.M{
+		"studyInstanceUid": studyUID,
+		"sopInstanceUid":   sopUID,
+		"patientId":        patient.ID,
+	}); err != nil {
+		slog.ErrorContext(ctx, "Error recording storage of DICOM instance", "instanceId", instance.ID.Hex(), "error", err)
+	}
+	if ds.Get(dicom.PixelData) != nil {
+		if err := queueAnalysis(ctx, &instance, req.owner); err != nil {
+			slog.ErrorContext(ctx, "DICOMweb: queueing an analysis failed", "sopInstanceUid", sopUID, "error", err)
+		}
+	}
+	return ds, &instance, nil
+}
+
+// matchDicomPatient finds the patient whose MRN is the instance's Patient
+// ID, or registers them from the instance's patient module.
+func matchDicomPatient(ctx context.Context, req stowRequest, ds *dicom.Dataset) (*models.Patient, *stowFailure) {
+	mrn := strings.ToUpper(ds.String(dicom.PatientID))
+	if mrn == "" {
+		return nil, &stowFailure{Reason: failureCannotUnderstand, Comment: "Patient ID (0010,0020) is required to match the patient"}
+	}
+
+	var patient models.Patient
+	err := models.Scoped("patients").FindOne(ctx, bson.M{"mrn": mrn}).Decode(&patient)
+	if err == nil {
+		if req.role == "doctor" {
+			if _, err := findWritablePatient(ctx, patient.ID, req.userID, req.role); err != nil {
+				return nil, &stowFailure{Reason: failureProcessing, Comment: "You cannot add studies to patient " + mrn}
+			}
+		}
+		if patient.ArchivedAt != nil {
+			return nil, &stowFailure{Reason: failureProcessing, Comment: "Patient " + mrn + " is archived"}
+		}
+		return &patient, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		slog.ErrorContext(ctx, "DICOMweb: looking up patient failed", "mrn", mrn, "error", err)
+		return nil, &stowFailure{Reason: failureProcessing, Comment: "Failed to fetch patient"}
+	}
+
+	patientReq := PatientRequest{
+		FullName: dicom.PersonName(ds.String(dicom.PatientName)),
+		MRN:      mrn,
+		Sex:      dicom.Sex(ds.String(dicom.PatientSex)),
+	}
+	if dob, ok := dicom.ParseDate(ds.String(dicom.PatientBirthDate)); ok {
+		patientReq.DateOfBirth = dob.Format("2006-01-02")
+	}
+	patient, err = newPatient(patientReq, req.owner)
+	if err != nil {
+		return nil, &stowFailure{Reason: failureCannotUnderstand, Comment: "Cannot register patient " + mrn + ": " + err.Error()}
+	}
+	if err := insertPatient(ctx, &patient, nil); err != nil {
+		if err == errMRNTaken {
+			// Registered by a concurrent request; its next attempt will match.
+			return nil, &stowFailure{Reason: failureProcessing, Comment: "Patient " + mrn + " was registered concurrently, please retry"}
+		}
+		slog.ErrorContext(ctx, "DICOMweb: registering patient failed", "mrn", mrn, "error", err)
+		return nil, &stowFailure{Reason: failureProcessing, Comment: "Failed to register patient"}
+	}
+	if err := recordAudit(ctx, "patient.dicom.create", req.userID, patient.ID, bson.M{"mrn": mrn}); err != nil {
+		slog.ErrorContext(ctx, "Error recording patient registration", "patientId", patient.ID.Hex(), "error", err)
+	}
+	return &patient, nil
+}
+
+// queueAnalysis adds an instance to the analysis outbox.
+func queueAnalysis(ctx context.Context, instance *models.DicomInstance, doctorID primitive.ObjectID) error {
+	now := time.Now()
+	_, err := models.Scoped("analysis_jobs").InsertOne(ctx, models.AnalysisJob{
+		ID:            primitive.NewObjectID(),
+		InstanceID:    instance.ID,
+		DoctorID:      doctorID,
+		Status:        models.NotificationQueued,
+		MaxAttempts:   models.DefaultAnalysisAttempts,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	return err
+}
+
+// RunAnalysisWorker analyzes the instances stored through STOW-RS until ctx
+// is done. Like RunNotificationWorker, it can run on several servers at once.
+func RunAnalysisWorker(ctx context.Context) {
+	pollOutbox(ctx, "DICOM analysis job", func(ctx context.Context) error {
+		j, err := models.ClaimAnalysisJob(ctx)
+		if err != nil {
+			return err
+		}
+		processAnalysisJob(ctx, j)
+		return nil
+	})
+}
+
+// processAnalysisJob makes one analysis attempt and records its outcome.
+func processAnalysisJob(ctx context.Context, j *models.AnalysisJob) {
+	jobCtx, cancel := context.WithTimeout(models.WithFacility(ctx, j.FacilityID), 3*time.Minute)
+	defer cancel()
+
+	err := analyzeInstance(jobCtx, j)
+	if err != nil {
+		slog.WarnContext(ctx, "DICOMweb: analysis job failed", "jobId", j.ID.Hex(), "attempt", j.Attempts, "maxAttempts", j.MaxAttempts, "error", err)
+	}
+	if err := models.CompleteAnalysisJob(ctx, j, err, errors.Is(err, errPermanent)); err != nil {
+		slog.ErrorContext(ctx, "DICOMweb: recording the outcome of an analysis job failed", "jobId", j.ID.Hex(), "error", err)
+	}
+}
+
+// analyzeInstance renders an instance, sends it to the analysis service and
+// creates the draft report of its findings. Instances that cannot be
+// rendered, or that the service rejects, are not retried.
+func analyzeInstance(ctx context.Context, j *models.AnalysisJob) error {
+	var instance models.DicomInstance
+	err := models.Scoped("dicom_instances").FindOne(ctx, bson.M{"_id": j.InstanceID}).Decode(&instance)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("%w: instance not found", errPermanent)
+	}
+	if err != nil {
+		return err
+	}
+	// An earlier attempt may have created the report and failed afterwards.
+	var report models.Report
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"dicomInstanceId": instance.ID}).Decode(&report)
+	if err == nil {
+		return linkInstanceReport(ctx, instance.ID, report.ID)
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	data, err := models.ReadDicomFile(ctx, instance.FileID)
+	if err != nil {
+		return err
+	}
+	ds, err := dicom.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	image, err := ds.PNG()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	analysis, err := requestAnalysis(ctx, instance.SOPInstanceUID+".png", bytes.NewReader(image))
+	var ie *inferenceError
+	if errors.As(err, &ie) && ie.StatusCode >= 400 && ie.StatusCode < 500 && ie.StatusCode != fiber.StatusTooManyRequests {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	report = newAnalyzedReport(instance.PatientID, j.DoctorID, instance.SOPInstanceUID+".dcm", analysis)
+	report.DicomInstanceID = instance.ID
+	if _, err := models.Scoped("reports").InsertOne(ctx, report); err != nil {
+		return err
+	}
+	report.FacilityID = j.FacilityID
+	emitReportEvent(ctx, models.EventReportCreated, &report)
+	return linkInstanceReport(ctx, instance.ID, report.ID)
+}
+
+func linkInstanceReport(ctx context.Context, instanceID, reportID primitive.ObjectID) error {
+	_, err := models.Scoped("dicom_instances").UpdateOne(ctx, bson.M{"_id": instanceID},
+		bson.M{"$set": bson.M{"reportId": reportID}})
+	return err
+}
+
+// qidoParam returns a QIDO-RS matching key, given by keyword or by tag.
+func qidoParam(c *fiber.Ctx, keyword string, tag dicom.Tag) string {
+	if v := c.Query(keyword); v != "" {
+		return v
+	}
+	return c.Query(tag.String())
+}
+
+// qidoMatch matches a value, with the * and ? wildcards of DICOM.
+func qidoMatch(value string, caseInsensitive bool) interface{} {
+	if !strings.ContainsAny(value, "*?") && !caseInsensitive {
+		return value
+	}
+	pattern := regexp.QuoteMeta(value)
+	pattern = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(pattern)
+	opts := ""
+	if caseInsensitive {
+		opts = "i"
+	}
+	return primitive.Regex{Pattern: "^" + pattern + "$", Options: opts}
+}
+
+// qidoUIDs matches a list of UIDs, separated by commas or backslashes.
+func qidoUIDs(value string) bson.M {
+	uids := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\\' })
+	return bson.M{"$in": uids}
+}
+
+var dicomDate = regexp.MustCompile(`^\d{8}$`)
+
+// qidoDateRange matches a DICOM date or date range, "from-to" with either
+// end left open.
+func qidoDateRange(value string) (interface{}, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	for _, d := range []string{from, to} {
+		if d != "" && !dicomDate.MatchString(d) {
+			return nil, fmt.Errorf("invalid date %q, expected YYYYMMDD", d)
+		}
+	}
+	if !isRange {
+		return from, nil
+	}
+	clause := bson.M{}
+	if from != "" {
+		clause["$gte"] = from
+	}
+	if to != "" {
+		clause["$lte"] = to
+	}
+	return clause, nil
+}
+
+// qidoPage reads the limit and offset of a QIDO-RS query.
+func qidoPage(c *fiber.Ctx) (limit, offset int) {
+	return min(max(c.QueryInt("limit", 100), 1), 1000), max(c.QueryInt("offset", 0), 0)
+}
+
+// qidoVisibility starts the filter of a QIDO-RS or WADO-RS request.
+func qidoVisibility(ctx context.Context, c *fiber.Ctx) (bson.M, error) {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	return dicomVisibilityFilter(ctx, userID, role)
+}
+
+// SearchStudies is QIDO-RS for studies. It matches PatientID, PatientName,
+// StudyInstanceUID, AccessionNumber, StudyDate and ModalitiesInStudy.
+func SearchStudies(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	filter, err := qidoVisibility(ctx, c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if v := qidoParam(c, "PatientID", dicom.PatientID); v != "" {
+		filter = withClause(filter, bson.M{"dicomPatientId": qidoMatch(strings.ToUpper(v), false)})
+	}
+	if v := qidoParam(c, "PatientName", dicom.PatientName); v != "" {
+		filter = withClause(filter, bson.M{"dicomPatientName": qidoMatch(v, true)})
+	}
+	if v := qidoParam(c, "StudyInstanceUID", dicom.StudyInstanceUID); v != "" {
+		filter = withClause(filter, bson.M{"studyInstanceUid": qidoUIDs(v)})
+	}
+	if v := qidoParam(c, "AccessionNumber", dicom.AccessionNumber); v != "" {
+		filter = withClause(filter, bson.M{"accessionNumber": qidoMatch(v, false)})
+	}
+	if v := qidoParam(c, "StudyDate", dicom.StudyDate); v != "" {
+		clause, err := qidoDateRange(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter = withClause(filter, bson.M{"studyDate": clause})
+	}
+	limit, offset := qidoPage(c)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":              "$studyInstanceUid",
+			"studyDate":        bson.M{"$first": "$studyDate"},
+			"studyTime":        bson.M{"$first": "$studyTime"},
+			"studyDescription": bson.M{"$first": "$studyDescription"},
+			"studyId":          bson.M{"$first": "$studyId"},
+			"accessionNumber":  bson.M{"$first": "$accessionNumber"},
+			"dicomPatientId":   bson.M{"$first": "$dicomPatientId"},
+			"dicomPatientName": bson.M{"$first": "$dicomPatientName"},
+			"modalities":       bson.M{"$addToSet": "$modality"},
+			"series":           bson.M{"$addToSet": "$seriesInstanceUid"},
+			"instances":        bson.M{"$sum": 1},
+		}}},
+	}
+	if v := qidoParam(c, "ModalitiesInStudy", dicom.ModalitiesInStudy); v != "" {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"modalities": bson.M{"$in": strings.Split(v, ",")}}}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "studyDate", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$skip", Value: offset}},
+		bson.D{{Key: "$limit", Value: limit}},
+	)
+
+	var studies []struct {
+		StudyInstanceUID string   `bson:"_id"`
+		StudyDate        string   `bson:"studyDate"`
+		StudyTime        string   `bson:"studyTime"`
+		StudyDescription string   `bson:"studyDescription"`
+		StudyID          string   `bson:"studyId"`
+		AccessionNumber  string   `bson:"accessionNumber"`
+		DicomPatientID   string   `bson:"dicomPatientId"`
+		DicomPatientName string   `bson:"dicomPatientName"`
+		Modalities       []string `bson:"modalities"`
+		Series           []string `bson:"series"`
+		Instances        int      `bson:"instances"`
+	}
+	if err := aggregateAll(ctx, models.Scoped("dicom_instances"), pipeline, &studies); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search studies"})
+	}
+
+	base := dicomwebBase(c)
+	results := make([]dicom.JSON, 0, len(studies))
+	for _, s := range studies {
+		modalities := make([]any, 0, len(s.Modalities))
+		for _, m := range s.Modalities {
+			modalities = append(modalities, m)
+		}
+		results = append(results, dicom.JSON{}.
+			Set(dicom.StudyDate, "DA", s.StudyDate).
+			Set(dicom.StudyTime, "TM", s.StudyTime).
+			Set(dicom.AccessionNumber, "SH", s.AccessionNumber).
+			Set(dicom.ModalitiesInStudy, "CS", modalities...).
+			Set(dicom.StudyDescription, "LO", s.StudyDescription).
+			Set(dicom.PatientName, "PN", s.DicomPatientName).
+			Set(dicom.PatientID, "LO", s.DicomPatientID).
+			Set(dicom.StudyInstanceUID, "UI", s.StudyInstanceUID).
+			Set(dicom.StudyID, "SH", s.StudyID).
+			Set(dicom.NumberOfStudyRelatedSeries, "IS", len(s.Series)).
+			Set(dicom.NumberOfStudyRelatedInstances, "IS", s.Instances).
+			Set(dicom.RetrieveURL, "UR", studyURL(base, s.StudyInstanceUID)))
+	}
+	return c.JSON(results, dicomJSONType)
+}
+
+// SearchSeries is QIDO-RS for the series of a study. It matches Modality and
+// SeriesInstanceUID.
+func SearchSeries(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	filter, err := qidoVisibility(ctx, c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	filter = withClause(filter, bson.M{"studyInstanceUid": c.Params("study")})
+	if v := qidoParam(c, "Modality", dicom.Modality); v != "" {
+		filter = withClause(filter, bson.M{"modality": qidoMatch(v, false)})
+	}
+	if v := qidoParam(c, "SeriesInstanceUID", dicom.SeriesInstanceUID); v != "" {
+		filter = withClause(filter, bson.M{"seriesInstanceUid": qidoUIDs(v)})
+	}
+	limit, offset := qidoPage(c)
+
+	var series []struct {
+		SeriesInstanceUID string `bson:"_id"`
+		StudyInstanceUID  string `bson:"studyInstanceUid"`
+		Modality          string `bson:"modality"`
+		SeriesDescription string `bson:"seriesDescription"`
+		SeriesNumber      *int   `bson:"seriesNumber"`
+		Instances         int    `bson:"instances"`
+	}
+	err = aggregateAll(ctx, models.Scoped("dicom_instances"), mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":               "$seriesInstanceUid",
+			"studyInstanceUid":  bson.M{"$first": "$studyInstanceUid"},
+			"modality":          bson.M{"$first": "$modality"},
+			"seriesDescription": bson.M{"$first": "$seriesDescription"},
+			"seriesNumber":      bson.M{"$first": "$seriesNumber"},
+			"instances":         bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "seriesNumber", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: offset}},
+		{{Key: "$limit", Value: limit}},
+	}, &series)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search series"})
+	}
+
+	base := dicomwebBase(c)
+	results := make([]dicom.JSON, 0, len(series))
+	for _, s := range series {
+		result := dicom.JSON{}.
+			Set(dicom.Modality, "CS", s.Modality).
+			Set(dicom.SeriesDescription, "LO", s.SeriesDescription).
+			Set(dicom.StudyInstanceUID, "UI", s.StudyInstanceUID).
+			Set(dicom.SeriesInstanceUID, "UI", s.SeriesInstanceUID).
+			Set(dicom.NumberOfSeriesRelatedInstances, "IS", s.Instances).
+			Set(dicom.RetrieveURL, "UR", studyURL(base, s.StudyInstanceUID)+"/series/"+s.SeriesInstanceUID)
+		if s.SeriesNumber != nil {
+			result.Set(dicom.SeriesNumber, "IS", *s.SeriesNumber)
+		}
+		results = append(results, result)
+	}
+	return c.JSON(results, dicomJSONType)
+}
+
+// SearchInstances is QIDO-RS for the instances of a series. It matches
+// SOPInstanceUID.
+func SearchInstances(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	filter, err := qidoVisibility(ctx, c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	filter = withClause(filter, bson.M{"studyInstanceUid": c.Params("study"), "seriesInstanceUid": c.Params("series")})
+	if v := qidoParam(c, "SOPInstanceUID", dicom.SOPInstanceUID); v != "" {
+		filter = withClause(filter, bson.M{"sopInstanceUid": qidoUIDs(v)})
+	}
+	limit, offset := qidoPage(c)
+
+	var instances []models.DicomInstance
+	err = findAll(ctx, models.Scoped("dicom_instances"), filter, &instances, options.Find().
+		SetSort(bson.D{{Key: "instanceNumber", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(offset)).SetLimit(int64(limit)))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search instances"})
+	}
+
+	base := dicomwebBase(c)
+	results := make([]dicom.JSON, 0, len(instances))
+	for i := range instances {
+		inst := &instances[i]
+		result := dicom.JSON{}.
+			Set(dicom.SOPClassUID, "UI", inst.SOPClassUID).
+			Set(dicom.SOPInstanceUID, "UI", inst.SOPInstanceUID).
+			Set(dicom.StudyInstanceUID, "UI", inst.StudyInstanceUID).
+			Set(dicom.SeriesInstanceUID, "UI", inst.SeriesInstanceUID).
+			Set(dicom.RetrieveURL, "UR", instanceURL(base, inst))
+		if inst.InstanceNumber != nil {
+			result.Set(dicom.InstanceNumber, "IS", *inst.InstanceNumber)
+		}
+		results = append(results, result)
+	}
+	return c.JSON(results, dicomJSONType)
+}
+
+// acceptsDicom reports whether an Accept header allows the multipart/related
+// application/dicom responses of WADO-RS.
+func acceptsDicom(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, r := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "*/*", "multipart/*", dicomMediaType:
+			return true
+		case "multipart/related":
+			if t := params["type"]; t == "" || t == dicomMediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RetrieveInstances is WADO-RS: it returns the instances of a study, a
+// series or a single instance, depending on the route, as
+// multipart/related application/dicom.
+func RetrieveInstances(c *fiber.Ctx) error {
+	if !acceptsDicom(c.Get(fiber.HeaderAccept)) {
+		return c.Status(fiber.StatusNotAcceptable).JSON(fiber.Map{"error": `Only multipart/related; type="application/dicom" is supported`})
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 2*time.Minute)
+	defer cancel()
+
+	filter, err := qidoVisibility(ctx, c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	match := bson.M{"studyInstanceUid": c.Params("study")}
+	if series := c.Params("series"); series != "" {
+		match["seriesInstanceUid"] = series
+	}
+	if instance := c.Params("instance"); instance != "" {
+		match["sopInstanceUid"] = instance
+	}
+	var instances []models.DicomInstance
+	err = findAll(ctx, models.Scoped("dicom_instances"), withClause(filter, match), &instances, options.Find().
+		SetSort(bson.D{{Key: "seriesNumber", Value: 1}, {Key: "instanceNumber", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch instances"})
+	}
+	if len(instances) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No matching instances"})
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, inst := range instances {
+		data, err := models.ReadDicomFile(ctx, inst.FileID)
+		if err != nil {
+			slog.ErrorContext(ctx, "DICOMweb: reading an instance file failed", "sopInstanceUid", inst.SOPInstanceUID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to read instance"})
+		}
+		part, err := writer.CreatePart(textproto.MIMEHeader{fiber.HeaderContentType: {dicomMediaType}})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to write response"})
+		}
+		part.Write(data)
+	}
+	writer.Close()
+
+	c.Set(fiber.HeaderContentType, fmt.Sprintf(`multipart/related; type="%s"; boundary=%s`, dicomMediaType, writer.Boundary()))
+	return c.Send(body.Bytes())
+}
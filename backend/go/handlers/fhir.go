@@ -0,0 +1,752 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/fhir"
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page sizes of FHIR searches, set with _count.
+const (
+	fhirDefaultCount = 50
+	fhirMaxCount     = 200
+)
+
+// errFHIRParam is wrapped by the errors of malformed search parameters.
+var errFHIRParam = errors.New("invalid search parameter")
+
+func fhirParamError(name, value string) error {
+	return fmt.Errorf("%w %s=%q", errFHIRParam, name, value)
+}
+
+// sendFHIR writes a FHIR resource or bundle.
+func sendFHIR(c *fiber.Ctx, status int, resource interface{}) error {
+	return c.Status(status).JSON(resource, fhir.ContentType)
+}
+
+// fhirError writes an OperationOutcome with a single error issue.
+func fhirError(c *fiber.Ctx, status int, code, diagnostics string) error {
+	return sendFHIR(c, status, fhir.NewOperationOutcome(code, diagnostics))
+}
+
+func fhirNotFound(c *fiber.Ctx, resourceType, id string) error {
+	return fhirError(c, fiber.StatusNotFound, "not-found", fmt.Sprintf("%s/%s not found", resourceType, id))
+}
+
+// fhirSearchError maps an error of a search onto a response: 400 for bad
+// parameters, 500 otherwise.
+func fhirSearchError(c *fiber.Ctx, resourceType string, err error) error {
+	if errors.Is(err, errFHIRParam) {
+		return fhirError(c, fiber.StatusBadRequest, "invalid", err.Error())
+	}
+	slog.ErrorContext(c.UserContext(), "Error searching FHIR resources", "resourceType", resourceType, "error", err)
+	return fhirError(c, fiber.StatusInternalServerError, "exception", "Search failed")
+}
+
+// fhirBase is the absolute URL the FHIR API is served at.
+func fhirBase(c *fiber.Ctx) string {
+	return c.BaseURL() + "/fhir"
+}
+
+// fhirParams returns every value of the repeatable query parameter name.
+func fhirParams(c *fiber.Ctx, name string) []string {
+	var values []string
+	for _, v := range c.Context().QueryArgs().PeekMulti(name) {
+		values = append(values, string(v))
+	}
+	return values
+}
+
+// fhirPage reads the _count and _offset paging parameters.
+func fhirPage(c *fiber.Ctx) (count, offset int, err error) {
+	count, offset = fhirDefaultCount, 0
+	if v := c.Query("_count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count < 0 {
+			return 0, 0, fhirParamError("_count", v)
+		}
+		count = min(count, fhirMaxCount)
+	}
+	if v := c.Query("_offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fhirParamError("_offset", v)
+		}
+	}
+	return count, offset, nil
+}
+
+// searchBundle wraps a page of matches in a searchset bundle, with a next
+// link when there are more.
+func searchBundle(c *fiber.Ctx, resourceType string, resources []interface{}, ids []string, total, count, offset int) fhir.Bundle {
+	base := fhirBase(c)
+	bundle := fhir.Bundle{ResourceType: "Bundle", Type: "searchset", Total: &total}
+	bundle.Link = append(bundle.Link, fhir.BundleLink{Relation: "self", URL: pageURL(c, count, offset)})
+	if offset+count < total && count > 0 {
+		bundle.Link = append(bundle.Link, fhir.BundleLink{Relation: "next", URL: pageURL(c, count, offset+count)})
+	}
+	bundle.Entry = make([]fhir.BundleEntry, 0, len(resources))
+	for i, resource := range resources {
+		bundle.Entry = append(bundle.Entry, fhir.BundleEntry{
+			FullURL:  base + "/" + resourceType + "/" + ids[i],
+			Resource: resource,
+			Search:   &fhir.BundleSearch{Mode: "match"},
+		})
+	}
+	return bundle
+}
+
+// pageURL is the current search URL with the given page.
+func pageURL(c *fiber.Ctx, count, offset int) string {
+	query, _ := url.ParseQuery(string(c.Context().QueryArgs().QueryString()))
+	query.Set("_count", strconv.Itoa(count))
+	query.Set("_offset", strconv.Itoa(offset))
+	return c.BaseURL() + c.Path() + "?" + query.Encode()
+}
+
+// fhirObjectID parses a resource ID.
+func fhirObjectID(name, value string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(value)
+	if err != nil {
+		return id, fhirParamError(name, value)
+	}
+	return id, nil
+}
+
+// idClause matches the comma-separated IDs of an _id parameter.
+func idClause(value string) (bson.M, error) {
+	var ids bson.A
+	for _, v := range strings.Split(value, ",") {
+		id, err := fhirObjectID("_id", v)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}, nil
+}
+
+// patientClause matches a patient reference parameter: "Patient/<id>" or a
+// bare ID, comma-separated.
+func patientClause(name, value string) (bson.M, error) {
+	var ids bson.A
+	for _, v := range strings.Split(value, ",") {
+		id, err := fhirObjectID(name, strings.TrimPrefix(v, "Patient/"))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return bson.M{"patientId": bson.M{"$in": ids}}, nil
+}
+
+// Date formats of date search parameters, from the most precise.
+var fhirDateFormats = []struct {
+	layout string
+	next   func(time.Time) time.Time // start of the next period
+}{
+	{time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{"2006-01-02T15:04", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// dateClause matches a date parameter against field. The value is a full or
+// partial date, optionally prefixed with eq, ne, gt, ge, lt or le; partial
+// dates stand for their whole period, so date=2024-03 matches all of March.
+func dateClause(name, field, value string) (bson.M, error) {
+	prefix := "eq"
+	if len(value) > 2 && value[0] >= 'a' && value[0] <= 'z' {
+		prefix, value = value[:2], value[2:]
+	}
+	var start, end time.Time
+	parsed := false
+	for _, f := range fhirDateFormats {
+		if t, err := time.Parse(f.layout, value); err == nil {
+			start, end, parsed = t, f.next(t), true
+			break
+		}
+	}
+	if !parsed {
+		return nil, fhirParamError(name, value)
+	}
+	switch prefix {
+	case "eq":
+		return bson.M{field: bson.M{"$gte": start, "$lt": end}}, nil
+	case "ne":
+		return bson.M{"$or": bson.A{bson.M{field: bson.M{"$lt": start}}, bson.M{field: bson.M{"$gte": end}}}}, nil
+	case "gt":
+		return bson.M{field: bson.M{"$gte": end}}, nil
+	case "ge":
+		return bson.M{field: bson.M{"$gte": start}}, nil
+	case "lt":
+		return bson.M{field: bson.M{"$lt": start}}, nil
+	case "le":
+		return bson.M{field: bson.M{"$lt": end}}, nil
+	}
+	return nil, fhirParamError(name, prefix+value)
+}
+
+// tokenValue returns the code of a token parameter, "system|code" or "code",
+// and whether its system, if any, is the expected one.
+func tokenValue(value, system string) (string, bool) {
+	if s, code, ok := strings.Cut(value, "|"); ok {
+		return code, s == "" || s == system
+	}
+	return value, true
+}
+
+// searchClauses turns the search parameters of a request into filter
+// clauses, using the builder of each supported parameter. Unknown parameters
+// are ignored, as FHIR servers do by default.
+func searchClauses(c *fiber.Ctx, params map[string]func(value string) (bson.M, error)) ([]interface{}, error) {
+	var clauses []interface{}
+	for name, build := range params {
+		for _, value := range fhirParams(c, name) {
+			if value == "" {
+				continue
+			}
+			clause, err := build(value)
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+	return clauses, nil
+}
+
+// FHIRMetadata returns the CapabilityStatement of the FHIR API.
+func FHIRMetadata(c *fiber.Ctx) error {
+	search := func(names ...string) []fiber.Map {
+		params := make([]fiber.Map, 0, len(names))
+		for _, n := range names {
+			name, typ, _ := strings.Cut(n, ":")
+			params = append(params, fiber.Map{"name": name, "type": typ})
+		}
+		return params
+	}
+	resource := func(typ string, params []fiber.Map) fiber.Map {
+		r := fiber.Map{
+			"type":        typ,
+			"interaction": []fiber.Map{{"code": "read"}, {"code": "search-type"}},
+		}
+		if params != nil {
+			r["searchParam"] = params
+		}
+		return r
+	}
+	return sendFHIR(c, fiber.StatusOK, fiber.Map{
+		"resourceType": "CapabilityStatement",
+		"status":       "active",
+		"date":         time.Now().UTC().Format("2006-01-02"),
+		"kind":         "instance",
+		"software":     fiber.Map{"name": "Fracture Detection"},
+		"implementation": fiber.Map{
+			"description": "Fracture Detection FHIR API",
+			"url":         fhirBase(c),
+		},
+		"fhirVersion": fhir.Version,
+		"format":      []string{"json"},
+		"rest": []fiber.Map{{
+			"mode": "server",
+			"security": fiber.Map{
+				"description": "Bearer token from /api/auth/login",
+			},
+			"resource": []fiber.Map{
+				resource("Patient", search("_id:token", "identifier:token", "name:string", "birthdate:date", "gender:token")),
+				resource("DiagnosticReport", search("_id:token", "patient:reference", "subject:reference", "date:date", "status:token")),
+				resource("Observation", search("_id:token", "patient:reference", "subject:reference", "date:date", "code:token")),
+				resource("Media", search("_id:token", "patient:reference", "subject:reference", "created:date")),
+				{"type": "Binary", "interaction": []fiber.Map{{"code": "read"}}},
+			},
+		}},
+	})
+}
+
+// ----- Patient -----
+
+// FHIRGetPatient returns a visible patient as a FHIR Patient.
+func FHIRGetPatient(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fhirNotFound(c, "Patient", c.Params("id"))
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findVisiblePatient(ctx, id, userID, role)
+	if err == errPatientNotFound {
+		return fhirNotFound(c, "Patient", c.Params("id"))
+	}
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch patient")
+	}
+	facility, err := models.CurrentFacility(ctx)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch facility")
+	}
+	return sendFHIR(c, fiber.StatusOK, fhir.FromPatient(patient, fhir.MRNSystem(facility)))
+}
+
+// FHIRSearchPatients searches the visible patients by _id, identifier, name,
+// birthdate and gender.
+func FHIRSearchPatients(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 15*time.Second)
+	defer cancel()
+
+	facility, err := models.CurrentFacility(ctx)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch facility")
+	}
+	mrnSystem := fhir.MRNSystem(facility)
+
+	clauses, err := searchClauses(c, map[string]func(string) (bson.M, error){
+		"_id": idClause,
+		"identifier": func(v string) (bson.M, error) {
+			mrn, ok := tokenValue(v, mrnSystem)
+			if !ok {
+				return bson.M{"_id": primitive.NilObjectID}, nil // another system: no match
+			}
+			return bson.M{"mrn": mrn}, nil
+		},
+		"name": func(v string) (bson.M, error) {
+			// FHIR string search: case-insensitive match at the start of
+			// any part of the name.
+			return bson.M{"fullName": bson.M{"$regex": `(^|\s)` + regexp.QuoteMeta(v), "$options": "i"}}, nil
+		},
+		"birthdate": func(v string) (bson.M, error) { return dateClause("birthdate", "dateOfBirth", v) },
+		"gender": func(v string) (bson.M, error) {
+			switch v {
+			case "male", "female", "other", "unknown":
+				return bson.M{"sex": v}, nil
+			}
+			return nil, fhirParamError("gender", v)
+		},
+	})
+	if err != nil {
+		return fhirSearchError(c, "Patient", err)
+	}
+	count, offset, err := fhirPage(c)
+	if err != nil {
+		return fhirSearchError(c, "Patient", err)
+	}
+
+	filter := bson.M{"$and": append(bson.A{patientVisibilityFilter(userID, role)}, clauses...)}
+	total, err := models.Scoped("patients").CountDocuments(ctx, filter)
+	if err != nil {
+		return fhirSearchError(c, "Patient", err)
+	}
+	var patients []models.Patient
+	if count > 0 {
+		opts := options.Find().SetSort(bson.D{{Key: "fullName", Value: 1}, {Key: "_id", Value: 1}}).
+			SetSkip(int64(offset)).SetLimit(int64(count))
+		if err := findAll(ctx, models.Scoped("patients"), filter, &patients, opts); err != nil {
+			return fhirSearchError(c, "Patient", err)
+		}
+	}
+
+	resources := make([]interface{}, 0, len(patients))
+	ids := make([]string, 0, len(patients))
+	for i := range patients {
+		resources = append(resources, fhir.FromPatient(&patients[i], mrnSystem))
+		ids = append(ids, patients[i].ID.Hex())
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, "Patient", resources, ids, int(total), count, offset))
+}
+
+// ----- Reports: DiagnosticReport, Observation, Media and Binary -----
+
+// reportSummaryProjection leaves out the images of reports, which can be
+// large, keeping only whether there is one: the first character of the
+// annotated image.
+var reportSummaryProjection = bson.M{
+	"annotatedImageBase64": 0,
+	"annotatedImage":       bson.M{"$substrCP": bson.A{bson.M{"$ifNull": bson.A{"$annotatedImage", ""}}, 0, 1}},
+}
+
+// findVisibleReport loads a report by ID if the caller can see it. Without
+// withImage, the image is left out as in reportSummaryProjection. It returns
+// mongo.ErrNoDocuments for reports that do not exist or are not visible.
+func findVisibleReport(ctx context.Context, id, userID primitive.ObjectID, role string, withImage bool) (*models.Report, error) {
+	visible, err := reportVisibilityFilter(ctx, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.FindOne()
+	if !withImage {
+		opts.SetProjection(reportSummaryProjection)
+	}
+	var report models.Report
+	if err := models.Scoped("reports").FindOne(ctx, withClause(visible, bson.M{"_id": id}), opts).Decode(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// reportParams are the search parameters common to the report resources.
+// dateParam is the name of the parameter matching the report's date.
+func reportParams(dateParam string) map[string]func(string) (bson.M, error) {
+	return map[string]func(string) (bson.M, error){
+		"_id":     idClause,
+		"patient": func(v string) (bson.M, error) { return patientClause("patient", v) },
+		"subject": func(v string) (bson.M, error) { return patientClause("subject", v) },
+		dateParam: func(v string) (bson.M, error) { return dateClause(dateParam, "createdAt", v) },
+	}
+}
+
+// searchVisibleReports returns a page of the visible reports matching clauses,
+// newest first and without images, along with the number of matches.
+func searchVisibleReports(ctx context.Context, userID primitive.ObjectID, role string, clauses []interface{}, count, offset int) ([]models.Report, int, error) {
+	visible, err := reportVisibilityFilter(ctx, userID, role)
+	if err != nil {
+		return nil, 0, err
+	}
+	filter := bson.M{"$and": append(bson.A{visible}, clauses...)}
+	total, err := models.Scoped("reports").CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	var reports []models.Report
+	if count > 0 {
+		opts := options.Find().SetProjection(reportSummaryProjection).
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(int64(offset)).SetLimit(int64(count))
+		if err := findAll(ctx, models.Scoped("reports"), filter, &reports, opts); err != nil {
+			return nil, 0, err
+		}
+	}
+	return reports, int(total), nil
+}
+
+// doctorNames returns the display names of the doctors of reports.
+func doctorNames(ctx context.Context, reports []models.Report) map[primitive.ObjectID]string {
+	ids := make([]primitive.ObjectID, 0, len(reports))
+	for _, r := range reports {
+		ids = append(ids, r.DoctorID)
+	}
+	names := make(map[primitive.ObjectID]string, len(ids))
+	var doctors []models.User
+	err := findAll(ctx, models.Scoped("users"), bson.M{"_id": bson.M{"$in": ids}}, &doctors,
+		options.Find().SetProjection(bson.M{"fullName": 1}))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching doctor names for FHIR", "error", err)
+		return names
+	}
+	for _, d := range doctors {
+		names[d.ID] = d.FullName
+	}
+	return names
+}
+
+func diagnosticReport(c *fiber.Ctx, r *models.Report, doctorName string) fhir.DiagnosticReport {
+	return fhir.FromReport(r, doctorName, c.BaseURL()+"/api/reports/"+r.ID.Hex()+"/pdf")
+}
+
+// FHIRGetDiagnosticReport returns a visible report as a DiagnosticReport.
+func FHIRGetDiagnosticReport(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fhirNotFound(c, "DiagnosticReport", c.Params("id"))
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	report, err := findVisibleReport(ctx, id, userID, role, false)
+	if err == mongo.ErrNoDocuments {
+		return fhirNotFound(c, "DiagnosticReport", c.Params("id"))
+	}
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch report")
+	}
+	names := doctorNames(ctx, []models.Report{*report})
+	return sendFHIR(c, fiber.StatusOK, diagnosticReport(c, report, names[report.DoctorID]))
+}
+
+// FHIRSearchDiagnosticReports searches the visible reports by _id, patient,
+// date and status.
+func FHIRSearchDiagnosticReports(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	params := reportParams("date")
+	params["status"] = func(v string) (bson.M, error) {
+		switch v {
+		case "final":
+			return bson.M{"status": models.ReportSigned}, nil
+		case "preliminary":
+			return bson.M{"status": bson.M{"$ne": models.ReportSigned}}, nil
+		}
+		return nil, fhirParamError("status", v)
+	}
+	clauses, err := searchClauses(c, params)
+	if err != nil {
+		return fhirSearchError(c, "DiagnosticReport", err)
+	}
+	count, offset, err := fhirPage(c)
+	if err != nil {
+		return fhirSearchError(c, "DiagnosticReport", err)
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 15*time.Second)
+	defer cancel()
+
+	reports, total, err := searchVisibleReports(ctx, userID, role, clauses, count, offset)
+	if err != nil {
+		return fhirSearchError(c, "DiagnosticReport", err)
+	}
+	names := doctorNames(ctx, reports)
+	resources := make([]interface{}, 0, len(reports))
+	ids := make([]string, 0, len(reports))
+	for i := range reports {
+		resources = append(resources, diagnosticReport(c, &reports[i], names[reports[i].DoctorID]))
+		ids = append(ids, reports[i].ID.Hex())
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, "DiagnosticReport", resources, ids, total, count, offset))
+}
+
+// observationClauses are the report filters matching the reports that have
+// an observation of the given code.
+var observationClauses = map[string]bson.M{
+	fhir.CodeFractureType: {},
+	fhir.CodeConfidence:   {"confidence": bson.M{"$ne": nil}},
+	fhir.CodeRecoveryTime: {"recoveryTime": bson.M{"$nin": bson.A{"", nil}}},
+}
+
+// FHIRGetObservation returns a finding of a visible report. Observation IDs
+// are "<report ID>-<code>".
+func FHIRGetObservation(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	reportIDStr, code, _ := strings.Cut(c.Params("id"), "-")
+	id, err := primitive.ObjectIDFromHex(reportIDStr)
+	if err != nil {
+		return fhirNotFound(c, "Observation", c.Params("id"))
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	report, err := findVisibleReport(ctx, id, userID, role, false)
+	if err == mongo.ErrNoDocuments {
+		return fhirNotFound(c, "Observation", c.Params("id"))
+	}
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch report")
+	}
+	obs, ok := fhir.ReportObservation(report, code)
+	if !ok {
+		return fhirNotFound(c, "Observation", c.Params("id"))
+	}
+	return sendFHIR(c, fiber.StatusOK, obs)
+}
+
+// FHIRSearchObservations searches the findings of the visible reports by
+// _id, patient, date and code. Paging counts reports, each of which has up to
+// one observation per code; total counts observations.
+func FHIRSearchObservations(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	codes := fhir.ObservationCodes
+	params := reportParams("date")
+	params["_id"] = func(v string) (bson.M, error) {
+		var ids bson.A
+		for _, obsID := range strings.Split(v, ",") {
+			reportID, _, _ := strings.Cut(obsID, "-")
+			id, err := fhirObjectID("_id", reportID)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return bson.M{"_id": bson.M{"$in": ids}}, nil
+	}
+	if values := fhirParams(c, "code"); len(values) > 0 {
+		codes = nil
+		for _, v := range strings.Split(strings.Join(values, ","), ",") {
+			if code, ok := tokenValue(v, fhir.CodeSystem); ok && observationClauses[code] != nil {
+				codes = append(codes, code)
+			}
+		}
+	}
+	clauses, err := searchClauses(c, params)
+	if err != nil {
+		return fhirSearchError(c, "Observation", err)
+	}
+	count, offset, err := fhirPage(c)
+	if err != nil {
+		return fhirSearchError(c, "Observation", err)
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 15*time.Second)
+	defer cancel()
+
+	// Reports having at least one of the requested observations.
+	var having bson.A
+	for _, code := range codes {
+		having = append(having, observationClauses[code])
+	}
+	var reports []models.Report
+	total := 0
+	if len(codes) > 0 {
+		reports, _, err = searchVisibleReports(ctx, userID, role, append(clauses, bson.M{"$or": having}), count, offset)
+		if err != nil {
+			return fhirSearchError(c, "Observation", err)
+		}
+		visible, err := reportVisibilityFilter(ctx, userID, role)
+		if err != nil {
+			return fhirSearchError(c, "Observation", err)
+		}
+		for _, code := range codes {
+			filter := bson.M{"$and": append(bson.A{visible, observationClauses[code]}, clauses...)}
+			n, err := models.Scoped("reports").CountDocuments(ctx, filter)
+			if err != nil {
+				return fhirSearchError(c, "Observation", err)
+			}
+			total += int(n)
+		}
+	}
+
+	var resources []interface{}
+	var ids []string
+	for i := range reports {
+		for _, code := range codes {
+			if obs, ok := fhir.ReportObservation(&reports[i], code); ok {
+				resources = append(resources, obs)
+				ids = append(ids, obs.ID)
+			}
+		}
+	}
+	bundle := searchBundle(c, "Observation", resources, ids, total, count, offset)
+	// Pages are of reports, so the next link depends on their number.
+	if len(reports) < count {
+		bundle.Link = bundle.Link[:1]
+	}
+	return sendFHIR(c, fiber.StatusOK, bundle)
+}
+
+func binaryURL(c *fiber.Ctx, id primitive.ObjectID) string {
+	return fhirBase(c) + "/Binary/" + id.Hex()
+}
+
+// FHIRGetMedia returns the annotated X-ray of a visible report.
+func FHIRGetMedia(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fhirNotFound(c, "Media", c.Params("id"))
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	report, err := findVisibleReport(ctx, id, userID, role, true)
+	if err == mongo.ErrNoDocuments {
+		return fhirNotFound(c, "Media", c.Params("id"))
+	}
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch report")
+	}
+	media, ok := fhir.FromReportImage(report, binaryURL(c, report.ID))
+	if !ok {
+		return fhirNotFound(c, "Media", c.Params("id"))
+	}
+	return sendFHIR(c, fiber.StatusOK, media)
+}
+
+// FHIRSearchMedia searches the annotated X-rays of the visible reports by
+// _id, patient and created.
+func FHIRSearchMedia(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	clauses, err := searchClauses(c, reportParams("created"))
+	if err != nil {
+		return fhirSearchError(c, "Media", err)
+	}
+	count, offset, err := fhirPage(c)
+	if err != nil {
+		return fhirSearchError(c, "Media", err)
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 15*time.Second)
+	defer cancel()
+
+	clauses = append(clauses, bson.M{"annotatedImage": bson.M{"$nin": bson.A{"", nil}}})
+	reports, total, err := searchVisibleReports(ctx, userID, role, clauses, count, offset)
+	if err != nil {
+		return fhirSearchError(c, "Media", err)
+	}
+	resources := make([]interface{}, 0, len(reports))
+	ids := make([]string, 0, len(reports))
+	for i := range reports {
+		// The images are not loaded, so the content type is not known.
+		media, _ := fhir.FromReportImage(&reports[i], binaryURL(c, reports[i].ID))
+		media.Content.ContentType = ""
+		resources = append(resources, media)
+		ids = append(ids, reports[i].ID.Hex())
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, "Media", resources, ids, total, count, offset))
+}
+
+// FHIRGetBinary returns the annotated X-ray of a visible report: the image
+// itself, or a FHIR Binary when the client asks for FHIR JSON.
+func FHIRGetBinary(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, "login", err.Error())
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fhirNotFound(c, "Binary", c.Params("id"))
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	report, err := findVisibleReport(ctx, id, userID, role, true)
+	if err == mongo.ErrNoDocuments {
+		return fhirNotFound(c, "Binary", c.Params("id"))
+	}
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch report")
+	}
+	binary, img, ok := fhir.ReportBinary(report)
+	if !ok {
+		return fhirNotFound(c, "Binary", c.Params("id"))
+	}
+	if accept := c.Get(fiber.HeaderAccept); strings.Contains(accept, "json") {
+		return sendFHIR(c, fiber.StatusOK, binary)
+	}
+	c.Set(fiber.HeaderContentType, binary.ContentType)
+	return c.Send(img)
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"fracture-detection-webapp/metrics"
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Probes for load balancers and orchestrators. /healthz only says the
+// process is serving requests; /readyz checks each dependency and reports
+// its status and latency. The server is unavailable when the database or
+// the DICOM store is down; the inference service and the mail server only
+// degrade it, since everything else keeps working without them.
+//
+// /readyz is public, so it only tells why a check failed to callers with the
+// metrics token, and reuses its results for a few seconds so that probing it
+// cannot flood the dependencies with connections.
+
+// healthCheckTimeout bounds each dependency check.
+const healthCheckTimeout = 3 * time.Second
+
+// readyCacheTTL is how long the results of the dependency checks are reused.
+const readyCacheTTL = 5 * time.Second
+
+// readiness holds the latest results of the dependency checks.
+var readiness struct {
+	sync.Mutex
+	checked time.Time
+	results map[string]DependencyStatus
+}
+
+// Dependency statuses.
+const (
+	checkUp       = "up"
+	checkDown     = "down"
+	checkDisabled = "disabled" // not configured
+)
+
+// dependencyCheck is a dependency /readyz checks.
+type dependencyCheck struct {
+	name     string
+	required bool // the server cannot work without it
+	check    func(ctx context.Context) (status string, err error)
+}
+
+// dependencyChecks lists the dependencies /readyz checks.
+var dependencyChecks = []dependencyCheck{
+	{"mongo", true, func(ctx context.Context) (string, error) {
+		return checkUp, models.PingMongo(ctx)
+	}},
+	{"dicomStore", true, func(ctx context.Context) (string, error) {
+		return checkUp, models.PingDicomStore(ctx)
+	}},
+	{"inference", false, pingInference},
+	{"smtp", false, func(ctx context.Context) (string, error) {
+		if cfg := utils.CurrentMailerConfig(); cfg.Transport == utils.TransportSMTP && cfg.Host == "" {
+			return checkDisabled, nil
+		}
+		return checkUp, utils.PingMailer(ctx)
+	}},
+}
+
+// DependencyStatus is the result of checking one dependency.
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	Required  bool   `json:"required"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Healthz answers as long as the process serves requests.
+func Healthz(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// Readyz reports the status of the dependencies. It answers 503 when a
+// required one is down, and reports "degraded" when only optional ones are.
+func Readyz(c *fiber.Ctx) error {
+	results := checkDependencies(c.UserContext())
+
+	status, code := "ok", fiber.StatusOK
+	for _, r := range results {
+		if r.Status != checkDown {
+			continue
+		}
+		if r.Required {
+			status, code = "unavailable", fiber.StatusServiceUnavailable
+			break
+		}
+		status = "degraded"
+	}
+	if !metrics.Authorized(c, settings.MetricsToken) {
+		public := make(map[string]DependencyStatus, len(results))
+		for name, r := range results {
+			r.Error = ""
+			public[name] = r
+		}
+		results = public
+	}
+	return c.Status(code).JSON(fiber.Map{"status": status, "checks": results})
+}
+
+// checkDependencies checks the dependencies concurrently, unless they were
+// checked less than readyCacheTTL ago. Concurrent callers wait for the same
+// checks. Failures are logged, as the public answer does not explain them.
+func checkDependencies(ctx context.Context) map[string]DependencyStatus {
+	readiness.Lock()
+	defer readiness.Unlock()
+	if time.Since(readiness.checked) < readyCacheTTL {
+		return readiness.results
+	}
+
+	results := make(map[string]DependencyStatus, len(dependencyChecks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, d := range dependencyChecks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The results are shared, so a caller going away must not
+			// cut the checks short.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			status, err := d.check(ctx)
+			result := DependencyStatus{Status: status, Required: d.required, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status, result.Error = checkDown, err.Error()
+				slog.WarnContext(ctx, "Dependency check failed", "dependency", d.name, "error", err)
+			}
+			mu.Lock()
+			results[d.name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	readiness.checked, readiness.results = time.Now(), results
+	return results
+}
+
+// pingInference checks the Python service answers at its /health endpoint,
+// next to the analysis endpoint. Any answer short of a server error means it
+// is reachable, so older versions without the endpoint still pass. Probes
+// are not traced, so this does not go through inferenceClient.
+func pingInference(ctx context.Context) (string, error) {
+	base, err := url.Parse(inferenceURL())
+	if err != nil {
+		return checkDown, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.ResolveReference(&url.URL{Path: "health"}).String(), nil)
+	if err != nil {
+		return checkDown, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return checkDown, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return checkDown, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return checkUp, nil
+}
@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/hl7"
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ----- Outbound: ORU^R01 results -----
+
+// queueResultMessage queues the ORU^R01 message of a signed report when the
+// report's facility has an HL7 receiver. Like webhooks, failures are logged
+// and never make the signature fail.
+func queueResultMessage(ctx context.Context, report *models.Report) {
+	facility, err := models.CurrentFacility(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading facility for HL7 result", "reportId", report.ID.Hex(), "error", err)
+		return
+	}
+	if !facility.HL7.SendsResults() {
+		return
+	}
+	if err := queueORU(ctx, facility, report); err != nil {
+		slog.ErrorContext(ctx, "Error queueing HL7 result", "reportId", report.ID.Hex(), "error", err)
+	}
+}
+
+func queueORU(ctx context.Context, facility *models.Facility, report *models.Report) error {
+	res := hl7.Result{Report: *report, Facility: *facility}
+	if err := models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&res.Patient); err != nil {
+		return fmt.Errorf("loading patient: %w", err)
+	}
+	err := models.Scoped("users").FindOne(ctx, bson.M{"_id": report.SignedBy}).Decode(&res.Doctor)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("loading doctor: %w", err)
+	}
+
+	now := time.Now()
+	id := primitive.NewObjectID()
+	to := hl7.Endpoint{Application: facility.HL7.ReceivingApplication, Facility: facility.HL7.ReceivingFacility}
+	msg := hl7.ORU(id.Hex(), to, res, now)
+	_, err = models.Scoped("hl7_messages").InsertOne(ctx, models.HL7Message{
+		ID:            id,
+		Type:          msg.Type(),
+		ControlID:     id.Hex(),
+		ReportID:      report.ID,
+		Payload:       string(msg.Bytes()),
+		Status:        models.NotificationQueued,
+		MaxAttempts:   models.DefaultHL7Attempts,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	return err
+}
+
+// RunHL7Worker sends queued HL7 messages until ctx is done. Like
+// RunNotificationWorker, it can run on several servers at once.
+func RunHL7Worker(ctx context.Context) {
+	pollOutbox(ctx, "HL7 message", func(ctx context.Context) error {
+		m, err := models.ClaimHL7Message(ctx)
+		if err != nil {
+			return err
+		}
+		processHL7Message(ctx, m)
+		return nil
+	})
+}
+
+// processHL7Message makes one delivery attempt and records its outcome.
+func processHL7Message(ctx context.Context, m *models.HL7Message) {
+	attempt, permanent := sendHL7Message(ctx, m)
+	if attempt.Error != "" {
+		slog.WarnContext(ctx, "HL7: message delivery failed", "messageId", m.ID.Hex(), "attempt", m.Attempts, "maxAttempts", m.MaxAttempts, "error", attempt.Error)
+	}
+	if err := models.CompleteHL7Message(ctx, m, attempt, permanent); err != nil {
+		slog.ErrorContext(ctx, "HL7: recording the outcome of a message failed", "messageId", m.ID.Hex(), "error", err)
+	}
+}
+
+// sendHL7Message sends a message to the receiver of its facility and checks
+// its acknowledgment. Rejections (AR) are permanent; errors (AE), timeouts
+// and connection failures are retried.
+func sendHL7Message(ctx context.Context, m *models.HL7Message) (models.HL7Attempt, bool) {
+	attempt := models.HL7Attempt{At: time.Now()}
+	facility, err := models.CurrentFacility(models.WithFacility(ctx, m.FacilityID))
+	if err != nil {
+		attempt.Error = "loading facility: " + err.Error()
+		return attempt, err == mongo.ErrNoDocuments
+	}
+	if !facility.HL7.SendsResults() {
+		attempt.Error = "the facility has no HL7 result receiver"
+		return attempt, true
+	}
+	msg, err := hl7.Parse([]byte(m.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hl7.Current().Timeout)
+	defer cancel()
+	ack, err := hl7.Send(ctx, facility.HL7.Addr, msg)
+	if ack != nil {
+		attempt.Ack = ack.Segment("MSA").Component(1, 1)
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		var nak *hl7.NegativeAck
+		return attempt, errors.As(err, &nak) && nak.Permanent()
+	}
+	return attempt, false
+}
+
+// GetHL7Messages returns the facility's HL7 outbox, newest first. ?status=
+// and ?reportId= filter it.
+func GetHL7Messages(c *fiber.Ctx) error {
+	filter := bson.M{}
+	switch status := c.Query("status"); status {
+	case "":
+	case models.NotificationQueued, models.NotificationSending, models.NotificationSent, models.NotificationFailed, models.NotificationDead:
+		filter["status"] = status
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid status"})
+	}
+	if v := c.Query("reportId"); v != "" {
+		reportID, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+		}
+		filter["reportId"] = reportID
+	}
+	limit := int64(c.QueryInt("limit", 100))
+	if limit < 1 || limit > 500 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 500"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	messages := []models.HL7Message{}
+	err := findAll(ctx, models.Scoped("hl7_messages"), filter, &messages,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch HL7 messages"})
+	}
+	return c.JSON(messages)
+}
+
+// RetryHL7Message queues a failed or dead HL7 message again, unchanged.
+func RetryHL7Message(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid message ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	msg, err := models.RetryHL7Message(ctx, id, chefID)
+	if errors.Is(err, models.ErrNotRetryable) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "HL7 message not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retry HL7 message"})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(msg)
+}
+
+// ----- Inbound: ADT^A04/A08 patients -----
+
+// errADTData is wrapped by the errors of ADT messages with invalid
+// demographics; other errors are failures of the application.
+var errADTData = errors.New("invalid patient data")
+
+// HandleHL7 processes a message received by the MLLP listener. ADT^A04 and
+// ADT^A08 register or update the patient with the PID-3 MRN in the facility
+// whose code is the receiving facility, MSH-6; either message creates the
+// patient if it is unknown, and updates it otherwise. Only the senders the
+// facility lists, by MSH-4 and source address, are accepted. Patients
+// registered this way have no owning doctor, so only chefs see them until
+// they are put on a care team.
+func HandleHL7(ctx context.Context, remote net.Addr, msg *hl7.Message) *hl7.Message {
+	msgType := msg.Type()
+	if msgType != hl7.ADTRegister && msgType != hl7.ADTUpdate {
+		return hl7.Ack(msg, hl7.AckReject, "unsupported message type "+msgType)
+	}
+	code := msg.Header().Component(6, 1)
+	if code == "" {
+		return hl7.Ack(msg, hl7.AckReject, "MSH-6 must be the code of the receiving facility")
+	}
+	sender := msg.Header().Component(4, 1)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Unknown facilities and senders get the same answer, so the listener
+	// does not reveal which facility codes exist.
+	facility, err := models.FacilityByCode(ctx, code)
+	if err != nil && err != mongo.ErrNoDocuments {
+		slog.ErrorContext(ctx, "HL7: loading facility failed", "facility", code, "error", err)
+		return hl7.Ack(msg, hl7.AckError, "internal error")
+	}
+	if err == mongo.ErrNoDocuments || !facility.HL7.AllowsSender(sender, remoteIP(remote)) {
+		slog.WarnContext(ctx, "HL7: message refused from unknown sender", "facility", code, "sender", sender, "remote", remote.String())
+		return hl7.Ack(msg, hl7.AckReject, "sender "+sender+" is not allowed to send to facility "+code)
+	}
+	ctx = models.WithFacility(ctx, facility.ID)
+
+	data, err := hl7.ParsePID(msg)
+	if err != nil {
+		return hl7.Ack(msg, hl7.AckReject, err.Error())
+	}
+	patient, created, err := applyADT(ctx, data)
+	if errors.Is(err, errADTData) {
+		return hl7.Ack(msg, hl7.AckError, err.Error())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "HL7: applying message failed", "type", msgType, "controlId", msg.ControlID(), "error", err)
+		return hl7.Ack(msg, hl7.AckError, "internal error")
+	}
+
+	action := "patient.hl7.update"
+	if created {
+		action = "patient.hl7.create"
+	}
+	details := bson.M{"type": msgType, "controlId": msg.ControlID(), "sender": msg.Header().Component(3, 1), "sendingFacility": sender, "remote": remote.String()}
+	if err := recordAudit(ctx, action, primitive.NilObjectID, patient.ID, details); err != nil {
+		slog.ErrorContext(ctx, "HL7: recording audit entry failed", "action", action, "patientId", patient.ID.Hex(), "error", err)
+	}
+	return hl7.Ack(msg, hl7.AckAccept, "")
+}
+
+// remoteIP returns the IP address of a TCP peer, or the zero address, which
+// no sender matches.
+func remoteIP(addr net.Addr) netip.Addr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(tcp.IP)
+		return ip
+	}
+	return netip.Addr{}
+}
+
+// applyADT creates the patient with the MRN of an ADT message, or updates
+// the fields the message has. It reports whether the patient was created.
+func applyADT(ctx context.Context, data hl7.PatientData) (*models.Patient, bool, error) {
+	req := PatientRequest{
+		FullName:    data.FullName,
+		MRN:         data.MRN,
+		Sex:         hl7.Sex(data.Sex),
+		PhoneNumber: data.Phone,
+		Email:       data.Email,
+	}
+	if data.DateOfBirth != nil {
+		req.DateOfBirth = data.DateOfBirth.Format("2006-01-02")
+	}
+	// Validate the same way as the API does. Updates may leave the name out,
+	// which newPatient requires.
+	if req.FullName == "" {
+		req.FullName = data.MRN
+	}
+	valid, err := newPatient(req, primitive.NilObjectID)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", errADTData, err)
+	}
+	if data.FullName == "" {
+		valid.FullName = ""
+	}
+
+	var existing models.Patient
+	err = models.Scoped("patients").FindOne(ctx, bson.M{"mrn": valid.MRN}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		if valid.FullName == "" {
+			return nil, false, fmt.Errorf("%w: PID-5 has no patient name", errADTData)
+		}
+		if err := insertPatient(ctx, &valid, nil); err != nil {
+			if err == errEmailTaken || err == errMRNTaken {
+				return nil, false, fmt.Errorf("%w: %v", errADTData, err)
+			}
+			return nil, false, err
+		}
+		return &valid, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	set := bson.M{}
+	if valid.FullName != "" {
+		set["fullName"] = valid.FullName
+	}
+	if valid.DateOfBirth != nil {
+		set["dateOfBirth"] = *valid.DateOfBirth
+		set["age"] = utils.AgeAt(*valid.DateOfBirth, time.Now())
+	}
+	if valid.Sex != "" {
+		set["sex"] = valid.Sex
+	}
+	if valid.PhoneNumber != "" {
+		set["phoneNumber"] = valid.PhoneNumber
+	}
+	if valid.Email != "" && !strings.EqualFold(valid.Email, existing.Email) {
+		if err := checkEmailAvailable(ctx, "patients", valid.Email, existing.ID); err != nil {
+			if err == errEmailTaken {
+				return nil, false, fmt.Errorf("%w: %v", errADTData, err)
+			}
+			return nil, false, err
+		}
+		set["email"] = valid.Email
+	}
+	if len(set) == 0 {
+		return &existing, false, nil
+	}
+	var updated models.Patient
+	err = models.Scoped("patients").FindOneAndUpdate(ctx, bson.M{"_id": existing.ID}, bson.M{"$set": set}, returnAfter()).Decode(&updated)
+	if err != nil {
+		return nil, false, err
+	}
+	return &updated, false, nil
+}
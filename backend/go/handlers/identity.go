@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// minDuplicateScore is the lowest score reported as a duplicate candidate.
+	minDuplicateScore = 0.5
+	// likelyDuplicateScore is the score above which a new registration is
+	// refused unless the caller explicitly allows the duplicate.
+	likelyDuplicateScore = 0.8
+)
+
+// DuplicateCandidate is an existing patient that may be the same person as
+// the one being looked up.
+type DuplicateCandidate struct {
+	Patient models.Patient `json:"patient"`
+	Score   float64        `json:"score"`
+	Reasons []string       `json:"reasons"` // which identifiers matched: "name", "dateOfBirth", "phoneNumber", "email", "mrn"
+}
+
+// MergePatientsRequest defines the payload for merging duplicate patients.
+type MergePatientsRequest struct {
+	SurvivorID   string   `json:"survivorId"`
+	DuplicateIDs []string `json:"duplicateIds"`
+}
+
+// findPatientByMRN returns the patient visible to the user with the given
+// MRN, or nil if there is none.
+func findPatientByMRN(ctx context.Context, mrn string, userID primitive.ObjectID, role string) (*models.Patient, error) {
+	if mrn == "" {
+		return nil, nil
+	}
+	var patient models.Patient
+	err := models.Scoped("patients").FindOne(ctx, withClause(patientVisibilityFilter(userID, role), bson.M{"mrn": mrn})).Decode(&patient)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &patient, nil
+}
+
+// findDuplicateCandidates looks for patients matching probe by MRN, date of
+// birth, phone number, email or fuzzy name, ranked by how likely they are to
+// be the same person. Every patient sharing an identifier is considered; only
+// the name search, which matches broadly, is capped.
+func findDuplicateCandidates(ctx context.Context, probe *models.Patient, visible bson.M) ([]DuplicateCandidate, error) {
+	var exact bson.A
+	if probe.MRN != "" {
+		exact = append(exact, bson.M{"mrn": probe.MRN})
+	}
+	if probe.DateOfBirth != nil {
+		exact = append(exact, bson.M{"dateOfBirth": *probe.DateOfBirth})
+	}
+	if digits := utils.DigitsOnly(probe.PhoneNumber); len(digits) >= 7 {
+		exact = append(exact, bson.M{"phoneNumber": primitive.Regex{Pattern: regexp.QuoteMeta(digits[len(digits)-7:]) + "$"}})
+	}
+	if probe.Email != "" {
+		exact = append(exact, bson.M{"email": probe.Email})
+	}
+	var names bson.A
+	for _, t := range utils.Tokenize(probe.FullName) {
+		prefix := []rune(t)
+		if len(prefix) > 2 {
+			prefix = prefix[:2]
+		}
+		names = append(names, bson.M{"fullName": primitive.Regex{Pattern: `(^|\s)` + regexp.QuoteMeta(string(prefix)), Options: "i"}})
+	}
+
+	if !probe.ID.IsZero() {
+		visible = withClause(visible, bson.M{"_id": bson.M{"$ne": probe.ID}})
+	}
+	patients := models.Scoped("patients")
+	var found []models.Patient
+	if len(exact) > 0 {
+		if err := findAll(ctx, patients, withClause(visible, bson.M{"$or": exact}), &found); err != nil {
+			return nil, err
+		}
+	}
+	if len(names) > 0 {
+		var byName []models.Patient
+		opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(searchCandidates)
+		if err := findAll(ctx, patients, withClause(visible, bson.M{"$or": names}), &byName, opts); err != nil {
+			return nil, err
+		}
+		found = append(found, byName...)
+	}
+
+	seen := make(map[primitive.ObjectID]bool, len(found))
+	var candidates []DuplicateCandidate
+	for _, p := range found {
+		if seen[p.ID] {
+			continue
+		}
+		seen[p.ID] = true
+		if c := scoreDuplicate(probe, &p); c.Score >= minDuplicateScore {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	return candidates, nil
+}
+
+// scoreDuplicate weighs name similarity with date of birth and phone
+// agreement. A date of birth present on both records but different is strong
+// evidence of two distinct people; an identical MRN or email is near-certain
+// identity.
+func scoreDuplicate(probe, other *models.Patient) DuplicateCandidate {
+	c := DuplicateCandidate{Patient: *other}
+
+	name := utils.NameSimilarity(probe.FullName, other.FullName)
+	if name >= 0.75 {
+		c.Reasons = append(c.Reasons, "name")
+	}
+	score := 0.6 * name
+
+	if probe.DateOfBirth != nil && other.DateOfBirth != nil {
+		a, b := *probe.DateOfBirth, *other.DateOfBirth
+		switch {
+		case a.Equal(b):
+			score += 0.3
+			c.Reasons = append(c.Reasons, "dateOfBirth")
+		case a.Year() == b.Year() && int(a.Month()) == b.Day() && a.Day() == int(b.Month()):
+			// Day and month swapped while typing.
+			score += 0.2
+			c.Reasons = append(c.Reasons, "dateOfBirth")
+		default:
+			score *= 0.5
+		}
+	} else {
+		// Without both dates a strong name match alone is still worth a look.
+		score += 0.15 * name
+	}
+
+	pa, pb := utils.DigitsOnly(probe.PhoneNumber), utils.DigitsOnly(other.PhoneNumber)
+	if len(pa) >= 7 && len(pb) >= 7 && pa[len(pa)-7:] == pb[len(pb)-7:] {
+		score += 0.2
+		c.Reasons = append(c.Reasons, "phoneNumber")
+	}
+
+	if probe.Email != "" && strings.EqualFold(probe.Email, other.Email) {
+		score = max(score, 0.95)
+		c.Reasons = append(c.Reasons, "email")
+	}
+
+	if probe.MRN != "" && probe.MRN == other.MRN {
+		score = max(score, 0.95)
+		c.Reasons = append(c.Reasons, "mrn")
+	}
+
+	c.Score = min(score, 1)
+	return c
+}
+
+// likelyDuplicates keeps the candidates scoring above likelyDuplicateScore.
+func likelyDuplicates(candidates []DuplicateCandidate) []DuplicateCandidate {
+	var likely []DuplicateCandidate
+	for _, c := range candidates {
+		if c.Score >= likelyDuplicateScore {
+			likely = append(likely, c)
+		}
+	}
+	return likely
+}
+
+// FindDuplicatePatients lists existing patients resembling the identity given
+// in the query string (fullName, dateOfBirth, phoneNumber, email, mrn), so a
+// doctor can check before registering someone new.
+func FindDuplicatePatients(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can look up patients"})
+	}
+
+	probe := models.Patient{
+		FullName:    c.Query("fullName"),
+		PhoneNumber: c.Query("phoneNumber"),
+		Email:       strings.ToLower(strings.TrimSpace(c.Query("email"))),
+		MRN:         strings.TrimSpace(c.Query("mrn")),
+	}
+	if dobStr := c.Query("dateOfBirth"); dobStr != "" {
+		dob, err := utils.ParseDateOfBirth(dobStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		probe.DateOfBirth = &dob
+	}
+	if probe.FullName == "" && probe.DateOfBirth == nil && probe.PhoneNumber == "" && probe.Email == "" && probe.MRN == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Provide at least one of fullName, dateOfBirth, phoneNumber, email or mrn"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	candidates, err := findDuplicateCandidates(ctx, &probe, activeOnly(patientVisibilityFilter(userID, role)))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search for duplicates"})
+	}
+	if candidates == nil {
+		candidates = make([]DuplicateCandidate, 0)
+	}
+	return c.JSON(candidates)
+}
+
+// GetPatientDuplicates lists patients that may be duplicates of an existing patient.
+func GetPatientDuplicates(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can look up patients"})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findVisiblePatient(ctx, patientID, userID, role)
+	if err == errPatientNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch patient"})
+	}
+
+	candidates, err := findDuplicateCandidates(ctx, patient, activeOnly(patientVisibilityFilter(userID, role)))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search for duplicates"})
+	}
+	if candidates == nil {
+		candidates = make([]DuplicateCandidate, 0)
+	}
+	return c.JSON(candidates)
+}
+
+// MergePatients folds duplicate patient records into a surviving one. Every
+// report of the duplicates is re-pointed to the survivor, identifiers missing
+// on the survivor are taken from the duplicates, and the duplicates are
+// archived with a link to the survivor. At most one of the records may have a
+// portal account, which then belongs to the survivor. The merge is recorded
+// in the audit log.
+func MergePatients(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req MergePatientsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	survivorID, err := primitive.ObjectIDFromHex(req.SurvivorID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid survivor ID format"})
+	}
+	if len(req.DuplicateIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "At least one duplicate ID is required"})
+	}
+	var duplicateIDs []primitive.ObjectID
+	for _, idStr := range req.DuplicateIDs {
+		id, err := primitive.ObjectIDFromHex(idStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid duplicate ID format: " + idStr})
+		}
+		if id == survivorID {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A patient cannot be merged into itself"})
+		}
+		duplicateIDs = append(duplicateIDs, id)
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 30*time.Second)
+	defer cancel()
+
+	patients := models.Scoped("patients")
+	var survivor models.Patient
+	if err := patients.FindOne(ctx, bson.M{"_id": survivorID}).Decode(&survivor); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Survivor patient not found"})
+	}
+	if survivor.ArchivedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The surviving patient is archived"})
+	}
+	var duplicates []models.Patient
+	if err := findAll(ctx, patients, bson.M{"_id": bson.M{"$in": duplicateIDs}}, &duplicates); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch patients"})
+	}
+	if len(duplicates) != len(duplicateIDs) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "One or more duplicate patients not found"})
+	}
+	accounts := 0
+	if !survivor.AccountID.IsZero() {
+		accounts++
+	}
+	for _, d := range duplicates {
+		if !d.MergedInto.IsZero() {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient " + d.ID.Hex() + " has already been merged"})
+		}
+		if !d.AccountID.IsZero() {
+			accounts++
+		}
+	}
+	// A patient keeps one portal account, and an account left on an archived
+	// record would lose access to its reports.
+	if accounts > 1 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "More than one of these patients has a portal account; delete all but one before merging"})
+	}
+
+	survivorSet, accountFrom := mergedFields(&survivor, duplicates)
+
+	var reportsMoved int64
+	err = models.RunInTransaction(ctx, func(ctx context.Context) error {
+		res, err := models.Scoped("reports").UpdateMany(ctx,
+			bson.M{"patientId": bson.M{"$in": duplicateIDs}},
+			bson.M{"$set": bson.M{"patientId": survivorID}})
+		if err != nil {
+			return err
+		}
+		reportsMoved = res.ModifiedCount
+
+		now := time.Now()
+		for _, d := range duplicates {
+			update := bson.M{"$set": bson.M{"archivedAt": now, "archivedBy": chefID, "mergedInto": survivorID}}
+			if d.ID == accountFrom {
+				// The portal account moves to the survivor.
+				update["$unset"] = bson.M{"accountId": ""}
+			}
+			if _, err := patients.UpdateOne(ctx, bson.M{"_id": d.ID}, update); err != nil {
+				return err
+			}
+		}
+		if !accountFrom.IsZero() {
+			_, err := models.Scoped("users").UpdateOne(ctx,
+				bson.M{"_id": survivorSet["accountId"]},
+				bson.M{"$set": bson.M{"patientId": survivorID}})
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := patients.UpdateOne(ctx, bson.M{"_id": survivorID}, bson.M{"$set": survivorSet}); err != nil {
+			return err
+		}
+
+		details := bson.M{"mergedIds": duplicateIDs, "reportsMoved": reportsMoved}
+		if !accountFrom.IsZero() {
+			details["accountFrom"] = accountFrom
+		}
+		return recordAudit(ctx, "patient.merge", chefID, survivorID, details)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error merging patients", "survivorId", survivorID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to merge patients"})
+	}
+
+	var merged models.Patient
+	if err := patients.FindOne(ctx, bson.M{"_id": survivorID}).Decode(&merged); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch merged patient"})
+	}
+
+	return c.JSON(fiber.Map{
+		"patient":      merged,
+		"mergedIds":    duplicateIDs,
+		"reportsMoved": reportsMoved,
+	})
+}
+
+// mergedFields works out what the survivor inherits from its duplicates: any
+// identifier it lacks, the duplicates' notes, and care team access for their
+// doctors. It also returns which duplicate, if any, hands over its portal
+// account; MergePatients refuses to merge records with more than one.
+func mergedFields(survivor *models.Patient, duplicates []models.Patient) (bson.M, primitive.ObjectID) {
+	set := bson.M{}
+	var accountFrom primitive.ObjectID
+	notes := []string{}
+	if survivor.Notes != "" {
+		notes = append(notes, survivor.Notes)
+	}
+
+	for _, d := range duplicates {
+		if survivor.Email == "" && d.Email != "" {
+			if _, ok := set["email"]; !ok {
+				set["email"] = d.Email
+			}
+		}
+		if survivor.AccountID.IsZero() && !d.AccountID.IsZero() {
+			set["accountId"] = d.AccountID
+			accountFrom = d.ID
+		}
+		if survivor.PhoneNumber == "" && d.PhoneNumber != "" {
+			if _, ok := set["phoneNumber"]; !ok {
+				set["phoneNumber"] = d.PhoneNumber
+			}
+		}
+		if survivor.DateOfBirth == nil && d.DateOfBirth != nil {
+			if _, ok := set["dateOfBirth"]; !ok {
+				set["dateOfBirth"] = *d.DateOfBirth
+				set["age"] = d.Age
+			}
+		}
+		if survivor.Sex == "" && d.Sex != "" {
+			if _, ok := set["sex"]; !ok {
+				set["sex"] = d.Sex
+			}
+		}
+		if survivor.Age == 0 && d.Age != 0 {
+			if _, ok := set["age"]; !ok {
+				set["age"] = d.Age
+			}
+		}
+		if d.Notes != "" && d.Notes != survivor.Notes {
+			notes = append(notes, d.Notes)
+		}
+	}
+	if len(notes) > 1 {
+		set["notes"] = strings.Join(notes, "\n\n")
+	}
+	set["careTeam"] = mergedCareTeam(survivor, duplicates)
+	return set, accountFrom
+}
+
+// mergedCareTeam combines the care teams of the survivor and its duplicates.
+// The duplicates' owners join with write access, and a doctor on several
+// teams keeps the highest access they had.
+func mergedCareTeam(survivor *models.Patient, duplicates []models.Patient) []models.CareTeamMember {
+	team := append([]models.CareTeamMember{}, survivor.CareTeam...)
+	index := map[primitive.ObjectID]int{}
+	for i, m := range team {
+		index[m.DoctorID] = i
+	}
+	add := func(m models.CareTeamMember) {
+		if m.DoctorID.IsZero() || m.DoctorID == survivor.CreatedBy {
+			return
+		}
+		if i, ok := index[m.DoctorID]; ok {
+			if m.Access == models.AccessWrite {
+				team[i].Access = models.AccessWrite
+			}
+			return
+		}
+		index[m.DoctorID] = len(team)
+		team = append(team, m)
+	}
+
+	for _, d := range duplicates {
+		add(models.CareTeamMember{DoctorID: d.CreatedBy, Access: models.AccessWrite, GrantedAt: time.Now()})
+		for _, m := range d.CareTeam {
+			add(m)
+		}
+	}
+	return team
+}
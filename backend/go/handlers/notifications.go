@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/emails"
+	"fracture-detection-webapp/metrics"
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/tracing"
+	"fracture-detection-webapp/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NotifyRequest defines the optional body of NotifyPatient.
+type NotifyRequest struct {
+	// Channel is "email" or "sms"; by default the patient's preferred channel.
+	Channel string `json:"channel"`
+	// Attach lists what to attach to an email: "pdf" for the report PDF,
+	// "image" for the annotated X-ray.
+	Attach []string `json:"attach"`
+}
+
+// Notifier delivers report notifications over one channel.
+type Notifier interface {
+	// Recipient returns the patient's address on the channel, or "" if the
+	// patient cannot be reached on it.
+	Recipient(patient *models.Patient) string
+	// Send delivers a notification about a report to the patient.
+	Send(ctx context.Context, n *models.Notification, report *models.Report, patient *models.Patient, data emails.Data) error
+}
+
+// notifiers are the available channels.
+var notifiers = map[string]Notifier{
+	models.ChannelEmail: emailNotifier{},
+	models.ChannelSMS:   smsNotifier{},
+}
+
+// normalizeChannel validates a notification channel name.
+func normalizeChannel(channel string) (string, error) {
+	channel = strings.ToLower(strings.TrimSpace(channel))
+	if _, ok := notifiers[channel]; !ok {
+		return "", errors.New("notification channel must be \"email\" or \"sms\"")
+	}
+	return channel, nil
+}
+
+// preferredChannel picks how to reach a patient: their preferred channel if
+// they can be reached on it, else email, else SMS. It returns "" when the
+// patient has neither an email address nor a phone number.
+func preferredChannel(patient *models.Patient) string {
+	for _, channel := range []string{patient.Channel, models.ChannelEmail, models.ChannelSMS} {
+		if notifier, ok := notifiers[channel]; ok && notifier.Recipient(patient) != "" {
+			return channel
+		}
+	}
+	return ""
+}
+
+// notificationPollInterval is how often the outbox workers look for
+// notifications and webhook deliveries due.
+const notificationPollInterval = 5 * time.Second
+
+// errPermanent marks delivery errors that retrying cannot fix, such as a
+// deleted report; the notification is dead-lettered at once.
+var errPermanent = errors.New("permanent failure")
+
+// NotifyPatient queues a notification to the patient for a report, by email
+// or SMS. Emails can have the report PDF or the annotated image attached.
+// The outbox worker delivers it; its progress is visible with
+// GetReportNotifications.
+func NotifyPatient(c *fiber.Ctx) error {
+	reportIDStr := c.Params("id")
+	reportID, err := primitive.ObjectIDFromHex(reportIDStr)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+	}
+
+	var req NotifyRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can notify patients"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var report models.Report
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if !models.CanWrite(access) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You only have read access to this patient"})
+	}
+
+	var patient models.Patient
+	err = models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&patient)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	channel := preferredChannel(&patient)
+	if req.Channel != "" {
+		if channel, err = normalizeChannel(req.Channel); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if channel == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Patient has neither an email address nor a phone number"})
+	}
+	recipient := notifiers[channel].Recipient(&patient)
+	if recipient == "" && channel == models.ChannelEmail {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Patient does not have an email address"})
+	}
+	if recipient == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Patient does not have a phone number"})
+	}
+	if channel != models.ChannelEmail && len(req.Attach) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Attachments can only be sent by email"})
+	}
+
+	for _, a := range req.Attach {
+		switch a {
+		case "pdf":
+		case "image":
+			if _, _, err := utils.DecodeBase64Image(report.AnnotatedImage); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "This report has no annotated image"})
+			}
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "attach may only contain \"pdf\" and \"image\""})
+		}
+	}
+
+	now := time.Now()
+	notification := models.Notification{
+		ID:            primitive.NewObjectID(),
+		Channel:       channel,
+		Template:      emails.ReportReady,
+		ReportID:      report.ID,
+		PatientID:     patient.ID,
+		Recipient:     recipient,
+		Attach:        req.Attach,
+		Status:        models.NotificationQueued,
+		MaxAttempts:   models.DefaultNotificationAttempts,
+		NextAttemptAt: now,
+		History:       []models.NotificationAttempt{{At: now, Status: models.NotificationQueued, By: userID}},
+		CreatedBy:     userID,
+		CreatedAt:     now,
+	}
+	if _, err := models.Scoped("notifications").InsertOne(ctx, notification); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue notification"})
+	}
+	notification.FacilityID, _ = models.FacilityFromContext(ctx)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message":      "Notification queued",
+		"notification": notification,
+	})
+}
+
+// GetReportNotifications returns the notifications sent, or being sent, for
+// a report, newest first, with their delivery history.
+func GetReportNotifications(c *fiber.Ctx) error {
+	reportID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+	}
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can view notifications"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var report models.Report
+	if err := models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+
+	notifications := []models.Notification{}
+	err = findAll(ctx, models.Scoped("notifications"), bson.M{"reportId": reportID}, &notifications,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch notifications"})
+	}
+	return c.JSON(notifications)
+}
+
+// GetNotifications lists the outbox of the facility, newest first. Chefs see
+// every notification and doctors the ones they queued. ?status= filters by
+// status, e.g. "dead" for the notifications that gave up.
+func GetNotifications(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can view notifications"})
+	}
+
+	filter := bson.M{}
+	if role != "chef" {
+		filter["createdBy"] = userID
+	}
+	switch status := c.Query("status"); status {
+	case "":
+	case models.NotificationQueued, models.NotificationSending, models.NotificationSent, models.NotificationFailed, models.NotificationDead:
+		filter["status"] = status
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid status"})
+	}
+	limit := int64(c.QueryInt("limit", 100))
+	if limit < 1 || limit > 500 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 500"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	notifications := []models.Notification{}
+	err = findAll(ctx, models.Scoped("notifications"), filter, &notifications,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch notifications"})
+	}
+	return c.JSON(notifications)
+}
+
+// RetryNotification queues a failed or dead notification again. Doctors can
+// only retry the notifications they queued.
+func RetryNotification(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid notification ID format"})
+	}
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can retry notifications"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var existing models.Notification
+	if err := models.Scoped("notifications").FindOne(ctx, bson.M{"_id": id}).Decode(&existing); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Notification not found"})
+	}
+	if role != "chef" && existing.CreatedBy != userID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Notification not found"})
+	}
+
+	notification, err := models.RetryNotification(ctx, id, userID)
+	if errors.Is(err, models.ErrNotRetryable) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retry notification"})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(notification)
+}
+
+// RunNotificationWorker delivers queued notifications until ctx is done.
+// Several servers can run it against the same database: each notification is
+// claimed by exactly one of them.
+func RunNotificationWorker(ctx context.Context) {
+	pollOutbox(ctx, "notification", func(ctx context.Context) error {
+		n, err := models.ClaimNotification(ctx)
+		if err != nil {
+			return err
+		}
+		processNotification(ctx, n)
+		return nil
+	})
+}
+
+// pollOutbox calls next until it returns an error, mongo.ErrNoDocuments
+// meaning there is nothing left to do, then waits for the next poll. It
+// returns when ctx is done.
+func pollOutbox(ctx context.Context, kind string, next func(ctx context.Context) error) {
+	ticker := time.NewTicker(notificationPollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			err := next(ctx)
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "Outbox: claiming failed", "kind", kind, "error", err)
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNotification makes one delivery attempt and records its outcome.
+func processNotification(ctx context.Context, n *models.Notification) {
+	ctx, span := tracing.Tracer("notifications").Start(ctx, "notification "+n.Channel, trace.WithAttributes(
+		attribute.String("notification.id", n.ID.Hex()),
+		attribute.String("notification.template", n.Template),
+		attribute.Int("notification.attempt", n.Attempts),
+	))
+	defer span.End()
+	sendCtx, cancel := context.WithTimeout(models.WithFacility(ctx, n.FacilityID), 60*time.Second)
+	defer cancel()
+
+	err := deliverNotification(sendCtx, n)
+	permanent := errors.Is(err, errPermanent)
+	if err != nil {
+		tracing.Fail(span, err)
+		slog.WarnContext(ctx, "Outbox: notification delivery failed", "notificationId", n.ID.Hex(), "attempt", n.Attempts, "maxAttempts", n.MaxAttempts, "error", err)
+	}
+	outcome := metrics.DeliverySent
+	switch {
+	case permanent:
+		outcome = metrics.DeliveryRejected
+	case err != nil:
+		outcome = metrics.DeliveryFailed
+	}
+	metrics.ObserveNotification(n.Channel, n.Template, outcome)
+	if err := models.CompleteNotification(ctx, n, err, permanent); err != nil {
+		slog.ErrorContext(ctx, "Outbox: recording the outcome of a notification failed", "notificationId", n.ID.Hex(), "error", err)
+	}
+}
+
+// deliverNotification builds the message of a notification from the current
+// report and sends it. ctx carries the notification's facility.
+func deliverNotification(ctx context.Context, n *models.Notification) error {
+	notifier, ok := notifiers[n.Channel]
+	if !ok || n.Template != emails.ReportReady {
+		return fmt.Errorf("%w: unsupported notification %s/%s", errPermanent, n.Channel, n.Template)
+	}
+
+	var report models.Report
+	if err := models.Scoped("reports").FindOne(ctx, bson.M{"_id": n.ReportID}).Decode(&report); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("%w: report not found", errPermanent)
+		}
+		return err
+	}
+	var patient models.Patient
+	if err := models.Scoped("patients").FindOne(ctx, bson.M{"_id": n.PatientID}).Decode(&patient); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("%w: patient not found", errPermanent)
+		}
+		return err
+	}
+	facility, err := models.CurrentFacility(ctx)
+	if err != nil {
+		return err
+	}
+
+	return notifier.Send(ctx, n, &report, &patient, emails.Data{
+		Facility:     *facility,
+		PatientName:  patient.FullName,
+		FractureType: report.FractureType,
+		RecoveryTime: report.RecoveryTime,
+		ActionURL:    emails.AppURL("/reports/" + report.ID.Hex()),
+	})
+}
+
+// emailNotifier sends notifications as emails rendered from the emails
+// templates, with the requested attachments.
+type emailNotifier struct{}
+
+func (emailNotifier) Recipient(patient *models.Patient) string {
+	return patient.Email
+}
+
+func (emailNotifier) Send(ctx context.Context, n *models.Notification, report *models.Report, patient *models.Patient, data emails.Data) error {
+	var attachments []utils.Attachment
+	for _, a := range n.Attach {
+		switch a {
+		case "pdf":
+			doc, filename, err := renderReportPDF(ctx, report)
+			if err != nil {
+				return fmt.Errorf("rendering the report PDF: %w", err)
+			}
+			attachments = append(attachments, utils.Attachment{Filename: filename, ContentType: "application/pdf", Data: doc})
+			data.ReportAttached = true
+		case "image":
+			img, contentType, err := utils.DecodeBase64Image(report.AnnotatedImage)
+			if err != nil {
+				return fmt.Errorf("%w: the report has no annotated image", errPermanent)
+			}
+			ext := ".jpg"
+			if contentType == "image/png" {
+				ext = ".png"
+			}
+			attachments = append(attachments, utils.Attachment{
+				Filename:    "annotated-xray" + ext,
+				ContentType: contentType,
+				Data:        img,
+				ContentID:   "annotated-xray",
+			})
+			data.ImageCID = "annotated-xray"
+		}
+	}
+
+	msg, err := emails.Render(n.Template, patient.Locale, data)
+	if err != nil {
+		return fmt.Errorf("%w: rendering the email: %v", errPermanent, err)
+	}
+	msg.To = []string{(&mail.Address{Name: patient.FullName, Address: n.Recipient}).String()}
+	msg.Attachments = append(msg.Attachments, attachments...)
+	return utils.SendMessage(ctx, msg)
+}
+
+// smsNotifier sends notifications as text messages through the SMS gateway.
+type smsNotifier struct{}
+
+func (smsNotifier) Recipient(patient *models.Patient) string {
+	return patient.PhoneNumber
+}
+
+func (smsNotifier) Send(ctx context.Context, n *models.Notification, report *models.Report, patient *models.Patient, data emails.Data) error {
+	text, err := emails.RenderSMS(n.Template, patient.Locale, data)
+	if err != nil {
+		return fmt.Errorf("%w: rendering the SMS: %v", errPermanent, err)
+	}
+	err = utils.SendSMS(ctx, n.Recipient, text)
+	var gatewayErr *utils.GatewayError
+	if errors.As(err, &gatewayErr) && !gatewayErr.Temporary() {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return err
+}
@@ -2,57 +2,623 @@ package handlers
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"strings"
 	"time"
 
+	"fracture-detection-webapp/emails"
 	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// GetMyPatients retrieves all patients created by the currently logged-in doctor.
-func GetMyPatients(c *fiber.Ctx) error {
-	doctorIDRaw := c.Locals("userId")
-	if doctorIDRaw == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User ID not found in token"})
+// PatientRequest defines the payload for registering a patient.
+type PatientRequest struct {
+	FullName    string `json:"fullName"`
+	Email       string `json:"email"`
+	Password    string `json:"password,omitempty"` // optional, gives the patient portal access
+	MRN         string `json:"mrn,omitempty"`      // generated when left empty
+	DateOfBirth string `json:"dateOfBirth,omitempty"`
+	Sex         string `json:"sex,omitempty"`
+	Age         *int   `json:"age,omitempty"`
+	PhoneNumber string `json:"phoneNumber,omitempty"`
+	Locale      string `json:"locale,omitempty"`              // language of notifications, such as "fr" or "ar"
+	Channel     string `json:"notificationChannel,omitempty"` // "email" or "sms"
+	Notes       string `json:"notes,omitempty"`
+	// AllowDuplicate creates the patient even when a likely duplicate exists.
+	AllowDuplicate bool `json:"allowDuplicate,omitempty"`
+}
+
+// UpdatePatientRequest defines the payload for a partial patient update.
+// Fields left out of the JSON body are not modified.
+type UpdatePatientRequest struct {
+	FullName    *string `json:"fullName"`
+	Email       *string `json:"email"`
+	DateOfBirth *string `json:"dateOfBirth"`
+	Sex         *string `json:"sex"`
+	Age         *int    `json:"age"`
+	PhoneNumber *string `json:"phoneNumber"`
+	Locale      *string `json:"locale"`
+	Channel     *string `json:"notificationChannel"`
+	Notes       *string `json:"notes"`
+}
+
+// PortalAccountRequest defines the payload for giving a patient portal access.
+type PortalAccountRequest struct {
+	Email    string `json:"email,omitempty"` // defaults to the patient's contact email
+	Password string `json:"password"`
+}
+
+var (
+	// errEmailTaken is returned when another patient or account already uses an email address.
+	errEmailTaken = errors.New("a user with this email already exists")
+	// errMRNTaken is returned when another patient already has the medical record number.
+	errMRNTaken = errors.New("a patient with this MRN already exists")
+)
+
+// newPatient validates a registration request and builds the patient
+// profile. Any password in the request is handled by newPortalAccount.
+func newPatient(req PatientRequest, creatorID primitive.ObjectID) (models.Patient, error) {
+	patient := models.Patient{
+		ID:        primitive.NewObjectID(),
+		FullName:  strings.TrimSpace(req.FullName),
+		CreatedBy: creatorID,
+		CreatedAt: time.Now(),
+		Notes:     strings.TrimSpace(req.Notes),
+		MRN:       strings.ToUpper(strings.TrimSpace(req.MRN)),
+	}
+	if patient.FullName == "" {
+		return patient, errors.New("full name is required")
+	}
+	if req.DateOfBirth != "" {
+		dob, err := utils.ParseDateOfBirth(req.DateOfBirth)
+		if err != nil {
+			return patient, err
+		}
+		patient.DateOfBirth = &dob
+		patient.Age = utils.AgeAt(dob, patient.CreatedAt)
+	}
+	if req.Sex != "" {
+		sex, err := utils.NormalizeSex(req.Sex)
+		if err != nil {
+			return patient, err
+		}
+		patient.Sex = sex
+	}
+	if req.Email != "" {
+		email, err := utils.NormalizeEmail(req.Email)
+		if err != nil {
+			return patient, err
+		}
+		patient.Email = email
+	}
+	if req.Age != nil && patient.DateOfBirth == nil {
+		if err := utils.ValidateAge(*req.Age); err != nil {
+			return patient, err
+		}
+		patient.Age = *req.Age
+	}
+	if req.PhoneNumber != "" {
+		phone, err := utils.NormalizePhone(req.PhoneNumber)
+		if err != nil {
+			return patient, err
+		}
+		patient.PhoneNumber = phone
+	}
+	if req.Locale != "" {
+		locale, err := emails.NormalizeLocale(req.Locale)
+		if err != nil {
+			return patient, err
+		}
+		patient.Locale = locale
+	}
+	if req.Channel != "" {
+		channel, err := normalizeChannel(req.Channel)
+		if err != nil {
+			return patient, err
+		}
+		patient.Channel = channel
+	}
+	return patient, nil
+}
+
+// newPortalAccount builds the login account giving a patient access to the
+// portal and links it to the patient. The email defaults to the patient's
+// contact email.
+func newPortalAccount(patient *models.Patient, email, password string) (*models.User, error) {
+	if password == "" {
+		return nil, errors.New("a password is required for portal access")
+	}
+	if email == "" {
+		email = patient.Email
+	}
+	if email == "" {
+		return nil, errors.New("an email is required to give a patient portal access")
+	}
+	email, err := utils.NormalizeEmail(email)
+	if err != nil {
+		return nil, err
 	}
 
-	doctorIDStr, ok := doctorIDRaw.(string)
-	if !ok {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "User ID is not in a valid format"})
+	account := &models.User{
+		ID:        primitive.NewObjectID(),
+		FullName:  patient.FullName,
+		Email:     email,
+		Password:  HashPasswordSHA256(password),
+		Role:      "patient",
+		CreatedBy: patient.CreatedBy,
+		CreatedAt: time.Now(),
+		PatientID: patient.ID,
 	}
+	patient.AccountID = account.ID
+	return account, nil
+}
 
-	doctorID, err := primitive.ObjectIDFromHex(doctorIDStr)
+// checkEmailAvailable returns errEmailTaken if a document of the collection
+// other than exceptID already uses the email. Empty emails are always available.
+func checkEmailAvailable(ctx context.Context, collection, email string, exceptID primitive.ObjectID) error {
+	if email == "" {
+		return nil
+	}
+	filter := bson.M{"email": email}
+	if !exceptID.IsZero() {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+	var count int64
+	var err error
+	if collection == "users" {
+		// Login emails are unique across all facilities.
+		count, err = models.DB.Collection(collection).CountDocuments(ctx, filter)
+	} else {
+		count, err = models.Scoped(collection).CountDocuments(ctx, filter)
+	}
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID in token"})
+		return err
+	}
+	if count > 0 {
+		return errEmailTaken
+	}
+	return nil
+}
+
+// insertPatient checks for duplicate emails, assigns a medical record number
+// if the patient has none, and stores the patient along with its portal
+// account, if any.
+func insertPatient(ctx context.Context, patient *models.Patient, account *models.User) error {
+	if err := checkEmailAvailable(ctx, "patients", patient.Email, primitive.NilObjectID); err != nil {
+		return err
+	}
+	if account != nil {
+		if err := checkEmailAvailable(ctx, "users", account.Email, primitive.NilObjectID); err != nil {
+			return err
+		}
 	}
+	if patient.MRN == "" {
+		facility, err := models.CurrentFacility(ctx)
+		if err != nil {
+			return err
+		}
+		mrn, err := models.NextMRN(ctx, facility.Code)
+		if err != nil {
+			return err
+		}
+		patient.MRN = mrn
+	}
+
+	return models.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := models.Scoped("patients").InsertOne(ctx, patient)
+		if mongo.IsDuplicateKeyError(err) {
+			return errMRNTaken
+		}
+		if err != nil || account == nil {
+			return err
+		}
+		_, err = models.Scoped("users").InsertOne(ctx, account)
+		return err
+	})
+}
 
-	log.Printf("Fetching patients for doctor with ID: %s", doctorID.Hex())
+// patientInsertError maps an insertPatient error onto an HTTP response.
+func patientInsertError(c *fiber.Ctx, err error) error {
+	switch err {
+	case errEmailTaken:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A user with this email already exists"})
+	case errMRNTaken:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A patient with this MRN already exists"})
+	}
+	slog.ErrorContext(c.UserContext(), "Error inserting patient", "error", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create patient"})
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// CreatePatient registers a new patient owned by the current doctor or chef.
+func CreatePatient(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can register patients"})
+	}
+
+	var req PatientRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	patient, err := newPatient(req, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	var account *models.User
+	if req.Password != "" {
+		if account, err = newPortalAccount(&patient, "", req.Password); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
-	// Temporarily remove the createdBy filter for debugging
-	cursor, err := models.DB.Collection("users").Find(ctx, bson.M{
-		"role": "patient",
-		// "createdBy": doctorID,
-	})
+	if !req.AllowDuplicate {
+		candidates, err := findDuplicateCandidates(ctx, &patient, activeOnly(patientVisibilityFilter(userID, role)))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check for duplicate patients"})
+		}
+		if likely := likelyDuplicates(candidates); len(likely) > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":      "This patient may already exist; resend with allowDuplicate to create it anyway",
+				"candidates": likely,
+			})
+		}
+	}
+
+	if err := insertPatient(ctx, &patient, account); err != nil {
+		return patientInsertError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(patient)
+}
+
+// GetMyPatients retrieves the patients the current user can see: every patient
+// for a chef, and for a doctor the patients they own or whose care team they
+// are on. Archived patients are only included with ?includeArchived=true.
+func GetMyPatients(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	filter := patientVisibilityFilter(userID, role)
+	if !c.QueryBool("includeArchived") {
+		filter = activeOnly(filter)
+	}
+
+	cursor, err := models.Scoped("patients").Find(ctx, filter)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch patients"})
 	}
 	defer cursor.Close(ctx)
 
-	var patients []models.User
+	var patients []models.Patient
 	if err = cursor.All(ctx, &patients); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to decode patients"})
 	}
 
 	// In case the doctor has no patients, return an empty array instead of null
 	if patients == nil {
-		patients = make([]models.User, 0)
+		patients = make([]models.Patient, 0)
 	}
 
 	return c.JSON(patients)
 }
+
+// GetPatient fetches a single patient visible to the current user.
+func GetPatient(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findVisiblePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return patientLookupError(c, err)
+	}
+
+	return c.JSON(patient)
+}
+
+// UpdatePatient applies a partial update to a patient's details.
+func UpdatePatient(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can update patients"})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	var req UpdatePatientRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	if req.FullName != nil {
+		name := strings.TrimSpace(*req.FullName)
+		if name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "full name cannot be empty"})
+		}
+		set["fullName"] = name
+	}
+	if req.Email != nil {
+		if *req.Email == "" {
+			unset["email"] = ""
+		} else {
+			email, err := utils.NormalizeEmail(*req.Email)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			set["email"] = email
+		}
+	}
+	if req.DateOfBirth != nil {
+		if *req.DateOfBirth == "" {
+			unset["dateOfBirth"] = ""
+		} else {
+			dob, err := utils.ParseDateOfBirth(*req.DateOfBirth)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			set["dateOfBirth"] = dob
+			set["age"] = utils.AgeAt(dob, time.Now())
+		}
+	}
+	if req.Sex != nil {
+		sex, err := utils.NormalizeSex(*req.Sex)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		set["sex"] = sex
+	}
+	if req.Age != nil && req.DateOfBirth == nil {
+		if err := utils.ValidateAge(*req.Age); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		set["age"] = *req.Age
+	}
+	if req.PhoneNumber != nil {
+		if *req.PhoneNumber == "" {
+			unset["phoneNumber"] = ""
+		} else {
+			phone, err := utils.NormalizePhone(*req.PhoneNumber)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			set["phoneNumber"] = phone
+		}
+	}
+	if req.Locale != nil {
+		if *req.Locale == "" {
+			unset["locale"] = ""
+		} else {
+			locale, err := emails.NormalizeLocale(*req.Locale)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			set["locale"] = locale
+		}
+	}
+	if req.Channel != nil {
+		if *req.Channel == "" {
+			unset["notificationChannel"] = ""
+		} else {
+			channel, err := normalizeChannel(*req.Channel)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			set["notificationChannel"] = channel
+		}
+	}
+	if req.Notes != nil {
+		set["notes"] = strings.TrimSpace(*req.Notes)
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No fields to update"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findWritablePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return patientLookupError(c, err)
+	}
+	if patient.ArchivedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Archived patients cannot be modified"})
+	}
+	if email, ok := set["email"].(string); ok {
+		if err := checkEmailAvailable(ctx, "patients", email, patient.ID); err != nil {
+			if err == errEmailTaken {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A user with this email already exists"})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update patient"})
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	var updated models.Patient
+	err = models.Scoped("patients").FindOneAndUpdate(ctx, bson.M{"_id": patient.ID}, update, returnAfter()).Decode(&updated)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating patient", "patientId", patient.ID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update patient"})
+	}
+
+	return c.JSON(updated)
+}
+
+// ArchivePatient hides a patient from lists and search. Patients are never
+// deleted so that their reports keep a valid owner; use RestorePatient to undo.
+func ArchivePatient(c *fiber.Ctx) error {
+	return setPatientArchived(c, true)
+}
+
+// RestorePatient brings an archived patient back into lists and search.
+func RestorePatient(c *fiber.Ctx) error {
+	return setPatientArchived(c, false)
+}
+
+func setPatientArchived(c *fiber.Ctx, archived bool) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can archive patients"})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findWritablePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return patientLookupError(c, err)
+	}
+
+	update := bson.M{"$unset": bson.M{"archivedAt": "", "archivedBy": ""}}
+	if archived {
+		update = bson.M{"$set": bson.M{"archivedAt": time.Now(), "archivedBy": userID}}
+	}
+	var updated models.Patient
+	err = models.Scoped("patients").FindOneAndUpdate(ctx, bson.M{"_id": patient.ID}, update, returnAfter()).Decode(&updated)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update patient"})
+	}
+
+	return c.JSON(updated)
+}
+
+// CreatePortalAccount gives a patient a login to the patient portal.
+func CreatePortalAccount(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can manage portal access"})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	var req PortalAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findWritablePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return patientLookupError(c, err)
+	}
+	if !patient.AccountID.IsZero() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "This patient already has portal access"})
+	}
+
+	account, err := newPortalAccount(patient, req.Email, req.Password)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := checkEmailAvailable(ctx, "users", account.Email, primitive.NilObjectID); err != nil {
+		return patientInsertError(c, err)
+	}
+
+	err = models.RunInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := models.Scoped("users").InsertOne(ctx, account); err != nil {
+			return err
+		}
+		_, err := models.Scoped("patients").UpdateOne(ctx, bson.M{"_id": patient.ID}, bson.M{"$set": bson.M{"accountId": account.ID}})
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating portal account", "patientId", patient.ID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create portal account"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Portal account created successfully",
+		"user":    account,
+	})
+}
+
+// DeletePortalAccount removes a patient's portal login. The patient profile
+// and its reports are kept.
+func DeletePortalAccount(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can manage portal access"})
+	}
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	patient, err := findWritablePatient(ctx, patientID, userID, role)
+	if err != nil {
+		return patientLookupError(c, err)
+	}
+	if patient.AccountID.IsZero() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "This patient has no portal access"})
+	}
+
+	err = models.RunInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := models.Scoped("users").DeleteOne(ctx, bson.M{"_id": patient.AccountID, "role": "patient"}); err != nil {
+			return err
+		}
+		_, err := models.Scoped("patients").UpdateOne(ctx, bson.M{"_id": patient.ID}, bson.M{"$unset": bson.M{"accountId": ""}})
+		return err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to remove portal account"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -3,19 +3,15 @@ package handlers
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
+	"fracture-detection-webapp/dicom"
 	"fracture-detection-webapp/models"
-	"fracture-detection-webapp/utils"
-
-	"mime/multipart"
-
-	"crypto/sha256"
+	"fracture-detection-webapp/pdf"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
@@ -36,10 +32,6 @@ type GetMyReportsRequest struct {
 	PatientID string `json:"patientId"`
 }
 
-// Hardcoded Gmail credentials for local testing
-var emailUser = "" // <-- put your Gmail here
-var emailPass = ""        // <-- put your Gmail's App password here 
-
 func GetMyReports(c *fiber.Ctx) error {
 	userIDFromTokenStr := c.Locals("userId").(string)
 	userRole := c.Locals("role").(string)
@@ -60,47 +52,32 @@ func GetMyReports(c *fiber.Ctx) error {
 		if req.PatientID != userIDFromTokenStr {
 			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not authorized to view these reports."})
 		}
-		filter = bson.M{"patientId": userIDFromToken}
+		filter, err = reportVisibilityFilter(c.UserContext(), userIDFromToken, userRole)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reports"})
+		}
 	} else if userRole == "doctor" {
-		// Doctors get the reports they have created.
-		filter = bson.M{"doctorId": userIDFromToken}
+		// Doctors get the reports they have created and those of the
+		// patients whose care team they are on.
+		filter, err = reportVisibilityFilter(c.UserContext(), userIDFromToken, userRole)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reports"})
+		}
 	} else {
 		// For other roles, return no reports.
 		return c.JSON([]EnrichedReport{})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
 	// Aggregation pipeline to enrich reports with patient and doctor names
-	pipeline := mongo.Pipeline{
-		{{"$match", filter}},
-		{{"$lookup", bson.M{
-			"from":         "users",
-			"localField":   "patientId",
-			"foreignField": "_id",
-			"as":           "patientInfo",
-		}}},
-		{{"$unwind", bson.M{"path": "$patientInfo", "preserveNullAndEmptyArrays": true}}},
-		{{"$lookup", bson.M{
-			"from":         "users",
-			"localField":   "doctorId",
-			"foreignField": "_id",
-			"as":           "doctorInfo",
-		}}},
-		{{"$unwind", bson.M{"path": "$doctorInfo", "preserveNullAndEmptyArrays": true}}},
-		{{"$addFields", bson.M{
-			"patientName": "$patientInfo.fullName",
-			"doctorName":  "$doctorInfo.fullName",
-		}}},
-		{{"$project", bson.M{
-			"patientInfo": 0,
-			"doctorInfo":  0,
-		}}},
-		{{"$sort", bson.M{"createdAt": -1}}},
-	}
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+	}, enrichReportStages()...)
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.M{"createdAt": -1}}})
 
-	cursor, err := models.DB.Collection("reports").Aggregate(ctx, pipeline, options.Aggregate())
+	cursor, err := models.Scoped("reports").Aggregate(ctx, pipeline, options.Aggregate())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reports"})
 	}
@@ -118,6 +95,35 @@ func GetMyReports(c *fiber.Ctx) error {
 	return c.JSON(reports)
 }
 
+// enrichReportStages returns the aggregation stages that resolve a report's
+// patient and doctor IDs into the names carried by EnrichedReport.
+func enrichReportStages() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "patients",
+			"localField":   "patientId",
+			"foreignField": "_id",
+			"as":           "patientInfo",
+		}}},
+		{{Key: "$unwind", Value: bson.M{"path": "$patientInfo", "preserveNullAndEmptyArrays": true}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "users",
+			"localField":   "doctorId",
+			"foreignField": "_id",
+			"as":           "doctorInfo",
+		}}},
+		{{Key: "$unwind", Value: bson.M{"path": "$doctorInfo", "preserveNullAndEmptyArrays": true}}},
+		{{Key: "$addFields", Value: bson.M{
+			"patientName": "$patientInfo.fullName",
+			"doctorName":  "$doctorInfo.fullName",
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"patientInfo": 0,
+			"doctorInfo":  0,
+		}}},
+	}
+}
+
 // CombinedResponse includes both the analysis result and the created report.
 type CombinedResponse struct {
 	Analysis models.AnalyzeResponse `json:"analysis"`
@@ -126,116 +132,121 @@ type CombinedResponse struct {
 
 // CreateReport handles the creation of a new report for a new or existing patient.
 func CreateReport(c *fiber.Ctx) error {
-	// 1. Handle Multipart Form Data
+	// 1. Check the caller may create reports before spending an analysis on it
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) && role != "service" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can create reports"})
+	}
+
+	// 2. Handle Multipart Form Data
 	form, err := c.MultipartForm()
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid form data"})
 	}
 
-	// 2. Handle Image Upload and Analysis
+	// 3. Handle Image Upload and Analysis
 	files := form.File["image"]
 	if len(files) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Image file is required"})
 	}
 	file := files[0]
 
-	// This block is from analyze.go
 	src, err := file.Open()
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not open uploaded file"})
 	}
 	defer src.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, _ := writer.CreateFormFile("file", file.Filename)
-	io.Copy(part, src)
-	writer.Close()
-
-	pythonURL := os.Getenv("PYTHON_SERVICE_URL")
-	if pythonURL == "" {
-		pythonURL = "http://localhost:8000/analyze"
-	}
-	req, _ := http.NewRequest("POST", pythonURL, body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	analysisResult, err := requestAnalysis(c.UserContext(), file.Filename, src)
 	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Analysis failed", "filename", file.Filename, "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Python service request failed"})
 	}
-	defer resp.Body.Close()
-
-	respBody, _ := io.ReadAll(resp.Body)
-	var analysisResult models.AnalyzeResponse
-	json.Unmarshal(respBody, &analysisResult)
-	// End of analysis block
 
-	// 3. Handle Patient Logic
-	doctorIDStr := c.Locals("userId").(string)
-	doctorID, _ := primitive.ObjectIDFromHex(doctorIDStr)
+	// 4. Handle Patient Logic
+	// Service accounts create reports and patients for their doctor.
+	doctorID, err := recordOwner(c.UserContext(), userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch account"})
+	}
 	var patientID primitive.ObjectID
 
 	existingPatientID := c.FormValue("existingPatientId")
 	if existingPatientID != "" {
-		patientID, _ = primitive.ObjectIDFromHex(existingPatientID)
-	} else {
-		age := 0
-		ageStr := c.FormValue("age")
-		if ageStr != "" {
-			fmt.Sscanf(ageStr, "%d", &age)
-		}
-		phoneNumber := c.FormValue("phoneNumber")
-		if phoneNumber == "" {
-			phoneNumber = ""
+		patientID, err = primitive.ObjectIDFromHex(existingPatientID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID format"})
 		}
-		notes := c.FormValue("notes")
-		if notes == "" {
-			notes = ""
+		patient, err := findWritablePatient(c.UserContext(), patientID, userID, role)
+		if err != nil {
+			return patientLookupError(c, err)
 		}
-		password := c.FormValue("password")
-		var hashedPassword string
-		if password != "" {
-			hashedPassword = fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+		if patient.ArchivedAt != nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Cannot create a report for an archived patient"})
 		}
-		newPatient := models.User{
-			ID:          primitive.NewObjectID(),
+	} else {
+		patientReq := PatientRequest{
 			FullName:    c.FormValue("fullName"),
 			Email:       c.FormValue("email"),
-			Password:    hashedPassword,
-			Role:        "patient",
-			CreatedBy:   doctorID,
-			CreatedAt:   time.Now(),
-			Age:         age,
-			PhoneNumber: phoneNumber,
-			Notes:       notes,
+			Password:    c.FormValue("password"),
+			MRN:         c.FormValue("mrn"),
+			DateOfBirth: c.FormValue("dateOfBirth"),
+			Sex:         c.FormValue("sex"),
+			PhoneNumber: c.FormValue("phoneNumber"),
+			Notes:       c.FormValue("notes"),
+		}
+		if ageStr := c.FormValue("age"); ageStr != "" {
+			age, err := strconv.Atoi(ageStr)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "age must be a number"})
+			}
+			patientReq.Age = &age
 		}
-		_, err := models.DB.Collection("users").InsertOne(context.Background(), newPatient)
+		patient, err := newPatient(patientReq, doctorID)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create new patient"})
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		var account *models.User
+		if patientReq.Password != "" {
+			if account, err = newPortalAccount(&patient, "", patientReq.Password); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
 		}
-		patientID = newPatient.ID
-	}
 
-	// 4. Create and Insert Report
-	newReport := models.Report{
-		ID:             primitive.NewObjectID(),
-		PatientID:      patientID,
-		DoctorID:       doctorID,
-		ImageName:      file.Filename,
-		AnnotatedImage: *analysisResult.ImageBase64,
-		FractureType:   analysisResult.Type,
-		RecoveryTime:   fmt.Sprintf("%d days", *analysisResult.RecoveryTime),
-		Confidence:     analysisResult.Confidence,
-		CreatedAt:      time.Now(),
+		// A known MRN identifies the patient unambiguously; reuse the record
+		// instead of registering the same person twice.
+		existing, err := findPatientByMRN(c.UserContext(), patient.MRN, userID, role)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch patient"})
+		}
+		if existing != nil {
+			if !models.CanWrite(existing.AccessFor(userID, role)) {
+				return patientLookupError(c, errReadOnlyAccess)
+			}
+			if existing.ArchivedAt != nil {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Cannot create a report for an archived patient"})
+			}
+			patient = *existing
+		} else if err := insertPatient(c.UserContext(), &patient, account); err != nil {
+			return patientInsertError(c, err)
+		}
+		patientID = patient.ID
 	}
 
-	_, err = models.DB.Collection("reports").InsertOne(context.Background(), newReport)
+	// 5. Create and Insert Report
+	newReport := newAnalyzedReport(patientID, doctorID, file.Filename, analysisResult)
+	newReport.Comments = c.FormValue("comments")
+
+	_, err = models.Scoped("reports").InsertOne(c.UserContext(), newReport)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create report"})
 	}
+	emitReportEvent(c.UserContext(), models.EventReportCreated, &newReport)
 
-	// 5. Return Combined Response
+	// 6. Return Combined Response
 	return c.Status(fiber.StatusCreated).JSON(CombinedResponse{
 		Analysis: analysisResult,
 		Report:   newReport,
@@ -251,10 +262,10 @@ func GetReportByID(c *fiber.Ctx) error {
 	}
 
 	var report models.Report
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
-	err = models.DB.Collection("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
@@ -262,13 +273,25 @@ func GetReportByID(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
 	}
 
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+
 	// Fetch patient info
-	var patient models.User
-	_ = models.DB.Collection("users").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&patient)
+	var patient models.Patient
+	_ = models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&patient)
 
 	// Fetch doctor info
 	var doctor models.User
-	_ = models.DB.Collection("users").FindOne(ctx, bson.M{"_id": report.DoctorID}).Decode(&doctor)
+	_ = models.Scoped("users").FindOne(ctx, bson.M{"_id": report.DoctorID}).Decode(&doctor)
 
 	return c.JSON(fiber.Map{
 		"id":             report.ID.Hex(),
@@ -279,10 +302,342 @@ func GetReportByID(c *fiber.Ctx) error {
 		"fractureType":   report.FractureType,
 		"recoveryTime":   report.RecoveryTime,
 		"confidence":     report.Confidence,
+		"status":         report.Status,
+		"signedBy":       report.SignedBy,
+		"signedAt":       report.SignedAt,
 		"createdAt":      report.CreatedAt,
 	})
 }
 
+// SignReport records the doctor's attestation of a report. Only doctors with
+// write access to the patient can sign, and a report is signed once.
+func SignReport(c *fiber.Ctx) error {
+	reportID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+	}
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if role != "doctor" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors can sign reports"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var report models.Report
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if !models.CanWrite(access) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You only have read access to this patient"})
+	}
+	if report.IsSigned() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Report is already signed"})
+	}
+
+	now := time.Now()
+	err = models.Scoped("reports").FindOneAndUpdate(ctx,
+		bson.M{"_id": reportID, "status": bson.M{"$ne": models.ReportSigned}},
+		bson.M{"$set": bson.M{"status": models.ReportSigned, "signedBy": userID, "signedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Report is already signed"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to sign report"})
+	}
+	if err := recordAudit(ctx, "report.sign", userID, report.ID, bson.M{"version": max(report.Version, 1)}); err != nil {
+		slog.ErrorContext(ctx, "Error recording report signature", "reportId", report.ID.Hex(), "error", err)
+	}
+	emitReportEvent(ctx, models.EventReportSigned, &report)
+	queueResultMessage(ctx, &report)
+
+	return c.JSON(report)
+}
+
+// AmendReportRequest changes the findings of a report. Fields left out are
+// kept; Reason is required and recorded in the audit log.
+type AmendReportRequest struct {
+	FractureType *string `json:"fractureType"`
+	RecoveryTime *string `json:"recoveryTime"`
+	Comments     *string `json:"comments"`
+	Reason       string  `json:"reason"`
+}
+
+// AmendReport changes the findings of a report and makes a new version of
+// it. An amended report is a draft again, to be signed anew; the previous
+// findings are kept in the audit log, so every version printed or exported
+// can be traced.
+func AmendReport(c *fiber.Ctx) error {
+	reportID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+	}
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if role != "doctor" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors can amend reports"})
+	}
+	var req AmendReportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "reason is required"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var report models.Report
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if !models.CanWrite(access) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You only have read access to this patient"})
+	}
+
+	set, previous := bson.M{}, bson.M{}
+	for _, f := range []struct {
+		key      string
+		from, to *string
+	}{
+		{"fractureType", &report.FractureType, req.FractureType},
+		{"recoveryTime", &report.RecoveryTime, req.RecoveryTime},
+		{"comments", &report.Comments, req.Comments},
+	} {
+		if f.to != nil && *f.to != *f.from {
+			set[f.key], previous[f.key] = *f.to, *f.from
+		}
+	}
+	if len(set) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Nothing to amend"})
+	}
+
+	// Reports written before versioning have no version, which means 1.
+	version := max(report.Version, 1)
+	current := bson.M{"_id": reportID, "version": version}
+	if version == 1 {
+		current["version"] = bson.M{"$in": bson.A{nil, 0, 1}}
+	}
+	set["version"] = version + 1
+	set["status"] = models.ReportDraft
+	err = models.Scoped("reports").FindOneAndUpdate(ctx, current,
+		bson.M{"$set": set, "$unset": bson.M{"signedBy": "", "signedAt": ""}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The report was amended meanwhile, please reload it"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to amend report"})
+	}
+	err = recordAudit(ctx, "report.amend", userID, report.ID, bson.M{
+		"version":  report.Version,
+		"reason":   req.Reason,
+		"previous": previous,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording report amendment", "reportId", report.ID.Hex(), "error", err)
+	}
+	emitReportEvent(ctx, models.EventReportAmended, &report)
+
+	return c.JSON(report)
+}
+
+// GetReportPDF renders a report as a PDF document.
+func GetReportPDF(c *fiber.Ctx) error {
+	reportID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+	}
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 20*time.Second)
+	defer cancel()
+
+	var report models.Report
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+
+	doc, filename, err := renderReportPDF(ctx, &report)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error rendering report PDF", "reportId", report.ID.Hex(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate PDF"})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+	return c.Send(doc)
+}
+
+// renderReportPDF renders a report with its patient, doctor and facility
+// branding, and returns the PDF along with a file name for it.
+func renderReportPDF(ctx context.Context, report *models.Report) ([]byte, string, error) {
+	doc := pdf.ReportDocument{Report: *report, GeneratedAt: time.Now()}
+	if err := models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&doc.Patient); err != nil && err != mongo.ErrNoDocuments {
+		return nil, "", err
+	}
+	if err := models.Scoped("users").FindOne(ctx, bson.M{"_id": report.DoctorID}).Decode(&doc.Doctor); err != nil && err != mongo.ErrNoDocuments {
+		return nil, "", err
+	}
+	facility, err := models.CurrentFacility(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	doc.Facility = *facility
+
+	var buf bytes.Buffer
+	if err := pdf.RenderReport(&buf, doc); err != nil {
+		return nil, "", err
+	}
+	name := doc.Patient.MRN
+	if name == "" {
+		name = report.ID.Hex()
+	}
+	return buf.Bytes(), fmt.Sprintf("report-%s-v%d.pdf", name, max(report.Version, 1)), nil
+}
+
+// GetReportDICOM exports a report as a DICOM object to open in a PACS
+// viewer: "sc" is a Secondary Capture of the annotated image, "sr" a
+// Structured Report of the findings.
+func GetReportDICOM(c *fiber.Ctx) error {
+	kind := c.Params("kind")
+	if kind != "sc" && kind != "sr" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown DICOM export, use sc or sr"})
+	}
+	reportID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
+	}
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 20*time.Second)
+	defer cancel()
+
+	var report models.Report
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if access == models.AccessNone {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+	}
+
+	data, filename, err := exportReportDICOM(ctx, &report, kind)
+	if err == dicom.ErrNoImage {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "This report has no annotated image"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error exporting report as DICOM", "reportId", report.ID.Hex(), "kind", kind, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate DICOM"})
+	}
+
+	c.Set(fiber.HeaderContentType, dicomMediaType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+	return c.Send(data)
+}
+
+// exportReportDICOM builds the DICOM export of a report, referencing the
+// instance analyzed when it came over DICOMweb, and returns the Part 10 file
+// along with a file name for it.
+func exportReportDICOM(ctx context.Context, report *models.Report, kind string) ([]byte, string, error) {
+	export := dicom.Export{Report: *report}
+	if err := models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&export.Patient); err != nil && err != mongo.ErrNoDocuments {
+		return nil, "", err
+	}
+	doctorID := report.DoctorID
+	if !report.SignedBy.IsZero() {
+		doctorID = report.SignedBy
+	}
+	if err := models.Scoped("users").FindOne(ctx, bson.M{"_id": doctorID}).Decode(&export.Doctor); err != nil && err != mongo.ErrNoDocuments {
+		return nil, "", err
+	}
+	facility, err := models.CurrentFacility(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	export.Facility = *facility
+	if !report.DicomInstanceID.IsZero() {
+		var source models.DicomInstance
+		err := models.Scoped("dicom_instances").FindOne(ctx, bson.M{"_id": report.DicomInstanceID}).Decode(&source)
+		if err == nil {
+			export.Source = &source
+		} else if err != mongo.ErrNoDocuments {
+			return nil, "", err
+		}
+	}
+
+	var ds *dicom.Dataset
+	if kind == "sc" {
+		if ds, err = dicom.SecondaryCapture(export); err != nil {
+			return nil, "", err
+		}
+	} else {
+		ds = dicom.StructuredReport(export)
+	}
+	data, err := dicom.WriteFile(ds)
+	if err != nil {
+		return nil, "", err
+	}
+	name := export.Patient.MRN
+	if name == "" {
+		name = report.ID.Hex()
+	}
+	return data, fmt.Sprintf("report-%s-v%d-%s.dcm", name, max(report.Version, 1), kind), nil
+}
+
 // DeleteReport handles the deletion of a single report.
 func DeleteReport(c *fiber.Ctx) error {
 	reportIDStr := c.Params("id")
@@ -291,64 +646,64 @@ func DeleteReport(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
 	}
 
-	userIDStr := c.Locals("userId").(string)
-	userID, _ := primitive.ObjectIDFromHex(userIDStr)
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !isStaff(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can delete reports"})
+	}
 
-	// Security check: Ensure the user deleting the report is the doctor who created it.
+	// Security check: Ensure the user deleting the report wrote it or has
+	// write access to the patient.
 	var report models.Report
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
-	err = models.DB.Collection("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
+	err = models.Scoped("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
 	if err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
 	}
 
-	if report.DoctorID != userID {
+	access, err := reportAccess(ctx, &report, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+	}
+	if !models.CanWrite(access) {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not authorized to delete this report"})
 	}
 
 	// Proceed with deletion
-	_, err = models.DB.Collection("reports").DeleteOne(ctx, bson.M{"_id": reportID})
+	_, err = models.Scoped("reports").DeleteOne(ctx, bson.M{"_id": reportID})
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete report"})
 	}
+	emitReportEvent(ctx, models.EventReportDeleted, &report)
 
 	return c.SendStatus(fiber.StatusNoContent) // 204 No Content on successful deletion
 }
 
-// GetAllReports returns all reports in the collection, enriched with patient and doctor names.
+// GetAllReports returns every report of the facility the user may see,
+// enriched with patient and doctor names.
 func GetAllReports(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
-	pipeline := mongo.Pipeline{
-		{{"$lookup", bson.M{
-			"from":         "users",
-			"localField":   "patientId",
-			"foreignField": "_id",
-			"as":           "patientInfo",
-		}}},
-		{{"$unwind", bson.M{"path": "$patientInfo", "preserveNullAndEmptyArrays": true}}},
-		{{"$lookup", bson.M{
-			"from":         "users",
-			"localField":   "doctorId",
-			"foreignField": "_id",
-			"as":           "doctorInfo",
-		}}},
-		{{"$unwind", bson.M{"path": "$doctorInfo", "preserveNullAndEmptyArrays": true}}},
-		{{"$addFields", bson.M{
-			"patientName": "$patientInfo.fullName",
-			"doctorName":  "$doctorInfo.fullName",
-		}}},
-		{{"$project", bson.M{
-			"patientInfo": 0,
-			"doctorInfo":  0,
-		}}},
-		{{"$sort", bson.M{"createdAt": -1}}},
+	filter, err := reportVisibilityFilter(ctx, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reports"})
 	}
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+	}, enrichReportStages()...)
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.M{"createdAt": -1}}})
 
-	cursor, err := models.DB.Collection("reports").Aggregate(ctx, pipeline, options.Aggregate())
+	cursor, err := models.Scoped("reports").Aggregate(ctx, pipeline, options.Aggregate())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reports"})
 	}
@@ -365,83 +720,3 @@ func GetAllReports(c *fiber.Ctx) error {
 
 	return c.JSON(reports)
 }
-
-// NotifyPatientByEmail sends an email notification to the patient for a report
-func NotifyPatientByEmail(c *fiber.Ctx) error {
-	reportIDStr := c.Params("reportId")
-	reportID, err := primitive.ObjectIDFromHex(reportIDStr)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report ID format"})
-	}
-
-	role := c.Locals("role").(string)
-	if role != "doctor" && role != "chef" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only doctors or chefs can notify patients"})
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	var report models.Report
-	err = models.DB.Collection("reports").FindOne(ctx, bson.M{"_id": reportID}).Decode(&report)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
-	}
-
-	var patient models.User
-	err = models.DB.Collection("users").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&patient)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
-	}
-
-	if patient.Email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Patient does not have an email address"})
-	}
-
-	subject := "New X-ray Report Available"
-	body := fmt.Sprintf(`
-		<!DOCTYPE html>
-		<html lang="en">
-		<head>
-			<meta charset="UTF-8">
-			<meta name="viewport" content="width=device-width, initial-scale=1.0">
-			<title>New X-ray Report</title>
-			<style>
-				body { font-family: Arial, sans-serif; margin: 0; padding: 0; background-color: #f4f4f4; }
-				.container { max-width: 600px; margin: 20px auto; background-color: #ffffff; border-radius: 8px; box-shadow: 0 4px 8px rgba(0,0,0,0.1); overflow: hidden; }
-				.header { background-color: #007bff; color: #ffffff; padding: 20px; text-align: center; }
-				.content { padding: 30px; }
-				.content h2 { color: #333333; }
-				.report-details { border-left: 4px solid #007bff; padding-left: 15px; margin-top: 20px; }
-				.footer { padding: 20px; text-align: center; font-size: 12px; color: #777777; background-color: #f9f9f9; }
-			</style>
-		</head>
-		<body>
-			<div class="container">
-				<div class="header">
-					<h1>New X-ray Report Available</h1>
-				</div>
-				<div class="content">
-					<h2>Dear %s,</h2>
-					<p>A new X-ray report has been generated for you. Please see the details below:</p>
-					<div class="report-details">
-						<p><strong>Fracture Type:</strong> %s</p>
-						<p><strong>Estimated Recovery:</strong> %s</p>
-					</div>
-					<p style="margin-top: 30px;">Please log in to your account to view the full report, including the annotated image.</p>
-				</div>
-				<div class="footer">
-					<p>This is an automated notification. Please do not reply to this email.</p>
-				</div>
-			</div>
-		</body>
-		</html>
-	`, patient.FullName, report.FractureType, report.RecoveryTime)
-
-	err = utils.SendEmailWithCreds(patient.Email, subject, body, emailUser, emailPass)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send email: " + err.Error()})
-	}
-
-	return c.JSON(fiber.Map{"message": "Notification email sent successfully"})
-}
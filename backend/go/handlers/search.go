@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	// searchCandidates caps how many documents each backing query may return
+	// before they are ranked in memory. Queries hitting the cap mark the
+	// response as truncated.
+	searchCandidates = 200
+)
+
+// PatientSearchResult is a patient matched by a search query.
+type PatientSearchResult struct {
+	Patient models.Patient `json:"patient"`
+	Score   float64        `json:"score"`
+}
+
+// ReportSearchResult is a report matched by a search query.
+type ReportSearchResult struct {
+	Report EnrichedReport `json:"report"`
+	Score  float64        `json:"score"`
+}
+
+// SearchResponse is the body returned by Search.
+type SearchResponse struct {
+	Query    string                `json:"query"`
+	Patients []PatientSearchResult `json:"patients"`
+	Reports  []ReportSearchResult  `json:"reports"`
+	// Truncated is set when more documents matched than could be ranked, so
+	// a better match may be missing; a longer query narrows the search.
+	Truncated bool `json:"truncated"`
+}
+
+// scoredPatient and scoredReport let the text-index score ride along with the
+// decoded document.
+type scoredPatient struct {
+	models.Patient `bson:",inline"`
+	TextScore      float64 `bson:"textScore"`
+}
+
+type scoredReport struct {
+	EnrichedReport `bson:",inline"`
+	TextScore      float64 `bson:"textScore"`
+}
+
+// Search looks up patients and reports visible to the current user.
+// Results are ranked by combining the MongoDB text score with a fuzzy prefix
+// score, so partial and slightly misspelled words still match.
+func Search(c *fiber.Ctx) error {
+	userID, role, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	tokens := utils.Tokenize(query)
+	if len(tokens) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Query parameter 'q' is required"})
+	}
+
+	limit := defaultSearchLimit
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, maxSearchLimit)
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	resp := SearchResponse{Query: query}
+
+	// Patients never search other patients.
+	if isStaff(role) {
+		var truncated bool
+		resp.Patients, truncated, err = searchPatients(ctx, query, tokens, activeOnly(patientVisibilityFilter(userID, role)), limit)
+		resp.Truncated = resp.Truncated || truncated
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search patients"})
+		}
+	}
+	visibleReports, err := reportVisibilityFilter(ctx, userID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search reports"})
+	}
+	var truncated bool
+	resp.Reports, truncated, err = searchReports(ctx, query, tokens, visibleReports, limit)
+	resp.Truncated = resp.Truncated || truncated
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search reports"})
+	}
+
+	if resp.Patients == nil {
+		resp.Patients = make([]PatientSearchResult, 0)
+	}
+	if resp.Reports == nil {
+		resp.Reports = make([]ReportSearchResult, 0)
+	}
+	return c.JSON(resp)
+}
+
+// searchPatients ranks the patients matching the query. It also reports
+// whether either backing query hit searchCandidates. Prefix matches are taken
+// in name order, so which ones are kept does not depend on storage order.
+func searchPatients(ctx context.Context, query string, tokens []string, visible bson.M, limit int) ([]PatientSearchResult, bool, error) {
+	coll := models.Scoped("patients")
+	candidates := map[primitive.ObjectID]scoredPatient{}
+	truncated := false
+
+	textFilter := withClause(visible, bson.M{"$text": bson.M{"$search": query}})
+	opts := options.Find().
+		SetProjection(bson.M{"textScore": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.M{"textScore": bson.M{"$meta": "textScore"}}).
+		SetLimit(searchCandidates + 1)
+	var hits []scoredPatient
+	if err := findAll(ctx, coll, textFilter, &hits, opts); err != nil {
+		return nil, false, err
+	}
+	if len(hits) > searchCandidates {
+		hits, truncated = hits[:searchCandidates], true
+	}
+	for _, h := range hits {
+		candidates[h.ID] = h
+	}
+
+	prefixFilter := withClause(visible, prefixClause(tokens, []string{"fullName", "email", "notes"}, "phoneNumber"))
+	opts = options.Find().
+		SetSort(bson.D{{Key: "fullName", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(searchCandidates + 1)
+	hits = nil
+	if err := findAll(ctx, coll, prefixFilter, &hits, opts); err != nil {
+		return nil, false, err
+	}
+	if len(hits) > searchCandidates {
+		hits, truncated = hits[:searchCandidates], true
+	}
+	for _, h := range hits {
+		if _, seen := candidates[h.ID]; !seen {
+			candidates[h.ID] = h
+		}
+	}
+
+	maxText := 0.0
+	for _, u := range candidates {
+		maxText = max(maxText, u.TextScore)
+	}
+
+	var results []PatientSearchResult
+	for _, u := range candidates {
+		score := utils.FuzzyScore(tokens, u.FullName, u.Email, u.Notes)
+		if phoneMatches(tokens, u.PhoneNumber) {
+			score = max(score, 1)
+		}
+		score += normalizedTextScore(u.TextScore, maxText)
+		if score == 0 {
+			continue
+		}
+		results = append(results, PatientSearchResult{Patient: u.Patient, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, truncated, nil
+}
+
+// searchReports ranks the reports matching the query, and reports whether
+// either backing query hit searchCandidates. Prefix matches are taken newest
+// first.
+func searchReports(ctx context.Context, query string, tokens []string, visible bson.M, limit int) ([]ReportSearchResult, bool, error) {
+	coll := models.Scoped("reports")
+	candidates := map[primitive.ObjectID]scoredReport{}
+	truncated := false
+
+	// $text must be the first stage of a pipeline, so the text query and the
+	// prefix query are run as two separate aggregations.
+	textPipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: withClause(visible, bson.M{"$text": bson.M{"$search": query}})}},
+		{{Key: "$addFields", Value: bson.M{"textScore": bson.M{"$meta": "textScore"}}}},
+		{{Key: "$sort", Value: bson.M{"textScore": -1}}},
+		{{Key: "$limit", Value: searchCandidates + 1}},
+	}, enrichReportStages()...)
+	var hits []scoredReport
+	if err := aggregateAll(ctx, coll, textPipeline, &hits); err != nil {
+		return nil, false, err
+	}
+	if len(hits) > searchCandidates {
+		hits, truncated = hits[:searchCandidates], true
+	}
+	for _, h := range hits {
+		candidates[h.ID] = h
+	}
+
+	prefixPipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: withClause(visible, prefixClause(tokens, []string{"fractureType", "comments"}, ""))}},
+		{{Key: "$sort", Value: bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$limit", Value: searchCandidates + 1}},
+	}, enrichReportStages()...)
+	hits = nil
+	if err := aggregateAll(ctx, coll, prefixPipeline, &hits); err != nil {
+		return nil, false, err
+	}
+	if len(hits) > searchCandidates {
+		hits, truncated = hits[:searchCandidates], true
+	}
+	for _, h := range hits {
+		if _, seen := candidates[h.ID]; !seen {
+			candidates[h.ID] = h
+		}
+	}
+
+	maxText := 0.0
+	for _, r := range candidates {
+		maxText = max(maxText, r.TextScore)
+	}
+
+	var results []ReportSearchResult
+	for _, r := range candidates {
+		score := utils.FuzzyScore(tokens, r.FractureType, r.Comments)
+		score += normalizedTextScore(r.TextScore, maxText)
+		if score == 0 {
+			continue
+		}
+		results = append(results, ReportSearchResult{Report: r.EnrichedReport, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].Report.CreatedAt.After(results[j].Report.CreatedAt)
+		}
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, truncated, nil
+}
+
+// prefixClause matches documents where any word of the given fields starts
+// like one of the tokens. Only the first three characters of longer tokens
+// are used so that typos further in still produce a candidate; the
+// fuzzy scorer then decides whether it is a real match. Numeric tokens are
+// also matched against phoneField, ignoring separators.
+func prefixClause(tokens []string, fields []string, phoneField string) bson.M {
+	var or bson.A
+	for _, t := range tokens {
+		prefix := []rune(t)
+		if len(prefix) > 3 {
+			prefix = prefix[:3]
+		}
+		pattern := `(^|[\s\-'.@_])` + regexp.QuoteMeta(string(prefix))
+		for _, f := range fields {
+			or = append(or, bson.M{f: primitive.Regex{Pattern: pattern, Options: "i"}})
+		}
+		if digits := utils.DigitsOnly(t); phoneField != "" && len(digits) >= 3 && digits == t {
+			or = append(or, bson.M{phoneField: primitive.Regex{Pattern: strings.Join(strings.Split(digits, ""), `\D*`)}})
+		}
+	}
+	return bson.M{"$or": or}
+}
+
+// phoneMatches reports whether a numeric token appears in the phone number.
+func phoneMatches(tokens []string, phone string) bool {
+	digits := utils.DigitsOnly(phone)
+	if digits == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if len(t) >= 3 && utils.DigitsOnly(t) == t && strings.Contains(digits, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizedTextScore scales a MongoDB text score into [0, 0.5] relative to
+// the best hit, so it can break ties between equally fuzzy matches.
+func normalizedTextScore(score, best float64) float64 {
+	if best <= 0 {
+		return 0
+	}
+	return 0.5 * score / best
+}
+
+// withClause combines a visibility filter with an additional clause.
+func withClause(filter, clause bson.M) bson.M {
+	return bson.M{"$and": bson.A{filter, clause}}
+}
+
+func findAll(ctx context.Context, coll *models.ScopedCollection, filter bson.M, out interface{}, opts ...*options.FindOptions) error {
+	cursor, err := coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, out)
+}
+
+func aggregateAll(ctx context.Context, coll *models.ScopedCollection, pipeline mongo.Pipeline, out interface{}) error {
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, out)
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Service accounts let other systems, such as a PACS, call the API. They are
+// users with the "service" role whose email is a generated client ID. They
+// cannot log in: they authenticate with API keys, limited to some scopes.
+
+// ServiceAccountRequest defines the payload for creating a service account.
+type ServiceAccountRequest struct {
+	Name     string `json:"name"`
+	DoctorID string `json:"doctorId"` // optional; the doctor owning the patients and reports it creates
+}
+
+// newClientID returns a random client ID.
+func newClientID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "svc-" + hex.EncodeToString(b), nil
+}
+
+// GetServiceAccounts lists the facility's service accounts.
+func GetServiceAccounts(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	accounts := []models.User{}
+	err := findAll(ctx, models.Scoped("users"), bson.M{"role": "service"}, &accounts,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch service accounts"})
+	}
+	return c.JSON(accounts)
+}
+
+// CreateServiceAccount creates a service account, without API keys yet.
+func CreateServiceAccount(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	var req ServiceAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var doctorID primitive.ObjectID
+	if req.DoctorID != "" {
+		if doctorID, err = primitive.ObjectIDFromHex(req.DoctorID); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid doctor ID format"})
+		}
+		count, err := models.Scoped("users").CountDocuments(ctx, bson.M{"_id": doctorID, "role": "doctor"})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch doctor"})
+		}
+		if count == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Doctor not found"})
+		}
+	}
+
+	clientID, err := newClientID()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate client ID"})
+	}
+	account := models.User{
+		ID:        primitive.NewObjectID(),
+		FullName:  name,
+		Email:     clientID,
+		Role:      "service",
+		CreatedBy: chefID,
+		CreatedAt: time.Now(),
+		Status:    models.UserActive,
+		DoctorID:  doctorID,
+	}
+	if _, err := models.Scoped("users").InsertOne(ctx, account); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create service account"})
+	}
+	if err := recordAudit(ctx, "service_account.create", chefID, account.ID, bson.M{"name": name}); err != nil {
+		slog.ErrorContext(ctx, "Error recording service account creation", "serviceAccountId", account.ID.Hex(), "error", err)
+	}
+	account.FacilityID, _ = models.FacilityFromContext(ctx)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"account": account, "clientId": clientID})
+}
+
+// DeleteServiceAccount removes a service account. What it created is kept.
+func DeleteServiceAccount(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid service account ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	res, err := models.Scoped("users").DeleteOne(ctx, bson.M{"_id": id, "role": "service"})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete service account"})
+	}
+	if res.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Service account not found"})
+	}
+	now := time.Now()
+	_, err = models.Scoped("api_keys").UpdateMany(ctx,
+		bson.M{"serviceAccountId": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now, "revokedBy": chefID}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error revoking API keys of service account", "serviceAccountId", id.Hex(), "error", err)
+	}
+	if err := recordAudit(ctx, "service_account.delete", chefID, id, nil); err != nil {
+		slog.ErrorContext(ctx, "Error recording service account deletion", "serviceAccountId", id.Hex(), "error", err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// APIKeyRequest defines the payload for issuing an API key.
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"` // optional; keys without one do not expire
+}
+
+// findServiceAccount checks that id is a service account of the facility.
+func findServiceAccount(ctx context.Context, id primitive.ObjectID) error {
+	count, err := models.Scoped("users").CountDocuments(ctx, bson.M{"_id": id, "role": "service"})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// serviceAccountLookupError maps a findServiceAccount error onto an HTTP
+// response.
+func serviceAccountLookupError(c *fiber.Ctx, err error) error {
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Service account not found"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch service account"})
+}
+
+// GetAPIKeys lists a service account's API keys, revoked ones included.
+func GetAPIKeys(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid service account ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	if err := findServiceAccount(ctx, id); err != nil {
+		return serviceAccountLookupError(c, err)
+	}
+	keys := []models.APIKey{}
+	err = findAll(ctx, models.Scoped("api_keys"), bson.M{"serviceAccountId": id}, &keys,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch API keys"})
+	}
+	return c.JSON(keys)
+}
+
+// CreateAPIKey issues an API key to a service account. The response holds the
+// key, which is not shown again.
+func CreateAPIKey(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid service account ID format"})
+	}
+	var req APIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+	}
+	if len(req.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "At least one scope is required"})
+	}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  "Unknown scope " + scope,
+				"scopes": models.APIKeyScopes,
+			})
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	now := time.Now()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "expiresAt must be in the future"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	if err := findServiceAccount(ctx, id); err != nil {
+		return serviceAccountLookupError(c, err)
+	}
+	key, prefix, err := models.NewAPIKey()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate API key"})
+	}
+	apiKey := models.APIKey{
+		ID:               primitive.NewObjectID(),
+		ServiceAccountID: id,
+		Name:             name,
+		Prefix:           prefix,
+		KeyHash:          models.HashAPIKey(key),
+		Scopes:           scopes,
+		ExpiresAt:        req.ExpiresAt,
+		CreatedBy:        chefID,
+		CreatedAt:        now,
+	}
+	if _, err := models.Scoped("api_keys").InsertOne(ctx, apiKey); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create API key"})
+	}
+	if err := recordAudit(ctx, "api_key.create", chefID, apiKey.ID, bson.M{"serviceAccountId": id, "scopes": scopes}); err != nil {
+		slog.ErrorContext(ctx, "Error recording API key creation", "apiKeyId", apiKey.ID.Hex(), "error", err)
+	}
+	apiKey.FacilityID, _ = models.FacilityFromContext(ctx)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"apiKey": apiKey, "key": key})
+}
+
+// RevokeAPIKey revokes a service account's API key; it is refused from then
+// on, but kept in the list.
+func RevokeAPIKey(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid service account ID format"})
+	}
+	keyID, err := primitive.ObjectIDFromHex(c.Params("keyId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid API key ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var apiKey models.APIKey
+	err = models.Scoped("api_keys").FindOneAndUpdate(ctx,
+		bson.M{"_id": keyID, "serviceAccountId": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now(), "revokedBy": chefID}}, returnAfter()).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "API key not found or already revoked"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke API key"})
+	}
+	if err := recordAudit(ctx, "api_key.revoke", chefID, keyID, bson.M{"serviceAccountId": id}); err != nil {
+		slog.ErrorContext(ctx, "Error recording API key revocation", "apiKeyId", keyID.Hex(), "error", err)
+	}
+	return c.JSON(apiKey)
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/sso"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Chefs and doctors of a hospital can sign in with its identity provider
+// instead of a password. The browser goes to /api/auth/oidc/login, signs in
+// at the provider and comes back to /api/auth/oidc/callback, which sends it
+// on to the web app with a JWT, as /login#token=..., or /login#error=....
+
+// ssoError is a sign-in failure the user is told about as is.
+type ssoError string
+
+func (e ssoError) Error() string { return string(e) }
+
+// oidcStateCookie holds a hash of the state of the sign-in the browser
+// started, so that the callback only completes sign-ins begun by the same
+// browser, and a user cannot be signed in to someone else's account with a
+// callback URL they were sent.
+const oidcStateCookie = "oidc_state"
+
+func stateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// setStateCookie sets the state cookie, or clears it when state is empty.
+// It is only sent back to the callback, and only over HTTPS when the
+// callback is served over HTTPS.
+func setStateCookie(c *fiber.Ctx, cfg sso.Config, state string) {
+	cookie := &fiber.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/auth/oidc",
+		HTTPOnly: true,
+		Secure:   strings.HasPrefix(cfg.RedirectURL, "https://"),
+		SameSite: fiber.CookieSameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.Expires = time.Unix(0, 0)
+	} else {
+		cookie.Value = stateHash(state)
+		cookie.MaxAge = int(models.OIDCLoginTTL / time.Second)
+	}
+	c.Cookie(cookie)
+}
+
+// GetAuthMethods tells the login page which ways of signing in are available.
+func GetAuthMethods(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"password": true, "oidc": sso.Current().Enabled()})
+}
+
+// OIDCLogin starts a single sign-on by sending the browser to the identity
+// provider.
+func OIDCLogin(c *fiber.Ctx) error {
+	cfg := sso.Current()
+	if !cfg.Enabled() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Single sign-on is not configured"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	login, err := sso.NewLogin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start sign-in"})
+	}
+	authURL, err := sso.AuthURL(ctx, login)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reaching the identity provider", "error", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "The identity provider is unavailable"})
+	}
+	err = models.SaveOIDCLogin(ctx, &models.OIDCLogin{State: login.State, Nonce: login.Nonce, Verifier: login.Verifier})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start sign-in"})
+	}
+	setStateCookie(c, cfg, login.State)
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// OIDCCallback completes a single sign-on: it redeems the provider's
+// authorization code, finds or creates the user's account and sends the
+// browser back to the web app with a JWT.
+func OIDCCallback(c *fiber.Ctx) error {
+	cfg := sso.Current()
+	if !cfg.Enabled() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Single sign-on is not configured"})
+	}
+	cookie := c.Cookies(oidcStateCookie)
+	back := func(key, value string) error {
+		setStateCookie(c, cfg, "")
+		return c.Redirect(cfg.PostLoginURL+"#"+url.Values{key: {value}}.Encode(), fiber.StatusFound)
+	}
+
+	if e := c.Query("error"); e != "" {
+		slog.WarnContext(c.UserContext(), "Identity provider refused sign-in", "error", e, "description", c.Query("error_description"))
+		return back("error", "Sign-in was cancelled or refused by the identity provider")
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return back("error", "Invalid sign-in response")
+	}
+	if subtle.ConstantTimeCompare([]byte(cookie), []byte(stateHash(state))) != 1 {
+		slog.WarnContext(c.UserContext(), "Refused sign-in started in another browser")
+		return back("error", "This sign-in was not started from this browser, please try again")
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 15*time.Second)
+	defer cancel()
+
+	pending, err := models.TakeOIDCLogin(ctx, state)
+	if err == mongo.ErrNoDocuments {
+		return back("error", "This sign-in has expired, please try again")
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching sign-in", "error", err)
+		return back("error", "Sign-in failed")
+	}
+	identity, err := sso.Exchange(ctx, sso.Login{State: pending.State, Nonce: pending.Nonce, Verifier: pending.Verifier}, code)
+	if err != nil {
+		slog.WarnContext(ctx, "Error verifying sign-in", "error", err)
+		return back("error", "Could not verify your identity")
+	}
+
+	user, err := ssoUser(ctx, identity)
+	var userErr ssoError
+	if errors.As(err, &userErr) {
+		slog.WarnContext(ctx, "Refused sign-in", "subject", identity.Subject, "issuer", identity.Issuer, "error", err)
+		return back("error", userErr.Error())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error provisioning single sign-on user", "subject", identity.Subject, "issuer", identity.Issuer, "error", err)
+		return back("error", "Sign-in failed")
+	}
+	if user.IsSuspended() {
+		return back("error", "This account has been suspended")
+	}
+
+	token, err := issueToken(user)
+	if err != nil {
+		return back("error", "Sign-in failed")
+	}
+	recordLogin(ctx, user.ID)
+	return back("token", token)
+}
+
+// ssoUser returns the account of a user signed in at the identity provider.
+// Users seen before are found by their identity there, and get the role
+// their groups map to now. Otherwise a chef or doctor account of the
+// identity's facility with the same, verified, email and the role their
+// groups map to is linked, or a new account is created in the facility from
+// the identity's claims. Linking never changes an account's facility or role.
+func ssoUser(ctx context.Context, identity *sso.Identity) (*models.User, error) {
+	if identity.Role == "" {
+		return nil, ssoError("Your account is not in a group allowed to use this application")
+	}
+	users := models.DB.Collection("users")
+
+	var user models.User
+	err := users.FindOne(ctx, bson.M{"oidcIssuer": identity.Issuer, "oidcSubject": identity.Subject}).Decode(&user)
+	if err == nil {
+		set := bson.M{}
+		if user.Role != identity.Role {
+			set["role"] = identity.Role
+		}
+		if identity.Name != "" && user.FullName != identity.Name {
+			set["fullName"] = identity.Name
+		}
+		if len(set) == 0 {
+			return &user, nil
+		}
+		if _, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": set}); err != nil {
+			return nil, err
+		}
+		if _, ok := set["role"]; ok {
+			auditSSO(ctx, "user.sso.role", &user, bson.M{"from": user.Role, "to": identity.Role})
+			user.Role = identity.Role
+		}
+		if name, ok := set["fullName"].(string); ok {
+			user.FullName = name
+		}
+		return &user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if identity.Email == "" {
+		return nil, ssoError("The identity provider did not share your email address")
+	}
+	facility, err := models.FacilityByCode(ctx, identity.Facility)
+	if err == mongo.ErrNoDocuments {
+		return nil, ssoError("Unknown facility " + identity.Facility)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fctx := models.WithFacility(ctx, facility.ID)
+
+	err = models.Scoped("users").FindOne(fctx, bson.M{"email": identity.Email}).Decode(&user)
+	if err == nil {
+		switch {
+		case user.Role != "chef" && user.Role != "doctor":
+			return nil, ssoError("An account with your email address already exists")
+		case user.UsesSSO():
+			return nil, ssoError("Your email address is linked to another single sign-on account")
+		case !identity.EmailVerified:
+			return nil, ssoError("An account with your email address already exists; it can only be linked once the identity provider has verified the address")
+		case user.Role != identity.Role:
+			return nil, ssoError("An account with your email address already exists with a different role; ask an administrator to link it")
+		}
+		_, err := models.Scoped("users").UpdateOne(fctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{
+			"oidcIssuer":  identity.Issuer,
+			"oidcSubject": identity.Subject,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		auditSSO(ctx, "user.sso.link", &user, bson.M{"issuer": identity.Issuer})
+		user.OIDCIssuer, user.OIDCSubject = identity.Issuer, identity.Subject
+		return &user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	// Accounts in other facilities are never linked, and their email cannot
+	// be reused.
+	if n, err := users.CountDocuments(ctx, bson.M{"email": identity.Email}); err != nil {
+		return nil, err
+	} else if n > 0 {
+		return nil, ssoError("An account with your email address already exists")
+	}
+
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
+	}
+	user = models.User{
+		ID:          primitive.NewObjectID(),
+		FullName:    name,
+		Email:       identity.Email,
+		Role:        identity.Role,
+		CreatedAt:   time.Now(),
+		Status:      models.UserActive,
+		OIDCIssuer:  identity.Issuer,
+		OIDCSubject: identity.Subject,
+	}
+	if _, err := models.Scoped("users").InsertOne(fctx, user); err != nil {
+		return nil, err
+	}
+	user.FacilityID = facility.ID
+	auditSSO(ctx, "user.sso.create", &user, bson.M{"issuer": identity.Issuer, "role": identity.Role})
+	return &user, nil
+}
+
+// auditSSO records a change single sign-on made to a user's account, as done
+// by the user.
+func auditSSO(ctx context.Context, action string, user *models.User, details bson.M) {
+	ctx = models.WithFacility(ctx, user.FacilityID)
+	if err := recordAudit(ctx, action, user.ID, user.ID, details); err != nil {
+		slog.ErrorContext(ctx, "Error recording single sign-on audit entry", "action", action, "userId", user.ID.Hex(), "error", err)
+	}
+}
@@ -0,0 +1,591 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"fracture-detection-webapp/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookRequest defines the payload for creating a webhook. The secret is
+// generated when left empty.
+type WebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// UpdateWebhookRequest defines the payload for a partial webhook update.
+// Fields left out of the JSON body are not modified.
+type UpdateWebhookRequest struct {
+	URL         *string   `json:"url"`
+	Events      *[]string `json:"events"`
+	Secret      *string   `json:"secret"` // "" generates a new secret
+	Description *string   `json:"description"`
+	Active      *bool     `json:"active"`
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks.
+type WebhookPayload struct {
+	ID         string      `json:"id"` // the event ID, the same for every webhook receiving the event
+	Event      string      `json:"event"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	FacilityID string      `json:"facilityId"`
+	Data       interface{} `json:"data"`
+}
+
+// WebhookReport is the report in the data of report events. Images are left
+// out; receivers fetch the PDF from the API if they need it.
+type WebhookReport struct {
+	ID           string     `json:"id"`
+	PatientID    string     `json:"patientId"`
+	PatientMRN   string     `json:"patientMrn,omitempty"`
+	DoctorID     string     `json:"doctorId"`
+	FractureType string     `json:"fractureType"`
+	RecoveryTime string     `json:"recoveryTime"`
+	Confidence   *float64   `json:"confidence,omitempty"`
+	Status       string     `json:"status"`
+	Version      int        `json:"version"`
+	SignedBy     string     `json:"signedBy,omitempty"`
+	SignedAt     *time.Time `json:"signedAt,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+// webhookTimeout bounds each delivery attempt. Receivers should answer
+// quickly and process the event asynchronously.
+const webhookTimeout = 10 * time.Second
+
+// webhookClient does not follow redirects: a 3xx is reported as a failure so
+// a moved endpoint is noticed and the subscription updated. It only connects
+// to public addresses, checked once host names are resolved so that DNS
+// cannot be used to get around it: chefs choose the URLs, and must not reach
+// the server's own network through them. No proxy is used, for the same
+// reason.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addr, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if !webhookAddressAllowed(addr.Addr()) {
+					return fmt.Errorf("%s is not a public address", addr.Addr())
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// nonPublicNetworks are ranges outside those netip.Addr already classifies
+// (loopback, link-local, private, multicast and unspecified) that are not
+// reachable on the internet either.
+var nonPublicNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, also used for cloud metadata
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+}
+
+// webhookAddressAllowed reports whether webhooks may connect to addr: a
+// public address, or one in the networks the operator allows.
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range settings.WebhookAllowedNetworks {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicNetworks {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeWebhookURL checks a webhook URL is an absolute http(s) URL. URLs
+// with a host name are checked again when delivering, once it is resolved.
+func normalizeWebhookURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("url must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return "", errors.New("url must not contain credentials; use the signature to authenticate requests")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !webhookAddressAllowed(addr) {
+		return "", errors.New("url must point to a public address")
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return "", errors.New("url must point to a public address")
+	}
+	return u.String(), nil
+}
+
+// normalizeWebhookEvents checks the event names and removes duplicates.
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("events is required, choose from %s", strings.Join(models.WebhookEvents, ", "))
+	}
+	out := make([]string, 0, len(events))
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if !slices.Contains(models.WebhookEvents, event) {
+			return nil, fmt.Errorf("unknown event %q, choose from %s", event, strings.Join(models.WebhookEvents, ", "))
+		}
+		if !slices.Contains(out, event) {
+			out = append(out, event)
+		}
+	}
+	return out, nil
+}
+
+// newWebhookSecret returns a random signing secret.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// signWebhook computes the X-Webhook-Signature header: the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the webhook secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// GetWebhooks lists the facility's webhooks.
+func GetWebhooks(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	webhooks := []models.Webhook{}
+	err := findAll(ctx, models.Scoped("webhooks"), bson.M{}, &webhooks,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch webhooks"})
+	}
+	return c.JSON(webhooks)
+}
+
+// CreateWebhook subscribes a URL to report events. The response holds the
+// signing secret, which is not shown again.
+func CreateWebhook(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	var req WebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	webhook := models.Webhook{
+		ID:          primitive.NewObjectID(),
+		Description: strings.TrimSpace(req.Description),
+		Secret:      req.Secret,
+		Active:      true,
+		CreatedBy:   chefID,
+		CreatedAt:   time.Now(),
+	}
+	if webhook.URL, err = normalizeWebhookURL(req.URL); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if webhook.Events, err = normalizeWebhookEvents(req.Events); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if webhook.Secret == "" {
+		if webhook.Secret, err = newWebhookSecret(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate secret"})
+		}
+	} else if len(webhook.Secret) < 16 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "secret must be at least 16 characters"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	if _, err := models.Scoped("webhooks").InsertOne(ctx, webhook); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create webhook"})
+	}
+	if err := recordAudit(ctx, "webhook.create", chefID, webhook.ID, bson.M{"url": webhook.URL, "events": webhook.Events}); err != nil {
+		slog.ErrorContext(ctx, "Error recording webhook creation", "webhookId", webhook.ID.Hex(), "error", err)
+	}
+	webhook.FacilityID, _ = models.FacilityFromContext(ctx)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"webhook": webhook, "secret": webhook.Secret})
+}
+
+// UpdateWebhook changes a webhook's URL, events, secret, description or
+// whether it is active. The response holds the secret only when it changed.
+func UpdateWebhook(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid webhook ID format"})
+	}
+	var req UpdateWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	set := bson.M{}
+	if req.URL != nil {
+		u, err := normalizeWebhookURL(*req.URL)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		set["url"] = u
+	}
+	if req.Events != nil {
+		events, err := normalizeWebhookEvents(*req.Events)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		set["events"] = events
+	}
+	secret := ""
+	if req.Secret != nil {
+		secret = *req.Secret
+		if secret == "" {
+			if secret, err = newWebhookSecret(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate secret"})
+			}
+		} else if len(secret) < 16 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "secret must be at least 16 characters"})
+		}
+		set["secret"] = secret
+	}
+	if req.Description != nil {
+		set["description"] = strings.TrimSpace(*req.Description)
+	}
+	if req.Active != nil {
+		set["active"] = *req.Active
+	}
+	if len(set) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No fields to update"})
+	}
+	set["updatedAt"] = time.Now()
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var updated models.Webhook
+	err = models.Scoped("webhooks").FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Webhook not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update webhook"})
+	}
+	fields := make([]string, 0, len(set))
+	for field := range set {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	if err := recordAudit(ctx, "webhook.update", chefID, id, bson.M{"fields": fields}); err != nil {
+		slog.ErrorContext(ctx, "Error recording webhook update", "webhookId", id.Hex(), "error", err)
+	}
+
+	if secret != "" {
+		return c.JSON(fiber.Map{"webhook": updated, "secret": secret})
+	}
+	return c.JSON(fiber.Map{"webhook": updated})
+}
+
+// DeleteWebhook removes a webhook along with its delivery log.
+func DeleteWebhook(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid webhook ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	res, err := models.Scoped("webhooks").DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete webhook"})
+	}
+	if res.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Webhook not found"})
+	}
+	if _, err := models.Scoped("webhook_deliveries").DeleteMany(ctx, bson.M{"webhookId": id}); err != nil {
+		slog.ErrorContext(ctx, "Error deleting webhook deliveries", "webhookId", id.Hex(), "error", err)
+	}
+	if err := recordAudit(ctx, "webhook.delete", chefID, id, nil); err != nil {
+		slog.ErrorContext(ctx, "Error recording webhook deletion", "webhookId", id.Hex(), "error", err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the delivery log of a webhook, newest first.
+// ?status= filters by status, e.g. "dead".
+func GetWebhookDeliveries(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid webhook ID format"})
+	}
+	filter := bson.M{"webhookId": id}
+	switch status := c.Query("status"); status {
+	case "":
+	case models.NotificationQueued, models.NotificationSending, models.NotificationSent, models.NotificationFailed, models.NotificationDead:
+		filter["status"] = status
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid status"})
+	}
+	limit := int64(c.QueryInt("limit", 100))
+	if limit < 1 || limit > 500 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 500"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	if count, err := models.Scoped("webhooks").CountDocuments(ctx, bson.M{"_id": id}); err != nil || count == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Webhook not found"})
+	}
+	deliveries := []models.WebhookDelivery{}
+	err = findAll(ctx, models.Scoped("webhook_deliveries"), filter, &deliveries,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch deliveries"})
+	}
+	return c.JSON(deliveries)
+}
+
+// ReplayWebhookDelivery queues a failed or dead delivery again. It is sent
+// with the same payload and event ID, signed with the webhook's current
+// secret.
+func ReplayWebhookDelivery(c *fiber.Ctx) error {
+	chefID, _, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid delivery ID format"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	delivery, err := models.ReplayWebhookDelivery(ctx, id, chefID)
+	if errors.Is(err, models.ErrNotRetryable) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Delivery not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to replay delivery"})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(delivery)
+}
+
+// webhookReport builds the event data of a report.
+func webhookReport(ctx context.Context, report *models.Report) WebhookReport {
+	out := WebhookReport{
+		ID:           report.ID.Hex(),
+		PatientID:    report.PatientID.Hex(),
+		DoctorID:     report.DoctorID.Hex(),
+		FractureType: report.FractureType,
+		RecoveryTime: report.RecoveryTime,
+		Confidence:   report.Confidence,
+		Status:       report.Status,
+		Version:      max(report.Version, 1),
+		SignedAt:     report.SignedAt,
+		CreatedAt:    report.CreatedAt,
+	}
+	if out.Status == "" {
+		out.Status = models.ReportDraft
+	}
+	if !report.SignedBy.IsZero() {
+		out.SignedBy = report.SignedBy.Hex()
+	}
+	var patient models.Patient
+	if err := models.Scoped("patients").FindOne(ctx, bson.M{"_id": report.PatientID}).Decode(&patient); err == nil {
+		out.PatientMRN = patient.MRN
+	}
+	return out
+}
+
+// emitReportEvent queues an event about a report for every active webhook
+// of the facility subscribed to it. Failures are logged: webhooks never make
+// the request that triggered them fail.
+func emitReportEvent(ctx context.Context, event string, report *models.Report) {
+	facilityID, _ := models.FacilityFromContext(ctx)
+	eventID := primitive.NewObjectID().Hex()
+	payload, err := json.Marshal(WebhookPayload{
+		ID:         eventID,
+		Event:      event,
+		CreatedAt:  time.Now().UTC(),
+		FacilityID: facilityID.Hex(),
+		Data:       fiber.Map{"report": webhookReport(ctx, report)},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding webhook event", "event", event, "reportId", report.ID.Hex(), "error", err)
+		return
+	}
+	if err := queueWebhookEvent(ctx, event, eventID, payload); err != nil {
+		slog.ErrorContext(ctx, "Error queueing webhook event", "event", event, "reportId", report.ID.Hex(), "error", err)
+	}
+}
+
+// queueWebhookEvent creates a delivery of an encoded WebhookPayload for each
+// subscribed webhook.
+func queueWebhookEvent(ctx context.Context, event, eventID string, payload []byte) error {
+	var webhooks []models.Webhook
+	if err := findAll(ctx, models.Scoped("webhooks"), bson.M{"active": true, "events": event}, &webhooks); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, webhook := range webhooks {
+		_, err := models.Scoped("webhook_deliveries").InsertOne(ctx, models.WebhookDelivery{
+			ID:            primitive.NewObjectID(),
+			WebhookID:     webhook.ID,
+			EventID:       eventID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        models.NotificationQueued,
+			MaxAttempts:   models.DefaultWebhookAttempts,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunWebhookWorker delivers queued webhook events until ctx is done. Like
+// RunNotificationWorker, it can run on several servers at once.
+func RunWebhookWorker(ctx context.Context) {
+	pollOutbox(ctx, "webhook delivery", func(ctx context.Context) error {
+		d, err := models.ClaimWebhookDelivery(ctx)
+		if err != nil {
+			return err
+		}
+		processWebhookDelivery(ctx, d)
+		return nil
+	})
+}
+
+// processWebhookDelivery makes one delivery attempt and records its outcome.
+func processWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) {
+	attempt, permanent := sendWebhook(models.WithFacility(ctx, d.FacilityID), d)
+	if attempt.Error != "" {
+		slog.WarnContext(ctx, "Webhooks: delivery failed", "deliveryId", d.ID.Hex(), "attempt", d.Attempts, "maxAttempts", d.MaxAttempts, "error", attempt.Error)
+	}
+	if err := models.CompleteWebhookDelivery(ctx, d, attempt, permanent); err != nil {
+		slog.ErrorContext(ctx, "Webhooks: recording the outcome of a delivery failed", "deliveryId", d.ID.Hex(), "error", err)
+	}
+}
+
+// sendWebhook POSTs a delivery's payload to its webhook. Any 2xx response
+// is a success. It reports whether a failure is permanent, which is only the
+// case when the webhook no longer exists or was disabled.
+func sendWebhook(ctx context.Context, d *models.WebhookDelivery) (models.WebhookAttempt, bool) {
+	attempt := models.WebhookAttempt{At: time.Now()}
+
+	var webhook models.Webhook
+	err := models.Scoped("webhooks").FindOne(ctx, bson.M{"_id": d.WebhookID}).Decode(&webhook)
+	if err == mongo.ErrNoDocuments {
+		attempt.Error = "webhook was deleted"
+		return attempt, true
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	if !webhook.Active {
+		attempt.Error = "webhook is disabled"
+		return attempt, true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, true
+	}
+	timestamp := strconv.FormatInt(attempt.At.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Fracture-Detection-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Id", webhook.ID.Hex())
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID.Hex())
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	attempt.Duration = time.Since(attempt.At).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	defer resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		attempt.Error = fmt.Sprintf("receiver returned %d", resp.StatusCode)
+		if s := strings.TrimSpace(string(snippet)); s != "" {
+			attempt.Error += ": " + s
+		}
+	}
+	return attempt, false
+}
@@ -0,0 +1,93 @@
+package hl7
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Patient messages handled by the listener.
+const (
+	ADTRegister = "ADT^A04" // register a patient
+	ADTUpdate   = "ADT^A08" // update patient information
+)
+
+// PatientData is the demographics of a PID segment. Empty fields were not
+// sent, and are left unchanged on an existing patient.
+type PatientData struct {
+	MRN         string
+	FullName    string
+	DateOfBirth *time.Time
+	Sex         string // HL7 table 0001: "M", "F", "O", "U", ...
+	Phone       string
+	Email       string
+}
+
+// ErrNoMRN is returned for a PID segment without a medical record number.
+var ErrNoMRN = errors.New("PID-3 has no medical record number")
+
+// ParsePID reads the demographics of the PID segment of a message. The MRN
+// is the PID-3 identifier of type MR, or the first one if none has a type.
+func ParsePID(m *Message) (PatientData, error) {
+	pid := m.Segment("PID")
+	if pid == nil {
+		return PatientData{}, errors.New("message has no PID segment")
+	}
+	var p PatientData
+	for i, id := range pid.Repetitions(3) {
+		if Component(id, 5) == "MR" || (i == 0 && Component(id, 5) == "") {
+			p.MRN = Component(id, 1)
+		}
+	}
+	if p.MRN == "" {
+		return p, ErrNoMRN
+	}
+
+	// PID-5 is family^given^middle^suffix^prefix.
+	name := []string{
+		Component(pid.Field(5), 2),
+		Component(pid.Field(5), 3),
+		Component(pid.Field(5), 1),
+	}
+	p.FullName = strings.Join(strings.Fields(strings.Join(name, " ")), " ")
+
+	if dob := pid.Field(7); dob != "" {
+		t, err := ParseDate(dob)
+		if err != nil {
+			return p, err
+		}
+		p.DateOfBirth = &t
+	}
+	p.Sex = pid.Component(8, 1)
+
+	for _, tel := range append(pid.Repetitions(13), pid.Repetitions(14)...) {
+		switch {
+		case Component(tel, 3) == "Internet" || Component(tel, 2) == "NET":
+			if p.Email == "" {
+				p.Email = Component(tel, 4)
+			}
+		case p.Phone == "":
+			p.Phone = Component(tel, 1)
+			if p.Phone == "" {
+				p.Phone = Component(tel, 12)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Sex maps an HL7 sex code onto the application's values, or "" for codes
+// it has no equivalent for.
+func Sex(code string) string {
+	switch strings.ToUpper(code) {
+	case "M":
+		return "male"
+	case "F":
+		return "female"
+	case "O", "A", "N":
+		return "other"
+	case "U":
+		return "unknown"
+	}
+	return ""
+}
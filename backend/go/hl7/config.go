@@ -0,0 +1,75 @@
+package hl7
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config describes the HL7 interfaces of the server. Patients are only
+// received when Listen is set. Where each facility's results are sent is
+// part of the facility, as models.FacilityHL7.
+type Config struct {
+	Listen  string        `yaml:"listen"` // address of the MLLP listener for ADT messages; loopback unless a host is given
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultConfig is used for anything not set in the environment or the
+// config file.
+var DefaultConfig = Config{Timeout: 30 * time.Second}
+
+// ConfigFromEnv overrides cfg with HL7_MLLP_LISTEN, where it is set. A listen
+// address without a host, such as ":2576", is bound to loopback: MLLP has no
+// authentication or encryption, so exposing the listener beyond the host
+// takes naming the interface.
+func ConfigFromEnv(cfg Config) (Config, error) {
+	// A single receiver for every facility would send each facility's
+	// results to the same system.
+	for _, key := range []string{"HL7_MLLP_ADDR", "HL7_RECEIVING_APPLICATION", "HL7_RECEIVING_FACILITY"} {
+		if os.Getenv(key) != "" {
+			return cfg, fmt.Errorf("%s is no longer used: set each facility's result receiver with PUT /api/admin/facilities/:id/hl7", key)
+		}
+	}
+	if v := os.Getenv("HL7_MLLP_LISTEN"); v != "" {
+		cfg.Listen = v
+	}
+	if host, port, err := net.SplitHostPort(cfg.Listen); err == nil && host == "" {
+		cfg.Listen = net.JoinHostPort("127.0.0.1", port)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the listen address.
+func (c Config) Validate() error {
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("invalid HL7 listen address %q", c.Listen)
+		}
+	}
+	return nil
+}
+
+var (
+	configMu sync.RWMutex
+	config   = DefaultConfig
+)
+
+// Configure installs the configuration returned by Current.
+func Configure(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	configMu.Lock()
+	config = cfg
+	configMu.Unlock()
+	return nil
+}
+
+// Current returns the configuration installed with Configure.
+func Current() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
@@ -0,0 +1,397 @@
+// Package hl7 speaks HL7 v2 with older hospital systems: it builds ORU^R01
+// result messages for signed reports, reads ADT^A04/A08 patient messages,
+// and carries both over MLLP.
+//
+// Only the default encoding characters (|^~\&) are supported, which is what
+// every system the application is used with sends.
+package hl7
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the HL7 version of the messages sent.
+const Version = "2.5.1"
+
+// Application is the sending application of the messages sent, MSH-3.
+const Application = "FRACTURE-DETECTION"
+
+const (
+	fieldSep      = '|'
+	componentSep  = '^'
+	repeatSep     = '~'
+	escapeChar    = '\\'
+	subSep        = '&'
+	encodingChars = `^~\&`
+	segmentSep    = '\r'
+)
+
+// timestampLayout is the layout of HL7 date/times (DTM) to the second.
+const timestampLayout = "20060102150405"
+
+// Timestamp formats a time as an HL7 date/time.
+func Timestamp(t time.Time) string {
+	return t.Format(timestampLayout)
+}
+
+// ParseDate parses an HL7 date or date/time, of which only the date is kept.
+func ParseDate(s string) (time.Time, error) {
+	if len(s) < 8 {
+		return time.Time{}, fmt.Errorf("invalid HL7 date %q", s)
+	}
+	return time.Parse("20060102", s[:8])
+}
+
+// Segment is a segment of a message: its name, then its fields, still
+// escaped, numbered as in the HL7 specification. For MSH, field 1 is the
+// field separator and field 2 the encoding characters.
+type Segment []string
+
+// NewSegment returns an empty segment.
+func NewSegment(name string) Segment {
+	if name == "MSH" {
+		return Segment{"MSH", string(fieldSep), encodingChars}
+	}
+	return Segment{name}
+}
+
+// Name returns the segment name, such as "PID".
+func (s Segment) Name() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
+// Field returns field i, escaped and with its components and repetitions.
+func (s Segment) Field(i int) string {
+	if i <= 0 || i >= len(s) {
+		return ""
+	}
+	return s[i]
+}
+
+// Repetitions returns the repetitions of field i, still escaped.
+func (s Segment) Repetitions(i int) []string {
+	f := s.Field(i)
+	if f == "" {
+		return nil
+	}
+	return strings.Split(f, string(repeatSep))
+}
+
+// Component returns component j of the first repetition of field i,
+// unescaped. Components are numbered from 1.
+func (s Segment) Component(i, j int) string {
+	reps := s.Repetitions(i)
+	if len(reps) == 0 {
+		return ""
+	}
+	return Component(reps[0], j)
+}
+
+// Component returns component j, numbered from 1, of an escaped field or
+// repetition, unescaped.
+func Component(field string, j int) string {
+	comps := strings.Split(field, string(componentSep))
+	if j <= 0 || j > len(comps) {
+		return ""
+	}
+	// Subcomponents are not used by the application; keep the first.
+	comp, _, _ := strings.Cut(comps[j-1], string(subSep))
+	return Unescape(comp)
+}
+
+// Set sets field i to an already encoded value, such as one built with
+// Components, growing the segment as needed.
+func (s *Segment) Set(i int, value string) {
+	for len(*s) <= i {
+		*s = append(*s, "")
+	}
+	(*s)[i] = value
+}
+
+// SetText sets field i to a plain value, escaping it.
+func (s *Segment) SetText(i int, value string) {
+	s.Set(i, Escape(value))
+}
+
+func (s Segment) encode() string {
+	fields := []string(s)
+	if s.Name() == "MSH" && len(fields) > 1 {
+		// MSH-1 is the separator between the name and MSH-2.
+		fields = append([]string{"MSH"}, fields[2:]...)
+	}
+	return strings.Join(trimEmpty(fields), string(fieldSep))
+}
+
+// Components escapes and joins the components of a field, leaving out
+// trailing empty ones.
+func Components(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = Escape(p)
+	}
+	return strings.Join(trimEmpty(escaped), string(componentSep))
+}
+
+// Repeat joins the repetitions of a field, leaving out empty ones.
+func Repeat(reps ...string) string {
+	var kept []string
+	for _, r := range reps {
+		if r != "" {
+			kept = append(kept, r)
+		}
+	}
+	return strings.Join(kept, string(repeatSep))
+}
+
+func trimEmpty(parts []string) []string {
+	for len(parts) > 1 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return parts
+}
+
+var escaper = strings.NewReplacer(
+	`\`, `\E\`,
+	"|", `\F\`,
+	"^", `\S\`,
+	"~", `\R\`,
+	"&", `\T\`,
+	"\r", `\X0D\`,
+	"\n", `\X0A\`,
+)
+
+// Escape escapes the delimiters in a text value.
+func Escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// Unescape replaces the escape sequences of a value with what they stand
+// for. Formatting sequences, such as \.br\, are dropped.
+func Unescape(s string) string {
+	if !strings.ContainsRune(s, escapeChar) {
+		return s
+	}
+	var b strings.Builder
+	for {
+		start := strings.IndexRune(s, escapeChar)
+		if start < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := strings.IndexRune(s[start+1:], escapeChar)
+		if end < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:start])
+		seq := s[start+1 : start+1+end]
+		switch {
+		case seq == "F":
+			b.WriteRune(fieldSep)
+		case seq == "S":
+			b.WriteRune(componentSep)
+		case seq == "R":
+			b.WriteRune(repeatSep)
+		case seq == "T":
+			b.WriteRune(subSep)
+		case seq == "E":
+			b.WriteRune(escapeChar)
+		case strings.HasPrefix(seq, "X"):
+			for hex := seq[1:]; len(hex) >= 2; hex = hex[2:] {
+				if c, err := strconv.ParseUint(hex[:2], 16, 8); err == nil {
+					b.WriteByte(byte(c))
+				}
+			}
+		}
+		s = s[start+2+end:]
+	}
+}
+
+// Message is an HL7 v2 message.
+type Message struct {
+	Segments []Segment
+}
+
+// ErrNotHL7 is returned when parsing data that does not start with an MSH
+// segment.
+var ErrNotHL7 = errors.New("not an HL7 v2 message")
+
+// Parse parses a message. Segments may be separated by CR, LF or CRLF.
+func Parse(data []byte) (*Message, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\r")
+	text = strings.ReplaceAll(text, "\n", "\r")
+	if !strings.HasPrefix(text, "MSH") || len(text) < 8 {
+		return nil, ErrNotHL7
+	}
+	if text[3] != fieldSep || text[4:8] != encodingChars {
+		return nil, errors.New("unsupported HL7 encoding characters")
+	}
+	m := &Message{}
+	for _, line := range strings.Split(text, string(segmentSep)) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		seg := Segment(strings.Split(line, string(fieldSep)))
+		if seg.Name() == "MSH" {
+			seg = append(Segment{"MSH", string(fieldSep)}, seg[1:]...)
+		}
+		m.Segments = append(m.Segments, seg)
+	}
+	return m, nil
+}
+
+// Bytes encodes the message, with a CR after every segment.
+func (m *Message) Bytes() []byte {
+	var b strings.Builder
+	for _, s := range m.Segments {
+		b.WriteString(s.encode())
+		b.WriteRune(segmentSep)
+	}
+	return []byte(b.String())
+}
+
+// String encodes the message with line breaks between segments, for logs.
+func (m *Message) String() string {
+	return strings.TrimSpace(strings.ReplaceAll(string(m.Bytes()), "\r", "\n"))
+}
+
+// Add appends segments to the message.
+func (m *Message) Add(segments ...Segment) {
+	m.Segments = append(m.Segments, segments...)
+}
+
+// Segment returns the first segment with the given name, or nil.
+func (m *Message) Segment(name string) Segment {
+	for _, s := range m.Segments {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Header returns the MSH segment.
+func (m *Message) Header() Segment {
+	return m.Segment("MSH")
+}
+
+// Type returns the message type and trigger event, such as "ADT^A04".
+func (m *Message) Type() string {
+	msh := m.Header()
+	return msh.Component(9, 1) + "^" + msh.Component(9, 2)
+}
+
+// ControlID returns the message control ID, MSH-10.
+func (m *Message) ControlID() string {
+	return Unescape(m.Header().Field(10))
+}
+
+// Endpoint is one end of an exchange, as named in the MSH segment.
+type Endpoint struct {
+	Application string `yaml:"application"`
+	Facility    string `yaml:"facility"`
+}
+
+// NewMessage starts a message of the given type, such as "ORU^R01^ORU_R01",
+// with its MSH segment.
+func NewMessage(msgType, controlID string, from, to Endpoint, at time.Time) *Message {
+	msh := NewSegment("MSH")
+	msh.Set(3, Components(from.Application))
+	msh.Set(4, Components(from.Facility))
+	msh.Set(5, Components(to.Application))
+	msh.Set(6, Components(to.Facility))
+	msh.Set(7, Timestamp(at))
+	msh.Set(9, msgType)
+	msh.SetText(10, controlID)
+	msh.Set(11, "P")
+	msh.Set(12, Version)
+	return &Message{Segments: []Segment{msh}}
+}
+
+// Acknowledgment codes, MSA-1.
+const (
+	AckAccept = "AA" // processed
+	AckError  = "AE" // failed; sending again may work
+	AckReject = "AR" // refused; sending the same message again will not work
+)
+
+// Ack builds the acknowledgment of a message with the given code and,
+// for errors, a description. m may be nil when the message could not be
+// parsed.
+func Ack(m *Message, code, text string) *Message {
+	from, to := Endpoint{Application: Application}, Endpoint{}
+	var controlID, version string
+	if m != nil {
+		msh := m.Header()
+		// Answer from the application the message was sent to.
+		from = Endpoint{Application: msh.Component(5, 1), Facility: msh.Component(6, 1)}
+		to = Endpoint{Application: msh.Component(3, 1), Facility: msh.Component(4, 1)}
+		if from.Application == "" {
+			from.Application = Application
+		}
+		controlID = m.ControlID()
+		version = msh.Field(12)
+	}
+	ackType := "ACK"
+	if m != nil {
+		ackType = Components("ACK", m.Header().Component(9, 2), "ACK")
+	}
+	ack := NewMessage(ackType, "ACK"+strconv.FormatInt(time.Now().UnixNano(), 36), from, to, time.Now())
+	if version != "" {
+		ack.Segments[0].Set(12, version)
+	}
+	msa := NewSegment("MSA")
+	msa.Set(1, code)
+	msa.SetText(2, controlID)
+	msa.SetText(3, text)
+	ack.Add(msa)
+	return ack
+}
+
+// NegativeAck is a negative acknowledgment.
+type NegativeAck struct {
+	Code string // AckError or AckReject, or their commit-level equivalents
+	Text string
+}
+
+func (e *NegativeAck) Error() string {
+	if e.Text == "" {
+		return "HL7 receiver answered " + e.Code
+	}
+	return fmt.Sprintf("HL7 receiver answered %s: %s", e.Code, e.Text)
+}
+
+// Permanent reports whether the receiver rejected the message itself, so
+// that sending it again cannot succeed.
+func (e *NegativeAck) Permanent() bool {
+	return e.Code == AckReject || e.Code == "CR"
+}
+
+// CheckAck checks that ack acknowledges the message with the given control
+// ID positively. A negative acknowledgment is returned as a *NegativeAck.
+func CheckAck(ack *Message, controlID string) error {
+	msa := ack.Segment("MSA")
+	if msa == nil {
+		return errors.New("HL7 acknowledgment has no MSA segment")
+	}
+	if got := msa.Component(2, 1); got != controlID {
+		return fmt.Errorf("HL7 acknowledgment is for message %q, not %q", got, controlID)
+	}
+	switch code := msa.Component(1, 1); code {
+	case AckAccept, "CA":
+		return nil
+	default:
+		text := msa.Component(3, 1)
+		if err := ack.Segment("ERR"); text == "" && err != nil {
+			text = err.Component(8, 1) // ERR-8, user message
+		}
+		return &NegativeAck{Code: code, Text: text}
+	}
+}
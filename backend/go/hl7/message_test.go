@@ -0,0 +1,195 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscape(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"Doe",
+		`O|Brien^Jr~&co\`,
+		"line one\r\nline two",
+		"\\E\\ already escaped",
+	} {
+		escaped := Escape(s)
+		if strings.ContainsAny(escaped, "|^~&\r\n") {
+			t.Errorf("Escape(%q) = %q, still holds a delimiter", s, escaped)
+		}
+		if got := Unescape(escaped); got != s {
+			t.Errorf("Unescape(Escape(%q)) = %q", s, got)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for in, want := range map[string]string{
+		`a\F\b`:       "a|b",
+		`\S\\R\\T\`:   "^~&",
+		`x\X0D0A\y`:   "x\r\ny",
+		`one\.br\two`: "onetwo",
+		`trailing\`:   `trailing\`,
+		`\E`:          `\E`,
+	} {
+		if got := Unescape(in); got != want {
+			t.Errorf("Unescape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, sep := range []string{"\r", "\n", "\r\n"} {
+		data := strings.Join([]string{
+			`MSH|^~\&|HIS|GENERAL|FRACTURE-DETECTION|RADIOLOGY|20240301120000||ADT^A04^ADT_A01|MSG1|P|2.5.1`,
+			`PID|1||12345^^^GENERAL^MR||Doe^Jane||19800229|F`,
+			"",
+		}, sep)
+		m, err := Parse([]byte(data))
+		if err != nil {
+			t.Fatalf("separator %q: %v", sep, err)
+		}
+		if len(m.Segments) != 2 {
+			t.Fatalf("separator %q: %d segments", sep, len(m.Segments))
+		}
+		if got := m.Type(); got != "ADT^A04" {
+			t.Errorf("type = %q", got)
+		}
+		if got := m.ControlID(); got != "MSG1" {
+			t.Errorf("control ID = %q", got)
+		}
+		if got := m.Header().Component(4, 1); got != "GENERAL" {
+			t.Errorf("MSH-4 = %q", got)
+		}
+		if got := m.Segment("PID").Component(5, 2); got != "Jane" {
+			t.Errorf("PID-5.2 = %q", got)
+		}
+		if again, err := Parse(m.Bytes()); err != nil || again.String() != m.String() {
+			t.Errorf("re-parsing %q: %v", m.Bytes(), err)
+		}
+	}
+
+	if _, err := Parse([]byte("PID|1")); !errors.Is(err, ErrNotHL7) {
+		t.Errorf("err = %v, want not HL7", err)
+	}
+	if _, err := Parse([]byte("MSH|^~")); !errors.Is(err, ErrNotHL7) {
+		t.Errorf("short header: err = %v, want not HL7", err)
+	}
+	if _, err := Parse([]byte("MSH|*~\\&|HIS")); err == nil {
+		t.Error("parsed other encoding characters")
+	}
+}
+
+func TestAck(t *testing.T) {
+	msg := NewMessage("ADT^A04^ADT_A01", "MSG|1",
+		Endpoint{Application: "HIS", Facility: "GENERAL"},
+		Endpoint{Application: "PACS", Facility: "RADIOLOGY"}, time.Now())
+
+	ack := Ack(msg, AckAccept, "")
+	msh := ack.Header()
+	if got := msh.Component(3, 1) + "/" + msh.Component(4, 1); got != "PACS/RADIOLOGY" {
+		t.Errorf("ack sent from %q", got)
+	}
+	if got := msh.Component(5, 1) + "/" + msh.Component(6, 1); got != "HIS/GENERAL" {
+		t.Errorf("ack sent to %q", got)
+	}
+	if got := ack.Type(); got != "ACK^A04" {
+		t.Errorf("ack type = %q", got)
+	}
+	if err := CheckAck(ack, "MSG|1"); err != nil {
+		t.Errorf("accepting ack: %v", err)
+	}
+	if err := CheckAck(ack, "MSG2"); err == nil {
+		t.Error("ack accepted for another message")
+	}
+
+	var nak *NegativeAck
+	err := CheckAck(Ack(msg, AckReject, "Unknown facility"), "MSG|1")
+	if !errors.As(err, &nak) || nak.Code != AckReject || nak.Text != "Unknown facility" || !nak.Permanent() {
+		t.Errorf("rejecting ack: %v", err)
+	}
+	err = CheckAck(Ack(msg, AckError, ""), "MSG|1")
+	if !errors.As(err, &nak) || nak.Permanent() {
+		t.Errorf("error ack: %v", err)
+	}
+
+	// A message that could not be parsed is still answered.
+	if got := Ack(nil, AckReject, "Not HL7").Segment("MSA").Field(1); got != AckReject {
+		t.Errorf("ack of nothing = %q", got)
+	}
+	if err := CheckAck(&Message{Segments: []Segment{NewSegment("MSH")}}, "MSG1"); err == nil {
+		t.Error("ack without MSA accepted")
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("noise")
+	WriteFrame(&b, []byte("first"))
+	WriteFrame(&b, []byte("second"))
+	r := bufio.NewReader(&b)
+	for _, want := range []string{"first", "second"} {
+		got, err := ReadFrame(r)
+		if err != nil || string(got) != want {
+			t.Errorf("frame = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: err = %v, want EOF", err)
+	}
+
+	var frame bytes.Buffer
+	WriteFrame(&frame, []byte("MSH|^~\\&|HIS"))
+	full := frame.Bytes()
+	for n := 1; n < len(full)-1; n++ {
+		if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(full[:n]))); err != io.ErrUnexpectedEOF {
+			t.Errorf("frame cut at %d bytes: err = %v, want unexpected EOF", n, err)
+		}
+	}
+
+	huge := append([]byte{startBlock}, bytes.Repeat([]byte("x"), MaxMessageSize+1)...)
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(huge))); err == nil || err == io.ErrUnexpectedEOF {
+		t.Errorf("oversized frame: err = %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, ln, func(ctx context.Context, remote net.Addr, msg *Message) *Message {
+			if msg.Header().Component(4, 1) != "GENERAL" {
+				return Ack(msg, AckReject, "Unknown facility")
+			}
+			return Ack(msg, AckAccept, "")
+		})
+	}()
+
+	sctx, scancel := context.WithTimeout(ctx, 5*time.Second)
+	defer scancel()
+	msg := NewMessage("ADT^A08^ADT_A01", "MSG1", Endpoint{Application: "HIS", Facility: "GENERAL"}, Endpoint{}, time.Now())
+	if _, err := Send(sctx, ln.Addr().String(), msg); err != nil {
+		t.Errorf("sending: %v", err)
+	}
+	msg = NewMessage("ADT^A08^ADT_A01", "MSG2", Endpoint{Application: "HIS", Facility: "ELSEWHERE"}, Endpoint{}, time.Now())
+	var nak *NegativeAck
+	if _, err := Send(sctx, ln.Addr().String(), msg); !errors.As(err, &nak) || nak.Code != AckReject {
+		t.Errorf("sending from an unknown facility: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("serving: %v", err)
+	}
+}
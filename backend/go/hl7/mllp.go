@@ -0,0 +1,168 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// MLLP frames each message between a start block and an end block followed
+// by a carriage return.
+const (
+	startBlock = 0x0b
+	endBlock   = 0x1c
+)
+
+// MaxMessageSize bounds the messages read, so a peer that never sends an end
+// block cannot exhaust memory.
+const MaxMessageSize = 1 << 20
+
+// idleTimeout is how long the listener keeps a quiet connection open.
+const idleTimeout = 5 * time.Minute
+
+// WriteFrame writes a message in an MLLP frame.
+func WriteFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 0, len(msg)+3)
+	frame = append(frame, startBlock)
+	frame = append(frame, msg...)
+	frame = append(frame, endBlock, '\r')
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads the next MLLP frame and returns the message in it. Bytes
+// before the start block are skipped.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+	var msg bytes.Buffer
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == endBlock {
+			if next, err := r.ReadByte(); err == nil && next != '\r' {
+				r.UnreadByte()
+			}
+			return msg.Bytes(), nil
+		}
+		if msg.Len() >= MaxMessageSize {
+			return nil, fmt.Errorf("HL7 message larger than %d bytes", MaxMessageSize)
+		}
+		msg.WriteByte(b)
+	}
+}
+
+// Send delivers a message to an MLLP receiver at addr (host:port) and
+// returns its acknowledgment, checked with CheckAck. The whole exchange is
+// bounded by ctx.
+func Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := WriteFrame(conn, msg.Bytes()); err != nil {
+		return nil, err
+	}
+	data, err := ReadFrame(bufio.NewReader(conn))
+	if err != nil {
+		return nil, fmt.Errorf("reading HL7 acknowledgment: %w", err)
+	}
+	ack, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading HL7 acknowledgment: %w", err)
+	}
+	return ack, CheckAck(ack, msg.ControlID())
+}
+
+// Handler processes an incoming message, received from remote, and returns
+// its acknowledgment.
+type Handler func(ctx context.Context, remote net.Addr, msg *Message) *Message
+
+// ListenAndServe accepts MLLP connections on addr and answers every message
+// with the acknowledgment returned by h, until ctx is done.
+func ListenAndServe(ctx context.Context, addr string, h Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, ln, h)
+}
+
+// Serve is ListenAndServe on an existing listener, which it closes.
+func Serve(ctx context.Context, ln net.Listener, h Handler) error {
+	var wg sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveConn(ctx, conn, h)
+		}()
+	}
+}
+
+// serveConn answers the messages of one connection in order.
+func serveConn(ctx context.Context, conn net.Conn, h Handler) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for ctx.Err() == nil {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		data, err := ReadFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				slog.WarnContext(ctx, "HL7: reading failed", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		var ack *Message
+		if msg, err := Parse(data); err != nil {
+			ack = Ack(nil, AckReject, err.Error())
+		} else {
+			ack = h(ctx, conn.RemoteAddr(), msg)
+		}
+		if err := WriteFrame(conn, ack.Bytes()); err != nil {
+			slog.WarnContext(ctx, "HL7: answering failed", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+	}
+}
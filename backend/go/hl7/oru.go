@@ -0,0 +1,156 @@
+package hl7
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+)
+
+// Result is what an ORU^R01 message reports: a signed report, with the
+// patient, reporting doctor and facility it belongs to.
+type Result struct {
+	Facility models.Facility
+	Patient  models.Patient
+	Doctor   models.User // who signed the report
+	Report   models.Report
+}
+
+// Codes of the OBX observations, in the local coding system "L". They are
+// the codes of the same findings in the FHIR API.
+const (
+	codingSystem     = "L"
+	codeFractureType = "fracture-type"
+	codeConfidence   = "fracture-confidence"
+	codeRecoveryTime = "recovery-time"
+)
+
+// ORU builds the ORU^R01 message reporting a result. The report's ID is the
+// filler order number (OBR-3), so receivers can match corrections.
+func ORU(controlID string, to Endpoint, res Result, at time.Time) *Message {
+	from := Endpoint{Application: Application, Facility: res.Facility.Code}
+	m := NewMessage(Components("ORU", "R01", "ORU_R01"), controlID, from, to, at)
+	m.Add(PID(res.Patient, res.Facility.Code))
+
+	r := res.Report
+	status := "P" // preliminary
+	if r.IsSigned() {
+		status = "F"
+		if r.Version > 1 {
+			status = "C" // corrected
+		}
+	}
+	observed := Timestamp(r.CreatedAt)
+	released := observed
+	if r.SignedAt != nil {
+		released = Timestamp(*r.SignedAt)
+	}
+	doctor := xcn(res.Doctor)
+
+	obr := NewSegment("OBR")
+	obr.Set(1, "1")
+	obr.Set(3, Components(r.ID.Hex(), Application))
+	obr.Set(4, Components("18748-4", "Diagnostic imaging study", "LN"))
+	obr.Set(7, observed)
+	obr.Set(16, doctor)   // ordering provider
+	obr.Set(22, released) // results reported
+	obr.Set(24, "RAD")
+	obr.Set(25, status)
+	obr.Set(32, doctor) // principal result interpreter
+	m.Add(obr)
+
+	set := 0
+	obx := func(valueType, code, name, value, units string) Segment {
+		set++
+		s := NewSegment("OBX")
+		s.Set(1, strconv.Itoa(set))
+		s.Set(2, valueType)
+		s.Set(3, Components(code, name, codingSystem))
+		s.Set(5, value)
+		s.Set(6, units)
+		s.Set(11, status)
+		s.Set(14, observed)
+		return s
+	}
+
+	finding := "No fracture detected"
+	if r.FractureType != "" {
+		finding = r.FractureType
+	}
+	m.Add(obx("ST", codeFractureType, "Fracture type", Escape(finding), ""))
+	if r.Comments != "" {
+		nte := NewSegment("NTE")
+		nte.Set(1, "1")
+		nte.SetText(3, r.Comments)
+		m.Add(nte)
+	}
+	if r.Confidence != nil {
+		percent := strconv.FormatFloat(*r.Confidence*100, 'f', 1, 64)
+		m.Add(obx("NM", codeConfidence, "Fracture detection confidence", percent, Components("%", "percent", "UCUM")))
+	}
+	if days, ok := r.RecoveryDays(); ok {
+		m.Add(obx("NM", codeRecoveryTime, "Estimated recovery time", strconv.Itoa(days), Components("d", "day", "UCUM")))
+	} else if r.RecoveryTime != "" {
+		m.Add(obx("ST", codeRecoveryTime, "Estimated recovery time", Escape(r.RecoveryTime), ""))
+	}
+	return m
+}
+
+// PID builds the patient identification segment of a patient, identified
+// by their MRN within the facility.
+func PID(p models.Patient, facilityCode string) Segment {
+	pid := NewSegment("PID")
+	pid.Set(1, "1")
+	pid.Set(3, Components(p.MRN, "", "", facilityCode, "MR"))
+	family, given := splitName(p.FullName)
+	pid.Set(5, Components(family, given))
+	if p.DateOfBirth != nil {
+		pid.Set(7, p.DateOfBirth.Format("20060102"))
+	}
+	pid.Set(8, sexCode(p.Sex))
+	var telecom []string
+	if p.PhoneNumber != "" {
+		telecom = append(telecom, Components(p.PhoneNumber, "PRN", "PH"))
+	}
+	if p.Email != "" {
+		telecom = append(telecom, Components("", "NET", "Internet", p.Email))
+	}
+	pid.Set(13, Repeat(telecom...))
+	return pid
+}
+
+// xcn formats a user as an extended composite name (XCN): ID, family name,
+// given names.
+func xcn(u models.User) string {
+	if u.ID.IsZero() {
+		return ""
+	}
+	family, given := splitName(u.FullName)
+	return Components(u.ID.Hex(), family, given)
+}
+
+// splitName splits a full name into the family name, its last word, and the
+// given names.
+func splitName(full string) (family, given string) {
+	parts := strings.Fields(full)
+	if len(parts) < 2 {
+		return strings.TrimSpace(full), ""
+	}
+	return parts[len(parts)-1], strings.Join(parts[:len(parts)-1], " ")
+}
+
+// sexCode maps the application's sex values onto HL7 table 0001.
+func sexCode(sex string) string {
+	switch sex {
+	case "male":
+		return "M"
+	case "female":
+		return "F"
+	case "other":
+		return "O"
+	case "unknown":
+		return "U"
+	}
+	return ""
+}
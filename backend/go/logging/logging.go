@@ -0,0 +1,136 @@
+// Package logging sets up structured logging with log/slog. Records are
+// written as JSON, or text for local development, carry the request and
+// trace IDs of their context, and have personal data and credentials masked.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Config describes the log output.
+type Config struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // json or text
+}
+
+// DefaultConfig is used for anything not set in the environment or the
+// config file.
+var DefaultConfig = Config{Level: "info", Format: FormatJSON}
+
+// ConfigFromEnv overrides cfg with LOG_LEVEL and LOG_FORMAT, where they are
+// set.
+func ConfigFromEnv(cfg Config) (Config, error) {
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		cfg.Level = v
+	}
+	if v := os.Getenv("LOG_FORMAT"); v != "" {
+		cfg.Format = v
+	}
+	cfg.Level = strings.ToLower(cfg.Level)
+	cfg.Format = strings.ToLower(cfg.Format)
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the level and format are known.
+func (c Config) Validate() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("unknown log level %q", c.Level)
+	}
+	if c.Format != FormatJSON && c.Format != FormatText {
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+	return nil
+}
+
+// Setup makes a logger for the configuration the default, for both log/slog
+// and the log package, whose output is logged at the info level.
+func Setup(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Level))
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if cfg.Format == FormatText {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&handler{next: h}))
+	return nil
+}
+
+// Fatal logs an error and exits, for failures the server cannot start or
+// keep running with.
+func Fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// RequestIDHeader carries request IDs, both on the API's requests and
+// responses and on its calls to other services.
+const RequestIDHeader = "X-Request-ID"
+
+// WithRequestID returns a context carrying a request ID, which is added to
+// every record logged with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of a context, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// handler adds the request and trace IDs of the context to each record and masks
+// personal data and credentials before passing it on.
+type handler struct {
+	next slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	if id := RequestID(ctx); id != "" {
+		out.AddAttrs(slog.String("requestId", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		out.AddAttrs(slog.String("traceId", sc.TraceID().String()), slog.String("spanId", sc.SpanID().String()))
+	}
+	return h.next.Handle(ctx, out)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &handler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{next: h.next.WithGroup(name)}
+}
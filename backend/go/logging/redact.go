@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces what is masked.
+const redacted = "[redacted]"
+
+// sensitiveKeys are attributes whose values are always masked, compared in
+// lower case without separators. Names cannot be recognized in free text, so
+// they must be logged under one of these keys, or not at all.
+var sensitiveKeys = map[string]bool{
+	"email":         true,
+	"phone":         true,
+	"phonenumber":   true,
+	"name":          true,
+	"fullname":      true,
+	"patientname":   true,
+	"firstname":     true,
+	"lastname":      true,
+	"filename":      true, // uploads are often named after the patient
+	"recipient":     true,
+	"mrn":           true,
+	"address":       true,
+	"birthdate":     true,
+	"dateofbirth":   true,
+	"authorization": true,
+	"cookie":        true,
+}
+
+// sensitiveKeyParts mask any attribute whose key contains them.
+var sensitiveKeyParts = []string{"password", "secret", "token", "apikey"}
+
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	bearerPattern = regexp.MustCompile(`\b(Bearer|Basic) [A-Za-z0-9._~+/=-]{8,}`)
+	jwtPattern    = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	apiKeyPattern = regexp.MustCompile(`\bfdk_[A-Za-z0-9_-]+`)
+	// Phone numbers are runs of at least nine digits, possibly with a
+	// leading + and spaces, dashes or parentheses between them. Dots are not
+	// allowed, and redactPhones skips runs next to one, so DICOM UIDs and IP
+	// addresses are kept.
+	phonePattern = regexp.MustCompile(`\+?\(?\d[\d ()-]{7,}\d`)
+	datePattern  = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+)
+
+// Redact masks email addresses, phone numbers and credentials in free text.
+func Redact(s string) string {
+	s = bearerPattern.ReplaceAllString(s, "$1 "+redacted)
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = apiKeyPattern.ReplaceAllString(s, redacted)
+	s = emailPattern.ReplaceAllString(s, redacted)
+	return redactPhones(s)
+}
+
+// redactPhones masks the phone numbers in s. Runs of digits next to a dot
+// are components of a DICOM UID or an IP address, and dates are kept.
+func redactPhones(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range phonePattern.FindAllStringIndex(s, -1) {
+		start, end := loc[0], loc[1]
+		m := s[start:end]
+		digits := 0
+		for _, r := range m {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits < 9 || datePattern.MatchString(m) ||
+			(start > 0 && s[start-1] == '.') ||
+			(end+1 < len(s) && s[end] == '.' && s[end+1] >= '0' && s[end+1] <= '9') {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(redacted)
+		last = end
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// isSensitive reports whether an attribute key names personal data or a
+// credential.
+func isSensitive(key string) bool {
+	k := strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(key))
+	if sensitiveKeys[k] {
+		return true
+	}
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(k, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAttr masks an attribute, recursing into groups. Errors and values
+// with a String method are logged as their redacted text.
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		out := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			out[i] = redactAttr(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(out...)}
+	}
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, Redact(v.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, Redact(v.String()))
+		}
+	}
+	return a
+}
@@ -1,35 +1,149 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
+	"time"
 
+	"fracture-detection-webapp/config"
+	"fracture-detection-webapp/emails"
 	"fracture-detection-webapp/handlers"
+	"fracture-detection-webapp/hl7"
+	"fracture-detection-webapp/logging"
+	"fracture-detection-webapp/metrics"
 	"fracture-detection-webapp/middleware"
 	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/sso"
+	"fracture-detection-webapp/tracing"
+	"fracture-detection-webapp/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/joho/godotenv"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 )
 
 func main() {
-	err := godotenv.Load()
+	configFile := flag.String("config", "", "YAML configuration file (default $CONFIG_FILE)")
+	printConfig := flag.Bool("print-config", false, "print the configuration, with secrets masked, then exit")
+	migratePatients := flag.Bool("migrate-patients", false, "move patients stored as users into the patients collection, then exit")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		fmt.Print(cfg)
+		return
+	}
+	if err := logging.Setup(cfg.Log); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		fmt.Println("Warning: .env file not found or could not be loaded")
+		logging.Fatal("Invalid tracing configuration", err)
+	}
+	if err := models.ConfigureMRN(cfg.MRN.Format, cfg.MRN.Facility); err != nil {
+		logging.Fatal("Invalid MRN configuration", err)
+	}
+	if err := utils.ConfigureMailer(cfg.Mail); err != nil {
+		logging.Fatal("Invalid mail configuration", err)
+	}
+	if err := utils.ConfigureSMS(cfg.SMS); err != nil {
+		logging.Fatal("Invalid SMS configuration", err)
+	}
+	if err := hl7.Configure(cfg.HL7); err != nil {
+		logging.Fatal("Invalid HL7 configuration", err)
+	}
+	if err := sso.Configure(cfg.SSO); err != nil {
+		logging.Fatal("Invalid single sign-on configuration", err)
+	}
+	middleware.SetJWTSecret(cfg.JWTSecret)
+	handlers.Configure(handlers.Config{
+		JWTSecret:              []byte(cfg.JWTSecret),
+		InferenceURL:           cfg.InferenceURL,
+		WebhookAllowedNetworks: cfg.WebhookNetworks(),
+		MetricsToken:           cfg.MetricsToken,
+	})
+	emails.SetAppURL(cfg.AppURL)
+	slog.Info("Connecting to MongoDB", "uri", config.RedactURI(cfg.Mongo.URI))
+	if err := models.InitMongo(cfg.Mongo.URI, cfg.Mongo.Database, cfg.Mongo.ConnectTimeout); err != nil {
+		logging.Fatal("Could not connect to MongoDB", err)
+	}
+
+	if *migratePatients {
+		res, err := models.MigratePatientsToProfiles(context.Background())
+		if err != nil {
+			logging.Fatal("Patient migration failed", err)
+		}
+		if err := models.MigrateFacilities(context.Background()); err != nil {
+			logging.Fatal("Facility migration failed", err)
+		}
+		slog.Info("Patient migration done", "profiles", res.Migrated, "portalAccountsKept", res.Accounts, "usersRemoved", res.UsersRemoved)
+		return
+	}
+
+	// Bootstrap the first super-admin, who can then create facilities and chefs.
+	if email, password := cfg.SuperAdmin.Email, cfg.SuperAdmin.Password; email != "" && password != "" {
+		created, err := models.EnsureSuperAdmin(context.Background(), email, handlers.HashPasswordSHA256(password))
+		if err != nil {
+			logging.Fatal("Could not create the super-admin account", err)
+		}
+		if created {
+			slog.Info("Created the super-admin account", "email", email)
+		}
+	}
+
+	// Notifications, webhook events and HL7 results are delivered in the
+	// background, and DICOM instances stored over DICOMweb analyzed.
+	go handlers.RunNotificationWorker(context.Background())
+	go handlers.RunWebhookWorker(context.Background())
+	go handlers.RunHL7Worker(context.Background())
+	go handlers.RunAnalysisWorker(context.Background())
+	if cfg.HL7.Listen != "" {
+		go func() {
+			slog.Info("HL7 MLLP listener started", "addr", cfg.HL7.Listen)
+			if err := hl7.ListenAndServe(context.Background(), cfg.HL7.Listen, handlers.HandleHL7); err != nil {
+				logging.Fatal("HL7 MLLP listener failed", err)
+			}
+		}()
 	}
-	models.InitMongo()
 
 	app := fiber.New(fiber.Config{
 		AppName: "Fracture Detection API",
+		// Bodies are streamed so STOW-RS requests, which carry whole studies,
+		// can be read as they arrive; LimitBody caps them everywhere else.
+		StreamRequestBody: true,
 	})
-	app.Use(logger.New())
+	// A panic in one handler answers 500 instead of taking the server down.
+	app.Use(recover.New(recover.Config{
+		EnableStackTrace: true,
+		StackTraceHandler: func(c *fiber.Ctx, e any) {
+			slog.ErrorContext(c.UserContext(), "Panic while handling request", "panic", fmt.Sprint(e), "stack", string(debug.Stack()))
+		},
+	}))
+	app.Use(middleware.RequestID())
+	// Probes and scrapes are registered before the access log and the
+	// request metrics so they do not flood them.
+	app.Get("/healthz", handlers.Healthz)
+	app.Get("/readyz", handlers.Readyz)
+	app.Get("/metrics", metrics.Handler(cfg.MetricsToken))
+	app.Use(tracing.Middleware())
+	app.Use(middleware.AccessLog())
+	app.Use(metrics.Middleware())
+	app.Use(middleware.LimitBody(fiber.DefaultBodyLimit, handlers.IsSTOWRequest))
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
-		AllowMethods: "GET, POST, PUT, DELETE",
+		AllowOrigins:  "*",
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, X-Request-ID",
+		ExposeHeaders: "X-Request-ID",
+		AllowMethods:  "GET, POST, PUT, PATCH, DELETE",
 	}))
 
 	api := app.Group("/api")
@@ -38,29 +152,124 @@ func main() {
 	auth := api.Group("/auth")
 	auth.Post("/register", handlers.Register)
 	auth.Post("/login", handlers.Login)
+	auth.Get("/methods", handlers.GetAuthMethods)
+	auth.Get("/oidc/login", handlers.OIDCLogin)
+	auth.Get("/oidc/callback", handlers.OIDCCallback)
 
 	// Protected routes
-	api.Get("/patients", middleware.IsAuthenticated, handlers.GetMyPatients)
-	api.Post("/analyze", middleware.IsAuthenticated, handlers.AnalyzeImage)
-	api.Get("/reports", middleware.IsAuthenticated, handlers.GetAllReports)
+	api.Get("/patients", middleware.Scope(models.ScopePatientsRead), middleware.IsAuthenticated, handlers.GetMyPatients)
+	api.Post("/patients", middleware.IsAuthenticated, handlers.CreatePatient)
+	api.Get("/patients/duplicates", middleware.IsAuthenticated, handlers.FindDuplicatePatients)
+	api.Get("/patients/:id", middleware.Scope(models.ScopePatientsRead), middleware.IsAuthenticated, handlers.GetPatient)
+	api.Get("/patients/:id/duplicates", middleware.IsAuthenticated, handlers.GetPatientDuplicates)
+	api.Patch("/patients/:id", middleware.IsAuthenticated, handlers.UpdatePatient)
+	api.Delete("/patients/:id", middleware.IsAuthenticated, handlers.ArchivePatient)
+	api.Post("/patients/:id/restore", middleware.IsAuthenticated, handlers.RestorePatient)
+	api.Post("/patients/:id/account", middleware.IsAuthenticated, handlers.CreatePortalAccount)
+	api.Delete("/patients/:id/account", middleware.IsAuthenticated, handlers.DeletePortalAccount)
+	api.Get("/patients/:id/care-team", middleware.IsAuthenticated, handlers.GetCareTeam)
+	api.Put("/patients/:id/care-team/:doctorId", middleware.IsAuthenticated, handlers.GrantCareTeamAccess)
+	api.Delete("/patients/:id/care-team/:doctorId", middleware.IsAuthenticated, handlers.RevokeCareTeamAccess)
+	api.Get("/search", middleware.IsAuthenticated, handlers.Search)
+	api.Post("/analyze", middleware.Scope(models.ScopeReportsCreate), middleware.IsAuthenticated, handlers.AnalyzeImage)
+	api.Get("/reports", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.GetAllReports)
 	api.Post("/reports/my-reports", middleware.IsAuthenticated, handlers.GetMyReports)
-	api.Post("/reports/create", middleware.IsAuthenticated, handlers.CreateReport)
-	api.Get("/reports/:id", middleware.IsAuthenticated, handlers.GetReportByID)
+	api.Post("/reports/create", middleware.Scope(models.ScopeReportsCreate), middleware.IsAuthenticated, handlers.CreateReport)
+	api.Get("/reports/:id", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.GetReportByID)
+	api.Get("/reports/:id/pdf", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.GetReportPDF)
+	api.Get("/reports/:id/dicom/:kind", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.GetReportDICOM)
 	api.Delete("/reports/:id", middleware.IsAuthenticated, handlers.DeleteReport)
-	api.Post("/reports/:reportId/notify", middleware.IsAuthenticated, handlers.NotifyPatientByEmail)
+	api.Post("/reports/:id/sign", middleware.IsAuthenticated, handlers.SignReport)
+	api.Put("/reports/:id", middleware.IsAuthenticated, handlers.AmendReport)
+	api.Post("/reports/:id/notify", middleware.IsAuthenticated, handlers.NotifyPatient)
+	api.Get("/reports/:id/notifications", middleware.IsAuthenticated, handlers.GetReportNotifications)
+	api.Get("/notifications", middleware.IsAuthenticated, handlers.GetNotifications)
+	api.Post("/notifications/:id/retry", middleware.IsAuthenticated, handlers.RetryNotification)
+
+	// FHIR R4 read API
+	fhir := app.Group("/fhir")
+	fhir.Get("/metadata", handlers.FHIRMetadata)
+	fhir.Get("/Patient", middleware.Scope(models.ScopePatientsRead), middleware.IsAuthenticated, handlers.FHIRSearchPatients)
+	fhir.Get("/Patient/:id", middleware.Scope(models.ScopePatientsRead), middleware.IsAuthenticated, handlers.FHIRGetPatient)
+	fhir.Get("/DiagnosticReport", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRSearchDiagnosticReports)
+	fhir.Get("/DiagnosticReport/:id", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRGetDiagnosticReport)
+	fhir.Get("/Observation", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRSearchObservations)
+	fhir.Get("/Observation/:id", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRGetObservation)
+	fhir.Get("/Media", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRSearchMedia)
+	fhir.Get("/Media/:id", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRGetMedia)
+	fhir.Get("/Binary/:id", middleware.Scope(models.ScopeReportsRead), middleware.IsAuthenticated, handlers.FHIRGetBinary)
+
+	// DICOMweb for PACS integration
+	dicomweb := app.Group("/dicomweb", middleware.ReadWriteScope(models.ScopeDicomRead, models.ScopeDicomWrite), middleware.IsAuthenticated, middleware.AuthRequired("service", "chef", "doctor"))
+	dicomweb.Post("/studies", handlers.StoreInstances)
+	dicomweb.Post("/studies/:study", handlers.StoreInstances)
+	dicomweb.Get("/studies", handlers.SearchStudies)
+	dicomweb.Get("/studies/:study", handlers.RetrieveInstances)
+	dicomweb.Get("/studies/:study/series", handlers.SearchSeries)
+	dicomweb.Get("/studies/:study/series/:series", handlers.RetrieveInstances)
+	dicomweb.Get("/studies/:study/series/:series/instances", handlers.SearchInstances)
+	dicomweb.Get("/studies/:study/series/:series/instances/:instance", handlers.RetrieveInstances)
 
 	// Chef-specific routes
-	chef := api.Group("/chef", middleware.IsAuthenticated)
+	chef := api.Group("/chef", middleware.IsAuthenticated, middleware.AuthRequired("chef"))
 	chef.Post("/add-doctor", handlers.CreateDoctor)
+	chef.Get("/doctors", handlers.GetDoctors)
+	chef.Patch("/doctors/:id", handlers.UpdateDoctor)
+	chef.Delete("/doctors/:id", handlers.DeleteDoctor)
+	chef.Post("/doctors/:id/suspend", handlers.SuspendDoctor)
+	chef.Post("/doctors/:id/reactivate", handlers.ReactivateDoctor)
+	chef.Post("/doctors/:id/reassign", handlers.ReassignDoctor)
+	chef.Post("/patients/merge", handlers.MergePatients)
+	chef.Get("/facility", handlers.GetFacility)
+	chef.Patch("/facility/branding", handlers.UpdateFacilityBranding)
+	chef.Post("/mail/test", handlers.TestMailSettings)
+	chef.Get("/email-templates", handlers.GetEmailTemplates)
+	chef.Get("/email-templates/:name/preview", handlers.PreviewEmailTemplate)
+	chef.Get("/webhooks", handlers.GetWebhooks)
+	chef.Post("/webhooks", handlers.CreateWebhook)
+	chef.Patch("/webhooks/:id", handlers.UpdateWebhook)
+	chef.Delete("/webhooks/:id", handlers.DeleteWebhook)
+	chef.Get("/webhooks/:id/deliveries", handlers.GetWebhookDeliveries)
+	chef.Post("/webhooks/deliveries/:id/replay", handlers.ReplayWebhookDelivery)
+	chef.Get("/hl7/messages", handlers.GetHL7Messages)
+	chef.Post("/hl7/messages/:id/retry", handlers.RetryHL7Message)
+	chef.Get("/service-accounts", handlers.GetServiceAccounts)
+	chef.Post("/service-accounts", handlers.CreateServiceAccount)
+	chef.Delete("/service-accounts/:id", handlers.DeleteServiceAccount)
+	chef.Get("/service-accounts/:id/api-keys", handlers.GetAPIKeys)
+	chef.Post("/service-accounts/:id/api-keys", handlers.CreateAPIKey)
+	chef.Delete("/service-accounts/:id/api-keys/:keyId", handlers.RevokeAPIKey)
+
+	// Super-admin routes
+	admin := api.Group("/admin", middleware.IsAuthenticated, middleware.AuthRequired("superadmin"))
+	admin.Get("/facilities", handlers.GetFacilities)
+	admin.Post("/facilities", handlers.CreateFacility)
+	admin.Post("/facilities/:id/chefs", handlers.AssignChef)
+	admin.Put("/facilities/:id/hl7", handlers.UpdateFacilityHL7)
 
 	api.Get("/test", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"message": "API is working!"})
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	// On SIGINT or SIGTERM, finish the requests in progress and flush the
+	// buffered spans before exiting.
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-stop.Done()
+		slog.Info("Shutting down")
+		if err := app.ShutdownWithTimeout(30 * time.Second); err != nil {
+			slog.Error("Shutdown failed", "error", err)
+		}
+	}()
+
+	slog.Info("API running", "url", "http://localhost:"+cfg.Port+"/api")
+	if err := app.Listen(":" + cfg.Port); err != nil {
+		logging.Fatal("Server stopped", err)
+	}
+	ctx, cancelFlush := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Flushing traces failed", "error", err)
 	}
-	log.Printf("API running at http://localhost:%s/api", port)
-	log.Fatal(app.Listen(":" + port))
 }
@@ -0,0 +1,147 @@
+// Package metrics exposes Prometheus metrics about the API, the inference
+// service, notification delivery and the database.
+package metrics
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	inferenceRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inference_requests_total",
+		Help: "Calls to the inference service, by outcome.",
+	}, []string{"outcome"})
+	inferenceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "inference_duration_seconds",
+		Help:    "Time taken by calls to the inference service, by outcome.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"outcome"})
+	detections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fracture_detections_total",
+		Help: "Images analyzed, by detected fracture type; \"none\" when nothing was found.",
+	}, []string{"type"})
+	confidence = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fracture_detection_confidence",
+		Help:    "Confidence of the fractures detected, by type.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"type"})
+
+	notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notification_deliveries_total",
+		Help: "Notification delivery attempts, by channel, template and outcome.",
+	}, []string{"channel", "template", "outcome"})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "Time taken by MongoDB commands, by command, collection and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"command", "collection", "outcome"})
+)
+
+// Inference outcomes.
+const (
+	InferenceSuccess         = "success"
+	InferenceError           = "error"            // the service answered with an error status
+	InferenceTimeout         = "timeout"          // no answer in time
+	InferenceUnreachable     = "unreachable"      // the service could not be reached
+	InferenceInvalidResponse = "invalid_response" // the answer could not be decoded
+)
+
+// ObserveInference records a call to the inference service.
+func ObserveInference(outcome string, d time.Duration) {
+	inferenceRequests.WithLabelValues(outcome).Inc()
+	inferenceDuration.WithLabelValues(outcome).Observe(d.Seconds())
+}
+
+// ObserveDetection records the finding of an analysis.
+func ObserveDetection(detected bool, fractureType string, conf *float64) {
+	if !detected || fractureType == "" {
+		detections.WithLabelValues("none").Inc()
+		return
+	}
+	fractureType = strings.ToLower(fractureType)
+	detections.WithLabelValues(fractureType).Inc()
+	if conf != nil {
+		confidence.WithLabelValues(fractureType).Observe(*conf)
+	}
+}
+
+// Notification delivery outcomes.
+const (
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"   // to be retried
+	DeliveryRejected = "rejected" // failed for good
+)
+
+// ObserveNotification records a notification delivery attempt.
+func ObserveNotification(channel, template, outcome string) {
+	notifications.WithLabelValues(channel, template, outcome).Inc()
+}
+
+// Middleware counts and times requests by route. Routes are labelled with
+// their pattern, such as /api/reports/:id, to keep the number of series
+// bounded; requests matching no route are labelled "unmatched".
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		own := c.Route()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+		// Without a matching route, the request ends here.
+		route := c.Route().Path
+		if c.Route() == own {
+			route = "unmatched"
+		}
+		labels := []string{c.Method(), route, strconv.Itoa(status)}
+		httpRequests.WithLabelValues(labels...).Inc()
+		httpDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. When token is
+// set, scrapers must send it as a bearer token.
+func Handler(token string) fiber.Handler {
+	serve := adaptor.HTTPHandler(promhttp.Handler())
+	return func(c *fiber.Ctx) error {
+		if token != "" && !Authorized(c, token) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid metrics token"})
+		}
+		return serve(c)
+	}
+}
+
+// Authorized reports whether a request carries token as its bearer token.
+// No request is authorized when token is empty.
+func Authorized(c *fiber.Ctx, token string) bool {
+	given := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
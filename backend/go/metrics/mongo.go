@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// MongoMonitor returns a command monitor timing every MongoDB command.
+func MongoMonitor() *event.CommandMonitor {
+	// Collections are only named in the started event, so they are kept
+	// until the command finishes.
+	var collections sync.Map // request ID → collection
+	finished := func(requestID int64, command string, d time.Duration, outcome string) {
+		collection, _ := collections.LoadAndDelete(requestID)
+		name, _ := collection.(string)
+		mongoDuration.WithLabelValues(command, name, outcome).Observe(d.Seconds())
+	}
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			// Most commands name their collection as their first value;
+			// getMore names it separately.
+			name, ok := e.Command.Index(0).Value().StringValueOK()
+			if !ok {
+				name, _ = e.Command.Lookup("collection").StringValueOK()
+			}
+			collections.Store(e.RequestID, name)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			finished(e.RequestID, e.CommandName, e.Duration, "success")
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finished(e.RequestID, e.CommandName, e.Duration, "failure")
+		},
+	}
+}
@@ -1,14 +1,79 @@
 package middleware
 
 import (
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// IsAuthenticated is a middleware that checks for a valid JWT.
+// jwtSecret verifies login tokens; see SetJWTSecret.
+var jwtSecret []byte
+
+// SetJWTSecret sets the secret login tokens are signed with.
+func SetJWTSecret(secret string) {
+	jwtSecret = []byte(secret)
+}
+
+var (
+	errAccountGone      = errors.New("account no longer exists")
+	errAccountSuspended = errors.New("account suspended")
+)
+
+// checkAccount verifies that an account still exists and has not been
+// suspended, and returns its role and facility. Credentials stay valid until
+// they expire, so this is checked on every request.
+func checkAccount(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
+	var user models.User
+	err := models.DB.Collection("users").FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"status": 1, "role": 1, "facilityId": 1})).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, errAccountGone
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.IsSuspended() {
+		return nil, errAccountSuspended
+	}
+	return &user, nil
+}
+
+// claimsMatch reports whether a login token still grants what the account
+// has: a chef moved to another facility, or a user whose role changed, must
+// not keep the old access until the token expires.
+func claimsMatch(claims jwt.MapClaims, user *models.User) bool {
+	facility, _ := claims["facilityId"].(string)
+	if user.FacilityID.IsZero() {
+		return facility == "" && claims["role"] == user.Role
+	}
+	return facility == user.FacilityID.Hex() && claims["role"] == user.Role
+}
+
+// accountError maps a checkAccount error onto an HTTP response.
+func accountError(c *fiber.Ctx, err error) error {
+	switch err {
+	case errAccountGone:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Account no longer exists"})
+	case errAccountSuspended:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "This account has been suspended"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to verify account"})
+}
+
+// IsAuthenticated is a middleware that checks for a valid JWT, or an API key
+// on routes that declare a Scope.
 func IsAuthenticated(c *fiber.Ctx) error {
 	authHeader := c.Get("Authorization")
 	if authHeader == "" {
@@ -16,12 +81,15 @@ func IsAuthenticated(c *fiber.Ctx) error {
 	}
 
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if models.IsAPIKey(tokenString) {
+		return authenticateAPIKey(c, tokenString)
+	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fiber.NewError(fiber.StatusUnauthorized, "Unexpected signing method")
 		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
+		return jwtSecret, nil
 	})
 
 	if err != nil || !token.Valid {
@@ -32,13 +100,121 @@ func IsAuthenticated(c *fiber.Ctx) error {
 	if !ok {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid JWT claims"})
 	}
+	// Service accounts used to be able to log in; their tokens would reach
+	// routes no API key scope covers.
+	if claims["role"] == "service" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Service accounts authenticate with API keys"})
+	}
+
+	// Tokens stay valid until they expire, so check on every request that the
+	// account still exists, has not been suspended, and still has the role
+	// and facility of the token.
+	userID, err := primitive.ObjectIDFromHex(fmt.Sprint(claims["userId"]))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid JWT claims"})
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+	defer cancel()
+	user, err := checkAccount(ctx, userID)
+	if err != nil {
+		return accountError(c, err)
+	}
+	if !claimsMatch(claims, user) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired, please log in again"})
+	}
 
 	c.Locals("userId", claims["userId"])
 	c.Locals("role", claims["role"])
 
+	// Scope every database access of the request to the user's facility.
+	// Only super-admins have none; tokens issued before facilities existed
+	// must be renewed.
+	if facilityID, err := primitive.ObjectIDFromHex(fmt.Sprint(claims["facilityId"])); err == nil {
+		c.SetUserContext(models.WithFacility(c.UserContext(), facilityID))
+	} else if claims["role"] != "superadmin" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired, please log in again"})
+	}
+
 	return c.Next()
 }
 
+// apiKeyUseInterval is how stale an API key's last use may get before it is
+// recorded again, so that busy keys are not written on every request.
+const apiKeyUseInterval = time.Minute
+
+// authenticateAPIKey authenticates a request made with an API key as the key's
+// service account, provided the key grants the route's scope.
+func authenticateAPIKey(c *fiber.Ctx, apiKey string) error {
+	scope, _ := c.Locals("scope").(string)
+	if scope == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "API keys cannot be used on this route"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+	defer cancel()
+
+	var key models.APIKey
+	err := models.DB.Collection("api_keys").FindOne(ctx, bson.M{"keyHash": models.HashAPIKey(apiKey)}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid API key"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to verify API key"})
+	}
+	now := time.Now()
+	if !key.Usable(now) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "API key revoked or expired"})
+	}
+	if !key.HasScope(scope) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "API key lacks the " + scope + " scope"})
+	}
+	if account, err := checkAccount(ctx, key.ServiceAccountID); err != nil {
+		return accountError(c, err)
+	} else if account.FacilityID != key.FacilityID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "API key revoked or expired"})
+	}
+
+	_, err = models.DB.Collection("api_keys").UpdateOne(ctx,
+		bson.M{"_id": key.ID, "$or": bson.A{
+			bson.M{"lastUsedAt": bson.M{"$exists": false}},
+			bson.M{"lastUsedAt": bson.M{"$lt": now.Add(-apiKeyUseInterval)}},
+		}},
+		bson.M{"$set": bson.M{"lastUsedAt": now, "lastUsedIp": c.IP()}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording use of API key", "apiKeyId", key.ID.Hex(), "error", err)
+	}
+
+	c.Locals("userId", key.ServiceAccountID.Hex())
+	c.Locals("role", "service")
+	c.Locals("apiKeyId", key.ID.Hex())
+	c.SetUserContext(models.WithFacility(c.UserContext(), key.FacilityID))
+
+	return c.Next()
+}
+
+// Scope returns a middleware declaring the scope an API key needs for the
+// route. It must run before IsAuthenticated, which refuses API keys on routes
+// without one; it does not restrict JWTs.
+func Scope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("scope", scope)
+		return c.Next()
+	}
+}
+
+// ReadWriteScope is Scope with one scope for reads (GET and HEAD) and another
+// for every other method, for groups of routes.
+func ReadWriteScope(read, write string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+			c.Locals("scope", read)
+		} else {
+			c.Locals("scope", write)
+		}
+		return c.Next()
+	}
+}
+
 // IsChef is a middleware that checks if the user is authenticated and has the 'chef' role.
 func IsChef(c *fiber.Ctx) error {
 	// First, run the standard authentication check.
@@ -55,8 +231,16 @@ func IsChef(c *fiber.Ctx) error {
 	return c.Next()
 }
 
-func AuthRequired(role string) fiber.Handler {
+// AuthRequired returns a middleware that only lets through users with one of
+// the given roles. It must run after IsAuthenticated.
+func AuthRequired(roles ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		return c.Next()
+		role, _ := c.Locals("role").(string)
+		for _, r := range roles {
+			if role == r {
+				return c.Next()
+			}
+		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied. Required role: " + strings.Join(roles, " or ")})
 	}
 }
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrBodyTooLarge is returned when reading more of a request body than its
+// limit allows.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// LimitBody reads request bodies of up to limit bytes, and answers 413 to
+// larger ones. The server streams request bodies (fiber.Config's
+// StreamRequestBody) so that a few routes can take large uploads; every
+// other route relies on this middleware to keep bodies small. Requests skip
+// returns true for are left streaming, and their handlers must read the body
+// with BodyReader.
+func LimitBody(limit int, skip func(c *fiber.Ctx) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := c.Request()
+		if !req.IsBodyStream() || skip(c) {
+			return c.Next()
+		}
+		if req.Header.ContentLength() > limit {
+			return BodyTooLarge(c)
+		}
+		body, err := io.ReadAll(BodyReader(c, limit))
+		if errors.Is(err, ErrBodyTooLarge) {
+			return BodyTooLarge(c)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Could not read request body"})
+		}
+		req.SetBody(body)
+		return c.Next()
+	}
+}
+
+// BodyTooLarge answers 413 and closes the connection, as the rest of the
+// body is left unread.
+func BodyTooLarge(c *fiber.Ctx) error {
+	c.Context().SetConnectionClose()
+	return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Request body too large"})
+}
+
+// BodyReader returns the request body as a stream, which fails with
+// ErrBodyTooLarge once more than limit bytes are read.
+func BodyReader(c *fiber.Ctx, limit int) io.Reader {
+	req := c.Request()
+	if !req.IsBodyStream() {
+		return &limitedReader{r: bytes.NewReader(req.Body()), left: limit}
+	}
+	return &limitedReader{r: req.BodyStream(), left: limit}
+}
+
+// limitedReader is io.LimitReader, failing instead of ending at the limit.
+type limitedReader struct {
+	r    io.Reader
+	left int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if len(p) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= n
+	if l.left < 0 {
+		return n + l.left, ErrBodyTooLarge
+	}
+	return n, err
+}
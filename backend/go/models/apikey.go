@@ -0,0 +1,78 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// API key scopes. A key can only be used on the routes of its scopes.
+const (
+	ScopePatientsRead  = "patients:read"
+	ScopeReportsRead   = "reports:read"
+	ScopeReportsCreate = "reports:create"
+	ScopeDicomRead     = "dicom:read"
+	ScopeDicomWrite    = "dicom:write"
+)
+
+// APIKeyScopes lists the scopes an API key can be given.
+var APIKeyScopes = []string{ScopePatientsRead, ScopeReportsRead, ScopeReportsCreate, ScopeDicomRead, ScopeDicomWrite}
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs.
+const APIKeyPrefix = "fdk_"
+
+// APIKey is a credential a chef issues to a service account, used as a
+// bearer token instead of a login JWT. Only the SHA-256 of the key is
+// stored; Prefix, its first characters, identifies it in lists.
+type APIKey struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FacilityID       primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	ServiceAccountID primitive.ObjectID `bson:"serviceAccountId" json:"serviceAccountId"`
+	Name             string             `bson:"name" json:"name"`
+	Prefix           string             `bson:"prefix" json:"prefix"`
+	KeyHash          string             `bson:"keyHash" json:"-"`
+	Scopes           []string           `bson:"scopes" json:"scopes"`
+	ExpiresAt        *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	LastUsedAt       *time.Time         `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	LastUsedIP       string             `bson:"lastUsedIp,omitempty" json:"lastUsedIp,omitempty"`
+	CreatedBy        primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+	CreatedAt        time.Time          `bson:"createdAt" json:"createdAt"`
+	RevokedAt        *time.Time         `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+	RevokedBy        primitive.ObjectID `bson:"revokedBy,omitempty" json:"revokedBy,omitempty"`
+}
+
+// NewAPIKey returns a random API key and its prefix.
+func NewAPIKey() (key, prefix string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = APIKeyPrefix + hex.EncodeToString(b)
+	return key, key[:len(APIKeyPrefix)+8], nil
+}
+
+// IsAPIKey reports whether a bearer token is an API key rather than a JWT.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// HashAPIKey returns the hash an API key is stored and looked up by.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Usable reports whether the key is neither revoked nor expired.
+func (k *APIKey) Usable(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// HasScope reports whether the key grants a scope.
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
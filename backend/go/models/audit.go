@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditLog records a sensitive administrative action for later review.
+type AuditLog struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Action     string             `bson:"action" json:"action"` // e.g. "patient.merge"
+	ActorID    primitive.ObjectID `bson:"actorId" json:"actorId"`
+	TargetID   primitive.ObjectID `bson:"targetId,omitempty" json:"targetId,omitempty"`
+	FacilityID primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	Details    bson.M             `bson:"details,omitempty" json:"details,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DicomInstance is a DICOM instance received over DICOMweb. Its attributes
+// are copied out of the file for queries; the file itself is kept in the
+// "dicom" GridFS bucket.
+type DicomInstance struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FacilityID        primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	PatientID         primitive.ObjectID `bson:"patientId" json:"patientId"`
+	StudyInstanceUID  string             `bson:"studyInstanceUid" json:"studyInstanceUid"`
+	SeriesInstanceUID string             `bson:"seriesInstanceUid" json:"seriesInstanceUid"`
+	SOPInstanceUID    string             `bson:"sopInstanceUid" json:"sopInstanceUid"`
+	SOPClassUID       string             `bson:"sopClassUid" json:"sopClassUid"`
+	TransferSyntaxUID string             `bson:"transferSyntaxUid" json:"transferSyntaxUid"`
+	Modality          string             `bson:"modality,omitempty" json:"modality,omitempty"`
+	StudyDate         string             `bson:"studyDate,omitempty" json:"studyDate,omitempty"` // DICOM DA, YYYYMMDD
+	StudyTime         string             `bson:"studyTime,omitempty" json:"studyTime,omitempty"`
+	StudyDescription  string             `bson:"studyDescription,omitempty" json:"studyDescription,omitempty"`
+	StudyID           string             `bson:"studyId,omitempty" json:"studyId,omitempty"`
+	AccessionNumber   string             `bson:"accessionNumber,omitempty" json:"accessionNumber,omitempty"`
+	SeriesNumber      *int               `bson:"seriesNumber,omitempty" json:"seriesNumber,omitempty"`
+	SeriesDescription string             `bson:"seriesDescription,omitempty" json:"seriesDescription,omitempty"`
+	InstanceNumber    *int               `bson:"instanceNumber,omitempty" json:"instanceNumber,omitempty"`
+	BodyPart          string             `bson:"bodyPart,omitempty" json:"bodyPart,omitempty"`
+	DicomPatientID    string             `bson:"dicomPatientId,omitempty" json:"dicomPatientId,omitempty"`     // as sent, the patient's MRN
+	DicomPatientName  string             `bson:"dicomPatientName,omitempty" json:"dicomPatientName,omitempty"` // as sent, in DICOM PN form
+	FileID            primitive.ObjectID `bson:"fileId" json:"-"`
+	Size              int64              `bson:"size" json:"size"`
+	ReportID          primitive.ObjectID `bson:"reportId,omitempty" json:"reportId,omitempty"` // the report of its analysis, once done
+	ReceivedBy        primitive.ObjectID `bson:"receivedBy" json:"receivedBy"`
+	CreatedAt         time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// dicomBucket opens the GridFS bucket DICOM files are kept in. Buckets hold
+// their deadlines, so each call gets its own.
+func dicomBucket(ctx context.Context) (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(DB, options.GridFSBucket().SetName("dicom"))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		bucket.SetReadDeadline(deadline)
+		bucket.SetWriteDeadline(deadline)
+	}
+	return bucket, nil
+}
+
+// PingDicomStore checks the GridFS bucket DICOM files are kept in can be
+// read.
+func PingDicomStore(ctx context.Context) error {
+	if DB == nil {
+		return errors.New("not connected")
+	}
+	err := DB.Collection("dicom.files").FindOne(ctx, bson.M{}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	return err
+}
+
+// StoreDicomFile saves a DICOM file and returns its ID.
+func StoreDicomFile(ctx context.Context, name string, data []byte) (primitive.ObjectID, error) {
+	bucket, err := dicomBucket(ctx)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return bucket.UploadFromStream(name, bytes.NewReader(data))
+}
+
+// ReadDicomFile returns a file saved with StoreDicomFile.
+func ReadDicomFile(ctx context.Context, id primitive.ObjectID) ([]byte, error) {
+	bucket, err := dicomBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := bucket.DownloadToStream(id, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeleteDicomFile removes a file saved with StoreDicomFile.
+func DeleteDicomFile(ctx context.Context, id primitive.ObjectID) error {
+	bucket, err := dicomBucket(ctx)
+	if err != nil {
+		return err
+	}
+	return bucket.DeleteContext(ctx, id)
+}
+
+// AnalysisJob is a DICOM instance waiting to be analyzed, in the analysis
+// outbox. It goes through the same statuses as a Notification, "sent"
+// meaning the report was created.
+type AnalysisJob struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FacilityID    primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	InstanceID    primitive.ObjectID `bson:"instanceId" json:"instanceId"`
+	DoctorID      primitive.ObjectID `bson:"doctorId" json:"doctorId"` // who the report is created for
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	MaxAttempts   int                `bson:"maxAttempts" json:"maxAttempts"`
+	LastError     string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	DoneAt        *time.Time         `bson:"doneAt,omitempty" json:"doneAt,omitempty"`
+}
+
+// DefaultAnalysisAttempts is how many times an instance is sent for analysis
+// before the job is dead-lettered.
+const DefaultAnalysisAttempts = 5
+
+// ClaimAnalysisJob atomically picks the next analysis job due, in any
+// facility, marks it as sending and counts the attempt. It returns
+// mongo.ErrNoDocuments when there is nothing to do.
+func ClaimAnalysisJob(ctx context.Context) (*AnalysisJob, error) {
+	var j AnalysisJob
+	if err := claimOutbox(ctx, "analysis_jobs", &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// CompleteAnalysisJob records the outcome of an analysis attempt; see
+// CompleteNotification.
+func CompleteAnalysisJob(ctx context.Context, j *AnalysisJob, jobErr error, permanent bool) error {
+	now := time.Now()
+	set := bson.M{}
+	if jobErr == nil {
+		set["status"] = NotificationSent
+		set["doneAt"] = now
+	} else {
+		set["lastError"] = jobErr.Error()
+		if permanent || j.Attempts >= j.MaxAttempts {
+			set["status"] = NotificationDead
+		} else {
+			set["status"] = NotificationFailed
+			set["nextAttemptAt"] = now.Add(NotificationBackoff(j.Attempts))
+		}
+	}
+	_, err := DB.Collection("analysis_jobs").UpdateOne(ctx,
+		bson.M{"_id": j.ID, "status": NotificationSending}, bson.M{"$set": set})
+	return err
+}
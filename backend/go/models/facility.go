@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Facility is an organization using the application, such as a hospital or a
+// clinic. Every user except super-admins, every patient and every report
+// belongs to exactly one facility, and never sees another facility's data.
+type Facility struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name string             `bson:"name" json:"name"`
+	Code string             `bson:"code" json:"code"` // short unique code, used in MRNs
+	// Branding printed at the top of the facility's report PDFs.
+	ReportHeader string             `bson:"reportHeader,omitempty" json:"reportHeader,omitempty"` // e.g. the department name
+	Address      string             `bson:"address,omitempty" json:"address,omitempty"`
+	Phone        string             `bson:"phone,omitempty" json:"phone,omitempty"`
+	LogoBase64   string             `bson:"logoBase64,omitempty" json:"logoBase64,omitempty"` // PNG or JPEG
+	HL7          *FacilityHL7       `bson:"hl7,omitempty" json:"hl7,omitempty"`
+	CreatedBy    primitive.ObjectID `bson:"createdBy,omitempty" json:"createdBy,omitempty"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// FacilityHL7 is how a facility exchanges HL7 v2 messages. Its signed
+// results are sent to Addr, when set, and ADT messages naming the facility
+// are only accepted from its Senders.
+type FacilityHL7 struct {
+	Addr                 string      `bson:"addr,omitempty" json:"addr,omitempty"`                                 // host:port of the MLLP receiver of results
+	ReceivingApplication string      `bson:"receivingApplication,omitempty" json:"receivingApplication,omitempty"` // MSH-5 of the results
+	ReceivingFacility    string      `bson:"receivingFacility,omitempty" json:"receivingFacility,omitempty"`       // MSH-6 of the results
+	Senders              []HL7Sender `bson:"senders,omitempty" json:"senders,omitempty"`
+}
+
+// HL7Sender is a system allowed to send ADT messages to a facility: the
+// sending facility it names in MSH-4, and the addresses it connects from.
+type HL7Sender struct {
+	Facility  string   `bson:"facility" json:"facility"`
+	Addresses []string `bson:"addresses" json:"addresses"` // IP addresses or CIDR ranges
+}
+
+// IsZero reports whether nothing is configured.
+func (h FacilityHL7) IsZero() bool {
+	return h.Addr == "" && h.ReceivingApplication == "" && h.ReceivingFacility == "" && len(h.Senders) == 0
+}
+
+// SendsResults reports whether the facility's results are sent over HL7.
+func (h *FacilityHL7) SendsResults() bool {
+	return h != nil && h.Addr != ""
+}
+
+// Validate checks the receiver address is a host:port pair, and every sender
+// has a name and valid addresses.
+func (h FacilityHL7) Validate() error {
+	if h.Addr != "" {
+		if host, port, err := net.SplitHostPort(h.Addr); err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid result receiver address %q, expected host:port", h.Addr)
+		}
+	}
+	for i, s := range h.Senders {
+		if strings.TrimSpace(s.Facility) == "" {
+			return fmt.Errorf("sender %d: the sending facility (MSH-4) is required", i+1)
+		}
+		if len(s.Addresses) == 0 {
+			return fmt.Errorf("sender %s: at least one address is required", s.Facility)
+		}
+		for _, a := range s.Addresses {
+			if _, err := parsePrefix(a); err != nil {
+				return fmt.Errorf("sender %s: invalid address %q, expected an IP address or CIDR range", s.Facility, a)
+			}
+		}
+	}
+	return nil
+}
+
+// AllowsSender reports whether a message naming sendingFacility in MSH-4
+// may come from addr.
+func (h *FacilityHL7) AllowsSender(sendingFacility string, addr netip.Addr) bool {
+	if h == nil || sendingFacility == "" {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, s := range h.Senders {
+		if !strings.EqualFold(s.Facility, sendingFacility) {
+			continue
+		}
+		for _, a := range s.Addresses {
+			if p, err := parsePrefix(a); err == nil && p.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR range, or an IP address as a range of one.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+var facilityCode = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// NormalizeFacilityCode upper-cases a facility code and checks it is 2 to 10
+// letters or digits.
+func NormalizeFacilityCode(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !facilityCode.MatchString(code) {
+		return "", errors.New("facility code must be 2 to 10 letters or digits")
+	}
+	return code, nil
+}
+
+// CurrentFacility loads the facility the context is scoped to.
+func CurrentFacility(ctx context.Context) (*Facility, error) {
+	facilityID, ok := FacilityFromContext(ctx)
+	if !ok {
+		return nil, ErrNoFacility
+	}
+	var facility Facility
+	if err := DB.Collection("facilities").FindOne(ctx, bson.M{"_id": facilityID}).Decode(&facility); err != nil {
+		return nil, err
+	}
+	return &facility, nil
+}
+
+// FacilityByCode loads a facility by its code.
+func FacilityByCode(ctx context.Context, code string) (*Facility, error) {
+	var facility Facility
+	if err := DB.Collection("facilities").FindOne(ctx, bson.M{"code": strings.ToUpper(code)}).Decode(&facility); err != nil {
+		return nil, err
+	}
+	return &facility, nil
+}
+
+// MigrateFacilities moves data created before facilities existed into a
+// default facility, using the FACILITY_CODE code, which it creates if needed.
+// It only touches documents without a facilityId, so it is cheap to run at
+// every startup.
+func MigrateFacilities(ctx context.Context) error {
+	orphan := bson.M{"facilityId": bson.M{"$exists": false}}
+	orphanUser := bson.M{"facilityId": bson.M{"$exists": false}, "role": bson.M{"$ne": "superadmin"}}
+
+	found := false
+	for _, c := range []struct {
+		name   string
+		filter bson.M
+	}{{"users", orphanUser}, {"patients", orphan}, {"reports", orphan}} {
+		n, err := DB.Collection(c.name).CountDocuments(ctx, c.filter, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		found = found || n > 0
+	}
+	if !found {
+		return nil
+	}
+
+	var facility Facility
+	err := DB.Collection("facilities").FindOneAndUpdate(ctx,
+		bson.M{"code": MRN.Facility},
+		bson.M{"$setOnInsert": bson.M{"name": "Default facility", "code": MRN.Facility, "createdAt": time.Now()}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&facility)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{"$set": bson.M{"facilityId": facility.ID}}
+	if _, err := DB.Collection("users").UpdateMany(ctx, orphanUser, set); err != nil {
+		return err
+	}
+	for _, name := range []string{"patients", "reports", "audit_logs"} {
+		if _, err := DB.Collection(name).UpdateMany(ctx, orphan, set); err != nil {
+			return err
+		}
+	}
+
+	// MRNs used to be unique across the whole database; they are now unique
+	// per facility.
+	if _, err := DB.Collection("patients").Indexes().DropOne(ctx, "patients_mrn_unique"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// EnsureSuperAdmin creates a super-admin account with the given email and
+// password hash unless a user with that email already exists.
+func EnsureSuperAdmin(ctx context.Context, email, passwordHash string) (bool, error) {
+	res, err := DB.Collection("users").UpdateOne(ctx,
+		bson.M{"email": email},
+		bson.M{"$setOnInsert": User{
+			FullName:  "Administrator",
+			Email:     email,
+			Password:  passwordHash,
+			Role:      "superadmin",
+			CreatedAt: time.Now(),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// HL7Message is an HL7 v2 message waiting in, or delivered from, the HL7
+// outbox. It goes through the same statuses as a Notification.
+type HL7Message struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FacilityID    primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	Type          string             `bson:"type" json:"type"`           // e.g. "ORU^R01"
+	ControlID     string             `bson:"controlId" json:"controlId"` // MSH-10, echoed in the acknowledgment
+	ReportID      primitive.ObjectID `bson:"reportId,omitempty" json:"reportId,omitempty"`
+	Payload       string             `bson:"payload" json:"payload"` // the message, segments separated by CR
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	MaxAttempts   int                `bson:"maxAttempts" json:"maxAttempts"`
+	LastError     string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	History       []HL7Attempt       `bson:"history,omitempty" json:"history,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	SentAt        *time.Time         `bson:"sentAt,omitempty" json:"sentAt,omitempty"`
+}
+
+// HL7Attempt is an entry of an HL7 message's delivery history.
+type HL7Attempt struct {
+	At     time.Time          `bson:"at" json:"at"`
+	Status string             `bson:"status" json:"status"`
+	Ack    string             `bson:"ack,omitempty" json:"ack,omitempty"` // the receiver's MSA-1, such as "AA"
+	Error  string             `bson:"error,omitempty" json:"error,omitempty"`
+	By     primitive.ObjectID `bson:"by,omitempty" json:"by,omitempty"` // who retried it
+}
+
+// DefaultHL7Attempts is how many times an HL7 message is sent before it is
+// dead-lettered.
+const DefaultHL7Attempts = 8
+
+// ClaimHL7Message atomically picks the next HL7 message due, in any
+// facility, marks it as sending and counts the attempt. It returns
+// mongo.ErrNoDocuments when there is nothing to do.
+func ClaimHL7Message(ctx context.Context) (*HL7Message, error) {
+	var m HL7Message
+	if err := claimOutbox(ctx, "hl7_messages", &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// CompleteHL7Message records the outcome of a delivery attempt; see
+// CompleteNotification.
+func CompleteHL7Message(ctx context.Context, m *HL7Message, attempt HL7Attempt, permanent bool) error {
+	set := bson.M{}
+	if attempt.Error == "" {
+		attempt.Status = NotificationSent
+		set["status"] = NotificationSent
+		set["sentAt"] = attempt.At
+	} else {
+		set["lastError"] = attempt.Error
+		if permanent || m.Attempts >= m.MaxAttempts {
+			attempt.Status = NotificationDead
+		} else {
+			attempt.Status = NotificationFailed
+			set["nextAttemptAt"] = attempt.At.Add(NotificationBackoff(m.Attempts))
+		}
+		set["status"] = attempt.Status
+	}
+	_, err := DB.Collection("hl7_messages").UpdateOne(ctx,
+		bson.M{"_id": m.ID, "status": NotificationSending},
+		bson.M{"$set": set, "$push": bson.M{"history": attempt}})
+	return err
+}
+
+// RetryHL7Message queues a failed or dead HL7 message of the facility in ctx
+// again with a fresh set of attempts. It returns ErrNotRetryable for
+// messages in any other state.
+func RetryHL7Message(ctx context.Context, id, by primitive.ObjectID) (*HL7Message, error) {
+	now := time.Now()
+	update := bson.M{
+		"$set":  bson.M{"status": NotificationQueued, "attempts": 0, "nextAttemptAt": now},
+		"$push": bson.M{"history": HL7Attempt{At: now, Status: NotificationQueued, By: by}},
+	}
+	var m HL7Message
+	err := Scoped("hl7_messages").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{NotificationFailed, NotificationDead}}},
+		update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		if count, _ := Scoped("hl7_messages").CountDocuments(ctx, bson.M{"_id": id}); count > 0 {
+			return nil, ErrNotRetryable
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyPatientUser is the shape patients had when they were stored as users
+// with the "patient" role.
+type legacyPatientUser struct {
+	ID          primitive.ObjectID   `bson:"_id"`
+	FullName    string               `bson:"fullName"`
+	Email       string               `bson:"email"`
+	Password    string               `bson:"password,omitempty"`
+	CreatedBy   primitive.ObjectID   `bson:"createdBy,omitempty"`
+	CreatedAt   time.Time            `bson:"createdAt"`
+	Age         int                  `bson:"age,omitempty"`
+	PhoneNumber string               `bson:"phoneNumber,omitempty"`
+	Notes       string               `bson:"notes,omitempty"`
+	MRN         string               `bson:"mrn,omitempty"`
+	DateOfBirth *time.Time           `bson:"dateOfBirth,omitempty"`
+	Sex         string               `bson:"sex,omitempty"`
+	SharedWith  []primitive.ObjectID `bson:"sharedWith,omitempty"`
+	ArchivedAt  *time.Time           `bson:"archivedAt,omitempty"`
+	ArchivedBy  primitive.ObjectID   `bson:"archivedBy,omitempty"`
+	MergedInto  primitive.ObjectID   `bson:"mergedInto,omitempty"`
+}
+
+// PatientMigrationResult summarizes a MigratePatientsToProfiles run.
+type PatientMigrationResult struct {
+	Migrated     int // patient profiles created
+	Accounts     int // users kept as portal accounts
+	UsersRemoved int // password-less users that only existed as patient records
+}
+
+// MigratePatientsToProfiles moves patients stored as "patient" users into the
+// patients collection. Each profile keeps the user's ObjectID so existing
+// reports still point at it. Users with a password stay as portal accounts
+// linked to their profile, stripped of clinical fields; users without one
+// were never able to log in and are removed. Running it again is harmless.
+func MigratePatientsToProfiles(ctx context.Context) (PatientMigrationResult, error) {
+	var result PatientMigrationResult
+	users := DB.Collection("users")
+	patients := DB.Collection("patients")
+
+	cursor, err := users.Find(ctx, bson.M{"role": "patient", "patientId": bson.M{"$exists": false}})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var legacy legacyPatientUser
+		if err := cursor.Decode(&legacy); err != nil {
+			return result, err
+		}
+
+		patient := Patient{
+			ID:          legacy.ID,
+			MRN:         legacy.MRN,
+			FullName:    legacy.FullName,
+			Email:       legacy.Email,
+			PhoneNumber: legacy.PhoneNumber,
+			DateOfBirth: legacy.DateOfBirth,
+			Sex:         legacy.Sex,
+			Age:         legacy.Age,
+			Notes:       legacy.Notes,
+			CreatedBy:   legacy.CreatedBy,
+			CreatedAt:   legacy.CreatedAt,
+			CareTeam:    careTeamFromShares(legacy.SharedWith, legacy.CreatedAt),
+			ArchivedAt:  legacy.ArchivedAt,
+			ArchivedBy:  legacy.ArchivedBy,
+			MergedInto:  legacy.MergedInto,
+		}
+		hasAccount := legacy.Password != "" && legacy.Email != ""
+		if hasAccount {
+			patient.AccountID = legacy.ID
+		}
+
+		_, err := patients.UpdateOne(ctx, bson.M{"_id": patient.ID}, bson.M{"$setOnInsert": patient}, options.Update().SetUpsert(true))
+		if err != nil {
+			return result, fmt.Errorf("creating profile for patient %s: %w", legacy.ID.Hex(), err)
+		}
+		result.Migrated++
+
+		if hasAccount {
+			_, err = users.UpdateOne(ctx, bson.M{"_id": legacy.ID}, bson.M{
+				"$set": bson.M{"patientId": legacy.ID},
+				"$unset": bson.M{
+					"age": "", "phoneNumber": "", "notes": "", "mrn": "", "dateOfBirth": "", "sex": "",
+					"sharedWith": "", "archivedAt": "", "archivedBy": "", "mergedInto": "",
+				},
+			})
+			result.Accounts++
+		} else {
+			_, err = users.DeleteOne(ctx, bson.M{"_id": legacy.ID})
+			result.UsersRemoved++
+		}
+		if err != nil {
+			return result, fmt.Errorf("updating user for patient %s: %w", legacy.ID.Hex(), err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return result, err
+	}
+
+	// The search and MRN indexes used to live on users; they are now on patients.
+	for _, name := range []string{"users_text_search", "users_mrn_unique"} {
+		if _, err := users.Indexes().DropOne(ctx, name); err != nil && !isIndexNotFound(err) {
+			slog.WarnContext(ctx, "Could not drop legacy index", "index", name, "error", err)
+		}
+	}
+	return result, nil
+}
+
+// careTeamFromShares turns the doctors a patient used to be shared with into
+// care team members. Sharing used to grant full access, so they get write access.
+func careTeamFromShares(sharedWith []primitive.ObjectID, since time.Time) []CareTeamMember {
+	var team []CareTeamMember
+	for _, id := range sharedWith {
+		team = append(team, CareTeamMember{DoctorID: id, Access: AccessWrite, GrantedAt: since})
+	}
+	return team
+}
+
+// MigrateCareTeams converts the sharedWith lists of patients shared before
+// care teams existed into care team members with write access. It only
+// touches patients that still have a sharedWith field, so it is cheap to run
+// at every startup.
+func MigrateCareTeams(ctx context.Context) error {
+	_, err := DB.Collection("patients").UpdateMany(ctx,
+		bson.M{"sharedWith": bson.M{"$exists": true}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"careTeam": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$careTeam", bson.A{}}},
+				bson.M{"$map": bson.M{
+					"input": "$sharedWith",
+					"as":    "doctorId",
+					"in":    bson.M{"doctorId": "$$doctorId", "access": AccessWrite, "grantedAt": "$createdAt"},
+				}},
+			}}}}},
+			{{Key: "$unset", Value: "sharedWith"}},
+		})
+	return err
+}
+
+// isIndexNotFound reports whether err is MongoDB's IndexNotFound error.
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 27
+}
@@ -2,39 +2,314 @@ package models
 
 import (
 	"context"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
+	"fracture-detection-webapp/metrics"
+	"fracture-detection-webapp/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 var DB *mongo.Database
 
-func InitMongo() {
-	mongoURI := os.Getenv("MONGO_URI")
-	dbName := os.Getenv("MONGO_DB")
+// Client is the connection DB was opened from, needed to start sessions.
+var Client *mongo.Client
+
+// InitMongo connects to the MongoDB server at mongoURI and opens dbName, then
+// creates indexes and migrates older data. A server that cannot be reached
+// yet, as when the API starts alongside it, is tried again with growing
+// pauses until wait has passed.
+func InitMongo(mongoURI, dbName string, wait time.Duration) error {
+	slog.Info("Using database", "database", dbName)
+
+	monitor := combineMonitors(metrics.MongoMonitor(), tracing.MongoMonitor())
+	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI).SetMonitor(monitor))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		return err
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancelPing := context.WithTimeout(ctx, 5*time.Second)
+		err = client.Ping(pingCtx, readpref.Primary())
+		cancelPing()
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			client.Disconnect(context.Background())
+			return fmt.Errorf("still unreachable after %d attempts over %s: %w", attempt, wait, err)
+		}
+		slog.Warn("MongoDB is not reachable yet", "retryIn", delay.String(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+	Client = client
+	DB = client.Database(dbName)
 
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017" // Default value if not set
+	if err := EnsureIndexes(context.Background()); err != nil {
+		slog.Warn("Could not create MongoDB indexes", "error", err)
+	}
+	if err := MigrateCareTeams(context.Background()); err != nil {
+		slog.Warn("Could not migrate shared patients to care teams", "error", err)
 	}
-	if dbName == "" {
-		dbName = "fracture_detection_db" // Default value if not set
+	if err := MigrateFacilities(context.Background()); err != nil {
+		slog.Warn("Could not move existing data into the default facility", "error", err)
 	}
+	return nil
+}
 
-	log.Printf("Connecting to MongoDB at URI: %s", mongoURI)
-	log.Printf("Using database: %s", dbName)
+// combineMonitors returns a command monitor passing each event to all of
+// monitors, as the driver only takes one.
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				m.Started(ctx, e)
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				m.Succeeded(ctx, e)
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				m.Failed(ctx, e)
+			}
+		},
+	}
+}
 
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
-	if err != nil {
-		panic(err)
+// PingMongo checks the database server answers.
+func PingMongo(ctx context.Context) error {
+	if Client == nil {
+		return errors.New("not connected")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	return Client.Ping(ctx, readpref.Primary())
+}
+
+// EnsureIndexes creates the indexes the handlers rely on. Creating an index
+// that already exists with the same definition is a no-op in MongoDB.
+func EnsureIndexes(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
-	err = client.Connect(ctx)
+
+	// Full-text index used by the search endpoint. Names weigh the most so a
+	// name hit outranks a word buried in the notes.
+	_, err := DB.Collection("patients").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "fullName", Value: "text"},
+			{Key: "email", Value: "text"},
+			{Key: "phoneNumber", Value: "text"},
+			{Key: "notes", Value: "text"},
+		},
+		Options: options.Index().
+			SetName("patients_text_search").
+			SetDefaultLanguage("none").
+			SetWeights(bson.M{"fullName": 10, "email": 5, "phoneNumber": 5, "notes": 1}),
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	DB = client.Database(dbName)
+
+	// Medical record numbers are unique within a facility; patients created
+	// before MRNs existed have none and are left out of the index.
+	_, err = DB.Collection("patients").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "facilityId", Value: 1}, {Key: "mrn", Value: 1}},
+		Options: options.Index().
+			SetName("patients_facility_mrn_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"mrn": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Collection("patients").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "accountId", Value: 1}},
+		Options: options.Index().SetName("patients_account").SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Collection("facilities").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetName("facilities_code_unique").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every tenant-scoped query filters on facilityId.
+	for _, name := range []string{"users", "patients", "reports", "notifications", "webhooks"} {
+		_, err = DB.Collection(name).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "facilityId", Value: 1}},
+			Options: options.Index().SetName(name + "_facility"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The outbox worker looks for due notifications; reports list theirs.
+	_, err = DB.Collection("notifications").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+			Options: options.Index().SetName("notifications_due"),
+		},
+		{
+			Keys:    bson.D{{Key: "reportId", Value: 1}, {Key: "createdAt", Value: -1}},
+			Options: options.Index().SetName("notifications_report"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Collection("webhook_deliveries").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+			Options: options.Index().SetName("webhook_deliveries_due"),
+		},
+		{
+			Keys:    bson.D{{Key: "webhookId", Value: 1}, {Key: "createdAt", Value: -1}},
+			Options: options.Index().SetName("webhook_deliveries_webhook"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Collection("hl7_messages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+			Options: options.Index().SetName("hl7_messages_due"),
+		},
+		{
+			Keys:    bson.D{{Key: "facilityId", Value: 1}, {Key: "createdAt", Value: -1}},
+			Options: options.Index().SetName("hl7_messages_facility"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// STOW-RS stores an instance once per facility; QIDO-RS queries by study.
+	_, err = DB.Collection("dicom_instances").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "facilityId", Value: 1}, {Key: "sopInstanceUid", Value: 1}},
+			Options: options.Index().SetName("dicom_instances_sop_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "facilityId", Value: 1}, {Key: "studyInstanceUid", Value: 1}, {Key: "seriesInstanceUid", Value: 1}},
+			Options: options.Index().SetName("dicom_instances_study"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Collection("analysis_jobs").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+		Options: options.Index().SetName("analysis_jobs_due"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Single sign-on users are found by their identity at the provider, and
+	// sign-ins in progress are dropped once they can no longer complete.
+	_, err = DB.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "oidcIssuer", Value: 1}, {Key: "oidcSubject", Value: 1}},
+		Options: options.Index().
+			SetName("users_oidc_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"oidcSubject": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = DB.Collection("oidc_logins").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "state", Value: 1}},
+			Options: options.Index().SetName("oidc_logins_state_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "createdAt", Value: 1}},
+			Options: options.Index().SetName("oidc_logins_ttl").SetExpireAfterSeconds(int32(OIDCLoginTTL.Seconds())),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// API keys are looked up by hash on every request they authenticate.
+	_, err = DB.Collection("api_keys").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "keyHash", Value: 1}},
+			Options: options.Index().SetName("api_keys_hash_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "facilityId", Value: 1}, {Key: "serviceAccountId", Value: 1}},
+			Options: options.Index().SetName("api_keys_account"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Collection("reports").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "fractureType", Value: "text"},
+			{Key: "comments", Value: "text"},
+		},
+		Options: options.Index().
+			SetName("reports_text_search").
+			SetDefaultLanguage("none").
+			SetWeights(bson.M{"fractureType": 5, "comments": 1}),
+	})
+	return err
+}
+
+// RunInTransaction runs fn inside a multi-document transaction. Transactions
+// need a replica set; on a standalone server fn is run without one so local
+// development setups keep working.
+func RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	if isTransactionUnsupported(err) {
+		slog.WarnContext(ctx, "MongoDB does not support transactions here, running without one")
+		return fn(ctx)
+	}
+	return err
+}
+
+// isTransactionUnsupported reports whether err is the IllegalOperation error a
+// standalone server returns for transactional commands.
+func isTransactionUnsupported(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 20
 }
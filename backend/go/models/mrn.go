@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MRNSettings controls how medical record numbers are generated.
+//
+// Format is a template in which {FACILITY} is replaced by the facility code,
+// {YYYY} and {YY} by the current year and {SEQ:n} by a per-facility sequence
+// number zero-padded to n digits. When the template contains a year, the
+// sequence restarts every year.
+type MRNSettings struct {
+	Format   string
+	Facility string
+}
+
+// DefaultMRNFormat is used when MRN_FORMAT is not set, e.g. "FX-2025-000042".
+const DefaultMRNFormat = "{FACILITY}-{YYYY}-{SEQ:6}"
+
+// MRN holds the active MRN settings; see ConfigureMRN.
+var MRN = MRNSettings{Format: DefaultMRNFormat, Facility: "FX"}
+
+var seqToken = regexp.MustCompile(`\{SEQ(?::(\d+))?\}`)
+
+// CheckMRNFormat checks an MRN format template; "" stands for the default.
+func CheckMRNFormat(format string) error {
+	if format != "" && len(seqToken.FindAllString(format, -1)) != 1 {
+		return errors.New("MRN format must contain exactly one {SEQ} or {SEQ:n} placeholder")
+	}
+	return nil
+}
+
+// ConfigureMRN validates and installs the MRN settings. Empty values keep the defaults.
+func ConfigureMRN(format, facility string) error {
+	if format == "" {
+		format = DefaultMRNFormat
+	}
+	if facility == "" {
+		facility = MRN.Facility
+	}
+	if err := CheckMRNFormat(format); err != nil {
+		return err
+	}
+	MRN = MRNSettings{Format: format, Facility: strings.ToUpper(facility)}
+	return nil
+}
+
+// NextMRN allocates the next medical record number for the given facility
+// code, using the active MRN format.
+func NextMRN(ctx context.Context, facility string) (string, error) {
+	settings := MRN
+	now := time.Now()
+	scope := "mrn:" + facility
+	if strings.Contains(settings.Format, "{YYYY}") || strings.Contains(settings.Format, "{YY}") {
+		scope += ":" + strconv.Itoa(now.Year())
+	}
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := DB.Collection("counters").FindOneAndUpdate(ctx,
+		bson.M{"_id": scope},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return "", fmt.Errorf("allocating MRN sequence: %w", err)
+	}
+
+	mrn := strings.NewReplacer(
+		"{FACILITY}", facility,
+		"{YYYY}", strconv.Itoa(now.Year()),
+		"{YY}", fmt.Sprintf("%02d", now.Year()%100),
+	).Replace(settings.Format)
+	mrn = seqToken.ReplaceAllStringFunc(mrn, func(tok string) string {
+		width := 0
+		if m := seqToken.FindStringSubmatch(tok); m[1] != "" {
+			width, _ = strconv.Atoi(m[1])
+		}
+		return fmt.Sprintf("%0*d", width, counter.Seq)
+	})
+	return mrn, nil
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Notification statuses. A notification is queued, picked up by the outbox
+// worker (sending), then either sent or failed; failed notifications are
+// retried with backoff until they run out of attempts and become dead.
+const (
+	NotificationQueued  = "queued"
+	NotificationSending = "sending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+	NotificationDead    = "dead"
+)
+
+// Notification channels.
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Notification is a message to a patient waiting in, or delivered from, the
+// outbox. The message itself is built when it is delivered, so a retry picks
+// up the current report.
+type Notification struct {
+	ID            primitive.ObjectID    `bson:"_id,omitempty" json:"id"`
+	FacilityID    primitive.ObjectID    `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	Channel       string                `bson:"channel" json:"channel"`   // ChannelEmail or ChannelSMS
+	Template      string                `bson:"template" json:"template"` // see package emails
+	ReportID      primitive.ObjectID    `bson:"reportId,omitempty" json:"reportId,omitempty"`
+	PatientID     primitive.ObjectID    `bson:"patientId" json:"patientId"`
+	Recipient     string                `bson:"recipient" json:"recipient"` // email address or phone number
+	Attach        []string              `bson:"attach,omitempty" json:"attach,omitempty"`
+	Status        string                `bson:"status" json:"status"`
+	Attempts      int                   `bson:"attempts" json:"attempts"`
+	MaxAttempts   int                   `bson:"maxAttempts" json:"maxAttempts"`
+	LastError     string                `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttemptAt time.Time             `bson:"nextAttemptAt" json:"nextAttemptAt"` // when queued or failed; the lease expiry while sending
+	History       []NotificationAttempt `bson:"history,omitempty" json:"history,omitempty"`
+	CreatedBy     primitive.ObjectID    `bson:"createdBy" json:"createdBy"`
+	CreatedAt     time.Time             `bson:"createdAt" json:"createdAt"`
+	SentAt        *time.Time            `bson:"sentAt,omitempty" json:"sentAt,omitempty"`
+}
+
+// NotificationAttempt is an entry of a notification's delivery history.
+type NotificationAttempt struct {
+	At     time.Time          `bson:"at" json:"at"`
+	Status string             `bson:"status" json:"status"`
+	Error  string             `bson:"error,omitempty" json:"error,omitempty"`
+	By     primitive.ObjectID `bson:"by,omitempty" json:"by,omitempty"` // who queued or retried it
+}
+
+// DefaultNotificationAttempts is how many times a notification is tried
+// before it is dead-lettered.
+const DefaultNotificationAttempts = 6
+
+// notificationLease is how long a notification stays claimed by a worker. A
+// worker that dies mid-delivery leaves it "sending"; it is picked up again
+// once the lease expires.
+const notificationLease = 5 * time.Minute
+
+// ErrNotRetryable is returned when retrying a notification or webhook
+// delivery that is not failed or dead.
+var ErrNotRetryable = errors.New("only failed or dead notifications can be retried")
+
+// NotificationBackoff is the delay before the next attempt after the given
+// number of failed attempts: 30s, 1m, 2m, ... capped at one hour.
+func NotificationBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
+
+// ClaimNotification atomically picks the next notification due for delivery,
+// in any facility, marks it as sending and counts the attempt. It returns
+// mongo.ErrNoDocuments when there is nothing to do.
+func ClaimNotification(ctx context.Context) (*Notification, error) {
+	var n Notification
+	if err := claimOutbox(ctx, "notifications", &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// claimOutbox claims the next item due of an outbox collection, whose items
+// have the status, attempts and nextAttemptAt fields of a Notification, and
+// decodes it into out.
+func claimOutbox(ctx context.Context, collection string, out interface{}) error {
+	now := time.Now()
+	filter := bson.M{
+		"status":        bson.M{"$in": bson.A{NotificationQueued, NotificationFailed, NotificationSending}},
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.M{"status": NotificationSending, "nextAttemptAt": now.Add(notificationLease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+	return DB.Collection(collection).FindOneAndUpdate(ctx, filter, update, opts).Decode(out)
+}
+
+// CompleteNotification records the outcome of a delivery attempt. A failed
+// attempt is retried after NotificationBackoff, or dead-lettered when the
+// notification has no attempts left or retrying cannot help.
+func CompleteNotification(ctx context.Context, n *Notification, sendErr error, permanent bool) error {
+	now := time.Now()
+	entry := NotificationAttempt{At: now, Status: NotificationSent}
+	set := bson.M{}
+	if sendErr == nil {
+		set["status"] = NotificationSent
+		set["sentAt"] = now
+	} else {
+		entry.Status = NotificationFailed
+		entry.Error = sendErr.Error()
+		set["lastError"] = entry.Error
+		if permanent || n.Attempts >= n.MaxAttempts {
+			entry.Status = NotificationDead
+			set["status"] = NotificationDead
+		} else {
+			set["status"] = NotificationFailed
+			set["nextAttemptAt"] = now.Add(NotificationBackoff(n.Attempts))
+		}
+	}
+	_, err := DB.Collection("notifications").UpdateOne(ctx,
+		bson.M{"_id": n.ID, "status": NotificationSending},
+		bson.M{"$set": set, "$push": bson.M{"history": entry}})
+	return err
+}
+
+// RetryNotification puts a failed or dead notification of the facility in
+// ctx back in the queue with a fresh set of attempts.
+func RetryNotification(ctx context.Context, id, by primitive.ObjectID) (*Notification, error) {
+	now := time.Now()
+	update := bson.M{
+		"$set":  bson.M{"status": NotificationQueued, "attempts": 0, "nextAttemptAt": now},
+		"$push": bson.M{"history": NotificationAttempt{At: now, Status: NotificationQueued, By: by}},
+	}
+	var n Notification
+	err := Scoped("notifications").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{NotificationFailed, NotificationDead}}},
+		update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&n)
+	if err == mongo.ErrNoDocuments {
+		if count, _ := Scoped("notifications").CountDocuments(ctx, bson.M{"_id": id}); count > 0 {
+			return nil, ErrNotRetryable
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Access levels a user can have on a patient, from least to most.
+const (
+	AccessNone  = ""
+	AccessRead  = "read"  // view the patient and their reports
+	AccessWrite = "write" // also edit the patient and create, delete or send reports
+	AccessOwner = "owner" // also manage the care team
+)
+
+// Patient holds a patient's clinical identity and demographics. It is
+// separate from User: a patient only has a login if AccountID points to a
+// User with the "patient" role giving them access to the patient portal.
+type Patient struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MRN         string             `bson:"mrn,omitempty" json:"mrn,omitempty"` // medical record number, unique per facility
+	FullName    string             `bson:"fullName" json:"fullName"`
+	Email       string             `bson:"email,omitempty" json:"email,omitempty"` // contact address, used for notifications
+	PhoneNumber string             `bson:"phoneNumber,omitempty" json:"phoneNumber,omitempty"`
+	DateOfBirth *time.Time         `bson:"dateOfBirth,omitempty" json:"dateOfBirth,omitempty"`
+	Sex         string             `bson:"sex,omitempty" json:"sex,omitempty"` // "male", "female", "other" or "unknown"
+	Age         int                `bson:"age,omitempty" json:"age,omitempty"`
+	Locale      string             `bson:"locale,omitempty" json:"locale,omitempty"`                           // language of notifications, such as "fr"; English when empty
+	Channel     string             `bson:"notificationChannel,omitempty" json:"notificationChannel,omitempty"` // preferred ChannelEmail or ChannelSMS; email, then SMS, when empty
+	Notes       string             `bson:"notes,omitempty" json:"notes,omitempty"`
+	FacilityID  primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	AccountID   primitive.ObjectID `bson:"accountId,omitempty" json:"accountId,omitempty"` // portal login, if any
+	CreatedBy   primitive.ObjectID `bson:"createdBy" json:"createdBy"`                     // the owning doctor, who registered the patient
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	CareTeam    []CareTeamMember   `bson:"careTeam,omitempty" json:"careTeam,omitempty"` // doctors given access besides the owner
+	ArchivedAt  *time.Time         `bson:"archivedAt,omitempty" json:"archivedAt,omitempty"`
+	ArchivedBy  primitive.ObjectID `bson:"archivedBy,omitempty" json:"archivedBy,omitempty"`
+	MergedInto  primitive.ObjectID `bson:"mergedInto,omitempty" json:"mergedInto,omitempty"` // surviving record after a merge
+}
+
+// CareTeamMember is a doctor other than the owner given access to a patient.
+type CareTeamMember struct {
+	DoctorID  primitive.ObjectID `bson:"doctorId" json:"doctorId"`
+	Access    string             `bson:"access" json:"access"` // AccessRead or AccessWrite
+	GrantedBy primitive.ObjectID `bson:"grantedBy,omitempty" json:"grantedBy,omitempty"`
+	GrantedAt time.Time          `bson:"grantedAt" json:"grantedAt"`
+}
+
+// AccessFor returns the access level the given user has on the patient.
+// Chefs administer every patient and are treated as owners; service accounts
+// can add to any.
+func (p *Patient) AccessFor(userID primitive.ObjectID, role string) string {
+	switch {
+	case role == "chef", role == "doctor" && p.CreatedBy == userID:
+		return AccessOwner
+	case role == "doctor":
+		for _, m := range p.CareTeam {
+			if m.DoctorID == userID {
+				return m.Access
+			}
+		}
+	case role == "service":
+		return AccessWrite
+	case role == "patient" && p.AccountID == userID:
+		return AccessRead
+	}
+	return AccessNone
+}
+
+// CanWrite reports whether an access level allows modifying the patient.
+func CanWrite(access string) bool {
+	return access == AccessWrite || access == AccessOwner
+}
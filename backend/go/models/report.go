@@ -1,25 +1,56 @@
 package models
 
 import (
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Report statuses. A report is a draft until its doctor signs it.
+const (
+	ReportDraft  = "draft"
+	ReportSigned = "signed"
+)
+
 // Report represents a single fracture analysis report in the database.
 type Report struct {
 	ID                   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	PatientID            primitive.ObjectID `bson:"patientId" json:"patientId"`
 	DoctorID             primitive.ObjectID `bson:"doctorId" json:"doctorId"`
+	FacilityID           primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
 	ImageName            string             `bson:"imageName" json:"imageName"`
 	AnnotatedImage       string             `bson:"annotatedImage,omitempty" json:"annotatedImage,omitempty"`
 	FractureType         string             `bson:"fractureType" json:"fractureType"`
 	RecoveryTime         string             `bson:"recoveryTime" json:"recoveryTime"`
 	Confidence           *float64           `bson:"confidence,omitempty" json:"confidence,omitempty"`
 	AnnotatedImageBase64 *string            `bson:"annotatedImageBase64,omitempty" json:"annotatedImageBase64,omitempty"`
+	Comments             string             `bson:"comments,omitempty" json:"comments,omitempty"` // free-text clinician comments
+	Version              int                `bson:"version,omitempty" json:"version,omitempty"`   // incremented on every amendment; 0 means 1
+	Status               string             `bson:"status,omitempty" json:"status,omitempty"`     // ReportDraft or ReportSigned; empty means draft
+	SignedBy             primitive.ObjectID `bson:"signedBy,omitempty" json:"signedBy,omitempty"`
+	SignedAt             *time.Time         `bson:"signedAt,omitempty" json:"signedAt,omitempty"`
+	DicomInstanceID      primitive.ObjectID `bson:"dicomInstanceId,omitempty" json:"dicomInstanceId,omitempty"` // the DICOM instance analyzed, for reports created over DICOMweb
 	CreatedAt            time.Time          `bson:"createdAt" json:"createdAt"`
 }
 
+// IsSigned reports whether the report has been signed.
+func (r *Report) IsSigned() bool {
+	return r.Status == ReportSigned
+}
+
+// RecoveryDays parses the recovery estimate, stored as "<n> days". It
+// reports false for estimates in any other form.
+func (r *Report) RecoveryDays() (int, bool) {
+	n, unit, ok := strings.Cut(strings.TrimSpace(r.RecoveryTime), " ")
+	if !ok || (unit != "days" && unit != "day") {
+		return 0, false
+	}
+	days, err := strconv.Atoi(n)
+	return days, err == nil
+}
+
 // AnalyzeResponse represents the expected response from the Python backend.
 type AnalyzeResponse struct {
 	Detected     bool     `json:"detected"`
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OIDCLoginTTL is how long a user has to sign in at the identity provider.
+const OIDCLoginTTL = 10 * time.Minute
+
+// OIDCLogin is a single sign-on in progress, between the redirect to the
+// identity provider and its callback. It belongs to no facility yet.
+type OIDCLogin struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	State     string             `bson:"state"`
+	Nonce     string             `bson:"nonce"`
+	Verifier  string             `bson:"verifier"` // PKCE code verifier
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+// SaveOIDCLogin records a sign-in started.
+func SaveOIDCLogin(ctx context.Context, l *OIDCLogin) error {
+	l.ID = primitive.NewObjectID()
+	l.CreatedAt = time.Now()
+	_, err := DB.Collection("oidc_logins").InsertOne(ctx, l)
+	return err
+}
+
+// TakeOIDCLogin removes and returns the sign-in with the given state, so it
+// can only complete once. It returns mongo.ErrNoDocuments when there is none
+// or it has expired.
+func TakeOIDCLogin(ctx context.Context, state string) (*OIDCLogin, error) {
+	var l OIDCLogin
+	err := DB.Collection("oidc_logins").FindOneAndDelete(ctx, bson.M{
+		"state":     state,
+		"createdAt": bson.M{"$gt": time.Now().Add(-OIDCLoginTTL)},
+	}).Decode(&l)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoFacility is returned by scoped collections used with a context that
+// carries no facility, so a missing scope never falls back to all tenants.
+var ErrNoFacility = errors.New("no facility in context")
+
+type facilityKey struct{}
+
+// WithFacility returns a context scoped to the given facility.
+func WithFacility(ctx context.Context, facilityID primitive.ObjectID) context.Context {
+	return context.WithValue(ctx, facilityKey{}, facilityID)
+}
+
+// FacilityFromContext returns the facility a context is scoped to.
+func FacilityFromContext(ctx context.Context) (primitive.ObjectID, bool) {
+	facilityID, ok := ctx.Value(facilityKey{}).(primitive.ObjectID)
+	return facilityID, ok && !facilityID.IsZero()
+}
+
+// ScopedCollection wraps a collection holding per-facility documents. Every
+// query it runs is restricted to the facility of the context it is called
+// with, and every document it inserts is stamped with that facility.
+// Only the operations below are exposed, so there is no unscoped way around it.
+type ScopedCollection struct {
+	coll *mongo.Collection
+}
+
+// Scoped returns the named collection restricted to the caller's facility.
+// Handlers must use it for users, patients, reports and audit logs.
+func Scoped(name string) *ScopedCollection {
+	return &ScopedCollection{coll: DB.Collection(name)}
+}
+
+// scope adds the context's facility to a filter.
+func scope(ctx context.Context, filter interface{}) (bson.M, error) {
+	facilityID, ok := FacilityFromContext(ctx)
+	if !ok {
+		return nil, ErrNoFacility
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{"facilityId": facilityID}}}, nil
+}
+
+// stamp converts a document to bson.D and sets its facilityId.
+func stamp(ctx context.Context, document interface{}) (bson.D, error) {
+	facilityID, ok := FacilityFromContext(ctx)
+	if !ok {
+		return nil, ErrNoFacility
+	}
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	for i := range doc {
+		if doc[i].Key == "facilityId" {
+			doc[i].Value = facilityID
+			return doc, nil
+		}
+	}
+	return append(doc, bson.E{Key: "facilityId", Value: facilityID}), nil
+}
+
+func (s *ScopedCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.coll.Find(ctx, f, opts...)
+}
+
+func (s *ScopedCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return s.coll.FindOne(ctx, f, opts...)
+}
+
+func (s *ScopedCollection) FindOneAndUpdate(ctx context.Context, filter, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return s.coll.FindOneAndUpdate(ctx, f, update, opts...)
+}
+
+func (s *ScopedCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.coll.CountDocuments(ctx, f, opts...)
+}
+
+func (s *ScopedCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := stamp(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+	return s.coll.InsertOne(ctx, doc, opts...)
+}
+
+func (s *ScopedCollection) UpdateOne(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.coll.UpdateOne(ctx, f, update, opts...)
+}
+
+func (s *ScopedCollection) UpdateMany(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.coll.UpdateMany(ctx, f, update, opts...)
+}
+
+func (s *ScopedCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.coll.DeleteOne(ctx, f, opts...)
+}
+
+func (s *ScopedCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	f, err := scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.coll.DeleteMany(ctx, f, opts...)
+}
+
+// Aggregate scopes the pipeline's leading $match stage, or prepends one.
+// Merging into an existing $match keeps $text queries in the first stage,
+// where MongoDB requires them.
+func (s *ScopedCollection) Aggregate(ctx context.Context, pipeline mongo.Pipeline, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	var match interface{} = bson.M{}
+	rest := pipeline
+	if len(pipeline) > 0 && len(pipeline[0]) == 1 && pipeline[0][0].Key == "$match" {
+		match, rest = pipeline[0][0].Value, pipeline[1:]
+	}
+	f, err := scope(ctx, match)
+	if err != nil {
+		return nil, err
+	}
+	scoped := append(mongo.Pipeline{{{Key: "$match", Value: f}}}, rest...)
+	return s.coll.Aggregate(ctx, scoped, opts...)
+}
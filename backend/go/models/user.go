@@ -7,18 +7,41 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// User represents a user in the database, who can be a chef, doctor, or patient.
+// Account statuses. Users created before statuses existed have none and are active.
+const (
+	UserActive    = "active"
+	UserSuspended = "suspended" // cannot log in, and existing tokens are rejected
+)
+
+// User represents a login account, which can belong to a chef, a doctor, or a
+// patient using the portal. A patient's clinical data lives in Patient.
+// Super-admins manage facilities and are the only users without one.
 type User struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	FullName    string             `bson:"fullName" json:"fullName"`
 	Email       string             `bson:"email" json:"email"`
 	Password    string             `bson:"password,omitempty" json:"-"`
-	Role        string             `bson:"role" json:"role"`                               // "chef", "doctor", or "patient"
+	Role        string             `bson:"role" json:"role"` // "superadmin", "chef", "doctor", "patient", or "service"
+	FacilityID  primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
 	CreatedBy   primitive.ObjectID `bson:"createdBy,omitempty" json:"createdBy,omitempty"` // chef creates doctors, doctor creates patients
 	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
-	Age         int                `bson:"age,omitempty" json:"age,omitempty"`
-	PhoneNumber string             `bson:"phoneNumber,omitempty" json:"phoneNumber,omitempty"`
-	Notes       string             `bson:"notes,omitempty" json:"notes,omitempty"`
+	PatientID   primitive.ObjectID `bson:"patientId,omitempty" json:"patientId,omitempty"` // for patient accounts, the linked Patient
+	Status      string             `bson:"status,omitempty" json:"status,omitempty"`       // UserActive or UserSuspended
+	SuspendedAt *time.Time         `bson:"suspendedAt,omitempty" json:"suspendedAt,omitempty"`
+	LastLoginAt *time.Time         `bson:"lastLoginAt,omitempty" json:"lastLoginAt,omitempty"`
+	DoctorID    primitive.ObjectID `bson:"doctorId,omitempty" json:"doctorId,omitempty"` // for service accounts, the doctor owning what they create
+	OIDCIssuer  string             `bson:"oidcIssuer,omitempty" json:"-"`                // for single sign-on, the identity provider
+	OIDCSubject string             `bson:"oidcSubject,omitempty" json:"-"`               // and the user's ID there
+}
+
+// UsesSSO reports whether the account signs in through the identity provider.
+func (u *User) UsesSSO() bool {
+	return u.OIDCSubject != ""
+}
+
+// IsSuspended reports whether the account has been suspended.
+func (u *User) IsSuspended() bool {
+	return u.Status == UserSuspended
 }
 
 // HashPassword hashes the user's password
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Webhook events.
+const (
+	EventReportCreated = "report.created"
+	EventReportSigned  = "report.signed"
+	EventReportAmended = "report.amended"
+	EventReportDeleted = "report.deleted"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to.
+var WebhookEvents = []string{EventReportCreated, EventReportSigned, EventReportAmended, EventReportDeleted}
+
+// Webhook is a facility's subscription to report events, delivered as
+// signed JSON POSTs to URL.
+type Webhook struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FacilityID  primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	URL         string             `bson:"url" json:"url"`
+	Events      []string           `bson:"events" json:"events"`
+	Secret      string             `bson:"secret" json:"-"` // HMAC-SHA256 key; only shown when set
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Active      bool               `bson:"active" json:"active"`
+	CreatedBy   primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   *time.Time         `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to one webhook. It goes
+// through the same statuses as a Notification.
+type WebhookDelivery struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FacilityID    primitive.ObjectID `bson:"facilityId,omitempty" json:"facilityId,omitempty"`
+	WebhookID     primitive.ObjectID `bson:"webhookId" json:"webhookId"`
+	EventID       string             `bson:"eventId" json:"eventId"` // shared by the deliveries of one event
+	Event         string             `bson:"event" json:"event"`
+	Payload       string             `bson:"payload" json:"payload"` // the JSON body, exactly as signed
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	MaxAttempts   int                `bson:"maxAttempts" json:"maxAttempts"`
+	LastError     string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	History       []WebhookAttempt   `bson:"history,omitempty" json:"history,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	DeliveredAt   *time.Time         `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+}
+
+// WebhookAttempt is an entry of a delivery's history.
+type WebhookAttempt struct {
+	At         time.Time          `bson:"at" json:"at"`
+	Status     string             `bson:"status" json:"status"`
+	StatusCode int                `bson:"statusCode,omitempty" json:"statusCode,omitempty"` // the receiver's HTTP response
+	Duration   int64              `bson:"durationMs,omitempty" json:"durationMs,omitempty"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+	By         primitive.ObjectID `bson:"by,omitempty" json:"by,omitempty"` // who replayed it
+}
+
+// DefaultWebhookAttempts is how many times a delivery is tried before it is
+// dead-lettered.
+const DefaultWebhookAttempts = 8
+
+// ClaimWebhookDelivery atomically picks the next delivery due, in any
+// facility, marks it as sending and counts the attempt. It returns
+// mongo.ErrNoDocuments when there is nothing to do.
+func ClaimWebhookDelivery(ctx context.Context) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	if err := claimOutbox(ctx, "webhook_deliveries", &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// CompleteWebhookDelivery records the outcome of a delivery attempt; see
+// CompleteNotification.
+func CompleteWebhookDelivery(ctx context.Context, d *WebhookDelivery, attempt WebhookAttempt, permanent bool) error {
+	set := bson.M{}
+	if attempt.Error == "" {
+		attempt.Status = NotificationSent
+		set["status"] = NotificationSent
+		set["deliveredAt"] = attempt.At
+	} else {
+		set["lastError"] = attempt.Error
+		if permanent || d.Attempts >= d.MaxAttempts {
+			attempt.Status = NotificationDead
+		} else {
+			attempt.Status = NotificationFailed
+			set["nextAttemptAt"] = attempt.At.Add(NotificationBackoff(d.Attempts))
+		}
+		set["status"] = attempt.Status
+	}
+	_, err := DB.Collection("webhook_deliveries").UpdateOne(ctx,
+		bson.M{"_id": d.ID, "status": NotificationSending},
+		bson.M{"$set": set, "$push": bson.M{"history": attempt}})
+	return err
+}
+
+// ReplayWebhookDelivery queues a failed or dead delivery of the facility in
+// ctx again with a fresh set of attempts. It returns ErrNotRetryable for
+// deliveries in any other state.
+func ReplayWebhookDelivery(ctx context.Context, id, by primitive.ObjectID) (*WebhookDelivery, error) {
+	now := time.Now()
+	update := bson.M{
+		"$set":  bson.M{"status": NotificationQueued, "attempts": 0, "nextAttemptAt": now},
+		"$push": bson.M{"history": WebhookAttempt{At: now, Status: NotificationQueued, By: by}},
+	}
+	var d WebhookDelivery
+	err := Scoped("webhook_deliveries").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{NotificationFailed, NotificationDead}}},
+		update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		if count, _ := Scoped("webhook_deliveries").CountDocuments(ctx, bson.M{"_id": id}); count > 0 {
+			return nil, ErrNotRetryable
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
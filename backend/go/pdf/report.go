@@ -0,0 +1,233 @@
+// Package pdf renders fracture reports as PDF documents, the canonical form
+// of a report for emailing and archiving.
+package pdf
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/models"
+	"fracture-detection-webapp/utils"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// ReportDocument gathers everything printed on a report PDF.
+type ReportDocument struct {
+	Facility    models.Facility
+	Patient     models.Patient
+	Doctor      models.User
+	Report      models.Report
+	GeneratedAt time.Time
+}
+
+// The report is set in DejaVu Sans Condensed, embedded in the PDF, so that
+// names and addresses print in any Latin, Greek or Cyrillic script.
+const font = "DejaVu"
+
+var (
+	//go:embed fonts/DejaVuSansCondensed.ttf
+	fontRegular []byte
+	//go:embed fonts/DejaVuSansCondensed-Bold.ttf
+	fontBold []byte
+)
+
+const (
+	margin     = 15.0
+	pageWidth  = 210.0 // A4, in millimetres
+	pageHeight = 297.0
+	bodyWidth  = pageWidth - 2*margin
+	labelWidth = 45.0
+	lineHeight = 6.0
+)
+
+// RenderReport writes the PDF of a report to w.
+func RenderReport(w io.Writer, doc ReportDocument) error {
+	if doc.GeneratedAt.IsZero() {
+		doc.GeneratedAt = time.Now()
+	}
+	version := max(doc.Report.Version, 1)
+
+	p := fpdf.New("P", "mm", "A4", "")
+	p.SetMargins(margin, margin, margin)
+	p.SetAutoPageBreak(true, 20)
+	p.AliasNbPages("{nb}")
+	p.SetTitle(fmt.Sprintf("Fracture report %s v%d", doc.Report.ID.Hex(), version), true)
+	p.SetAuthor(doc.Facility.Name, true)
+	p.SetCreationDate(doc.GeneratedAt)
+	p.AddUTF8FontFromBytes(font, "", fontRegular)
+	p.AddUTF8FontFromBytes(font, "B", fontBold)
+
+	logo := ""
+	if img, kind, err := decodeImage(doc.Facility.LogoBase64); err == nil {
+		logo = "facility-logo"
+		p.RegisterImageOptionsReader(logo, fpdf.ImageOptions{ImageType: kind}, bytes.NewReader(img))
+	}
+
+	p.SetHeaderFunc(func() {
+		textX := margin
+		if logo != "" {
+			p.ImageOptions(logo, margin, margin, 0, 16, false, fpdf.ImageOptions{}, 0, "")
+			textX = margin + 30
+		}
+		p.SetXY(textX, margin)
+		p.SetFont(font, "B", 14)
+		p.CellFormat(100, 7, doc.Facility.Name, "", 2, "L", false, 0, "")
+		p.SetFont(font, "", 8)
+		p.SetTextColor(90, 90, 90)
+		for _, line := range []string{doc.Facility.ReportHeader, doc.Facility.Address, doc.Facility.Phone} {
+			if line != "" {
+				p.CellFormat(100, 4, line, "", 2, "L", false, 0, "")
+			}
+		}
+
+		p.SetXY(pageWidth-margin-60, margin)
+		p.SetTextColor(0, 0, 0)
+		p.SetFont(font, "B", 12)
+		p.CellFormat(60, 7, "Medical Report", "", 2, "R", false, 0, "")
+		p.SetFont(font, "", 8)
+		p.SetTextColor(180, 0, 0)
+		p.CellFormat(60, 4, "CONFIDENTIAL", "", 2, "R", false, 0, "")
+		p.SetTextColor(0, 0, 0)
+
+		p.SetDrawColor(200, 200, 200)
+		p.Line(margin, margin+20, pageWidth-margin, margin+20)
+		p.SetY(margin + 25)
+	})
+	p.SetFooterFunc(func() {
+		p.SetY(-15)
+		p.SetFont(font, "", 8)
+		p.SetTextColor(120, 120, 120)
+		p.CellFormat(bodyWidth/2, 5, fmt.Sprintf("Report %s, version %d, generated %s",
+			doc.Report.ID.Hex(), version, doc.GeneratedAt.Format("2006-01-02 15:04 MST")), "", 0, "L", false, 0, "")
+		p.CellFormat(bodyWidth/2, 5, fmt.Sprintf("Page %d of {nb}", p.PageNo()), "", 0, "R", false, 0, "")
+	})
+
+	p.AddPage()
+	p.SetFont(font, "B", 16)
+	p.CellFormat(bodyWidth, 10, "Fracture Analysis Report", "", 1, "L", false, 0, "")
+	p.Ln(2)
+
+	section(p, "Patient")
+	field(p, "Full name", doc.Patient.FullName)
+	field(p, "MRN", doc.Patient.MRN)
+	if doc.Patient.DateOfBirth != nil {
+		field(p, "Date of birth", doc.Patient.DateOfBirth.Format("2006-01-02"))
+	}
+	if doc.Patient.Age > 0 {
+		field(p, "Age", fmt.Sprintf("%d", doc.Patient.Age))
+	}
+	field(p, "Sex", doc.Patient.Sex)
+
+	section(p, "Examination")
+	field(p, "Report date", doc.Report.CreatedAt.Format("2006-01-02 15:04"))
+	field(p, "Reporting doctor", doc.Doctor.FullName)
+	field(p, "Image", doc.Report.ImageName)
+	field(p, "Report version", fmt.Sprintf("%d", version))
+
+	section(p, "Findings")
+	fracture := doc.Report.FractureType
+	if fracture == "" {
+		fracture = "No fracture detected"
+	}
+	field(p, "Fracture type", fracture)
+	if doc.Report.Confidence != nil {
+		field(p, "Confidence", fmt.Sprintf("%.0f%%", *doc.Report.Confidence*100))
+	}
+	field(p, "Estimated recovery", doc.Report.RecoveryTime)
+	field(p, "Comments", doc.Report.Comments)
+
+	if img, kind, err := decodeImage(doc.Report.AnnotatedImage); err == nil {
+		section(p, "Annotated image")
+		info := p.RegisterImageOptionsReader("annotated", fpdf.ImageOptions{ImageType: kind}, bytes.NewReader(img))
+		if p.Ok() {
+			w, h := fitImage(info.Width(), info.Height(), bodyWidth, 120)
+			if p.GetY()+h > pageHeight-25 {
+				p.AddPage()
+			}
+			p.ImageOptions("annotated", margin+(bodyWidth-w)/2, p.GetY(), w, h, false, fpdf.ImageOptions{}, 0, "")
+			p.SetY(p.GetY() + h + 4)
+		}
+	}
+
+	signatureBlock(p, doc)
+
+	if err := p.Error(); err != nil {
+		return err
+	}
+	return p.Output(w)
+}
+
+// signatureBlock prints the reporting doctor's attestation, on a new page if
+// it would otherwise be split.
+func signatureBlock(p *fpdf.Fpdf, doc ReportDocument) {
+	if p.GetY()+45 > pageHeight-25 {
+		p.AddPage()
+	}
+	section(p, "Signature")
+	p.SetFont(font, "", 10)
+	p.MultiCell(bodyWidth, 5, "I have reviewed the images and the automated analysis above and confirm this report.", "", "L", false)
+	p.Ln(10)
+
+	y := p.GetY()
+	p.SetDrawColor(0, 0, 0)
+	p.Line(margin, y, margin+80, y)
+	p.Line(pageWidth-margin-60, y, pageWidth-margin, y)
+	p.SetFont(font, "", 9)
+	p.SetXY(margin, y+1)
+	p.CellFormat(80, 5, doc.Doctor.FullName, "", 0, "L", false, 0, "")
+	p.SetX(pageWidth - margin - 60)
+	p.CellFormat(60, 5, "Date", "", 1, "L", false, 0, "")
+}
+
+func section(p *fpdf.Fpdf, title string) {
+	p.Ln(3)
+	p.SetFont(font, "B", 12)
+	p.SetFillColor(240, 240, 240)
+	p.CellFormat(bodyWidth, 8, title, "", 1, "L", true, 0, "")
+	p.Ln(1)
+}
+
+// field prints a label and its value, wrapping long values. Empty values are
+// shown as "N/A".
+func field(p *fpdf.Fpdf, label, value string) {
+	if strings.TrimSpace(value) == "" {
+		value = "N/A"
+	}
+	p.SetFont(font, "B", 10)
+	p.CellFormat(labelWidth, lineHeight, label, "", 0, "L", false, 0, "")
+	p.SetFont(font, "", 10)
+	p.MultiCell(bodyWidth-labelWidth, lineHeight, value, "", "L", false)
+}
+
+// fitImage scales an image to fit in a box, keeping its aspect ratio.
+func fitImage(w, h, maxW, maxH float64) (float64, float64) {
+	if w <= 0 || h <= 0 {
+		return maxW, maxH
+	}
+	scale := min(maxW/w, maxH/h)
+	return w * scale, h * scale
+}
+
+// decodeImage decodes a base64 PNG or JPEG and returns it with its fpdf
+// image type.
+func decodeImage(s string) ([]byte, string, error) {
+	img, contentType, err := utils.DecodeBase64Image(s)
+	if err != nil {
+		return nil, "", err
+	}
+	if contentType == "image/png" {
+		return img, "PNG", nil
+	}
+	return img, "JPG", nil
+}
+
+// ValidateImage checks that s is a base64 PNG or JPEG that can be printed.
+func ValidateImage(s string) error {
+	_, _, err := decodeImage(s)
+	return err
+}
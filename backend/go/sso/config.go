@@ -0,0 +1,159 @@
+// Package sso signs staff in with an OpenID Connect identity provider, using
+// the authorization code flow with PKCE, and maps their groups to roles.
+package sso
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Config describes the identity provider. Single sign-on is disabled when
+// Issuer is empty.
+type Config struct {
+	Issuer       string   `yaml:"issuer"` // issuer URL, where /.well-known/openid-configuration is found
+	ClientID     string   `yaml:"clientId"`
+	ClientSecret string   `yaml:"clientSecret"` // optional; public clients rely on PKCE alone
+	RedirectURL  string   `yaml:"redirectUrl"`  // the API's callback, such as https://api.example.com/api/auth/oidc/callback
+	Scopes       []string `yaml:"scopes"`
+	GroupsClaim  string   `yaml:"groupsClaim"`  // claim listing the user's groups or roles
+	ChefGroups   []string `yaml:"chefGroups"`   // groups whose members sign in as chefs
+	DoctorGroups []string `yaml:"doctorGroups"` // groups whose members sign in as doctors
+	// FacilityClaim names a claim holding the code of the user's facility;
+	// users without it join Facility.
+	FacilityClaim string `yaml:"facilityClaim"`
+	Facility      string `yaml:"facility"`
+	PostLoginURL  string `yaml:"postLoginUrl"` // web app page the browser is sent back to, with the token or an error
+}
+
+// DefaultConfig is used for anything not set in the environment or the
+// config file.
+var DefaultConfig = Config{
+	Scopes:      []string{"openid", "profile", "email"},
+	GroupsClaim: "groups",
+}
+
+// ConfigFromEnv overrides cfg with the OIDC_* variables that are set. The
+// post-login page defaults to the web app's /login page under appURL.
+func ConfigFromEnv(cfg Config, appURL string) (Config, error) {
+	for key, dst := range map[string]*string{
+		"OIDC_ISSUER":         &cfg.Issuer,
+		"OIDC_CLIENT_ID":      &cfg.ClientID,
+		"OIDC_CLIENT_SECRET":  &cfg.ClientSecret,
+		"OIDC_REDIRECT_URL":   &cfg.RedirectURL,
+		"OIDC_GROUPS_CLAIM":   &cfg.GroupsClaim,
+		"OIDC_FACILITY_CLAIM": &cfg.FacilityClaim,
+		"OIDC_FACILITY":       &cfg.Facility,
+		"OIDC_POST_LOGIN_URL": &cfg.PostLoginURL,
+	} {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	for key, dst := range map[string]*[]string{
+		"OIDC_SCOPES":        &cfg.Scopes,
+		"OIDC_CHEF_GROUPS":   &cfg.ChefGroups,
+		"OIDC_DOCTOR_GROUPS": &cfg.DoctorGroups,
+	} {
+		if v := os.Getenv(key); v != "" {
+			*dst = splitList(v)
+		}
+	}
+	if cfg.PostLoginURL == "" {
+		if base := strings.TrimRight(appURL, "/"); base != "" {
+			cfg.PostLoginURL = base + "/login"
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Enabled reports whether single sign-on is configured.
+func (c Config) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// Validate checks that an enabled configuration is complete.
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, v := range []struct{ name, url string }{
+		{"OIDC_ISSUER", c.Issuer},
+		{"OIDC_REDIRECT_URL", c.RedirectURL},
+		{"OIDC_POST_LOGIN_URL", c.PostLoginURL},
+	} {
+		u, err := url.Parse(v.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid %s %q, expected an http(s) URL", v.name, v.url)
+		}
+	}
+	if c.ClientID == "" {
+		return errors.New("OIDC_CLIENT_ID is required")
+	}
+	if !slices.Contains(c.Scopes, "openid") {
+		return errors.New(`OIDC_SCOPES must include "openid"`)
+	}
+	if len(c.ChefGroups) == 0 && len(c.DoctorGroups) == 0 {
+		return errors.New("set OIDC_CHEF_GROUPS or OIDC_DOCTOR_GROUPS, or nobody can sign in")
+	}
+	if c.FacilityClaim == "" && c.Facility == "" {
+		return errors.New("set OIDC_FACILITY or OIDC_FACILITY_CLAIM")
+	}
+	return nil
+}
+
+// Role returns the role granted by a user's groups: chef takes precedence
+// over doctor, and "" means none.
+func (c Config) Role(groups []string) string {
+	for _, g := range groups {
+		if slices.Contains(c.ChefGroups, g) {
+			return "chef"
+		}
+	}
+	for _, g := range groups {
+		if slices.Contains(c.DoctorGroups, g) {
+			return "doctor"
+		}
+	}
+	return ""
+}
+
+var (
+	configMu sync.RWMutex
+	config   = DefaultConfig
+	provider *oidcProvider // discovered on first use; see current
+)
+
+// Configure installs the configuration returned by Current.
+func Configure(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	configMu.Lock()
+	config = cfg
+	provider = nil
+	configMu.Unlock()
+	return nil
+}
+
+// Current returns the configuration installed with Configure.
+func Current() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
@@ -0,0 +1,183 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrDisabled is returned when single sign-on is not configured.
+var ErrDisabled = errors.New("single sign-on is not configured")
+
+// oidcProvider is the identity provider, as discovered from its issuer.
+type oidcProvider struct {
+	provider *oidc.Provider
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// current returns the configuration and its provider, discovering the
+// provider the first time it is needed. A provider that cannot be reached is
+// looked up again on the next sign-in rather than failing the startup.
+func current(ctx context.Context) (Config, *oidcProvider, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if !config.Enabled() {
+		return config, nil, ErrDisabled
+	}
+	if provider == nil {
+		p, err := oidc.NewProvider(ctx, config.Issuer)
+		if err != nil {
+			return config, nil, fmt.Errorf("discovering %s: %w", config.Issuer, err)
+		}
+		provider = &oidcProvider{
+			provider: p,
+			oauth: oauth2.Config{
+				ClientID:     config.ClientID,
+				ClientSecret: config.ClientSecret,
+				RedirectURL:  config.RedirectURL,
+				Endpoint:     p.Endpoint(),
+				Scopes:       config.Scopes,
+			},
+			verifier: p.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		}
+	}
+	return config, provider, nil
+}
+
+// Login holds what a sign-in needs to remember between the redirect to the
+// identity provider and the callback.
+type Login struct {
+	State    string // echoed back by the provider, identifies the sign-in
+	Nonce    string // bound into the ID token
+	Verifier string // PKCE code verifier
+}
+
+// NewLogin returns random values for a new sign-in.
+func NewLogin() (Login, error) {
+	var l Login
+	for _, v := range []*string{&l.State, &l.Nonce} {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return Login{}, err
+		}
+		*v = base64.RawURLEncoding.EncodeToString(b)
+	}
+	l.Verifier = oauth2.GenerateVerifier()
+	return l, nil
+}
+
+// AuthURL returns the provider's authorization URL the browser is sent to
+// for a sign-in.
+func AuthURL(ctx context.Context, l Login) (string, error) {
+	_, p, err := current(ctx)
+	if err != nil {
+		return "", err
+	}
+	return p.oauth.AuthCodeURL(l.State, oidc.Nonce(l.Nonce), oauth2.S256ChallengeOption(l.Verifier)), nil
+}
+
+// Identity is who the provider says signed in.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+	Facility      string // facility code, from the configured claim
+	Role          string // mapped from Groups; "" when none applies
+}
+
+// Exchange redeems the authorization code of a sign-in and verifies the ID
+// token it returns. Claims missing from the ID token are looked up at the
+// provider's userinfo endpoint.
+func Exchange(ctx context.Context, l Login, code string) (*Identity, error) {
+	cfg, p, err := current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(l.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no ID token in the token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verifying ID token: %w", err)
+	}
+	if idToken.Nonce != l.Nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	if claims["email"] == nil || claims[cfg.GroupsClaim] == nil ||
+		(cfg.FacilityClaim != "" && claims[cfg.FacilityClaim] == nil) {
+		if info, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token)); err == nil {
+			var extra map[string]any
+			if err := info.Claims(&extra); err == nil && extra["sub"] == idToken.Subject {
+				for k, v := range extra {
+					if _, ok := claims[k]; !ok {
+						claims[k] = v
+					}
+				}
+			}
+		}
+	}
+
+	id := &Identity{
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		Email:    strings.ToLower(stringClaim(claims, "email")),
+		Name:     stringClaim(claims, "name"),
+		Groups:   listClaim(claims, cfg.GroupsClaim),
+		Facility: stringClaim(claims, cfg.FacilityClaim),
+	}
+	id.EmailVerified, _ = claims["email_verified"].(bool)
+	if id.Name == "" {
+		id.Name = strings.TrimSpace(stringClaim(claims, "given_name") + " " + stringClaim(claims, "family_name"))
+	}
+	if id.Name == "" {
+		id.Name = stringClaim(claims, "preferred_username")
+	}
+	if id.Facility == "" {
+		id.Facility = cfg.Facility
+	}
+	id.Role = cfg.Role(id.Groups)
+	return id, nil
+}
+
+func stringClaim(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return strings.TrimSpace(s)
+}
+
+// listClaim reads a claim holding either a list of strings or a single,
+// space- or comma-separated, string.
+func listClaim(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	}
+	return nil
+}
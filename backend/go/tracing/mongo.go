@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"fracture-detection-webapp/logging"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MongoMonitor returns a command monitor recording a client span for each
+// MongoDB command, under the span of the context the command runs with.
+// Command documents hold patient data, so only the command and collection
+// names are recorded. Commands run outside of a trace, such as the polling of
+// the background workers, are left out rather than each starting one.
+func MongoMonitor() *event.CommandMonitor {
+	tracer := Tracer("mongo")
+	var spans sync.Map // request ID → trace.Span
+	end := func(requestID int64, err string) {
+		s, ok := spans.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		span := s.(trace.Span)
+		if err != "" {
+			span.SetStatus(codes.Error, logging.Redact(err))
+		}
+		span.End()
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				return
+			}
+			name := e.CommandName
+			collection, ok := e.Command.Index(0).Value().StringValueOK()
+			if !ok {
+				collection, _ = e.Command.Lookup("collection").StringValueOK()
+			}
+			if collection != "" {
+				name += " " + collection
+			}
+			_, span := tracer.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemMongoDB,
+					semconv.DBOperationName(e.CommandName),
+					semconv.DBCollectionName(collection),
+					semconv.DBNamespace(e.DatabaseName),
+				),
+			)
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			end(e.RequestID, "")
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			end(e.RequestID, e.Failure)
+		},
+	}
+}
@@ -0,0 +1,150 @@
+// Package tracing records OpenTelemetry traces of API requests, MongoDB
+// commands, calls to the inference service and email sends, and exports them
+// over OTLP to a collector or to standard output.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"fracture-detection-webapp/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters.
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"   // OTLP over HTTP, to a collector
+	ExporterStdout = "stdout" // pretty-printed JSON, for local development
+)
+
+// Config describes where traces go.
+type Config struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"` // base URL of the OTLP/HTTP collector; traces go to /v1/traces
+	ServiceName string  `yaml:"serviceName"`
+	SampleRatio float64 `yaml:"sampleRatio"` // share of new traces recorded, from 0 to 1
+}
+
+// DefaultConfig is used for anything not set in the environment or the
+// config file. Tracing is off by default.
+var DefaultConfig = Config{
+	Exporter:    ExporterNone,
+	Endpoint:    "http://localhost:4318",
+	ServiceName: "fracture-detection-api",
+	SampleRatio: 1,
+}
+
+// ConfigFromEnv overrides cfg with the standard OTEL_TRACES_EXPORTER,
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER_ARG
+// variables, where they are set. "console" is accepted for stdout.
+func ConfigFromEnv(cfg Config) (Config, error) {
+	for key, dst := range map[string]*string{
+		"OTEL_TRACES_EXPORTER":        &cfg.Exporter,
+		"OTEL_EXPORTER_OTLP_ENDPOINT": &cfg.Endpoint,
+		"OTEL_SERVICE_NAME":           &cfg.ServiceName,
+	} {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q", v)
+		}
+		cfg.SampleRatio = ratio
+	}
+	cfg.Exporter = strings.ToLower(cfg.Exporter)
+	if cfg.Exporter == "console" {
+		cfg.Exporter = ExporterStdout
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the exporter is known and has what it needs.
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case ExporterNone, ExporterStdout:
+	case ExporterOTLP:
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint %q, expected an http(s) URL", c.Endpoint)
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter %q", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio %v is not between 0 and 1", c.SampleRatio)
+	}
+	return nil
+}
+
+// Setup installs the tracer provider for the configuration and the W3C trace
+// context propagator. The returned function flushes the spans still
+// buffered; it must be called before the process exits. Trace context is
+// propagated even when tracing is off, so that callers' traces carry on
+// through to the inference service.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Exporter == ExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterOTLP:
+		endpoint := strings.TrimRight(cfg.Endpoint, "/") + "/v1/traces"
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating the %s trace exporter: %w", cfg.Exporter, err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of an instrumented package.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("fracture-detection-webapp/" + name)
+}
+
+// Fail marks a span as failed. The error is recorded redacted, as in the
+// logs, since span data leaves the server.
+func Fail(span trace.Span, err error) {
+	msg := logging.Redact(err.Error())
+	span.AddEvent("exception", trace.WithAttributes(
+		attribute.String("exception.type", fmt.Sprintf("%T", err)),
+		attribute.String("exception.message", msg),
+	))
+	span.SetStatus(codes.Error, msg)
+}
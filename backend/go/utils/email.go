@@ -1,42 +1,263 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
-	"net/smtp"
-	"os"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"fracture-detection-webapp/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// SendEmailWithCreds sends an email using the provided credentials
-func SendEmailWithCreds(to, subject, body, emailUser, emailPass string) error {
-	if emailUser == "" {
-		log.Println("EMAIL_USER is missing!")
+// Attachment is a file sent along with an email. Attachments with a
+// ContentID are inline images, referenced from the HTML body as
+// "cid:<ContentID>"; the others are regular attachments.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	ContentID   string
+}
+
+// Message is an email with an HTML body, a plain-text alternative and
+// optional attachments.
+type Message struct {
+	From        string
+	To          []string
+	ReplyTo     string
+	Subject     string
+	HTMLBody    string
+	TextBody    string
+	Attachments []Attachment
+}
+
+// Bytes encodes the message as RFC 5322 / MIME. The layout is
+//
+//	multipart/mixed
+//	├── multipart/related
+//	│   ├── multipart/alternative (text/plain, text/html)
+//	│   └── inline images
+//	└── attachments
+//
+// with the related level left out when there are no inline images.
+// Non-ASCII headers are RFC 2047-encoded.
+func (m *Message) Bytes() ([]byte, error) {
+	if len(m.To) == 0 {
+		return nil, errors.New("email has no recipient")
+	}
+	var inline, attached []Attachment
+	for _, a := range m.Attachments {
+		if a.ContentID != "" {
+			inline = append(inline, a)
+		} else {
+			attached = append(attached, a)
+		}
+	}
+
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	if m.From != "" {
+		header.Set("From", encodeAddress(m.From))
+	}
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		to[i] = encodeAddress(addr)
+	}
+	header.Set("To", strings.Join(to, ", "))
+	if m.ReplyTo != "" {
+		header.Set("Reply-To", encodeAddress(m.ReplyTo))
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+
+	mixed := multipart.NewWriter(&buf)
+	header.Set("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	writeHeader(&buf, header)
+
+	body := mixed
+	if len(inline) > 0 {
+		related, err := nestedWriter(mixed, "related")
+		if err != nil {
+			return nil, err
+		}
+		body = related
+	}
+	if err := writeAlternative(body, m.TextBody, m.HTMLBody); err != nil {
+		return nil, err
+	}
+	for _, a := range inline {
+		if err := writeAttachment(body, a, "inline"); err != nil {
+			return nil, err
+		}
+	}
+	if body != mixed {
+		if err := body.Close(); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range attached {
+		if err := writeAttachment(mixed, a, "attachment"); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAlternative writes the text and HTML versions of the body as a
+// multipart/alternative part, plain text first as RFC 2046 requires.
+func writeAlternative(parent *multipart.Writer, text, html string) error {
+	alt, err := nestedWriter(parent, "alternative")
+	if err != nil {
+		return err
+	}
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", text},
+		{"text/html; charset=UTF-8", html},
+	} {
+		if part.content == "" {
+			continue
+		}
+		pw, err := alt.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := io.WriteString(qp, part.content); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	return alt.Close()
+}
+
+// nestedWriter starts a multipart part of the given subtype inside parent.
+func nestedWriter(parent *multipart.Writer, subtype string) (*multipart.Writer, error) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	w, err := parent.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/" + subtype + "; boundary=" + boundary}})
+	if err != nil {
+		return nil, err
+	}
+	child := multipart.NewWriter(w)
+	return child, child.SetBoundary(boundary)
+}
+
+// writeAttachment writes a base64-encoded file part.
+func writeAttachment(parent *multipart.Writer, a Attachment, disposition string) error {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(a.Data)
 	}
-	if emailPass == "" {
-		log.Println("EMAIL_PASSWORD is missing!")
+	header := textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": a.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})},
 	}
-	if emailUser == "" || emailPass == "" {
-		return fmt.Errorf("email credentials not set")
+	if a.ContentID != "" {
+		header.Set("Content-ID", "<"+a.ContentID+">")
 	}
+	w, err := parent.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	// Base64 lines must not exceed 76 characters.
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(w, encoded+"\r\n")
+	return err
+}
 
-	smtpHost := "smtp.gmail.com"
-	smtpPort := "587"
-	auth := smtp.PlainAuth("", emailUser, emailPass, smtpHost)
+func writeHeader(w io.Writer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Reply-To", "Subject", "Date", "MIME-Version", "Content-Type"} {
+		if v := header.Get(key); v != "" {
+			fmt.Fprintf(w, "%s: %s\r\n", key, v)
+		}
+	}
+	io.WriteString(w, "\r\n")
+}
 
-	// Compose the message
-	msg := []byte("To: " + to + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"MIME-version: 1.0;\r\n" +
-		"Content-Type: text/html; charset=\"UTF-8\";\r\n\r\n" +
-		body)
+// encodeAddress RFC 2047-encodes the display name of an address such as
+// "José Núñez <jose@example.com>". Bare addresses are returned as is.
+func encodeAddress(addr string) string {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+	return parsed.String()
+}
+
+// addressOnly strips the display name from an address.
+func addressOnly(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		return parsed.Address
+	}
+	return addr
+}
 
-	addr := smtpHost + ":" + smtpPort
-	return smtp.SendMail(addr, auth, emailUser, []string{to}, msg)
+// DecodeBase64Image decodes a base64 PNG or JPEG, optionally given as a data
+// URI, and returns it with its MIME type.
+func DecodeBase64Image(s string) ([]byte, string, error) {
+	if s == "" {
+		return nil, "", errors.New("no image")
+	}
+	if i := strings.Index(s, ";base64,"); strings.HasPrefix(s, "data:") && i >= 0 {
+		s = s[i+len(";base64,"):]
+	}
+	img, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, "", err
+	}
+	switch contentType := http.DetectContentType(img); contentType {
+	case "image/png", "image/jpeg":
+		return img, contentType, nil
+	}
+	return nil, "", errors.New("unsupported image type")
+}
+
+// SendMessage sends a message with the configured mailer; see ConfigureMailer.
+// Sends are traced, without the addresses or the subject.
+func SendMessage(ctx context.Context, m *Message) error {
+	ctx, span := tracing.Tracer("mail").Start(ctx, "email send", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("mail.transport", CurrentMailerConfig().Transport),
+			attribute.Int("mail.recipients", len(m.To)),
+			attribute.Int("mail.attachments", len(m.Attachments)),
+		))
+	defer span.End()
+	err := currentMailer().Send(ctx, m)
+	if err != nil {
+		tracing.Fail(span, err)
+	}
+	return err
 }
 
-// SendEmail sends an email using Gmail SMTP and env vars
+// SendEmail sends an HTML email with the configured mailer.
 func SendEmail(to, subject, body string) error {
-	emailUser := os.Getenv("EMAIL_USER")
-	emailPass := os.Getenv("EMAIL_PASSWORD")
-	return SendEmailWithCreds(to, subject, body, emailUser, emailPass)
+	return SendMessage(context.Background(), &Message{To: []string{to}, Subject: subject, HTMLBody: body})
 }
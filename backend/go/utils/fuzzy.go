@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenize lower-cases s and splits it into words on anything that is not a
+// letter or a digit.
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// DigitsOnly strips everything but the digits from s, which is how phone
+// numbers are compared regardless of the separators they were typed with.
+func DigitsOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// maxTypos is the number of edits tolerated for a query token of the given
+// length. Very short tokens must match exactly or they would match anything.
+func maxTypos(n int) int {
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Levenshtein returns the edit distance between a and b.
+func Levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// prefixDistance is the smallest edit distance between token and any prefix
+// of word, so "hume" and "humr" both match "humerus".
+func prefixDistance(token, word string) int {
+	rw := []rune(word)
+	n := len([]rune(token))
+	best := -1
+	for l := max(0, n-2); l <= min(len(rw), n+2); l++ {
+		d := Levenshtein(token, string(rw[:l]))
+		if best < 0 || d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// TokenScore rates how well a single query token matches a single word:
+// 1 for an exact match, 0.9 for a prefix, and less for each typo. It returns
+// 0 when the token does not match at all.
+func TokenScore(token, word string) float64 {
+	switch {
+	case token == word:
+		return 1
+	case strings.HasPrefix(word, token):
+		return 0.9
+	}
+	allowed := maxTypos(len([]rune(token)))
+	if allowed == 0 {
+		return 0
+	}
+	d := prefixDistance(token, word)
+	if d > allowed {
+		return 0
+	}
+	return 0.8 - 0.2*float64(d)
+}
+
+// FuzzyScore rates how well the query tokens match the given text fields.
+// Every token has to match some word for the score to be non-zero; the
+// result is the mean of the best per-token scores.
+func FuzzyScore(tokens []string, fields ...string) float64 {
+	if len(tokens) == 0 {
+		return 0
+	}
+	var words []string
+	for _, f := range fields {
+		words = append(words, Tokenize(f)...)
+	}
+
+	total := 0.0
+	for _, t := range tokens {
+		best := 0.0
+		for _, w := range words {
+			if s := TokenScore(t, w); s > best {
+				best = s
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total / float64(len(tokens))
+}
+
+// NameSimilarity rates how likely two person names refer to the same person,
+// from 0 (nothing in common) to 1 (same words). Word order is ignored, so
+// "Doe John" matches "John Doe", and each word tolerates a typo or two.
+func NameSimilarity(a, b string) float64 {
+	ta, tb := Tokenize(a), Tokenize(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	if len(ta) > len(tb) {
+		ta, tb = tb, ta
+	}
+
+	total := 0.0
+	for _, x := range ta {
+		best := 0.0
+		for _, y := range tb {
+			n := max(len([]rune(x)), len([]rune(y)))
+			d := Levenshtein(x, y)
+			if d > maxTypos(n) {
+				continue
+			}
+			best = max(best, 1-float64(d)/float64(n))
+		}
+		total += best
+	}
+	// Names with extra words (a middle name on one record only) score a bit lower.
+	return total / float64(len(ta)) * (0.9 + 0.1*float64(len(ta))/float64(len(tb)))
+}
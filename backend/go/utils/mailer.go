@@ -0,0 +1,467 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail transports.
+const (
+	TransportSMTP   = "smtp"
+	TransportFile   = "file"   // writes each message as an .eml file, for local development
+	TransportStdout = "stdout" // prints each message, for local development
+)
+
+// SMTP connection security modes.
+const (
+	TLSStartTLS = "starttls" // plain connection upgraded with STARTTLS, usually port 587
+	TLSImplicit = "tls"      // TLS from the first byte, usually port 465
+	TLSNone     = "none"     // no encryption, only for local relays
+)
+
+// SMTP authentication mechanisms.
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthNone    = "none"
+)
+
+// MailerConfig describes how outgoing email is delivered.
+type MailerConfig struct {
+	Transport string        `json:"transport" yaml:"transport"`
+	Host      string        `json:"host" yaml:"host"`
+	Port      int           `json:"port" yaml:"port"`
+	TLS       string        `json:"tls" yaml:"tls"`
+	Auth      string        `json:"auth" yaml:"auth"`
+	Username  string        `json:"username" yaml:"username"`
+	Password  string        `json:"password" yaml:"password"`
+	From      string        `json:"from" yaml:"from"`         // sender address
+	FromName  string        `json:"fromName" yaml:"fromName"` // sender display name
+	ReplyTo   string        `json:"replyTo" yaml:"replyTo"`
+	Dir       string        `json:"dir" yaml:"dir"` // output directory of the file transport
+	Timeout   time.Duration `json:"-" yaml:"timeout"`
+}
+
+// DefaultMailerConfig is used for anything not set in the environment or
+// the config file.
+var DefaultMailerConfig = MailerConfig{
+	Transport: TransportSMTP,
+	Port:      587,
+	TLS:       TLSStartTLS,
+	Auth:      AuthPlain,
+	Dir:       "mail",
+	Timeout:   30 * time.Second,
+}
+
+// MailerConfigFromEnv overrides cfg with the mailer environment.
+// MAILER_CONFIG may name a JSON file holding a MailerConfig; the SMTP_* and
+// MAIL_* variables override it. EMAIL_USER and EMAIL_PASSWORD are still
+// honoured as the username and password, with Gmail as the default host.
+func MailerConfigFromEnv(cfg MailerConfig) (MailerConfig, error) {
+	if path := os.Getenv("MAILER_CONFIG"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading mailer config: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing mailer config %s: %w", path, err)
+		}
+	}
+
+	setString := func(dst *string, keys ...string) {
+		for _, key := range keys {
+			if v := os.Getenv(key); v != "" {
+				*dst = v
+				return
+			}
+		}
+	}
+	setString(&cfg.Transport, "MAIL_TRANSPORT")
+	setString(&cfg.Host, "SMTP_HOST")
+	setString(&cfg.TLS, "SMTP_TLS")
+	setString(&cfg.Auth, "SMTP_AUTH")
+	setString(&cfg.Username, "SMTP_USERNAME", "EMAIL_USER")
+	setString(&cfg.Password, "SMTP_PASSWORD", "EMAIL_PASSWORD")
+	setString(&cfg.From, "MAIL_FROM")
+	setString(&cfg.FromName, "MAIL_FROM_NAME")
+	setString(&cfg.ReplyTo, "MAIL_REPLY_TO")
+	setString(&cfg.Dir, "MAIL_DIR")
+	if v := os.Getenv("SMTP_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SMTP_PORT %q", v)
+		}
+		cfg.Port = port
+	}
+
+	// Deployments configured with EMAIL_USER only keep using Gmail.
+	if cfg.Host == "" && cfg.Transport == TransportSMTP && cfg.Username != "" {
+		cfg.Host = "smtp.gmail.com"
+	}
+	if cfg.From == "" {
+		cfg.From = cfg.Username
+	}
+	cfg.Transport = strings.ToLower(cfg.Transport)
+	cfg.TLS = strings.ToLower(cfg.TLS)
+	cfg.Auth = strings.ToLower(cfg.Auth)
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration is usable. An SMTP configuration without
+// a host is accepted so the server can start without email; sending then fails.
+func (c MailerConfig) Validate() error {
+	switch c.Transport {
+	case TransportFile:
+		if c.Dir == "" {
+			return errors.New("the file mail transport needs a directory")
+		}
+	case TransportStdout:
+	case TransportSMTP:
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("invalid SMTP port %d", c.Port)
+		}
+		switch c.TLS {
+		case TLSStartTLS, TLSImplicit, TLSNone:
+		default:
+			return fmt.Errorf("unknown SMTP TLS mode %q", c.TLS)
+		}
+		switch c.Auth {
+		case AuthNone:
+		case AuthPlain, AuthLogin, AuthCRAMMD5:
+			if c.Host != "" && c.Username == "" {
+				return fmt.Errorf("SMTP auth %q needs a username", c.Auth)
+			}
+		default:
+			return fmt.Errorf("unknown SMTP auth mechanism %q", c.Auth)
+		}
+	default:
+		return fmt.Errorf("unknown mail transport %q", c.Transport)
+	}
+	if c.From != "" {
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			return fmt.Errorf("invalid from address %q", c.From)
+		}
+	}
+	if c.ReplyTo != "" {
+		if _, err := mail.ParseAddress(c.ReplyTo); err != nil {
+			return fmt.Errorf("invalid reply-to address %q", c.ReplyTo)
+		}
+	}
+	return nil
+}
+
+// Sender returns the From header value, with the display name if any.
+func (c MailerConfig) Sender() string {
+	if c.FromName == "" {
+		return c.From
+	}
+	return (&mail.Address{Name: c.FromName, Address: c.From}).String()
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	// Send delivers a message, filling in the configured sender and reply-to
+	// address when the message has none.
+	Send(ctx context.Context, m *Message) error
+	// Test checks the mailer can deliver, without sending anything.
+	Test(ctx context.Context) error
+}
+
+// NewMailer returns the Mailer for a configuration.
+func NewMailer(cfg MailerConfig) (Mailer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	switch cfg.Transport {
+	case TransportFile:
+		return &fileMailer{cfg: cfg}, nil
+	case TransportStdout:
+		return &writerMailer{cfg: cfg, w: os.Stdout}, nil
+	}
+	return &smtpMailer{cfg: cfg}, nil
+}
+
+var (
+	mailerMu  sync.RWMutex
+	mailer    Mailer = &smtpMailer{cfg: DefaultMailerConfig}
+	mailerCfg        = DefaultMailerConfig
+)
+
+// ConfigureMailer installs the mailer used by SendMessage.
+func ConfigureMailer(cfg MailerConfig) error {
+	m, err := NewMailer(cfg)
+	if err != nil {
+		return err
+	}
+	mailerMu.Lock()
+	mailer, mailerCfg = m, cfg
+	mailerMu.Unlock()
+	return nil
+}
+
+// CurrentMailerConfig returns the installed configuration with the password
+// removed, for display.
+func CurrentMailerConfig() MailerConfig {
+	mailerMu.RLock()
+	defer mailerMu.RUnlock()
+	cfg := mailerCfg
+	if cfg.Password != "" {
+		cfg.Password = "********"
+	}
+	return cfg
+}
+
+// TestMailer checks the configured mailer can deliver.
+func TestMailer(ctx context.Context) error {
+	return currentMailer().Test(ctx)
+}
+
+// PingMailer checks the configured SMTP server accepts connections, without
+// the TLS and authentication TestMailer goes through, so that it is cheap
+// enough for health checks. Other transports are tested as by TestMailer.
+func PingMailer(ctx context.Context) error {
+	cfg := CurrentMailerConfig()
+	if cfg.Transport != TransportSMTP {
+		return TestMailer(ctx)
+	}
+	if cfg.Host == "" {
+		return errors.New("SMTP host is not configured")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func currentMailer() Mailer {
+	mailerMu.RLock()
+	defer mailerMu.RUnlock()
+	return mailer
+}
+
+// withDefaults fills in the sender and reply-to address.
+func withDefaults(cfg MailerConfig, m *Message) {
+	if m.From == "" {
+		m.From = cfg.Sender()
+	}
+	if m.ReplyTo == "" {
+		m.ReplyTo = cfg.ReplyTo
+	}
+}
+
+// smtpMailer delivers messages to an SMTP server.
+type smtpMailer struct {
+	cfg MailerConfig
+}
+
+func (s *smtpMailer) Send(ctx context.Context, m *Message) error {
+	withDefaults(s.cfg, m)
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Mail(addressOnly(s.cfg.From)); err != nil {
+		return fmt.Errorf("smtp MAIL FROM: %w", err)
+	}
+	for _, to := range m.To {
+		if err := client.Rcpt(addressOnly(to)); err != nil {
+			return fmt.Errorf("smtp RCPT TO %s: %w", addressOnly(to), err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	return client.Quit()
+}
+
+func (s *smtpMailer) Test(ctx context.Context) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Quit()
+}
+
+// connect dials the server and goes through TLS and authentication.
+func (s *smtpMailer) connect(ctx context.Context) (*smtp.Client, error) {
+	cfg := s.cfg
+	if cfg.Host == "" {
+		return nil, errors.New("SMTP host is not configured")
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultMailerConfig.Timeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if cfg.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp greeting from %s: %w", addr, err)
+	}
+	if cfg.TLS == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("smtp STARTTLS: %w", err)
+		}
+	}
+
+	var auth smtp.Auth
+	switch cfg.Auth {
+	case AuthPlain:
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	case AuthLogin:
+		auth = &loginAuth{username: cfg.Username, password: cfg.Password}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(cfg.Username, cfg.Password)
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("smtp authentication: %w", err)
+		}
+	}
+	return client, nil
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp lacks but some
+// servers, such as Office 365, still require.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("refusing LOGIN authentication over an unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// fileMailer writes each message to its own .eml file.
+type fileMailer struct {
+	cfg MailerConfig
+}
+
+func (f *fileMailer) Send(ctx context.Context, m *Message) error {
+	withDefaults(f.cfg, m)
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.cfg.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000"), safeFilename(addressOnly(m.To[0])))
+	return os.WriteFile(filepath.Join(f.cfg.Dir, name), msg, 0o644)
+}
+
+func (f *fileMailer) Test(ctx context.Context) error {
+	if err := os.MkdirAll(f.cfg.Dir, 0o755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(f.cfg.Dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// writerMailer prints each message to a writer.
+type writerMailer struct {
+	cfg MailerConfig
+	mu  sync.Mutex
+	w   io.Writer
+}
+
+func (p *writerMailer) Send(ctx context.Context, m *Message) error {
+	withDefaults(p.cfg, m)
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = fmt.Fprintf(p.w, "----- email to %s -----\n%s\n----- end of email -----\n", strings.Join(m.To, ", "), msg)
+	return err
+}
+
+func (p *writerMailer) Test(ctx context.Context) error {
+	return nil
+}
+
+// safeFilename replaces the characters of s that are awkward in file names.
+func safeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMS transports.
+const (
+	SMSTransportHTTP   = "http"   // posts each message to an HTTP gateway
+	SMSTransportStdout = "stdout" // prints each message, for local development
+)
+
+// SMSConfig describes how text messages are delivered.
+//
+// The HTTP transport speaks a minimal gateway protocol that most providers
+// can be adapted to: a POST of {"from", "to", "text"} as JSON to URL, with
+// the API key as a bearer token. Any 2xx response means the gateway accepted
+// the message.
+type SMSConfig struct {
+	Transport string        `yaml:"transport"`
+	URL       string        `yaml:"url"`
+	APIKey    string        `yaml:"apiKey"`
+	From      string        `yaml:"from"` // sender ID or number, if the gateway needs one
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// DefaultSMSConfig is used for anything not set in the environment or the
+// config file.
+var DefaultSMSConfig = SMSConfig{
+	Transport: SMSTransportHTTP,
+	Timeout:   15 * time.Second,
+}
+
+// SMSConfigFromEnv overrides cfg with SMS_TRANSPORT, SMS_GATEWAY_URL,
+// SMS_API_KEY and SMS_FROM, where they are set.
+func SMSConfigFromEnv(cfg SMSConfig) (SMSConfig, error) {
+	for key, dst := range map[string]*string{
+		"SMS_TRANSPORT":   &cfg.Transport,
+		"SMS_GATEWAY_URL": &cfg.URL,
+		"SMS_API_KEY":     &cfg.APIKey,
+		"SMS_FROM":        &cfg.From,
+	} {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	cfg.Transport = strings.ToLower(cfg.Transport)
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration is usable. An HTTP configuration without
+// a URL is accepted so the server can start without SMS; sending then fails.
+func (c SMSConfig) Validate() error {
+	switch c.Transport {
+	case SMSTransportStdout:
+	case SMSTransportHTTP:
+		if c.URL != "" {
+			u, err := url.Parse(c.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid SMS gateway URL %q", c.URL)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown SMS transport %q", c.Transport)
+	}
+	return nil
+}
+
+// GatewayError is returned when the SMS gateway refuses a message.
+type GatewayError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *GatewayError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("SMS gateway returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("SMS gateway returned %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether sending again later may succeed: the gateway was
+// rate limiting or failing, rather than rejecting the message itself.
+func (e *GatewayError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// SMSSender delivers text messages.
+type SMSSender interface {
+	Send(ctx context.Context, to, text string) error
+}
+
+// NewSMSSender returns the SMSSender for a configuration.
+func NewSMSSender(cfg SMSConfig) (SMSSender, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Transport == SMSTransportStdout {
+		return &writerSMS{w: os.Stdout}, nil
+	}
+	return &httpSMS{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+var (
+	smsMu     sync.RWMutex
+	smsSender SMSSender = &httpSMS{cfg: DefaultSMSConfig, client: http.DefaultClient}
+)
+
+// ConfigureSMS installs the sender used by SendSMS.
+func ConfigureSMS(cfg SMSConfig) error {
+	s, err := NewSMSSender(cfg)
+	if err != nil {
+		return err
+	}
+	smsMu.Lock()
+	smsSender = s
+	smsMu.Unlock()
+	return nil
+}
+
+// SendSMS sends a text message with the configured sender; see ConfigureSMS.
+func SendSMS(ctx context.Context, to, text string) error {
+	smsMu.RLock()
+	s := smsSender
+	smsMu.RUnlock()
+	return s.Send(ctx, to, text)
+}
+
+// httpSMS posts messages to an HTTP gateway.
+type httpSMS struct {
+	cfg    SMSConfig
+	client *http.Client
+}
+
+func (h *httpSMS) Send(ctx context.Context, to, text string) error {
+	if h.cfg.URL == "" {
+		return errors.New("SMS gateway is not configured (SMS_GATEWAY_URL)")
+	}
+	body, err := json.Marshal(map[string]string{"from": h.cfg.From, "to": to, "text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+h.cfg.APIKey)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &GatewayError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// writerSMS prints each message to a writer.
+type writerSMS struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *writerSMS) Send(ctx context.Context, to, text string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "----- SMS to %s -----\n%s\n----- end of SMS -----\n", to, text)
+	return err
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Bounds accepted for a patient's age, in years.
+const (
+	MinPatientAge = 0
+	MaxPatientAge = 130
+)
+
+// NormalizeEmail trims and lower-cases an email address and checks that it
+// is a bare address such as "jane@example.com".
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "", errors.New("invalid email address")
+	}
+	return email, nil
+}
+
+// NormalizePhone strips the usual separators from a phone number. Numbers
+// written in international form ("+212 6 12-34-56-78" or "00212...") are
+// returned as "+" followed by digits; local numbers keep only their digits.
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	international := strings.HasPrefix(phone, "+")
+	for _, r := range phone {
+		switch {
+		case r >= '0' && r <= '9', r == '+' && international:
+		case r == ' ', r == '-', r == '.', r == '(', r == ')', r == '/':
+		default:
+			return "", errors.New("phone number contains invalid characters")
+		}
+	}
+
+	digits := DigitsOnly(phone)
+	if !international && strings.HasPrefix(digits, "00") {
+		international = true
+		digits = digits[2:]
+	}
+	if len(digits) < 6 || len(digits) > 15 {
+		return "", errors.New("phone number must have between 6 and 15 digits")
+	}
+	if international {
+		return "+" + digits, nil
+	}
+	return digits, nil
+}
+
+// ValidateAge checks that an age in years is within the accepted range.
+func ValidateAge(age int) error {
+	if age < MinPatientAge || age > MaxPatientAge {
+		return errors.New("age must be between 0 and 130")
+	}
+	return nil
+}
+
+// ParseDateOfBirth parses a date of birth written as YYYY-MM-DD and checks
+// that it is neither in the future nor older than the maximum patient age.
+func ParseDateOfBirth(s string) (time.Time, error) {
+	dob, err := time.Parse("2006-01-02", strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, errors.New("date of birth must be formatted as YYYY-MM-DD")
+	}
+	now := time.Now()
+	if dob.After(now) || dob.Before(now.AddDate(-MaxPatientAge, 0, 0)) {
+		return time.Time{}, errors.New("date of birth is out of range")
+	}
+	return dob, nil
+}
+
+// AgeAt returns the age in whole years of someone born on dob at the given
+// time. Someone born on February 29 turns a year older on March 1 in common
+// years.
+func AgeAt(dob, at time.Time) int {
+	age := at.Year() - dob.Year()
+	if at.Month() < dob.Month() || (at.Month() == dob.Month() && at.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+// NormalizeSex maps the accepted spellings of a patient's sex onto
+// "male", "female", "other" or "unknown".
+func NormalizeSex(sex string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(sex)) {
+	case "m", "male":
+		return "male", nil
+	case "f", "female":
+		return "female", nil
+	case "o", "other":
+		return "other", nil
+	case "u", "unknown":
+		return "unknown", nil
+	}
+	return "", errors.New("sex must be one of male, female, other or unknown")
+}
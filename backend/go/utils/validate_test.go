@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgeAt(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, tt := range []struct {
+		dob, at string
+		want    int
+	}{
+		{"2000-03-01", "2025-03-01", 25},
+		{"2000-03-01", "2025-02-28", 24},
+		{"2000-03-01", "2024-02-29", 23},
+		{"2000-03-01", "2024-03-01", 24},
+		{"2001-03-01", "2024-02-29", 22},
+		{"2000-02-29", "2024-02-29", 24},
+		{"2000-02-29", "2025-02-28", 24},
+		{"2000-02-29", "2025-03-01", 25},
+		{"2000-02-28", "2024-02-28", 24},
+		{"2000-02-28", "2024-02-27", 23},
+		{"1990-12-31", "2024-12-31", 34},
+		{"1990-12-31", "2025-01-01", 34},
+		{"2024-06-15", "2024-06-15", 0},
+	} {
+		if got := AgeAt(date(tt.dob), date(tt.at)); got != tt.want {
+			t.Errorf("AgeAt(%s, %s) = %d, want %d", tt.dob, tt.at, got, tt.want)
+		}
+	}
+}
@@ -20,6 +20,22 @@ app.add_middleware(
     allow_headers=["*"],
 )
 
+# Echo the API's request ID so calls can be matched with its logs.
+@app.middleware("http")
+async def request_id(request, call_next):
+    response = await call_next(request)
+    if "x-request-id" in request.headers:
+        response.headers["X-Request-ID"] = request.headers["x-request-id"]
+    return response
+
+# Join the API's traces when OpenTelemetry is installed; it is set up with the
+# standard OTEL_* environment variables.
+try:
+    from opentelemetry.instrumentation.fastapi import FastAPIInstrumentor
+    FastAPIInstrumentor.instrument_app(app, excluded_urls="health")
+except ImportError:
+    pass
+
 model_path = r"path\to\XRayFractureNet\ModelV4Yolo\model.pt"
 model = YOLO(model_path)
 
@@ -33,6 +49,10 @@ recovery_params = {
     'wrist positive': (100, 3000, 10, 20),
 }
 
+@app.get("/health")
+async def health():
+    return {"status": "ok"}
+
 @app.post("/analyze")
 async def analyze(file: UploadFile = File(...)):
     # Save uploaded file to temp
@@ -74,6 +74,23 @@ export const login = async (credentials: LoginCredentials): Promise<ApiResponse<
   }
 };
 
+// Ways of signing in offered by the backend
+export const getAuthMethods = async (): Promise<{ password: boolean; oidc: boolean }> => {
+  try {
+    const response = await fetch('http://localhost:3000/api/auth/methods');
+    if (!response.ok) {
+      return { password: true, oidc: false };
+    }
+    return await response.json();
+  } catch (error) {
+    return { password: true, oidc: false };
+  }
+};
+
+// Single sign-on starts with a full-page redirect to the identity provider,
+// which comes back to /login with #token=... or #error=...
+export const SSO_LOGIN_URL = 'http://localhost:3000/api/auth/oidc/login';
+
 // Register API
 export const register = async (credentials: RegisterCredentials): Promise<ApiResponse<{ message: string }>> => {
   try {
@@ -1,23 +1,49 @@
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import { Link, useNavigate } from 'react-router-dom';
 import { useAuth } from '../../context/AuthContext';
+import { getAuthMethods, SSO_LOGIN_URL } from '../../api/auth';
 import { AlertCircle } from 'lucide-react';
 
 const LoginForm: React.FC = () => {
-  const { login, loading, error } = useAuth();
+  const { login, loginWithToken, setError, loading, error } = useAuth();
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
+  const [ssoEnabled, setSsoEnabled] = useState(false);
   const navigate = useNavigate();
 
+  const goHome = (role?: string) => {
+    if (role === 'patient') {
+      navigate('/my-reports');
+    } else {
+      navigate('/');
+    }
+  };
+
+  // Coming back from single sign-on, the token or error is in the fragment.
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    const token = params.get('token');
+    const ssoError = params.get('error');
+    if (token || ssoError) {
+      window.history.replaceState(null, '', window.location.pathname);
+    }
+    if (token) {
+      const { success, role } = loginWithToken(token);
+      if (success) {
+        goHome(role);
+      }
+    } else if (ssoError) {
+      setError(ssoError);
+    }
+    getAuthMethods().then((methods) => setSsoEnabled(methods.oidc));
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, []);
+
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
     const { success, role } = await login({ email, password });
     if (success) {
-      if (role === 'patient') {
-        navigate('/my-reports');
-      } else {
-        navigate('/');
-      }
+      goHome(role);
     }
   };
 
@@ -80,6 +106,25 @@ const LoginForm: React.FC = () => {
           {loading ? 'Signing In...' : 'Sign In'}
         </button>
       </form>
+
+      {ssoEnabled && (
+        <div className="mt-6">
+          <div className="relative mb-6">
+            <div className="absolute inset-0 flex items-center">
+              <div className="w-full border-t border-gray-200" />
+            </div>
+            <div className="relative flex justify-center text-xs">
+              <span className="bg-white px-2 text-gray-500">or</span>
+            </div>
+          </div>
+          <a
+            href={SSO_LOGIN_URL}
+            className="block w-full text-center border border-gray-300 text-gray-700 py-2 px-4 rounded-md font-medium hover:bg-gray-50 focus:outline-none focus:ring-2 focus:ring-primary-500 focus:ring-offset-2"
+          >
+            Sign in with your hospital account
+          </a>
+        </div>
+      )}
       
       
     </div>
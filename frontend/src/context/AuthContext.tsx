@@ -12,6 +12,8 @@ interface DecodedToken {
 
 interface AuthContextType extends AuthState {
   login: (credentials: LoginCredentials) => Promise<{ success: boolean; role?: string }>;
+  loginWithToken: (token: string) => { success: boolean; role?: string };
+  setError: (error: string) => void;
   register: (credentials: RegisterCredentials) => Promise<void>;
   logout: () => void;
 }
@@ -82,21 +84,33 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({ children
     }
   }, []);
 
-  const login = async (credentials: LoginCredentials): Promise<{ success: boolean; role?: string }> => {
-    const response = await authApi.login(credentials);
-    if (response.data?.token) {
-      const token = response.data.token;
+  const loginWithToken = (token: string): { success: boolean; role?: string } => {
+    try {
       const decodedToken = jwtDecode<DecodedToken>(token);
       const user: User = { id: decodedToken.userId, email: decodedToken.email, role: decodedToken.role, fullName: '', createdAt: '' };
       localStorage.setItem('jwt', token);
       dispatch({ type: 'LOGIN_SUCCESS', payload: { user, token } });
       return { success: true, role: user.role };
+    } catch (error) {
+      dispatch({ type: 'AUTH_FAILURE', payload: 'Login failed' });
+      return { success: false };
+    }
+  };
+
+  const login = async (credentials: LoginCredentials): Promise<{ success: boolean; role?: string }> => {
+    const response = await authApi.login(credentials);
+    if (response.data?.token) {
+      return loginWithToken(response.data.token);
     } else {
       dispatch({ type: 'AUTH_FAILURE', payload: response.error || 'Login failed' });
       return { success: false };
     }
   };
 
+  const setError = (error: string) => {
+    dispatch({ type: 'AUTH_FAILURE', payload: error });
+  };
+
   const register = async (credentials: RegisterCredentials) => {
     const response = await authApi.register(credentials);
     if (response.error) {
@@ -111,7 +125,7 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({ children
     dispatch({ type: 'LOGOUT' });
   };
 
-  const value = { ...state, login, register, logout };
+  const value = { ...state, login, loginWithToken, setError, register, logout };
 
   return <AuthContext.Provider value={value}>{children}</AuthContext.Provider>;
 };